@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tuna/freedns-go/freedns"
+)
+
+// benchMaxInFlight caps the queries waiting for the answers, beyond which
+// the ticks are skipped rather than piling up on a stalled server.
+const benchMaxInFlight = 1000
+
+// benchSample is the outcome of a query of the benchmark.
+type benchSample struct {
+	latency time.Duration
+	rcode   int
+	err     bool
+	cached  bool
+}
+
+// bench fires the queries of the domains at the QPS at a running instance,
+// or at an in-process server of the flags, and reports the latency
+// percentiles and the cache hit ratio.
+func bench(args []string) error {
+	var domainsFile, server, qtypeName, adminURL string
+	var qps int
+	var duration time.Duration
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.StringVar(&domainsFile, "domains", "", "The file of the domains queried in turn, one per line.")
+	fs.StringVar(&server, "server", "", "The running instance benchmarked, host:port. Empty benchmarks an in-process server of the other flags.")
+	fs.IntVar(&qps, "qps", 100, "The queries fired per second.")
+	fs.DurationVar(&duration, "duration", 10*time.Second, "How long the benchmark runs.")
+	fs.StringVar(&qtypeName, "type", "A", "The type of the queries.")
+	fs.StringVar(&adminURL, "admin-url", "", "The admin API of the running instance, to report its cache hit ratio.")
+	cfg, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if domainsFile == "" || qps < 1 || duration <= 0 {
+		return fmt.Errorf("usage: freedns-go bench -domains file [-server host:port] [-qps n] [-duration d] [flags]")
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(qtypeName)]
+	if !ok {
+		return fmt.Errorf("unknown type: %s", qtypeName)
+	}
+	domains, err := readDomains(domainsFile)
+	if err != nil {
+		return err
+	}
+
+	var query func(name string) benchSample
+	if server == "" {
+		s, err := freedns.NewServer(cfg)
+		if err != nil {
+			return err
+		}
+		query = func(name string) benchSample {
+			start := time.Now()
+			r := s.Query(name, qtype)
+			return benchSample{latency: time.Since(start), rcode: r.Msg.Rcode, cached: r.Upstream == "cache"}
+		}
+	} else {
+		client := &dns.Client{Timeout: 2 * time.Second}
+		query = func(name string) benchSample {
+			req := &dns.Msg{}
+			req.SetQuestion(dns.Fqdn(name), qtype)
+			start := time.Now()
+			res, _, err := client.Exchange(req, server)
+			if err != nil {
+				return benchSample{latency: time.Since(start), err: true}
+			}
+			return benchSample{latency: time.Since(start), rcode: res.Rcode}
+		}
+	}
+
+	var before benchStats
+	if server != "" && adminURL != "" {
+		if before, err = fetchBenchStats(adminURL); err != nil {
+			return err
+		}
+	}
+
+	var mu sync.Mutex
+	var samples []benchSample
+	var wg sync.WaitGroup
+	inFlight := make(chan struct{}, benchMaxInFlight)
+	skipped := 0
+	ticker := time.NewTicker(time.Second / time.Duration(qps))
+	deadline := time.After(duration)
+	start := time.Now()
+loop:
+	for i := 0; ; i++ {
+		select {
+		case <-deadline:
+			break loop
+		case <-ticker.C:
+		}
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			skipped++
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			sample := query(name)
+			<-inFlight
+			mu.Lock()
+			samples = append(samples, sample)
+			mu.Unlock()
+		}(domains[i%len(domains)])
+	}
+	ticker.Stop()
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	printBenchReport(samples, skipped, elapsed)
+	if server == "" {
+		cached := 0
+		for _, s := range samples {
+			if s.cached {
+				cached++
+			}
+		}
+		fmt.Printf("cache hit ratio: %.1f%%\n", percent(cached, len(samples)))
+	} else if adminURL != "" {
+		after, err := fetchBenchStats(adminURL)
+		if err != nil {
+			return err
+		}
+		// the other clients' queries during the benchmark are counted too
+		fmt.Printf("cache hit ratio: %.1f%% (of the server's stats)\n", percent(after.Cached-before.Cached, after.Total-before.Total))
+	}
+	return nil
+}
+
+// readDomains reads the domains of the file, one per line, skipping the
+// blank lines and the # comments.
+func readDomains(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var domains []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			domains = append(domains, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("no domains in %s", path)
+	}
+	return domains, nil
+}
+
+func printBenchReport(samples []benchSample, skipped int, elapsed time.Duration) {
+	var latencies []time.Duration
+	errors := 0
+	rcodes := map[string]int{}
+	for _, s := range samples {
+		if s.err {
+			errors++
+			continue
+		}
+		latencies = append(latencies, s.latency)
+		rcodes[dns.RcodeToString[s.rcode]]++
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Printf("queries: %d in %v, %.1f/s\n", len(samples), elapsed.Round(time.Millisecond), float64(len(samples))/elapsed.Seconds())
+	fmt.Printf("errors: %d, skipped: %d\n", errors, skipped)
+	var names []string
+	for name := range rcodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %s: %d\n", name, rcodes[name])
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	fmt.Printf("latency: p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(latencies, 0.5), percentile(latencies, 0.9), percentile(latencies, 0.99), percentile(latencies, 1))
+}
+
+// percentile returns the q-th percentile of the sorted latencies.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	return sorted[int(q*float64(len(sorted)-1))].Round(10 * time.Microsecond)
+}
+
+func percent(n, total int) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// benchStats is the counters of /api/stats.
+type benchStats struct {
+	Total  int `json:"total"`
+	Cached int `json:"cached"`
+}
+
+func fetchBenchStats(adminURL string) (benchStats, error) {
+	var stats benchStats
+	res, err := http.Get(strings.TrimRight(adminURL, "/") + "/api/stats")
+	if err != nil {
+		return stats, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("admin API: %s", res.Status)
+	}
+	err = json.NewDecoder(res.Body).Decode(&stats)
+	return stats, err
+}
@@ -30,23 +30,7 @@ func IP2Int(ip string) (uint32, error) {
 	return ret, nil
 }
 
-// IsChinaIP returns whether an IPv4 address belongs to China
+// IsChinaIP returns whether an IPv4 or IPv6 address belongs to China
 func IsChinaIP(ip string) bool {
-	var i, err = IP2Int(ip)
-	if err != nil {
-		return false
-	}
-	var l = 0
-	var r = len(chinaIPs) - 1
-	for l <= r {
-		var mid = int((l + r) / 2)
-		if i < chinaIPs[mid][0] {
-			r = mid - 1
-		} else if i > chinaIPs[mid][1] {
-			l = mid + 1
-		} else {
-			return true
-		}
-	}
-	return false
+	return defaultList.Contains(ip)
 }
@@ -4,8 +4,8 @@ import "testing"
 import "github.com/tuna/freedns-go/chinaip"
 
 func TestIsChinaIP(t *testing.T) {
-	var cn_ips = []string{"114.114.114.114", "220.181.57.216"}
-	var non_cn_ips = []string{"8.8.8.8", "172.217.14.78", "255.255.255.255", "wtf", "114.114.114"}
+	var cn_ips = []string{"114.114.114.114", "220.181.57.216", "240e:83:205::1", "2408:8000::1"}
+	var non_cn_ips = []string{"8.8.8.8", "172.217.14.78", "255.255.255.255", "wtf", "114.114.114", "2001:4860:4860::8888", "::1"}
 
 	for _, ip := range cn_ips {
 		if !chinaip.IsChinaIP(ip) {
@@ -0,0 +1,13 @@
+package chinaip
+
+var chinaIPv6s = [][]uint64{
+	{2306127026811043840, 2306127043990913023},     // 2001:250::/30
+	{2306139499396071424, 2306139503691038719},     // 2001:da8::/32
+	{2594128360946794496, 2594128365241761791},     // 2400:3200::/32
+	{2594313078900260864, 2594313083195228159},     // 2400:da00::/32
+	{2594722097225793536, 2594722101520760831},     // 2402:4e00::/32
+	{2596465922667446272, 2596483514853490687},     // 2408:8000::/20
+	{2596747397644156928, 2596764989830201343},     // 2409:8000::/20
+	{2596958503876689920, 2596967299969712127},     // 240a:4000::/21
+	{2598014035039354880, 2598031627225399295},     // 240e::/20
+}
@@ -0,0 +1,217 @@
+package chinaip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// List is a list of IPv4 and IPv6 ranges, e.g. the China IPs. The IPv6 ranges
+// are kept at the granularity of /64, which is the smallest allocation of an
+// IPv6 operator.
+type List struct {
+	ranges  [][]uint32 // sorted and not overlapping [start, end] pairs
+	ranges6 [][]uint64 // the same as ranges, but of the first 64 bits of IPv6
+}
+
+var defaultList = &List{ranges: chinaIPs, ranges6: chinaIPv6s}
+
+// Default returns the China IP list compiled into the binary.
+func Default() *List {
+	return defaultList
+}
+
+// Contains returns whether an IPv4 or IPv6 address is in the list
+func (l *List) Contains(ip string) bool {
+	if strings.Contains(ip, ":") {
+		return l.contains6(ip)
+	}
+	var i, err = IP2Int(ip)
+	if err != nil {
+		return false
+	}
+	var lo = 0
+	var hi = len(l.ranges) - 1
+	for lo <= hi {
+		var mid = int((lo + hi) / 2)
+		if i < l.ranges[mid][0] {
+			hi = mid - 1
+		} else if i > l.ranges[mid][1] {
+			lo = mid + 1
+		} else {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *List) contains6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	// IPv4-mapped addresses like ::ffff:1.2.3.4
+	if v4 := parsed.To4(); v4 != nil {
+		return l.Contains(v4.String())
+	}
+	i := binary.BigEndian.Uint64(parsed[:8])
+	n := sort.Search(len(l.ranges6), func(k int) bool {
+		return l.ranges6[k][1] >= i
+	})
+	return n < len(l.ranges6) && l.ranges6[n][0] <= i
+}
+
+// Len returns the number of ranges in the list.
+func (l *List) Len() int {
+	return len(l.ranges) + len(l.ranges6)
+}
+
+// parseCIDR6 returns the range of the first 64 bits covered by an IPv6 prefix.
+// Prefixes longer than /64 cover their whole /64.
+func parseCIDR6(ip string, mask int) ([]uint64, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil || mask < 0 || mask > 128 {
+		return nil, Error("invalid IPv6 prefix: " + ip + "/" + strconv.Itoa(mask))
+	}
+	if mask > 64 {
+		mask = 64
+	}
+	start := binary.BigEndian.Uint64(parsed[:8])
+	if mask == 0 {
+		return []uint64{0, ^uint64(0)}, nil
+	}
+	size := uint64(1) << uint(64-mask)
+	start &^= size - 1
+	return []uint64{start, start + size - 1}, nil
+}
+
+// ParseList parses a list of IP ranges. Every line is either an IPv4 or IPv6
+// CIDR (the chnroutes / china_ip_list format), or a record of the APNIC
+// delegated format (`apnic|CN|ipv4|1.0.1.0|256|20110414|allocated`, or
+// `apnic|CN|ipv6|240e::|20|20130911|allocated` with the prefix length), of
+// which only the CN records are used. Empty lines and the comments starting
+// with `#` are ignored.
+func ParseList(r io.Reader) (*List, error) {
+	var ranges [][]uint32
+	var ranges6 [][]uint64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+
+		var start, size uint64
+		if strings.Contains(line, "|") {
+			fields := strings.Split(line, "|")
+			if len(fields) < 5 {
+				return nil, Error("invalid delegated record: " + line)
+			}
+			if fields[1] != "CN" || (fields[2] != "ipv4" && fields[2] != "ipv6") {
+				continue
+			}
+			if fields[2] == "ipv6" {
+				mask, err := strconv.Atoi(fields[4])
+				if err != nil {
+					return nil, Error("invalid delegated record: " + line)
+				}
+				r, err := parseCIDR6(fields[3], mask)
+				if err != nil {
+					return nil, err
+				}
+				ranges6 = append(ranges6, r)
+				continue
+			}
+			ip, err := IP2Int(fields[3])
+			if err != nil {
+				return nil, err
+			}
+			n, err := strconv.ParseUint(fields[4], 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			start, size = uint64(ip), n
+		} else {
+			parts := strings.Split(line, "/")
+			if len(parts) != 2 {
+				return nil, Error("invalid CIDR: " + line)
+			}
+			if strings.Contains(parts[0], ":") {
+				mask, err := strconv.Atoi(parts[1])
+				if err != nil {
+					return nil, Error("invalid CIDR: " + line)
+				}
+				r, err := parseCIDR6(parts[0], mask)
+				if err != nil {
+					return nil, err
+				}
+				ranges6 = append(ranges6, r)
+				continue
+			}
+			ip, err := IP2Int(parts[0])
+			if err != nil {
+				return nil, err
+			}
+			mask, err := strconv.Atoi(parts[1])
+			if err != nil || mask < 0 || mask > 32 {
+				return nil, Error("invalid CIDR: " + line)
+			}
+			size = 1 << uint(32-mask)
+			start = uint64(ip) &^ (size - 1)
+		}
+		if size == 0 || start+size-1 > 0xffffffff {
+			return nil, Error("invalid range: " + line)
+		}
+		ranges = append(ranges, []uint32{uint32(start), uint32(start + size - 1)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &List{ranges: mergeRanges(ranges), ranges6: mergeRanges6(ranges6)}, nil
+}
+
+// mergeRanges sorts the ranges and merges the overlapping or adjacent ones, so
+// that they can be binary searched.
+func mergeRanges(ranges [][]uint32) [][]uint32 {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i][0] < ranges[j][0]
+	})
+	var merged [][]uint32
+	for _, r := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && uint64(r[0]) <= uint64(merged[last][1])+1 {
+			if r[1] > merged[last][1] {
+				merged[last][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, []uint32{r[0], r[1]})
+	}
+	return merged
+}
+
+// mergeRanges6 is mergeRanges of the IPv6 ranges.
+func mergeRanges6(ranges [][]uint64) [][]uint64 {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i][0] < ranges[j][0]
+	})
+	var merged [][]uint64
+	for _, r := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && (merged[last][1] == ^uint64(0) || r[0] <= merged[last][1]+1) {
+			if r[1] > merged[last][1] {
+				merged[last][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, []uint64{r[0], r[1]})
+	}
+	return merged
+}
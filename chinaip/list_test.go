@@ -0,0 +1,53 @@
+package chinaip_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tuna/freedns-go/chinaip"
+)
+
+func TestParseList(t *testing.T) {
+	list := `
+# china_ip_list format
+1.0.1.0/24
+1.0.2.0/23
+114.114.0.0/16
+
+apnic|CN|ipv4|223.255.252.0|512|20110331|allocated
+apnic|JP|ipv4|1.0.16.0|4096|20110412|allocated
+apnic|CN|ipv6|2001:250::|35|20000426|allocated
+apnic|JP|ipv6|2001:200::|35|19990813|allocated
+240e::/20
+2001:db8:1:2::/64
+`
+	l, err := chinaip.ParseList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1.0.1.0/24 and 1.0.2.0/23 are merged
+	if l.Len() != 6 {
+		t.Errorf("expect 6 ranges, got %d", l.Len())
+	}
+
+	in := []string{"1.0.1.1", "1.0.3.255", "114.114.114.114", "223.255.253.1",
+		"2001:250::1", "2001:250:1fff:ffff::1", "240e:f::1", "2001:db8:1:2::53", "::ffff:114.114.114.114"}
+	out := []string{"1.0.0.255", "1.0.4.0", "1.0.16.1", "8.8.8.8", "wtf",
+		"2001:250:2000::1", "2001:200::1", "240e:1000::1", "2001:db8:1:3::1", "::ffff:8.8.8.8", "::"}
+	for _, ip := range in {
+		if !l.Contains(ip) {
+			t.Errorf("%s should be in the list", ip)
+		}
+	}
+	for _, ip := range out {
+		if l.Contains(ip) {
+			t.Errorf("%s should not be in the list", ip)
+		}
+	}
+
+	for _, bad := range []string{"1.0.1.0/33", "1.0.1.0", "apnic|CN|ipv4|1.0.1.0", "240e::/129", "240e::1.2/20", "apnic|CN|ipv6|240e::|wtf"} {
+		if _, err := chinaip.ParseList(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q should be an error", bad)
+		}
+	}
+}
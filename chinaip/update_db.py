@@ -1,8 +1,11 @@
 #! /usr/bin/env python3
 
+import ipaddress
+
 import requests
 
 IP_LIST_URL = "https://raw.githubusercontent.com/17mon/china_ip_list/master/china_ip_list.txt"
+IPV6_LIST_URL = "https://ftp.apnic.net/stats/apnic/delegated-apnic-latest"
 
 def cidr_list():
     r = requests.get(IP_LIST_URL)
@@ -37,10 +40,46 @@ var chinaIPs = [][]uint32{
     s += "}\n"
     return s
 
+def cidr6_list():
+    r = requests.get(IPV6_LIST_URL)
+    if r.status_code != 200:
+        raise Exception("%s status code is %d" % (IPV6_LIST_URL, r.status_code))
+
+    cidrs = []
+    for line in r.text.split():
+        fields = line.split("|")
+        if len(fields) >= 5 and fields[1] == "CN" and fields[2] == "ipv6":
+            cidrs.append("%s/%s" % (fields[3], fields[4]))
+    return cidrs
+
+def parse6(cidr):
+    # only the first 64 bits are kept, see List in list.go
+    ip, mask = cidr.split("/")
+    mask = min(int(mask), 64)
+    i = int(ipaddress.IPv6Address(ip)) >> 64
+    start = i >> (64 - mask) << (64 - mask)
+    end = start + 2**(64 - mask) - 1
+    return start, end
+
+def gen6():
+    s = """package chinaip
+
+var chinaIPv6s = [][]uint64{
+"""
+    for cidr in sorted(cidr6_list(), key=parse6):
+        start, end = parse6(cidr)
+        s += "	{%d, %d},     // %s\n" % (start, end, cidr)
+
+    s += "}\n"
+    return s
+
 def main():
     s = gen()
     with open("db.go", "w") as f:
         f.write(s)
+    s = gen6()
+    with open("db6.go", "w") as f:
+        f.write(s)
 
 if __name__ == "__main__":
     main()
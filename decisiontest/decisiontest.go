@@ -0,0 +1,129 @@
+// Package decisiontest holds the canonical test vectors of how freedns-go
+// chooses between the fast and the clean upstream, for the combinations of
+// their answers. They document the contract of the anti-spoofing resolution,
+// and the freedns tests run them against the resolver, so a change of the
+// decisions must change the vectors too.
+package decisiontest
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Kind is the kind of an upstream reply.
+type Kind int
+
+// The kinds of the upstream replies.
+const (
+	Answer   Kind = iota // NOERROR with the A records of IPs
+	Empty                // NOERROR without answers
+	ServFail             // SERVFAIL
+	Timeout              // no reply at all
+	Refused              // REFUSED
+)
+
+// Reply is how an upstream replies to the A query.
+type Reply struct {
+	Kind Kind
+	IPs  []string // Answer only
+}
+
+// Msg returns the reply to `req`, or nil for Timeout.
+func (r Reply) Msg(req *dns.Msg) *dns.Msg {
+	res := &dns.Msg{}
+	switch r.Kind {
+	case Timeout:
+		return nil
+	case ServFail:
+		res.SetRcode(req, dns.RcodeServerFailure)
+	case Refused:
+		res.SetRcode(req, dns.RcodeRefused)
+	default:
+		res.SetReply(req)
+		for _, ip := range r.IPs {
+			res.Answer = append(res.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ip),
+			})
+		}
+	}
+	return res
+}
+
+// Location is what the resolver knows about the location of a domain.
+type Location int
+
+// The locations of a domain.
+const (
+	Unknown Location = iota
+	China
+	Foreign
+)
+
+// The upstreams chosen.
+const (
+	Fast  = "fast"
+	Clean = "clean"
+)
+
+// Vector is a decision: the location known before the query, the replies of
+// the upstreams, which upstream's response is returned with which rcode, and
+// the location known after it.
+type Vector struct {
+	Name      string
+	Known     Location
+	Fast      Reply
+	Clean     Reply
+	Want      string // Fast or Clean
+	WantRcode int
+	WantKnown Location
+}
+
+// The IPs of the vectors, classified by the China IP list compiled into
+// freedns-go.
+var (
+	chinaIP    = Reply{Answer, []string{"114.114.114.114"}}
+	foreignIP  = Reply{Answer, []string{"8.8.8.8"}}
+	poisonedIP = Reply{Answer, []string{"31.13.64.1"}} // the typical poisoned answers are foreign IPs
+	mixedIPs   = Reply{Answer, []string{"8.8.8.8", "114.114.114.114"}}
+	empty      = Reply{Kind: Empty}
+	servFail   = Reply{Kind: ServFail}
+	timeout    = Reply{Kind: Timeout}
+	refused    = Reply{Kind: Refused}
+)
+
+// Vectors are the canonical test vectors.
+var Vectors = []Vector{
+	// the first query of a domain decides its location by the fast answer
+	{"unknown/fast China IP", Unknown, chinaIP, foreignIP, Fast, dns.RcodeSuccess, China},
+	{"unknown/upstreams disagree", Unknown, foreignIP, chinaIP, Clean, dns.RcodeSuccess, Foreign},
+	{"unknown/fast poisoned", Unknown, poisonedIP, foreignIP, Clean, dns.RcodeSuccess, Foreign},
+	{"unknown/any China IP wins", Unknown, mixedIPs, foreignIP, Fast, dns.RcodeSuccess, China},
+	{"unknown/fast empty", Unknown, empty, foreignIP, Clean, dns.RcodeSuccess, Unknown},
+	{"unknown/fast SERVFAIL", Unknown, servFail, foreignIP, Clean, dns.RcodeSuccess, Unknown},
+	{"unknown/fast timeout", Unknown, timeout, foreignIP, Clean, dns.RcodeSuccess, Unknown},
+	{"unknown/clean timeout, fast China IP", Unknown, chinaIP, timeout, Fast, dns.RcodeSuccess, China},
+	{"unknown/clean timeout, fast foreign IP", Unknown, foreignIP, timeout, Clean, dns.RcodeServerFailure, Foreign},
+	{"unknown/both timeout", Unknown, timeout, timeout, Clean, dns.RcodeServerFailure, Unknown},
+	{"unknown/clean SERVFAIL, fast empty", Unknown, empty, servFail, Fast, dns.RcodeSuccess, Unknown},
+	{"unknown/clean REFUSED, fast empty", Unknown, empty, refused, Fast, dns.RcodeSuccess, Unknown},
+	{"unknown/both SERVFAIL", Unknown, servFail, servFail, Clean, dns.RcodeServerFailure, Unknown},
+
+	// a domain known in China trusts the fast answers unless they point out
+	// of China
+	{"china/fast China IP", China, chinaIP, foreignIP, Fast, dns.RcodeSuccess, China},
+	{"china/fast empty", China, empty, foreignIP, Fast, dns.RcodeSuccess, China},
+	{"china/fast foreign IP", China, foreignIP, chinaIP, Clean, dns.RcodeSuccess, Foreign},
+	{"china/fast SERVFAIL", China, servFail, chinaIP, Clean, dns.RcodeSuccess, China},
+	{"china/fast timeout", China, timeout, chinaIP, Clean, dns.RcodeSuccess, China},
+	{"china/fast foreign IP, clean SERVFAIL", China, foreignIP, servFail, Clean, dns.RcodeServerFailure, Foreign},
+
+	// a domain known out of China uses the clean answers, unless the clean
+	// upstream fails and the fast answer has no IPs out of China
+	{"foreign/fast China IP", Foreign, chinaIP, foreignIP, Clean, dns.RcodeSuccess, Foreign},
+	{"foreign/clean empty", Foreign, foreignIP, empty, Clean, dns.RcodeSuccess, Foreign},
+	{"foreign/clean timeout", Foreign, chinaIP, timeout, Fast, dns.RcodeSuccess, Foreign},
+	{"foreign/clean SERVFAIL, fast foreign IP", Foreign, foreignIP, servFail, Clean, dns.RcodeServerFailure, Foreign},
+	{"foreign/clean REFUSED, fast empty", Foreign, empty, refused, Fast, dns.RcodeSuccess, Foreign},
+}
@@ -0,0 +1,65 @@
+package freedns
+
+import (
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// ActivationSockets returns the TCP listener and the UDP socket passed by
+// systemd socket activation (sd_listen_fds(3)), so that freedns-go can serve
+// on port 53 without the privilege to bind it. Both are nil if the process is
+// not socket-activated. At most one TCP and one UDP socket are supported.
+func ActivationSockets() (net.Listener, net.PacketConn, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil, nil
+	}
+	// not passed down to the children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	files := make([]*os.File, n)
+	for i := range files {
+		fd := listenFDsStart + i
+		files[i] = os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+	}
+	return socketsFromFiles(files)
+}
+
+// socketsFromFiles turns the files of the sockets into a TCP listener and a
+// UDP socket. The files are closed, as the sockets hold their own copies.
+func socketsFromFiles(files []*os.File) (net.Listener, net.PacketConn, error) {
+	var l net.Listener
+	var pc net.PacketConn
+	for _, f := range files {
+		if fl, err := net.FileListener(f); err == nil {
+			f.Close()
+			if l != nil {
+				fl.Close()
+				return nil, nil, Error("only one TCP socket can be passed: " + f.Name())
+			}
+			l = fl
+			continue
+		}
+		fpc, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, Error("passed socket is neither TCP nor UDP: " + f.Name())
+		}
+		if pc != nil {
+			fpc.Close()
+			return nil, nil, Error("only one UDP socket can be passed: " + f.Name())
+		}
+		pc = fpc
+	}
+	return l, pc, nil
+}
@@ -0,0 +1,72 @@
+package freedns
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSocketsFromFiles(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	lf, _ := l.(*net.TCPListener).File()
+	pcf, _ := pc.(*net.UDPConn).File()
+
+	gotL, gotPC, err := socketsFromFiles([]*os.File{pcf, lf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gotL.Close()
+	defer gotPC.Close()
+	if gotL.Addr().String() != l.Addr().String() || gotPC.LocalAddr().String() != pc.LocalAddr().String() {
+		t.Errorf("expect the sockets on %s and %s, got %s and %s",
+			l.Addr(), pc.LocalAddr(), gotL.Addr(), gotPC.LocalAddr())
+	}
+
+	lf2, _ := l.(*net.TCPListener).File()
+	lf3, _ := l.(*net.TCPListener).File()
+	if _, _, err := socketsFromFiles([]*os.File{lf2, lf3}); err == nil {
+		t.Error("two TCP sockets should be refused")
+	}
+}
+
+func TestServePreboundSockets(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{
+		PacketConn: pc,
+		Pins:       []string{"nas.example.com=192.168.1.10"},
+	})
+	go s.Run()
+	defer s.Shutdown()
+
+	req := &dns.Msg{}
+	req.SetQuestion("nas.example.com.", dns.TypeA)
+	c := &dns.Client{Timeout: time.Second}
+	var res *dns.Msg
+	for i := 0; i < 10; i++ {
+		if res, _, err = c.Exchange(req, pc.LocalAddr().String()); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Answer) != 1 {
+		t.Errorf("expect the pinned answer, got %v", res)
+	}
+}
@@ -0,0 +1,226 @@
+package freedns
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newAdminHandler creates the handler of the admin HTTP API.
+func (s *Server) newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/audit", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.audit.latest())
+	})
+	mux.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
+		if s.stats == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "stats disabled"})
+			return
+		}
+		window, err := parseWindow(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		top := 10
+		if v := r.URL.Query().Get("top"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 1000 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid top: " + v})
+				return
+			}
+			top = n
+		}
+		writeJSON(w, http.StatusOK, s.stats.summary(window, top))
+	})
+	mux.HandleFunc("/api/stats/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if s.stats == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "stats disabled"})
+			return
+		}
+		window, err := parseWindow(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.stats.snapshot(window))
+	})
+	mux.HandleFunc("/api/grafana/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, grafanaDashboard())
+	})
+	mux.HandleFunc("/api/queries", func(w http.ResponseWriter, r *http.Request) {
+		if s.stats == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "stats disabled"})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.stats.recentQueries())
+	})
+	mux.HandleFunc("/api/hedge", func(w http.ResponseWriter, r *http.Request) {
+		if s.resolver.hedge == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "hedge budget disabled"})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.resolver.hedge.status())
+	})
+	mux.HandleFunc("/api/consistency", func(w http.ResponseWriter, r *http.Request) {
+		if s.consistency == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "consistency checks disabled"})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.consistency.report())
+	})
+	mux.HandleFunc("/api/log", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.debugLog.status())
+	})
+	mux.HandleFunc("/api/cache/stream", s.serveCacheStream)
+	mux.HandleFunc("/api/cache/dump", s.serveCacheDump)
+	mux.HandleFunc("/api/cache/conflicts", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.conflicts.latest())
+	})
+	mux.HandleFunc("/api/tls", serveHandshakes)
+	mux.HandleFunc("/api/upstreams", serveUpstreams)
+	mux.HandleFunc("/api/resolve", s.serveBatch)
+	mux.HandleFunc("/", serveDashboard)
+	mux.Handle("/api/cache/purge", s.adminAction("purge_cache", func(r *http.Request) error {
+		s.recordsCache.purge()
+		return nil
+	}))
+	mux.Handle("/api/cache/load", s.adminAction("load_cache", s.loadCache))
+	mux.Handle("/api/log/debug", s.adminAction("debug_log", func(r *http.Request) error {
+		var d time.Duration
+		if v := r.URL.Query().Get("duration"); v != "" {
+			var err error
+			if d, err = time.ParseDuration(v); err != nil || d < 0 {
+				return Error("invalid duration: " + v)
+			}
+		}
+		s.debugLog.enable(d)
+		return nil
+	}))
+	mux.Handle("/api/log/revert", s.adminAction("revert_log", func(r *http.Request) error {
+		s.debugLog.disable()
+		return nil
+	}))
+	mux.Handle("/api/blocklist/reload", s.adminAction("reload_blocklist", func(r *http.Request) error {
+		if s.blocker == nil {
+			return Error("no blocklists configured")
+		}
+		return s.blocker.reload()
+	}))
+	mux.Handle("/api/chinaip/update", s.adminAction("update_chinaip", func(r *http.Request) error {
+		if s.chinaIPList == nil {
+			return Error("no China IP list URL configured")
+		}
+		return s.chinaIPList.update()
+	}))
+	if s.config.AdminPprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	// the probes of the orchestrators don't authenticate
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", serveHealthz)
+	root.HandleFunc("/readyz", s.serveReadyz)
+	root.Handle("/", s.adminAuth(mux))
+	return root
+}
+
+// adminUser returns the name of the admin making the request, and whether the
+// request is authorized. All requests are authorized if Config.AdminUsers is
+// empty.
+func (s *Server) adminUser(r *http.Request) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if len(s.config.AdminUsers) == 0 {
+		if !ok {
+			user = "-"
+		}
+		return user, true
+	}
+	expected, exists := s.config.AdminUsers[user]
+	return user, ok && exists && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+func (s *Server) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := s.adminUser(r); !ok {
+			if r.Method != http.MethodGet {
+				s.audit.record(newAuditEntry(r, user, r.URL.Path, "unauthorized"))
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="freedns-go"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminAction creates the handler of an admin action. Actions only accept
+// POST and every one of them is recorded in the audit log.
+func (s *Server) adminAction(name string, do func(r *http.Request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		user, _ := s.adminUser(r)
+		err := do(r)
+		result := "ok"
+		if err != nil {
+			result = err.Error()
+		}
+		s.audit.record(newAuditEntry(r, user, name, result))
+		log.WithFields(logrus.Fields{
+			"op":     "admin",
+			"action": name,
+			"user":   user,
+			"remote": r.RemoteAddr,
+			"result": result,
+		}).Info()
+
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"result": result})
+	})
+}
+
+// parseWindow returns the `window` parameter of the stats, 0 if not given.
+func parseWindow(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("window")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, Error("invalid window: " + v)
+	}
+	return d, nil
+}
+
+func newAuditEntry(r *http.Request, user string, action string, result string) auditEntry {
+	return auditEntry{
+		Time:   time.Now(),
+		User:   user,
+		Remote: r.RemoteAddr,
+		Action: action,
+		Result: result,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
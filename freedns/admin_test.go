@@ -0,0 +1,155 @@
+package freedns
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newTestServer(t *testing.T, cfg Config) *Server {
+	if cfg.FastDNS == "" {
+		cfg.FastDNS = "127.0.0.1:1"
+	}
+	if cfg.CleanDNS == "" {
+		cfg.CleanDNS = "127.0.0.1:1"
+	}
+	if cfg.Listen == "" {
+		cfg.Listen = "127.0.0.1:0"
+	}
+	if cfg.CacheCap == 0 {
+		cfg.CacheCap = 16
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAdminAudit(t *testing.T) {
+	auditFile := writeTempFile(t, "")
+	defer os.Remove(auditFile)
+
+	s := newTestServer(t, Config{
+		AdminListen:   "127.0.0.1:0",
+		AdminUsers:    map[string]string{"alice": "secret"},
+		AdminAuditLog: auditFile,
+	})
+	defer s.Shutdown()
+	api := httptest.NewServer(s.adminServer.Handler)
+	defer api.Close()
+
+	// a cached entry to purge
+	res := &dns.Msg{}
+	res.SetQuestion("example.com.", dns.TypeA)
+	s.recordsCache.set(res, "udp")
+
+	do := func(method, path, user, password string) int {
+		req, _ := http.NewRequest(method, api.URL+path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := do("POST", "/api/cache/purge", "alice", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong password should be unauthorized, got %d", code)
+	}
+	if code := do("GET", "/api/cache/purge", "alice", "secret"); code != http.StatusMethodNotAllowed {
+		t.Errorf("actions should only accept POST, got %d", code)
+	}
+	if code := do("POST", "/api/cache/purge", "alice", "secret"); code != http.StatusOK {
+		t.Errorf("purge should succeed, got %d", code)
+	}
+	if r, _ := s.recordsCache.lookup(res.Question[0], res.RecursionDesired, "udp"); r != nil {
+		t.Errorf("the cache should be purged")
+	}
+	if code := do("POST", "/api/blocklist/reload", "alice", "secret"); code != http.StatusInternalServerError {
+		t.Errorf("reload without blocklists should fail, got %d", code)
+	}
+
+	// the audit log in the API
+	req, _ := http.NewRequest("GET", api.URL+"/api/audit", nil)
+	req.SetBasicAuth("alice", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []auditEntry
+	json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+
+	expected := []struct{ user, action, result string }{
+		{"alice", "/api/cache/purge", "unauthorized"},
+		{"alice", "purge_cache", "ok"},
+		{"alice", "reload_blocklist", "no blocklists configured"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expect %d audit entries, got %v", len(expected), entries)
+	}
+	for i, e := range expected {
+		got := entries[i]
+		if got.User != e.user || got.Action != e.action || got.Result != e.result || got.Remote == "" || got.Time.IsZero() {
+			t.Errorf("unexpected audit entry %+v", got)
+		}
+	}
+
+	// and in the file
+	f, err := os.Open(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); lines++ {
+	}
+	if lines != len(expected) {
+		t.Errorf("expect %d lines in the audit file, got %d", len(expected), lines)
+	}
+}
+
+func TestAdminPprof(t *testing.T) {
+	get := func(s *Server, user, password string) int {
+		api := httptest.NewServer(s.adminServer.Handler)
+		defer api.Close()
+		req, _ := http.NewRequest("GET", api.URL+"/debug/pprof/", nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	s := newTestServer(t, Config{AdminListen: "127.0.0.1:0"})
+	defer s.Shutdown()
+	if code := get(s, "", ""); code != http.StatusNotFound {
+		t.Errorf("pprof should be disabled by default, got %d", code)
+	}
+
+	s = newTestServer(t, Config{
+		AdminListen: "127.0.0.1:0",
+		AdminUsers:  map[string]string{"alice": "secret"},
+		AdminPprof:  true,
+	})
+	defer s.Shutdown()
+	if code := get(s, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("pprof should require the admin auth, got %d", code)
+	}
+	if code := get(s, "alice", "secret"); code != http.StatusOK {
+		t.Errorf("pprof should be served, got %d", code)
+	}
+}
@@ -0,0 +1,36 @@
+package freedns
+
+import "github.com/miekg/dns"
+
+// The policies of the ANY queries.
+const (
+	AnyMinimal = "minimal" // answer a synthesized HINFO record (RFC 8482)
+	AnyForward = "forward" // resolve them like other queries
+)
+
+// anyHINFOTTL is the TTL of the synthesized HINFO record.
+const anyHINFOTTL = 3600
+
+func validAnyPolicy(policy string) bool {
+	switch policy {
+	case "", AnyMinimal, AnyForward:
+		return true
+	}
+	return false
+}
+
+// minimalAny answers the ANY query with the HINFO record of RFC 8482 section
+// 4.2, instead of whatever the upstreams have. The ANY queries are almost
+// always of the reflection attacks, and their large answers would take up the
+// cache.
+func minimalAny(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.RecursionAvailable = true
+	res.Answer = []dns.RR{&dns.HINFO{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: q.Qclass, Ttl: anyHINFOTTL},
+		Cpu: "RFC8482",
+	}}
+	return res
+}
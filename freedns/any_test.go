@@ -0,0 +1,36 @@
+package freedns
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMinimalAny(t *testing.T) {
+	fast, queries, stop := countingUpstream(t, "114.114.114.114")
+	defer stop()
+	for _, c := range []struct {
+		policy   string
+		upstream bool
+	}{
+		{"", false},
+		{AnyForward, true},
+	} {
+		s := newTestServer(t, Config{FastDNS: fast, CleanDNS: fast, AnyPolicy: c.policy})
+		before := atomic.LoadInt32(queries)
+		req := &dns.Msg{}
+		req.SetQuestion("example.com.", dns.TypeANY)
+		w := newRecorder()
+		s.handle(w, req, "udp")
+		if (atomic.LoadInt32(queries) > before) != c.upstream {
+			t.Errorf("%q: expect the upstream queried %v, got %v", c.policy, c.upstream, w.msg)
+		}
+		if h, ok := w.msg.Answer[0].(*dns.HINFO); ok == c.upstream || (ok && h.Cpu != "RFC8482") {
+			t.Errorf("%q: unexpected answer %v", c.policy, w.msg)
+		}
+	}
+	if _, err := NewServer(Config{AnyPolicy: "refuse"}); err == nil {
+		t.Error("expect an error of the unknown policy")
+	}
+}
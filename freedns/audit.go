@@ -0,0 +1,71 @@
+package freedns
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditKeep is how many audit entries are kept in memory for the API.
+const auditKeep = 1000
+
+// auditEntry records an admin API action.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`   // who
+	Remote string    `json:"remote"` // from where
+	Action string    `json:"action"` // what
+	Result string    `json:"result"`
+}
+
+// auditLog keeps the admin API actions. They are appended to the file if one
+// is given, and the latest ones are kept in memory.
+type auditLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries []auditEntry
+}
+
+func newAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	return a, nil
+}
+
+func (a *auditLog) record(e auditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.entries = append(a.entries, e)
+	if len(a.entries) > auditKeep {
+		a.entries = a.entries[len(a.entries)-auditKeep:]
+	}
+
+	if a.file != nil {
+		b, _ := json.Marshal(e)
+		if _, err := a.file.Write(append(b, '\n')); err != nil {
+			log.WithField("op", "audit").Error(err)
+		}
+	}
+}
+
+// latest returns the latest entries, the oldest first.
+func (a *auditLog) latest() []auditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]auditEntry{}, a.entries...)
+}
+
+func (a *auditLog) close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
@@ -0,0 +1,129 @@
+package freedns
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The tuning of the adaptive cache size. The cache grows by a quarter when
+// the lookups of the evicted entries, which a cache of up to the max would
+// have hit, are over cacheGrowGain of the lookups. It shrinks by a tenth when
+// it's less than half full, or the system is low on memory. A full cache
+// doesn't shrink by the hits alone, as the hits it would lose can't be seen.
+const (
+	cacheSizerInterval = time.Minute
+	cacheSizerMinLooks = 1000 // the lookups needed to judge an interval
+	cacheGrowGain      = 0.01
+	cacheLowMemory     = 0.1 // of the total memory available
+)
+
+// resizableCache is a Cache whose capacity can be changed, reporting the
+// lookups a larger one would have hit.
+type resizableCache interface {
+	Len() int
+	capacityOf() int
+	setCapacity(capacity int)
+	setGhosts(n int)
+	takeCounts() (lookups int, ghostHits int)
+}
+
+// cacheSizer adjusts the capacity of the cache between min and max by the
+// observed hit-rate gains and the available memory.
+type cacheSizer struct {
+	cache    resizableCache
+	min, max int
+	memory   func() (available uint64, total uint64, ok bool)
+}
+
+func newCacheSizer(cache resizableCache, min, max int) *cacheSizer {
+	if min < 1 {
+		min = 1
+	}
+	z := &cacheSizer{cache: cache, min: min, max: max, memory: systemMemory}
+	capacity := cache.capacityOf()
+	if capacity < min {
+		capacity = min
+	} else if capacity > max {
+		capacity = max
+	}
+	cache.setCapacity(capacity)
+	cache.setGhosts(max - capacity)
+	return z
+}
+
+// step judges the last interval, and returns the new capacity.
+func (z *cacheSizer) step() int {
+	capacity := z.cache.capacityOf()
+	lookups, ghostHits := z.cache.takeCounts()
+	next := capacity
+	if available, total, ok := z.memory(); ok && float64(available) < cacheLowMemory*float64(total) {
+		next = capacity - capacity/10 - 1
+	} else if lookups >= cacheSizerMinLooks && float64(ghostHits) > cacheGrowGain*float64(lookups) {
+		next = capacity + capacity/4 + 1
+	} else if z.cache.Len() < capacity/2 {
+		next = capacity - capacity/10 - 1
+	}
+	if next < z.min {
+		next = z.min
+	} else if next > z.max {
+		next = z.max
+	}
+	if next != capacity {
+		z.cache.setCapacity(next)
+		z.cache.setGhosts(z.max - next)
+		log.WithFields(logrus.Fields{
+			"op":         "cache_size",
+			"from":       capacity,
+			"to":         next,
+			"lookups":    lookups,
+			"ghost_hits": ghostHits,
+		}).Info()
+	}
+	return next
+}
+
+func (z *cacheSizer) run(done <-chan struct{}) {
+	ticker := time.NewTicker(cacheSizerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			z.step()
+		}
+	}
+}
+
+// systemMemory reads MemAvailable and MemTotal from /proc/meminfo, so the
+// memory is only considered on Linux.
+func systemMemory() (available uint64, total uint64, ok bool) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemAvailable:":
+			available = n
+		case "MemTotal:":
+			total = n
+		}
+	}
+	return available, total, available > 0 && total > 0
+}
@@ -0,0 +1,51 @@
+package freedns
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCacheSizer(t *testing.T) {
+	c := newSizedMemoryCache(10, 0, nil)
+	z := newCacheSizer(c, 5, 100)
+	z.memory = func() (uint64, uint64, bool) { return 0, 0, false }
+	work := func(keys int) {
+		for i := 0; i < 2000; i++ {
+			key := strconv.Itoa(i % keys)
+			if _, ok := c.Get(key); !ok {
+				c.Set(key, i)
+			}
+		}
+	}
+
+	// cycling over more keys than it holds, a larger cache would hit
+	work(12)
+	if got := z.step(); got <= 10 {
+		t.Errorf("the cache should grow, got %d", got)
+	}
+	for i := 0; i < 20; i++ {
+		work(50)
+		z.step()
+	}
+	if got := c.capacityOf(); got < 50 || got > 100 {
+		t.Errorf("the cache should grow to hold the working set within the max, got %d", got)
+	}
+
+	// a small working set after the purge doesn't fill it
+	c.Purge()
+	for i := 0; i < 50; i++ {
+		work(3)
+		z.step()
+	}
+	if got := c.capacityOf(); got < 5 || got > 7 {
+		t.Errorf("the cache should shrink until half full, got %d", got)
+	}
+
+	// shrinks on low memory regardless of the gains
+	c.setCapacity(50)
+	z.memory = func() (uint64, uint64, bool) { return 5, 100, true }
+	work(100)
+	if got := z.step(); got >= 50 {
+		t.Errorf("the cache should shrink on low memory, got %d", got)
+	}
+}
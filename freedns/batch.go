@@ -0,0 +1,111 @@
+package freedns
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// batchConcurrency is the default concurrency of the batches.
+const batchConcurrency = 8
+
+// The limits of a batch on the admin API.
+const (
+	batchMaxQueries     = 1000
+	batchMaxConcurrency = 64
+)
+
+// BatchQuery is a question of QueryBatch.
+type BatchQuery struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // A if empty
+}
+
+// BatchResult is the outcome of a BatchQuery.
+type BatchResult struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Rcode    string   `json:"rcode,omitempty"`
+	Upstream string   `json:"upstream,omitempty"`
+	Location string   `json:"location,omitempty"`
+	Answers  []string `json:"answers,omitempty"` // the records in the presentation format
+	Latency  float64  `json:"latency_ms"`
+	Error    string   `json:"error,omitempty"` // of the invalid queries
+}
+
+// QueryBatch resolves the queries through the pipeline of the server, as
+// Query does, with up to `concurrency` of them at once, 8 if it's 0. The
+// results are in the order of the queries. It's useful to warm the cache up
+// or to audit a list of domains.
+func (s *Server) QueryBatch(queries []BatchQuery, concurrency int) []BatchResult {
+	if concurrency <= 0 {
+		concurrency = batchConcurrency
+	}
+	results := make([]BatchResult, len(queries))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, q := range queries {
+		qtype := strings.ToUpper(q.Type)
+		if qtype == "" {
+			qtype = "A"
+		}
+		results[i] = BatchResult{Name: dns.Fqdn(q.Name), Type: qtype}
+		t, ok := dns.StringToType[qtype]
+		if !ok {
+			results[i].Error = "unknown type: " + q.Type
+			continue
+		}
+		if _, ok := dns.IsDomainName(q.Name); !ok || q.Name == "" {
+			results[i].Error = "invalid name: " + q.Name
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r *BatchResult, qtype uint16) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			start := time.Now()
+			res := s.Query(r.Name, qtype)
+			r.Latency = milliseconds(time.Since(start))
+			r.Rcode = dns.RcodeToString[res.Msg.Rcode]
+			r.Upstream, r.Location = res.Upstream, res.Location
+			for _, rr := range res.Msg.Answer {
+				r.Answers = append(r.Answers, rr.String())
+			}
+		}(&results[i], t)
+	}
+	wg.Wait()
+	return results
+}
+
+// batchRequest is the body of /api/resolve.
+type batchRequest struct {
+	Queries     []BatchQuery `json:"queries"`
+	Concurrency int          `json:"concurrency"`
+}
+
+// serveBatch resolves the queries of the POSTed batch.
+func (s *Server) serveBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	var req batchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid batch: " + err.Error()})
+		return
+	}
+	if len(req.Queries) > batchMaxQueries {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "too many queries, at most 1000 in a batch"})
+		return
+	}
+	if req.Concurrency > batchMaxConcurrency {
+		req.Concurrency = batchMaxConcurrency
+	}
+	writeJSON(w, http.StatusOK, s.QueryBatch(req.Queries, req.Concurrency))
+}
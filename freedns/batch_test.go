@@ -0,0 +1,55 @@
+package freedns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestQueryBatch(t *testing.T) {
+	blocklist := writeTempFile(t, "ads.example.com\n")
+	defer os.Remove(blocklist)
+	fast, _, stopFast := countingUpstream(t, "114.114.114.114")
+	defer stopFast()
+	clean, _, stopClean := countingUpstream(t, "8.8.8.8")
+	defer stopClean()
+	s := newTestServer(t, Config{FastDNS: fast, CleanDNS: clean, Blocklists: []string{blocklist}, AdminListen: "127.0.0.1:0"})
+	defer s.Shutdown()
+	api := httptest.NewServer(s.adminServer.Handler)
+	defer api.Close()
+
+	body := `{"queries": [{"name": "www.example.com"}, {"name": "ads.example.com", "type": "aaaa"}, {"name": "x.example.com", "type": "NOPE"}], "concurrency": 2}`
+	resp, err := http.Post(api.URL+"/api/resolve", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var results []BatchResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expect 3 results, got %+v", results)
+	}
+	if r := results[0]; r.Name != "www.example.com." || r.Type != "A" || r.Rcode != "NOERROR" || r.Location != LocationChina || len(r.Answers) != 1 {
+		t.Errorf("expect the answer of the fast upstream, got %+v", r)
+	}
+	if r := results[1]; r.Type != "AAAA" || r.Upstream != "blocklist" || r.Rcode != "NXDOMAIN" {
+		t.Errorf("expect the blocked answer, got %+v", r)
+	}
+	if r := results[2]; r.Error == "" || r.Rcode != "" {
+		t.Errorf("expect the unknown type rejected, got %+v", r)
+	}
+
+	resp, err = http.Get(api.URL + "/api/resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expect only POST accepted, got %d", resp.StatusCode)
+	}
+}
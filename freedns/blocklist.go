@@ -0,0 +1,364 @@
+package freedns
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// The responses a blocked query can get.
+const (
+	BlockNXDomain = "nxdomain" // NXDOMAIN
+	BlockZeroIP   = "zero"     // 0.0.0.0 for A, :: for AAAA, empty NOERROR otherwise
+	BlockEmpty    = "empty"    // empty NOERROR
+)
+
+// blockTTL is the ttl of the synthesized records for blocked queries.
+const blockTTL = 60
+
+// domainSet is a set of domains. A name matches the set if either itself or
+// one of its parent domains is in the set. It's a plain hash set, so the match
+// costs one lookup per label no matter how many domains are loaded.
+type domainSet map[string]struct{}
+
+func normalizeDomain(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+func (s domainSet) add(name string) {
+	s[normalizeDomain(name)] = struct{}{}
+}
+
+func (s domainSet) match(name string) bool {
+	name = normalizeDomain(name)
+	for {
+		if _, ok := s[name]; ok {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// hostsPlaceholders are the names in hosts files which are not actual blocking
+// entries.
+var hostsPlaceholders = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+// parseBlocklistLine extracts the domains from a line of a blocklist. It
+// supports the hosts format, plain domain lists and the basic AdGuard syntax
+// (`||example.com^`, and `@@||example.com^` for exceptions, in which case
+// `exception` is true). Rules it can not express are ignored.
+func parseBlocklistLine(line string) (domains []string, exception bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return nil, false
+	}
+
+	// AdGuard / Adblock syntax
+	if strings.HasPrefix(line, "@@") {
+		line = strings.TrimPrefix(line, "@@")
+		exception = true
+	}
+	if strings.HasPrefix(line, "||") {
+		rule := strings.TrimPrefix(line, "||")
+		if i := strings.IndexByte(rule, '$'); i >= 0 {
+			rule = rule[:i]
+		}
+		rule = strings.TrimSuffix(rule, "^")
+		if !isPlainDomain(rule) {
+			return nil, false
+		}
+		return []string{rule}, exception
+	}
+	if exception || strings.HasPrefix(line, "/") {
+		return nil, false
+	}
+
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, false
+	}
+
+	// hosts format
+	if net.ParseIP(fields[0]) != nil {
+		for _, f := range fields[1:] {
+			if !hostsPlaceholders[strings.ToLower(f)] && isPlainDomain(f) {
+				domains = append(domains, f)
+			}
+		}
+		return domains, false
+	}
+
+	// plain domain list
+	if len(fields) == 1 && isPlainDomain(fields[0]) {
+		return []string{fields[0]}, false
+	}
+	return nil, false
+}
+
+func isPlainDomain(s string) bool {
+	if s == "" || strings.ContainsAny(s, "*/|^$") {
+		return false
+	}
+	_, ok := dns.IsDomainName(s)
+	return ok
+}
+
+// parseBlocklist adds all domains of the blocklist read from `r` into `set`,
+// except the ones of the exception rules, which go to `exceptions`.
+func parseBlocklist(r io.Reader, set domainSet, exceptions domainSet) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		domains, exception := parseBlocklistLine(scanner.Text())
+		for _, d := range domains {
+			if exception {
+				exceptions.add(d)
+			} else {
+				set.add(d)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// blocker decides if a query is blocked and synthesizes the responses for
+// the blocked ones. The responses are synthesized on every query and are never
+// cached: a single rule covers any number of subdomains, so blocking a whole
+// zone costs no cache entries.
+type blocker struct {
+	sources      []string // files or http(s) URLs
+	allowSources []string // the same as sources, but for the allowed domains
+	cacheDir     string   // where the last good copies of the URLs are kept
+	response     string
+
+	mu      sync.RWMutex
+	domains domainSet
+	allowed domainSet // evaluated before domains
+}
+
+func newBlocker(sources []string, allowSources []string, response string, cacheDir string) (*blocker, error) {
+	if response == "" {
+		response = BlockNXDomain
+	}
+	if response != BlockNXDomain && response != BlockZeroIP && response != BlockEmpty {
+		return nil, Error("unknown block response: " + response)
+	}
+
+	b := &blocker{
+		sources:      sources,
+		allowSources: allowSources,
+		cacheDir:     cacheDir,
+		response:     response,
+	}
+	if err := b.reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// reload compiles the rule set from all sources again and swaps it in. The
+// current rule set is kept if any source fails.
+func (b *blocker) reload() error {
+	domains := domainSet{}
+	allowed := domainSet{}
+	for _, src := range b.sources {
+		if err := b.load(src, domains, allowed); err != nil {
+			return err
+		}
+	}
+	// every rule of an allowlist allows the domains
+	for _, src := range b.allowSources {
+		if err := b.load(src, allowed, allowed); err != nil {
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	b.domains = domains
+	b.allowed = allowed
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *blocker) load(src string, set domainSet, exceptions domainSet) error {
+	var data []byte
+	var err error
+	if isURL(src) {
+		data, err = b.fetch(src)
+	} else {
+		data, err = ioutil.ReadFile(src)
+	}
+	if err != nil {
+		return err
+	}
+	return parseBlocklist(bytes.NewReader(data), set, exceptions)
+}
+
+// updateLoop reloads the blocklists every `interval` until `done` is closed,
+// waiting for the maintenance windows if any.
+func (b *blocker) updateLoop(interval time.Duration, windows maintenanceWindows, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !windows.wait(done) {
+				return
+			}
+			// drop the tick while waiting, which would update again at once
+			select {
+			case <-ticker.C:
+			default:
+			}
+			l := log.WithField("op", "update_blocklist")
+			if err := b.reload(); err != nil {
+				l.Error(err)
+			} else {
+				l.Info()
+			}
+		}
+	}
+}
+
+func isURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+var blocklistHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetch downloads the blocklist at `url`. The last good copy is persisted in
+// the cache dir so that the blocklist is still available if the download
+// fails, e.g. starting without network.
+func (b *blocker) fetch(url string) ([]byte, error) {
+	var cached string
+	if b.cacheDir != "" {
+		sum := sha1.Sum([]byte(url))
+		cached = filepath.Join(b.cacheDir, hex.EncodeToString(sum[:])+".txt")
+	}
+
+	data, err := download(url)
+	if err == nil {
+		if cached != "" {
+			if err := writeFileAtomic(cached, data, 0644); err != nil {
+				log.WithFields(logrus.Fields{
+					"op":  "fetch_blocklist",
+					"url": url,
+				}).Warn(err)
+			}
+		}
+		return data, nil
+	}
+
+	if cached != "" {
+		if data, cacheErr := ioutil.ReadFile(cached); cacheErr == nil {
+			log.WithFields(logrus.Fields{
+				"op":  "fetch_blocklist",
+				"url": url,
+			}).Warn(err, ", using the cached copy")
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+func download(url string) ([]byte, error) {
+	resp, err := blocklistHTTPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, Error(url + ": " + resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// writeFileAtomic writes the file by renaming a temporary file, so readers
+// never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (b *blocker) blocked(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return !b.allowed.match(name) && b.domains.match(name)
+}
+
+// reply synthesizes the response for the blocked request.
+func (b *blocker) reply(req *dns.Msg) *dns.Msg {
+	res := &dns.Msg{}
+	res.SetReply(req)
+
+	if b.response == BlockNXDomain {
+		res.Rcode = dns.RcodeNameError
+		return res
+	}
+
+	if b.response == BlockZeroIP {
+		q := req.Question[0]
+		hdr := dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: q.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    blockTTL,
+		}
+		switch q.Qtype {
+		case dns.TypeA:
+			res.Answer = append(res.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+		case dns.TypeAAAA:
+			res.Answer = append(res.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+		}
+	}
+	return res
+}
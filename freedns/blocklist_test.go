@@ -0,0 +1,188 @@
+package freedns
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	list := `
+# hosts format
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # inline comment
+::1 ip6-localhost
+
+# domain list
+doubleclick.net
+
+! AdGuard syntax
+||adserver.org^
+||metrics.io^$important
+@@||allowed.org^
+/banner[0-9]+/
+||*.wildcard.com^
+`
+	set := domainSet{}
+	exceptions := domainSet{}
+	if err := parseBlocklist(strings.NewReader(list), set, exceptions); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		blocked bool
+	}{
+		{"ads.example.com.", true},
+		{"TRACKER.example.com.", true},
+		{"example.com.", false},
+		{"doubleclick.net.", true},
+		{"stats.g.doubleclick.net.", true},
+		{"adserver.org.", true},
+		{"metrics.io.", true},
+		{"allowed.org.", false},
+		{"localhost.", false},
+		{"wildcard.com.", false},
+		{"net.", false},
+	}
+	for _, c := range cases {
+		if set.match(c.name) != c.blocked {
+			t.Errorf("match(%s) should be %v", c.name, c.blocked)
+		}
+	}
+	if !exceptions.match("allowed.org.") {
+		t.Errorf("@@ rules should be exceptions")
+	}
+}
+
+func TestBlockerReply(t *testing.T) {
+	req := &dns.Msg{}
+	req.SetQuestion("ads.example.com.", dns.TypeA)
+
+	cases := []struct {
+		response string
+		rcode    int
+		answers  int
+	}{
+		{BlockNXDomain, dns.RcodeNameError, 0},
+		{BlockZeroIP, dns.RcodeSuccess, 1},
+		{BlockEmpty, dns.RcodeSuccess, 0},
+	}
+	for _, c := range cases {
+		b, err := newBlocker(nil, nil, c.response, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := b.reply(req)
+		if res.Rcode != c.rcode || len(res.Answer) != c.answers {
+			t.Errorf("%s: got rcode %d with %d answers", c.response, res.Rcode, len(res.Answer))
+		}
+	}
+
+	if _, err := newBlocker(nil, nil, "wtf", ""); err == nil {
+		t.Errorf("unknown block response should be an error")
+	}
+}
+
+func TestBlockerAllowlist(t *testing.T) {
+	blocklist := writeTempFile(t, "example.com\n@@||shop.example.com^\n")
+	defer os.Remove(blocklist)
+	allowlist := writeTempFile(t, "cdn.example.com\n")
+	defer os.Remove(allowlist)
+
+	b, err := newBlocker([]string{blocklist}, []string{allowlist}, BlockNXDomain, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		blocked bool
+	}{
+		{"example.com.", true},
+		{"ads.example.com.", true},
+		{"shop.example.com.", false},
+		{"cdn.example.com.", false},
+		{"img.cdn.example.com.", false},
+	}
+	for _, c := range cases {
+		if b.blocked(c.name) != c.blocked {
+			t.Errorf("blocked(%s) should be %v", c.name, c.blocked)
+		}
+	}
+}
+
+func TestBlockerFetch(t *testing.T) {
+	list := "||ads.example.com^\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(list))
+	}))
+
+	dir, err := ioutil.TempDir("", "freedns-blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := newBlocker([]string{srv.URL}, nil, BlockNXDomain, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.blocked("ads.example.com.") {
+		t.Errorf("ads.example.com should be blocked")
+	}
+
+	// reload swaps in the new rule set
+	list = "||tracker.example.com^\n"
+	if err := b.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if b.blocked("ads.example.com.") || !b.blocked("tracker.example.com.") {
+		t.Errorf("the rule set should be replaced after reload")
+	}
+
+	// the last good copy is used when the URL is unreachable
+	srv.Close()
+	b, err = newBlocker([]string{srv.URL}, nil, BlockNXDomain, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.blocked("tracker.example.com.") {
+		t.Errorf("the cached copy should be loaded")
+	}
+}
+
+func TestBlockedQueriesAreNotCached(t *testing.T) {
+	blocklist := writeTempFile(t, "||example.com^\n")
+	defer os.Remove(blocklist)
+
+	// unreachable upstreams, the blocked queries must not reach them
+	s, err := NewServer(Config{
+		FastDNS:    "127.0.0.1:1",
+		CleanDNS:   "127.0.0.1:1",
+		Listen:     "127.0.0.1:0",
+		CacheCap:   16,
+		Blocklists: []string{blocklist},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"example.com.", "a.example.com.", "b.a.example.com."} {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		w := newRecorder()
+		s.handle(w, req, "udp")
+		if w.msg == nil || w.msg.Rcode != dns.RcodeNameError {
+			t.Errorf("%s should be blocked, got %v", name, w.msg)
+		}
+		if res, _ := s.recordsCache.lookup(req.Question[0], req.RecursionDesired, "udp"); res != nil {
+			t.Errorf("the blocked %s should not be cached", name)
+		}
+	}
+}
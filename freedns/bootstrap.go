@@ -0,0 +1,150 @@
+package freedns
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// The TTLs of the addresses of the upstreams are clamped, so a tiny TTL
+// doesn't resolve the name on every connection, and the upstream moving is
+// still followed.
+const (
+	bootstrapMinTTL = time.Minute
+	bootstrapMaxTTL = time.Hour
+)
+
+// upstreamDialer connects to the upstreams of a resolver, resolving their
+// host names by `bootstrap` if it's not nil, and the DNS over TLS ones
+// through the HTTP `proxy` if it's not nil. A nil upstreamDialer resolves
+// them by the system and connects them directly.
+type upstreamDialer struct {
+	bootstrap *bootstrapResolver
+	proxy     *url.URL
+}
+
+// resolve returns the address to dial for the upstream `address`.
+func (d *upstreamDialer) resolve(address string, timeout time.Duration) (string, error) {
+	if d == nil {
+		return address, nil
+	}
+	return d.bootstrap.resolve(address, timeout)
+}
+
+// bootstrapResolver resolves the host names of the upstreams by a DNS server
+// of its own, independently of the pipeline, so an upstream given by the name,
+// e.g. dns.google:853, doesn't depend on the system resolver, which is often
+// freedns-go itself. The addresses are cached by their TTLs, and the last
+// ones are kept while the names fail to resolve again.
+type bootstrapResolver struct {
+	server string
+
+	mu    sync.Mutex
+	hosts map[string]*bootstrapHost
+}
+
+type bootstrapHost struct {
+	ips     []string
+	next    int // round-robin over the ips
+	expires time.Time
+}
+
+// newBootstrapResolver creates the resolver querying `server`, an IP with an
+// optional port, e.g. 223.5.5.5. It returns nil if `server` is empty.
+func newBootstrapResolver(server string) (*bootstrapResolver, error) {
+	if server == "" {
+		return nil, nil
+	}
+	server = appendDefaultPort(server)
+	host, _, err := net.SplitHostPort(server)
+	if err != nil || net.ParseIP(host) == nil {
+		return nil, Error("invalid bootstrap DNS server, expect an IP: " + server)
+	}
+	return &bootstrapResolver{server: server, hosts: map[string]*bootstrapHost{}}, nil
+}
+
+// resolve returns the address to dial for the upstream `address`, i.e. its
+// host name replaced by one of its IPs. The address is returned as is if the
+// host is an IP or `b` is nil.
+func (b *bootstrapResolver) resolve(address string, timeout time.Duration) (string, error) {
+	if b == nil {
+		return address, nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return address, nil
+	}
+
+	// one lookup at a time, so a burst of connections doesn't flood the
+	// bootstrap server
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := b.hosts[host]
+	if h == nil || time.Now().After(h.expires) {
+		ips, ttl, err := b.lookup(host, timeout)
+		if err != nil || len(ips) == 0 {
+			if err == nil {
+				err = Error("no addresses of " + host)
+			}
+			if h == nil {
+				return "", err
+			}
+			log.WithFields(logrus.Fields{
+				"op":        "bootstrap",
+				"bootstrap": b.server,
+				"upstream":  address,
+			}).Warn("keep the last addresses: ", err)
+			h.expires = time.Now().Add(bootstrapMinTTL)
+		} else {
+			h = &bootstrapHost{ips: ips, expires: time.Now().Add(ttl)}
+			b.hosts[host] = h
+		}
+	}
+	ip := h.ips[h.next%len(h.ips)]
+	h.next++
+	return net.JoinHostPort(ip, port), nil
+}
+
+// lookup queries the A records of `host`, or the AAAA records if it has none,
+// and returns the IPs with their TTL.
+func (b *bootstrapResolver) lookup(host string, timeout time.Duration) ([]string, time.Duration, error) {
+	c := &dns.Client{Timeout: timeout}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := &dns.Msg{}
+		req.SetQuestion(dns.Fqdn(host), qtype)
+		req.Id = queryID()
+		res, _, err := c.Exchange(req, b.server)
+		if err != nil {
+			return nil, 0, err
+		}
+		if res.Rcode != dns.RcodeSuccess {
+			return nil, 0, Error("the bootstrap DNS server answered " + dns.RcodeToString[res.Rcode] + " for " + host)
+		}
+		var ips []string
+		ttl := bootstrapMaxTTL
+		for _, rr := range res.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A.String())
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA.String())
+			default:
+				continue
+			}
+			if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+		if len(ips) > 0 {
+			if ttl < bootstrapMinTTL {
+				ttl = bootstrapMinTTL
+			}
+			return ips, ttl, nil
+		}
+	}
+	return nil, 0, nil
+}
@@ -0,0 +1,49 @@
+package freedns
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBootstrapResolver(t *testing.T) {
+	server, queries, stop := countingUpstream(t, "127.0.0.2")
+	b, err := newBootstrapResolver(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := b.resolve("dns.example:853", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "127.0.0.2:853" {
+			t.Errorf("expect 127.0.0.2:853, got %s", got)
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 1 {
+		t.Errorf("expect the address cached after 1 query, got %d", n)
+	}
+	if got, _ := b.resolve("8.8.8.8:53", time.Second); got != "8.8.8.8:53" {
+		t.Errorf("expect the IP kept as is, got %s", got)
+	}
+
+	// the last addresses are kept while the bootstrap server fails
+	stop()
+	b.hosts["dns.example"].expires = time.Now()
+	if got, err := b.resolve("dns.example:853", 100*time.Millisecond); err != nil || got != "127.0.0.2:853" {
+		t.Errorf("expect the last address, got %s, %v", got, err)
+	}
+	if _, err := b.resolve("other.example:853", 100*time.Millisecond); err == nil {
+		t.Error("expect an error of a name never resolved")
+	}
+
+	var none *bootstrapResolver
+	if got, _ := none.resolve("dns.example:853", time.Second); got != "dns.example:853" {
+		t.Errorf("expect the address kept as is without a bootstrap server, got %s", got)
+	}
+	if _, err := newBootstrapResolver("dns.example"); err == nil {
+		t.Error("expect an error of a bootstrap server by the name")
+	}
+}
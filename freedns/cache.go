@@ -0,0 +1,305 @@
+package freedns
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache is the backend of the caches of the server and the resolver, e.g. the
+// cached responses and the locations of the domains. The backend decides
+// which entries to keep. It must be safe for concurrent use.
+type Cache interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, value interface{})
+	Purge()
+	Len() int
+}
+
+// memoryCache is the default Cache, an in-memory LRU cache bounded by the
+// count of the entries, and optionally by their estimated sizes.
+type memoryCache struct {
+	capacity int
+	maxBytes int
+	sizeOf   func(key string, value interface{}) int
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	order *list.List // of *memoryItem, the most recently used first
+	bytes int
+
+	// The ghosts are the keys evicted lately, up to ghostCap of them. The
+	// lookups of the ghosts would have hit a larger cache.
+	ghostCap   int
+	ghosts     map[string]*list.Element
+	ghostOrder *list.List // of the keys, the latest evicted first
+	lookups    int
+	ghostHits  int
+
+	// onEvict is called with the entries evicted over the limits, with c.mu
+	// held, if not nil.
+	onEvict func(key string, value interface{})
+}
+
+type memoryItem struct {
+	key   string
+	value interface{}
+	size  int
+}
+
+// NewMemoryCache creates an in-memory LRU cache of up to `capacity` entries.
+func NewMemoryCache(capacity int) Cache {
+	return newSizedMemoryCache(capacity, 0, nil)
+}
+
+// newSizedMemoryCache creates an in-memory LRU cache of up to `capacity`
+// entries and, if maxBytes > 0, up to `maxBytes` bytes in total as estimated by
+// `sizeOf`.
+func newSizedMemoryCache(capacity int, maxBytes int, sizeOf func(key string, value interface{}) int) *memoryCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if sizeOf == nil {
+		maxBytes = 0
+	}
+	return &memoryCache{
+		capacity: capacity,
+		maxBytes: maxBytes,
+		sizeOf:   sizeOf,
+		items:    map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (c *memoryCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lookups++
+	e, ok := c.items[key]
+	if !ok {
+		if g, ok := c.ghosts[key]; ok {
+			c.ghostHits++
+			c.ghostOrder.Remove(g)
+			delete(c.ghosts, key)
+		}
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*memoryItem).value, true
+}
+
+func (c *memoryCache) Set(key string, value interface{}) {
+	size := 0
+	if c.maxBytes > 0 {
+		size = c.sizeOf(key, value)
+		if size > c.maxBytes {
+			return // it would evict everything else
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		item := e.Value.(*memoryItem)
+		c.bytes += size - item.size
+		item.value, item.size = value, size
+		c.order.MoveToFront(e)
+	} else {
+		c.items[key] = c.order.PushFront(&memoryItem{key, value, size})
+		c.bytes += size
+		if g, ok := c.ghosts[key]; ok {
+			c.ghostOrder.Remove(g)
+			delete(c.ghosts, key)
+		}
+	}
+	c.evict()
+}
+
+// evict removes the least recently used entries over the limits. c.mu must
+// be held.
+func (c *memoryCache) evict() {
+	for c.order.Len() > c.capacity || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		oldest := c.order.Back()
+		item := oldest.Value.(*memoryItem)
+		c.order.Remove(oldest)
+		delete(c.items, item.key)
+		c.bytes -= item.size
+		if c.onEvict != nil {
+			c.onEvict(item.key, item.value)
+		}
+		if c.ghostCap > 0 {
+			c.ghosts[item.key] = c.ghostOrder.PushFront(item.key)
+			for c.ghostOrder.Len() > c.ghostCap {
+				delete(c.ghosts, c.ghostOrder.Remove(c.ghostOrder.Back()).(string))
+			}
+		}
+	}
+}
+
+func (c *memoryCache) Purge() {
+	c.mu.Lock()
+	c.items = map[string]*list.Element{}
+	c.order.Init()
+	c.bytes = 0
+	if c.ghostCap > 0 {
+		c.ghosts = map[string]*list.Element{}
+		c.ghostOrder.Init()
+	}
+	c.mu.Unlock()
+}
+
+func (c *memoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// each calls `f` with the entries, the least recently used first. `f` must
+// not use the cache.
+func (c *memoryCache) each(f func(key string, value interface{})) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.order.Back(); e != nil; e = e.Prev() {
+		item := e.Value.(*memoryItem)
+		f(item.key, item.value)
+	}
+}
+
+// size returns the estimated bytes of the entries.
+func (c *memoryCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// capacityOf returns the maximum count of the entries.
+func (c *memoryCache) capacityOf() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.capacity
+}
+
+// setCapacity changes the maximum count of the entries, evicting the least
+// recently used ones if it shrinks.
+func (c *memoryCache) setCapacity(capacity int) {
+	if capacity < 1 {
+		capacity = 1
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity = capacity
+	c.evict()
+}
+
+// setGhosts starts keeping up to `n` evicted keys, or stops if it's 0.
+func (c *memoryCache) setGhosts(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ghosts == nil {
+		c.ghosts = map[string]*list.Element{}
+		c.ghostOrder = list.New()
+	}
+	c.ghostCap = n
+	for c.ghostOrder.Len() > n {
+		delete(c.ghosts, c.ghostOrder.Remove(c.ghostOrder.Back()).(string))
+	}
+}
+
+// takeCounts returns the lookups and the ghost hits since the last call.
+func (c *memoryCache) takeCounts() (lookups int, ghostHits int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lookups, ghostHits = c.lookups, c.ghostHits
+	c.lookups, c.ghostHits = 0, 0
+	return lookups, ghostHits
+}
+
+// shardedCache splits the entries into memoryCaches by the hashes of the
+// keys, each with its own lock, so the concurrent lookups and refreshes of
+// different keys don't wait for each other. The LRU order is kept per shard.
+type shardedCache struct {
+	shards []*memoryCache
+}
+
+// newShardedMemoryCache creates `n` shards sharing `capacity` and `maxBytes`
+// evenly, rounded up.
+func newShardedMemoryCache(n int, capacity int, maxBytes int, sizeOf func(key string, value interface{}) int) *shardedCache {
+	if n < 1 {
+		n = 1
+	}
+	c := &shardedCache{shards: make([]*memoryCache, n)}
+	for i := range c.shards {
+		c.shards[i] = newSizedMemoryCache((capacity+n-1)/n, (maxBytes+n-1)/n, sizeOf)
+	}
+	return c
+}
+
+// shard picks the shard of the key by its FNV-1a hash.
+func (c *shardedCache) shard(key string) *memoryCache {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+func (c *shardedCache) Get(key string) (interface{}, bool) {
+	return c.shard(key).Get(key)
+}
+
+func (c *shardedCache) Set(key string, value interface{}) {
+	c.shard(key).Set(key, value)
+}
+
+func (c *shardedCache) Purge() {
+	for _, s := range c.shards {
+		s.Purge()
+	}
+}
+
+func (c *shardedCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+// size returns the estimated bytes of the entries.
+func (c *shardedCache) size() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.size()
+	}
+	return n
+}
+
+func (c *shardedCache) capacityOf() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.capacityOf()
+	}
+	return n
+}
+
+func (c *shardedCache) setCapacity(capacity int) {
+	n := len(c.shards)
+	for _, s := range c.shards {
+		s.setCapacity((capacity + n - 1) / n)
+	}
+}
+
+func (c *shardedCache) setGhosts(n int) {
+	for _, s := range c.shards {
+		s.setGhosts((n + len(c.shards) - 1) / len(c.shards))
+	}
+}
+
+func (c *shardedCache) takeCounts() (lookups int, ghostHits int) {
+	for _, s := range c.shards {
+		l, g := s.takeCounts()
+		lookups += l
+		ghostHits += g
+	}
+	return lookups, ghostHits
+}
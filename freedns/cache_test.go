@@ -0,0 +1,131 @@
+package freedns
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMemoryCache(t *testing.T) {
+	c := NewMemoryCache(2)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a") // b is the least recently used now
+	c.Set("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("the least recently used entry should be evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v.(int) != 1 {
+		t.Errorf("expect a=1, got %v", v)
+	}
+	c.Set("a", 4)
+	if v, _ := c.Get("a"); v.(int) != 4 || c.Len() != 2 {
+		t.Errorf("expect a=4 and 2 entries, got %v and %d", v, c.Len())
+	}
+
+	c.Purge()
+	if c.Len() != 0 {
+		t.Errorf("expect no entries after purging, got %d", c.Len())
+	}
+}
+
+func TestCustomCache(t *testing.T) {
+	backend := NewMemoryCache(16)
+	s := newTestServer(t, Config{Cache: backend})
+
+	res := &dns.Msg{}
+	res.SetQuestion("example.com.", dns.TypeA)
+	s.recordsCache.set(res, "udp")
+	if backend.Len() != 1 {
+		t.Errorf("the server should use the given cache, got %d entries", backend.Len())
+	}
+}
+
+func TestSizedMemoryCache(t *testing.T) {
+	c := newSizedDNSCache(1000, 4000)
+	backend := c.backend.(*memoryCache)
+
+	answer := func(name string, n int) *dns.Msg {
+		res := &dns.Msg{}
+		res.SetQuestion(name, dns.TypeA)
+		for i := 0; i < n; i++ {
+			rr, _ := dns.NewRR(name + " 300 IN A 10.0.0." + strconv.Itoa(i+1))
+			res.Answer = append(res.Answer, rr)
+		}
+		return res
+	}
+
+	small := answer("small.example.", 1)
+	c.set(small, "udp")
+	one := backend.size()
+	if one < cacheEntryOverhead+cacheRecordOverhead {
+		t.Errorf("the estimate %d is less than the overheads", one)
+	}
+
+	// the large responses take more of the budget than the small ones
+	for i := 0; i < 10; i++ {
+		c.set(answer("large"+strconv.Itoa(i)+".example.", 8), "udp")
+	}
+	if backend.size() > 4000 {
+		t.Errorf("the cache should be within the budget, got %d bytes", backend.size())
+	}
+	if backend.Len() >= 10 {
+		t.Errorf("the least recently used entries should be evicted by the size, got %d entries", backend.Len())
+	}
+	if res, _ := c.lookup(small.Question[0], true, "udp"); res != nil {
+		t.Error("the oldest entry should be evicted first")
+	}
+
+	backend.Purge()
+	if backend.size() != 0 {
+		t.Errorf("expect 0 bytes after purging, got %d", backend.size())
+	}
+}
+
+func TestShardedCache(t *testing.T) {
+	c := newShardedMemoryCache(4, 100, 0, nil)
+	for i := 0; i < 100; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	for i := 0; i < 100; i++ {
+		if v, ok := c.Get(strconv.Itoa(i)); ok && v.(int) != i {
+			t.Fatalf("expect %d, got %v", i, v)
+		}
+	}
+	// the keys don't spread exactly evenly, so some shards may evict
+	if n := c.Len(); n > 100 || n < 50 {
+		t.Errorf("expect about 100 entries, got %d", n)
+	}
+	used := 0
+	for _, s := range c.shards {
+		if s.Len() > 25 {
+			t.Errorf("a shard is over its capacity: %d", s.Len())
+		}
+		if s.Len() > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("the keys should be spread over the shards, %d used", used)
+	}
+
+	c.Purge()
+	if c.Len() != 0 {
+		t.Errorf("expect no entries after purging, got %d", c.Len())
+	}
+}
+
+func TestShardedDNSCache(t *testing.T) {
+	s := newTestServer(t, Config{CacheCap: 64, CacheShards: 8})
+	if _, ok := s.recordsCache.backend.(*shardedCache); !ok {
+		t.Fatalf("expect the sharded cache, got %T", s.recordsCache.backend)
+	}
+	res := &dns.Msg{}
+	res.SetQuestion("example.com.", dns.TypeA)
+	s.recordsCache.set(res, "udp")
+	if got, _ := s.recordsCache.lookup(res.Question[0], true, "udp"); got == nil {
+		t.Error("the response should be cached")
+	}
+}
@@ -0,0 +1,177 @@
+package freedns
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// iterableCache is a Cache whose entries can be listed, for the dumps.
+type iterableCache interface {
+	each(f func(key string, value interface{}))
+}
+
+// CacheRecord is a cached response in a dump of the cache, with the TTLs of
+// its records reduced to the remaining ones.
+type CacheRecord struct {
+	Net      string   `json:"net"`
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Rcode    string   `json:"rcode"`
+	TTL      int      `json:"ttl"`                // the remaining seconds of the shortest record
+	Upstream string   `json:"upstream,omitempty"` // which produced the answer, if known
+	Verdict  string   `json:"verdict,omitempty"`  // clean, china or unverified, if known
+	Answers  []string `json:"answers,omitempty"`  // in the presentation format, for reading
+	Msg      []byte   `json:"msg"`                // in the wire format, which is loaded
+}
+
+// dump returns the unexpired responses of the cache, without the ones of its
+// views, or an error if the backend can't be listed.
+func (c *dnsCache) dump() ([]CacheRecord, error) {
+	backend, ok := c.backend.(iterableCache)
+	if !ok {
+		return nil, Error("the cache backend can't be listed")
+	}
+	records := []CacheRecord{}
+	now := time.Now()
+	backend.each(func(key string, value interface{}) {
+		entry, ok := value.(cacheEntry)
+		if !ok || len(entry.reply.Question) == 0 || !c.owns(key) {
+			return
+		}
+		age := now.Sub(entry.putin)
+		remaining := entryTTL(entry.reply) - age
+		if remaining < time.Second {
+			return
+		}
+		res := entry.reply.Copy()
+		subTTL(res, int(age.Seconds()))
+		b, err := res.Pack()
+		if err != nil {
+			return
+		}
+		r := CacheRecord{
+			Net:      key[strings.LastIndex(key, "_")+1:],
+			Name:     res.Question[0].Name,
+			Type:     dns.TypeToString[res.Question[0].Qtype],
+			Rcode:    dns.RcodeToString[res.Rcode],
+			TTL:      int(remaining.Seconds()),
+			Upstream: entry.provenance.upstream,
+			Verdict:  entry.provenance.verdict,
+			Msg:      b,
+		}
+		for _, rr := range res.Answer {
+			r.Answers = append(r.Answers, rr.String())
+		}
+		records = append(records, r)
+	})
+	return records, nil
+}
+
+// load sets the records of a dump to the cache, as if they were just
+// resolved with their remaining TTLs, and returns how many were loaded.
+func (c *dnsCache) load(records []CacheRecord) (int, error) {
+	n := 0
+	for _, r := range records {
+		res := &dns.Msg{}
+		if err := res.Unpack(r.Msg); err != nil || len(res.Question) == 0 {
+			return n, Error("invalid cache record of " + r.Name)
+		}
+		net := r.Net
+		if net == "" {
+			net = "udp"
+		}
+		c.setFrom(res, net, provenance{upstream: r.Upstream, verdict: r.Verdict})
+		n++
+	}
+	return n, nil
+}
+
+// serveCacheDump writes the unexpired responses of the cache.
+func (s *Server) serveCacheDump(w http.ResponseWriter, r *http.Request) {
+	records, err := s.recordsCache.dump()
+	if err != nil {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// loadCache sets the records of the dump POSTed to the cache.
+func (s *Server) loadCache(r *http.Request) error {
+	var records []CacheRecord
+	if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+		return Error("invalid cache dump: " + err.Error())
+	}
+	n, err := s.recordsCache.load(records)
+	log.WithFields(logrus.Fields{
+		"op":      "cache_load",
+		"records": n,
+	}).Info("cache records loaded")
+	return err
+}
+
+// each lists the entries of the shards, the shards in turn.
+func (c *shardedCache) each(f func(key string, value interface{})) {
+	for _, s := range c.shards {
+		s.each(f)
+	}
+}
+
+// each lists the entries of the memory tier, and then the others of the disk
+// tier, which are read from the disk. Unlike memoryCache.each, `f` may use the
+// cache.
+func (c *tieredCache) each(f func(key string, value interface{})) {
+	type item struct {
+		key   string
+		value interface{}
+	}
+	var hot []item
+	seen := map[string]bool{}
+	c.hot.each(func(key string, value interface{}) {
+		hot = append(hot, item{key, value})
+		seen[key] = true
+	})
+	for _, i := range hot {
+		f(i.key, i.value)
+	}
+	for _, key := range c.disk.keys() {
+		if seen[key] {
+			continue
+		}
+		if entry, ok := c.disk.get(key); ok {
+			f(key, entry)
+		}
+	}
+}
+
+// keys returns the keys of the records, the least recently used first.
+func (d *diskCache) keys() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var keys []string
+	d.index.each(func(key string, value interface{}) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// each reads the entries of the cache, in the order of the keys in Redis.
+func (c *redisCache) each(f func(key string, value interface{})) {
+	err := c.scan(func(keys []string) error {
+		for _, key := range keys {
+			key = strings.TrimPrefix(key, redisKeyPrefix)
+			if v, ok := c.Get(key); ok {
+				f(key, v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.logError(err)
+	}
+}
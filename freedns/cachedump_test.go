@@ -0,0 +1,118 @@
+package freedns
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCacheDumpAndLoad(t *testing.T) {
+	primary := newTestServer(t, Config{AdminListen: "127.0.0.1:0"})
+	api := httptest.NewServer(primary.adminServer.Handler)
+	defer api.Close()
+	defer primary.Shutdown()
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Answer = append(res.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(93, 184, 216, 34),
+	})
+	primary.recordsCache.backend.Set(requestToString(req.Question[0], true, "tcp"), cacheEntry{
+		putin: time.Now().Add(-100 * time.Second),
+		reply: res,
+	})
+	expired := res.Copy()
+	expired.Question[0].Name = "example.org."
+	primary.recordsCache.backend.Set(requestToString(expired.Question[0], true, "udp"), cacheEntry{
+		putin: time.Now().Add(-time.Hour),
+		reply: expired,
+	})
+
+	resp, err := http.Get(api.URL + "/api/cache/dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []CacheRecord
+	err = json.NewDecoder(resp.Body).Decode(&records)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expect the unexpired record only, got %+v", records)
+	}
+	r := records[0]
+	if r.Net != "tcp" || r.Name != "example.com." || r.Type != "A" || r.Rcode != "NOERROR" || len(r.Answers) != 1 {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if r.TTL < 195 || r.TTL > 200 {
+		t.Errorf("expect the remaining TTL of about 200s, got %d", r.TTL)
+	}
+
+	s := newTestServer(t, Config{AdminListen: "127.0.0.1:0"})
+	api2 := httptest.NewServer(s.adminServer.Handler)
+	defer api2.Close()
+	defer s.Shutdown()
+	body, _ := json.Marshal(records)
+	resp, err = http.Post(api2.URL+"/api/cache/load", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect the dump loaded, got %s", resp.Status)
+	}
+	cached, _ := s.recordsCache.lookup(req.Question[0], true, "tcp")
+	if cached == nil || len(cached.Answer) != 1 {
+		t.Fatalf("the loaded record should be cached, got %v", cached)
+	}
+	if ttl := cached.Answer[0].Header().Ttl; ttl < 195 || ttl > 200 {
+		t.Errorf("the loaded record should keep the remaining TTL, got %d", ttl)
+	}
+
+	resp, err = http.Post(api2.URL+"/api/cache/load", "application/json", bytes.NewReader([]byte(`[{"msg": "AAAA"}]`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("an invalid record should fail the load")
+	}
+}
+
+func TestTieredCacheEach(t *testing.T) {
+	path := writeTempFile(t, "")
+	defer os.Remove(path)
+	disk, err := openDiskCache(path, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTieredCache(newSizedMemoryCache(1, 0, nil), disk)
+	defer c.close()
+	res := &dns.Msg{}
+	res.SetQuestion("example.com.", dns.TypeA)
+	c.Set("a", cacheEntry{putin: time.Now(), reply: res})
+	c.Set("b", cacheEntry{putin: time.Now(), reply: res}) // evicts a to the disk
+	deadline := time.Now().Add(5 * time.Second)
+	for c.disk.len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	keys := map[string]bool{}
+	c.each(func(key string, value interface{}) {
+		keys[key] = true
+	})
+	if len(keys) != 2 || !keys["a"] || !keys["b"] {
+		t.Errorf("expect the entries of both tiers, got %v", keys)
+	}
+}
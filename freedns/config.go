@@ -0,0 +1,298 @@
+package freedns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Duration is a time.Duration written as a string like "1h30m" in the config
+// file.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return durationError{string(b), err}
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// durationError is an invalid Duration, with its JSON to locate it in the
+// config file.
+type durationError struct {
+	raw string
+	err error
+}
+
+func (e durationError) Error() string {
+	return e.err.Error()
+}
+
+// LoadConfig fills `cfg` with the JSON config file at `path`. The fields
+// absent from the file keep their values, and unknown fields are errors
+// so that typos do not pass silently. The errors are prefixed by the line
+// and the column of the problem in the file when they're known.
+func LoadConfig(path string, cfg *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		if offset := errorOffset(data, err); offset >= 0 {
+			line, col := lineColumn(data, offset)
+			return Error(fmt.Sprintf("%s:%d:%d: %s", path, line, col, err))
+		}
+		return Error(path + ": " + err.Error())
+	}
+	return nil
+}
+
+// errorOffset returns the offset in `data` of the decoding error, or -1 if
+// it's unknown.
+func errorOffset(data []byte, err error) int64 {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		// the offset is past the offending byte
+		if e.Offset > 0 {
+			return e.Offset - 1
+		}
+		return 0
+	case *json.UnmarshalTypeError:
+		// the offset is past the value, point at its key instead
+		if i := keyOffset(data[:e.Offset], `"`+e.Field+`"`); e.Field != "" && i >= 0 {
+			return i
+		}
+		return e.Offset
+	case durationError:
+		return int64(bytes.Index(data, []byte(e.raw)))
+	}
+	// the unknown fields are reported without the offsets
+	const unknown = "json: unknown field "
+	if msg := err.Error(); strings.HasPrefix(msg, unknown) {
+		return keyOffset(data, strings.TrimPrefix(msg, unknown))
+	}
+	return -1
+}
+
+// keyOffset returns the offset of the last object key `key`, quoted, in
+// `data`, or -1.
+func keyOffset(data []byte, key string) int64 {
+	for end := len(data); end > 0; {
+		i := bytes.LastIndex(data[:end], []byte(key))
+		if i < 0 {
+			break
+		}
+		if rest := bytes.TrimLeft(data[i+len(key):], " \t\r\n"); len(rest) > 0 && rest[0] == ':' {
+			return int64(i)
+		}
+		end = i
+	}
+	return -1
+}
+
+// lineColumn returns the line and the column, from 1, of the offset.
+func lineColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// setDefaults replaces the zero values of the settings having a default
+// other than off by that default, the same as the flag of the command line,
+// so a Config built in Go or loaded from JSON runs like the flags. The
+// negative values turn them off.
+func (cfg *Config) setDefaults() {
+	if cfg.BlocklistUpdateInterval == 0 {
+		cfg.BlocklistUpdateInterval = Duration(24 * time.Hour)
+	}
+	if cfg.ChinaIPListUpdateInterval == 0 {
+		cfg.ChinaIPListUpdateInterval = Duration(24 * time.Hour)
+	}
+	if cfg.QueueLimit == 0 {
+		cfg.QueueLimit = 1024
+	}
+	if cfg.UpstreamBurst == 0 {
+		cfg.UpstreamBurst = 10
+	}
+	if cfg.QueryLogMaxSize == 0 {
+		cfg.QueryLogMaxSize = 100
+	}
+	if cfg.QueryLogBackups == 0 {
+		cfg.QueryLogBackups = 7
+	}
+	if cfg.StatsWindow == 0 {
+		cfg.StatsWindow = Duration(24 * time.Hour)
+	}
+}
+
+// CheckConfig checks the config the way NewServer does, loading the
+// blocklists and the GeoIP database, and also the addresses of the
+// upstreams, resolving their host names, so a typo fails the check instead of
+// the queries after the deploy. The upstream errors are reported all at once,
+// by the fields. Unlike NewServer, it doesn't open the files of the logs and
+// the disk cache, or change the logger.
+func CheckConfig(cfg Config) error {
+	addresses := []struct {
+		field   string
+		address string
+	}{{"FastDNS", cfg.FastDNS}, {"CleanDNS", cfg.CleanDNS}, {"ReplicaDNS", cfg.ReplicaDNS}}
+	for _, g := range []struct {
+		field   string
+		members []string
+	}{{"FastDNSGroups", cfg.FastDNSGroups}, {"CleanDNSGroups", cfg.CleanDNSGroups}} {
+		for _, m := range g.members {
+			if i := strings.Index(m, "="); i >= 0 {
+				addresses = append(addresses, struct {
+					field   string
+					address string
+				}{g.field, m[i+1:]})
+			}
+		}
+	}
+
+	if _, err := newServer(cfg, true); err != nil {
+		return err
+	}
+	bootstrap, _ := newBootstrapResolver(cfg.Bootstrap)
+	var errs []string
+	for _, a := range addresses {
+		if a.address == "" || a.address == recursiveUpstream {
+			continue
+		}
+		if err := checkUpstream(appendDefaultPort(a.address), bootstrap); err != nil {
+			errs = append(errs, a.field+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return Error(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// checkUpstream checks the upstream is a host:port with a valid port, and
+// resolves the host if it's a name, by `bootstrap` if it's not nil.
+func checkUpstream(address string, bootstrap *bootstrapResolver) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return Error("invalid upstream, expect host:port: " + address)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return Error("invalid port of upstream: " + address)
+	}
+	if host == "" {
+		return Error("missing host of upstream: " + address)
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if _, ok := dns.IsDomainName(host); !ok {
+		return Error("invalid host of upstream: " + address)
+	}
+	if bootstrap != nil {
+		if _, err := bootstrap.resolve(address, exchangeTimeout); err != nil {
+			return Error("can't resolve the upstream " + address + ": " + err.Error())
+		}
+		return nil
+	}
+	if _, err := net.LookupHost(host); err != nil {
+		return Error("can't resolve the upstream " + address + ": " + err.Error())
+	}
+	return nil
+}
+
+// ConfigSchema generates the JSON Schema of the config file from the Config
+// struct. Fields are documented by their `desc` tags, and the `enum` tags
+// list the accepted values of a field separated by commas.
+func ConfigSchema() ([]byte, error) {
+	schema := typeSchema(reflect.TypeOf(Config{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "freedns-go config"
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(Duration(0)) {
+		return map[string]interface{}{
+			"type":    "string",
+			"pattern": `^(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`,
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem()),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem()),
+		}
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := f.Name
+			if tag := f.Tag.Get("json"); tag != "" {
+				name = strings.Split(tag, ",")[0]
+			}
+			if f.PkgPath != "" || name == "-" {
+				continue
+			}
+
+			p := typeSchema(f.Type)
+			if desc := f.Tag.Get("desc"); desc != "" {
+				p["description"] = desc
+			}
+			if enum := f.Tag.Get("enum"); enum != "" {
+				p["enum"] = strings.Split(enum, ",")
+			}
+			props[name] = p
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+	}
+	return map[string]interface{}{}
+}
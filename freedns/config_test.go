@@ -0,0 +1,220 @@
+package freedns
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "freedns-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTempFile(t, `{"FastDNS": "223.5.5.5:53", "Blocklists": ["a.txt", "b.txt"]}`)
+	defer os.Remove(path)
+
+	cfg := Config{FastDNS: "114.114.114.114:53", CleanDNS: "8.8.8.8:53"}
+	if err := LoadConfig(path, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.FastDNS != "223.5.5.5:53" || cfg.CleanDNS != "8.8.8.8:53" || len(cfg.Blocklists) != 2 {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+
+	typo := writeTempFile(t, `{"FastDSN": "223.5.5.5:53"}`)
+	defer os.Remove(typo)
+	if err := LoadConfig(typo, &cfg); err == nil {
+		t.Errorf("unknown fields should be an error")
+	}
+}
+
+func TestLoadConfigErrorLocations(t *testing.T) {
+	for _, c := range []struct {
+		content string
+		loc     string
+	}{
+		{"{\n  \"FastDNS\": \"223.5.5.5\",\n  \"FastDSN\": \"223.5.5.5\"\n}", ":3:3: "},
+		{"{\n  \"CacheCap\": \"big\"\n}", ":2:3: "},
+		{"{\n  \"UpstreamTimeout\": \"3x\"\n}", ":2:22: "},
+		{"{\n  \"FastDNS\": \"223.5.5.5\",,\n}", ":2:26: "},
+	} {
+		path := writeTempFile(t, c.content)
+		defer os.Remove(path)
+		cfg := Config{}
+		err := LoadConfig(path, &cfg)
+		if err == nil || !strings.HasPrefix(err.Error(), path+c.loc) {
+			t.Errorf("expect the error at %s of %q, got %v", c.loc, c.content, err)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	cfg := Config{Listen: "127.0.0.1:0", FastDNS: "114.114.114.114:53", CleanDNS: "8.8.8.8:53", CacheCap: 16}
+	if err := CheckConfig(cfg); err != nil {
+		t.Errorf("expect the config valid, got %v", err)
+	}
+
+	cfg.FastDNS = "114.114.114.114:5e"
+	cfg.CleanDNSGroups = []string{"sh=bad_host.invalid"}
+	err := CheckConfig(cfg)
+	if err == nil {
+		t.Fatal("expect the invalid upstreams to fail the check")
+	}
+	for _, field := range []string{"FastDNS: ", "CleanDNSGroups: "} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("expect the error of %s, got %v", field, err)
+		}
+	}
+
+	cfg.FastDNS = "114.114.114.114"
+	cfg.CleanDNSGroups = nil
+	cfg.Blocklists = []string{"/nonexistent/hosts.txt"}
+	if err := CheckConfig(cfg); err == nil {
+		t.Error("expect the missing blocklist to fail the check")
+	}
+}
+
+func TestCheckConfigSideEffects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	formatter, hooks := log.Formatter, len(log.Hooks[logrus.InfoLevel])
+
+	cfg := Config{
+		Listen: "127.0.0.1:0", FastDNS: "114.114.114.114:53", CleanDNS: "8.8.8.8:53", CacheCap: 16,
+		LogFormat:     "json",
+		Syslog:        "udp://127.0.0.1:514",
+		QueryLog:      filepath.Join(dir, "query.log"),
+		UpstreamLog:   filepath.Join(dir, "upstream.log"),
+		AdminListen:   "127.0.0.1:0",
+		AdminAuditLog: filepath.Join(dir, "audit.log"),
+		CacheDiskFile: filepath.Join(dir, "freedns.cache"),
+	}
+	if err := CheckConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expect no files created by the check, got %d", len(files))
+	}
+	if log.Formatter != formatter || len(log.Hooks[logrus.InfoLevel]) != hooks {
+		t.Error("expect the logger unchanged by the check")
+	}
+
+	cfg.CacheMaxCap = 64
+	if err := CheckConfig(cfg); err == nil {
+		t.Error("expect the adaptive cache size to fail the check with the disk cache")
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	b, err := ConfigSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var schema struct {
+		Type       string
+		Properties map[string]struct {
+			Type        string
+			Description string
+			Enum        []string
+			Items       struct{ Type string }
+		}
+	}
+	if err := json.Unmarshal(b, &schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema.Type != "object" {
+		t.Errorf("the schema should describe an object")
+	}
+	if p := schema.Properties["CacheCap"]; p.Type != "integer" || p.Description == "" {
+		t.Errorf("unexpected CacheCap schema: %+v", p)
+	}
+	if p := schema.Properties["Blocklists"]; p.Type != "array" || p.Items.Type != "string" {
+		t.Errorf("unexpected Blocklists schema: %+v", p)
+	}
+	if p := schema.Properties["BlockResponse"]; len(p.Enum) != 3 {
+		t.Errorf("unexpected BlockResponse schema: %+v", p)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	for field, name := range map[string]string{
+		"FastDNS":          "FREEDNS_FAST_DNS",
+		"GeoIPDatabase":    "FREEDNS_GEO_IP_DATABASE",
+		"TTLStretchMax":    "FREEDNS_TTL_STRETCH_MAX",
+		"NAT64Prefixes":    "FREEDNS_NAT64_PREFIXES",
+		"ChinaIPListURL":   "FREEDNS_CHINA_IP_LIST_URL",
+		"DebugLogDuration": "FREEDNS_DEBUG_LOG_DURATION",
+	} {
+		if got := EnvName(field); got != name {
+			t.Errorf("expect %s of %s, got %s", name, field, got)
+		}
+	}
+
+	cfg := Config{FastDNS: "114.114.114.114:53", CacheCap: 16}
+	err := LoadEnv(&cfg, []string{
+		"PATH=/usr/bin",
+		"FREEDNS_CONFIG=config.json",
+		"FREEDNS_CLEAN_DNS=8.8.8.8:53",
+		"FREEDNS_CACHE_CAP=4096",
+		"FREEDNS_FLATTEN_CNAME=true",
+		"FREEDNS_UPSTREAM_TIMEOUT=1500ms",
+		"FREEDNS_BLOCKLISTS=a.txt, b.txt",
+		`FREEDNS_ALLOWLISTS=["c,d.txt"]`,
+		`FREEDNS_ADMIN_USERS={"alice": "secret"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.FastDNS != "114.114.114.114:53" || cfg.CleanDNS != "8.8.8.8:53" || cfg.CacheCap != 4096 || !cfg.FlattenCNAME {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if cfg.UpstreamTimeout != Duration(1500*time.Millisecond) {
+		t.Errorf("unexpected duration: %v", cfg.UpstreamTimeout)
+	}
+	if len(cfg.Blocklists) != 2 || cfg.Blocklists[1] != "b.txt" || len(cfg.Allowlists) != 1 || cfg.AdminUsers["alice"] != "secret" {
+		t.Errorf("unexpected lists: %v %v %v", cfg.Blocklists, cfg.Allowlists, cfg.AdminUsers)
+	}
+
+	if err := LoadEnv(&cfg, []string{"FREEDNS_CLEAN_DSN=8.8.8.8"}); err == nil {
+		t.Error("an unknown variable should be an error")
+	}
+	if err := LoadEnv(&cfg, []string{"FREEDNS_CACHE_CAP=big"}); err == nil || !strings.HasPrefix(err.Error(), "FREEDNS_CACHE_CAP: ") {
+		t.Errorf("expect the error of the variable, got %v", err)
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	s := newTestServer(t, Config{AdminListen: "127.0.0.1:0"})
+	defer s.Shutdown()
+	if s.config.StatsWindow != Duration(24*time.Hour) || s.config.QueueLimit != 1024 || s.config.QueryLogBackups != 7 {
+		t.Errorf("expect the defaults of the flags, got %+v", s.config)
+	}
+	if s.stats == nil {
+		t.Error("the stats should be on by default")
+	}
+
+	s = newTestServer(t, Config{AdminListen: "127.0.0.1:0", StatsWindow: Duration(-time.Second)})
+	defer s.Shutdown()
+	if s.stats != nil {
+		t.Error("a negative StatsWindow should disable the stats")
+	}
+}
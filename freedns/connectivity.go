@@ -0,0 +1,75 @@
+package freedns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The policies of the connectivity-check domains.
+const (
+	ConnectivityFresh  = "fresh"  // never filtered, and resolved on the upstreams every time
+	ConnectivityPass   = "pass"   // never filtered, but cached as usual
+	ConnectivityIgnore = "ignore" // handled like any other domain
+)
+
+// connectivityDomains are the domains the operating systems and browsers
+// check the connectivity and the captive portals with. A stale or blocked
+// answer makes the devices think they're offline, or miss the login page of
+// a captive portal.
+var connectivityDomains = []string{
+	// Android and ChromeOS
+	"connectivitycheck.gstatic.com", "connectivitycheck.android.com",
+	"clients1.google.com", "clients3.google.com",
+	// Android of the Chinese vendors
+	"connect.rom.miui.com", "connectivitycheck.platform.hicloud.com",
+	"conn1.oppomobile.com", "wifi.vivo.com.cn",
+	// Apple
+	"captive.apple.com", "www.appleiphonecell.com", "www.airport.us",
+	"www.ibook.info", "www.itools.info", "www.thinkdifferent.us",
+	// Windows
+	"www.msftconnecttest.com", "ipv6.msftconnecttest.com",
+	"www.msftncsi.com", "dns.msftncsi.com",
+	// Firefox and Linux desktops
+	"detectportal.firefox.com", "nmcheck.gnome.org",
+	"connectivity-check.ubuntu.com", "networkcheck.kde.org",
+}
+
+// connectivityChecks matches the connectivity-check domains and their
+// subdomains.
+type connectivityChecks struct {
+	policy  string
+	domains map[string]bool
+}
+
+// newConnectivityChecks creates the checks of the policy, ConnectivityFresh
+// if empty, with the extra domains as well.
+func newConnectivityChecks(policy string, extra []string) (*connectivityChecks, error) {
+	switch policy {
+	case "":
+		policy = ConnectivityFresh
+	case ConnectivityFresh, ConnectivityPass, ConnectivityIgnore:
+	default:
+		return nil, Error("unknown connectivity check policy: " + policy)
+	}
+	c := &connectivityChecks{policy: policy, domains: map[string]bool{}}
+	for _, d := range append(append([]string{}, connectivityDomains...), extra...) {
+		c.domains[strings.ToLower(dns.Fqdn(d))] = true
+	}
+	return c, nil
+}
+
+// match returns if the name is a connectivity-check domain or under one.
+func (c *connectivityChecks) match(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	for {
+		if c.domains[name] {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i+1 >= len(name) {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
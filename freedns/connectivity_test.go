@@ -0,0 +1,49 @@
+package freedns
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestConnectivityChecks(t *testing.T) {
+	fast, queries, stopFast := countingUpstream(t, "114.114.114.114")
+	defer stopFast()
+	clean, _, stopClean := countingUpstream(t, "8.8.8.8")
+	defer stopClean()
+	blocklist := writeTempFile(t, "||apple.com^\n||example.com^\n")
+	for _, c := range []struct {
+		policy  string
+		queries int32 // to the fast upstream, of the two queries
+		rcode   int
+	}{
+		{"", 2, dns.RcodeSuccess},
+		{ConnectivityPass, 1, dns.RcodeSuccess},
+		{ConnectivityIgnore, 0, dns.RcodeNameError},
+	} {
+		s := newTestServer(t, Config{
+			FastDNS:                  fast,
+			CleanDNS:                 clean,
+			Blocklists:               []string{blocklist},
+			ConnectivityChecks:       c.policy,
+			ConnectivityCheckDomains: []string{"check.example.com"},
+		})
+		for _, name := range []string{"captive.apple.com.", "www.check.example.com."} {
+			before := atomic.LoadInt32(queries)
+			var w *recorder
+			for i := 0; i < 2; i++ {
+				req := &dns.Msg{}
+				req.SetQuestion(name, dns.TypeA)
+				w = newRecorder()
+				s.handle(w, req, "udp")
+			}
+			if w.msg.Rcode != c.rcode || atomic.LoadInt32(queries)-before != c.queries {
+				t.Errorf("%q %s: expect %d upstream queries, got %d and %v", c.policy, name, c.queries, atomic.LoadInt32(queries)-before, w.msg)
+			}
+		}
+	}
+	if _, err := newConnectivityChecks("never", nil); err == nil {
+		t.Error("expect an error of the unknown policy")
+	}
+}
@@ -0,0 +1,207 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// consistencyDefaultInterval is the default interval of the checks.
+const consistencyDefaultInterval = 10 * time.Minute
+
+// consistencySamples is how many checks of a domain are kept, a day of them
+// at the default interval.
+const consistencySamples = 144
+
+// consistencySample is a check of a domain: whether the answers of the
+// upstreams diverged from the reference.
+type consistencySample struct {
+	Time  time.Time `json:"time"`
+	Fast  bool      `json:"fast_diverged"`
+	Clean bool      `json:"clean_diverged"`
+	Error string    `json:"error,omitempty"` // of the reference, which skips the check
+}
+
+// consistencyRecord is the history of a watched domain.
+type consistencyRecord struct {
+	Domain        string              `json:"domain"`
+	Checks        int                 `json:"checks"`
+	FastDiverged  int                 `json:"fast_diverged"`
+	CleanDiverged int                 `json:"clean_diverged"`
+	Fast          []string            `json:"fast"` // the IPs of the last check
+	Clean         []string            `json:"clean"`
+	Reference     []string            `json:"reference"`
+	Samples       []consistencySample `json:"samples"` // the oldest first
+}
+
+// consistencyChecker resolves the watched domains periodically on both
+// upstreams and on a reference resolver over DNS over TLS, which can't be
+// spoofed on the way, and records how often the upstreams diverge from it.
+// An answer diverges if it shares no IP with the reference's, or has another
+// rcode. The CDNs answering by the location of the resolver diverge too, so
+// the watchlist is best kept to the domains of a single IP set.
+type consistencyChecker struct {
+	domains   []string
+	reference string
+	interval  time.Duration
+
+	mu      sync.Mutex
+	records map[string]*consistencyRecord
+}
+
+// newConsistencyChecker creates the checker of the domains, using the
+// reference resolver at host[:port], 853 by default.
+func newConsistencyChecker(domains []string, reference string, interval time.Duration) (*consistencyChecker, error) {
+	if reference == "" {
+		return nil, Error("the consistency checks need a reference resolver")
+	}
+	if _, _, err := net.SplitHostPort(reference); err != nil {
+		reference = net.JoinHostPort(strings.Trim(reference, "[]"), "853")
+	}
+	if interval <= 0 {
+		interval = consistencyDefaultInterval
+	}
+	c := &consistencyChecker{
+		reference: reference,
+		interval:  interval,
+		records:   map[string]*consistencyRecord{},
+	}
+	for _, d := range domains {
+		name := normalizeDomain(d)
+		if name == "" {
+			return nil, Error("invalid consistency check domain: " + d)
+		}
+		c.domains = append(c.domains, name)
+		c.records[name] = &consistencyRecord{Domain: name}
+	}
+	return c, nil
+}
+
+func (c *consistencyChecker) run(resolver *spoofingProofResolver, done <-chan struct{}) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		for _, d := range c.domains {
+			c.check(resolver, d)
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check resolves the domain on the upstreams and the reference, and records
+// the divergence.
+func (c *consistencyChecker) check(resolver *spoofingProofResolver, domain string) {
+	q := dns.Question{Name: dns.Fqdn(domain), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	var fast, clean TraceAnswer
+	var ref *dns.Msg
+	var refErr error
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		fast = resolver.traceQuery(q, resolver.fastUpstream)
+	}()
+	go func() {
+		defer wg.Done()
+		clean = resolver.traceQuery(q, resolver.cleanUpstream)
+	}()
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), resolver.resolveTimeout())
+		defer cancel()
+		ref, refErr = naiveResolve(ctx, q, true, "tcp-tls", c.reference, resolver.client)
+	}()
+	wg.Wait()
+
+	sample := consistencySample{Time: time.Now()}
+	var refIPs []string
+	if refErr != nil {
+		sample.Error = refErr.Error()
+	} else {
+		refIPs = answerIPs(ref)
+		sample.Fast = diverges(fast.Msg, ref)
+		sample.Clean = diverges(clean.Msg, ref)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.records[domain]
+	r.Samples = append(r.Samples, sample)
+	if len(r.Samples) > consistencySamples {
+		r.Samples = r.Samples[len(r.Samples)-consistencySamples:]
+	}
+	if refErr != nil {
+		return
+	}
+	r.Checks++
+	if sample.Fast {
+		r.FastDiverged++
+	}
+	if sample.Clean {
+		r.CleanDiverged++
+	}
+	r.Fast, r.Clean, r.Reference = msgIPs(fast.Msg), msgIPs(clean.Msg), refIPs
+	if sample.Fast || sample.Clean {
+		log.WithFields(logrus.Fields{
+			"op":        "consistency",
+			"domain":    domain,
+			"fast":      strings.Join(r.Fast, ","),
+			"clean":     strings.Join(r.Clean, ","),
+			"reference": strings.Join(refIPs, ","),
+		}).Info("upstream answers diverged from the reference")
+	}
+}
+
+// diverges returns if the answer, nil if it failed, has another rcode than
+// the reference's, or shares no IP with it.
+func diverges(res *dns.Msg, ref *dns.Msg) bool {
+	if res == nil || res.Rcode != ref.Rcode {
+		return true
+	}
+	refIPs := map[string]bool{}
+	for _, ip := range answerIPs(ref) {
+		refIPs[ip] = true
+	}
+	ips := answerIPs(res)
+	if len(ips) == 0 || len(refIPs) == 0 {
+		return len(ips) != len(refIPs)
+	}
+	for _, ip := range ips {
+		if refIPs[ip] {
+			return false
+		}
+	}
+	return true
+}
+
+// msgIPs returns the IPs of the answer, nil if it failed.
+func msgIPs(res *dns.Msg) []string {
+	if res == nil {
+		return nil
+	}
+	return answerIPs(res)
+}
+
+// report returns the records of the domains, sorted by the names.
+func (c *consistencyChecker) report() []consistencyRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	records := make([]consistencyRecord, 0, len(c.records))
+	for _, r := range c.records {
+		copied := *r
+		copied.Samples = append([]consistencySample{}, r.Samples...)
+		records = append(records, copied)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Domain < records[j].Domain })
+	return records
+}
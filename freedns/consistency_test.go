@@ -0,0 +1,57 @@
+package freedns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/tuna/freedns-go/decisiontest"
+)
+
+func TestDiverges(t *testing.T) {
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	answer := func(ips ...string) *dns.Msg {
+		return decisiontest.Reply{Kind: decisiontest.Answer, IPs: ips}.Msg(req)
+	}
+	ref := answer("203.0.113.1", "203.0.113.2")
+	for _, c := range []struct {
+		res  *dns.Msg
+		want bool
+	}{
+		{answer("203.0.113.2", "203.0.113.3"), false},
+		{answer("31.13.64.1"), true},
+		{answer(), true},
+		{decisiontest.Reply{Kind: decisiontest.ServFail}.Msg(req), true},
+		{nil, true},
+	} {
+		if got := diverges(c.res, ref); got != c.want {
+			t.Errorf("expect %v diverging %v, got %v", c.res, c.want, got)
+		}
+	}
+	if diverges(answer(), answer()) {
+		t.Error("expect the empty answers to agree")
+	}
+}
+
+func TestConsistencyChecker(t *testing.T) {
+	fast, stopFast := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.Answer, IPs: []string{"31.13.64.1"}})
+	defer stopFast()
+	clean, stopClean := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.Answer, IPs: []string{"8.8.8.8"}})
+	defer stopClean()
+	s := newTestServer(t, Config{
+		FastDNS:              fast,
+		CleanDNS:             clean,
+		ConsistencyDomains:   []string{"Example.com."},
+		ConsistencyReference: "127.0.0.1:1",
+	})
+
+	// the reference is down, so the check is skipped
+	s.consistency.check(s.resolver, "example.com")
+	r := s.consistency.report()
+	if len(r) != 1 || r[0].Domain != "example.com" || r[0].Checks != 0 || len(r[0].Samples) != 1 || r[0].Samples[0].Error == "" {
+		t.Errorf("expect a skipped check of example.com, got %+v", r)
+	}
+	if _, err := newConsistencyChecker([]string{"example.com"}, "1.1.1.1", 0); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,115 @@
+package freedns
+
+import (
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// cookieUDPSize is the UDP payload size advertised in the OPT record of the
+// upstream queries carrying cookies, the one of the DNS flag day 2020.
+const cookieUDPSize = 1232
+
+// clientCookieLen is the length of a client cookie in hex, 8 bytes.
+const clientCookieLen = 16
+
+// cookieJar keeps the DNS cookies (RFC 7873) of the UDP queries to the
+// upstreams: a random client cookie of each upstream, and the server cookie
+// it answered with last. An off-path attacker spoofing the responses has to
+// guess the client cookie in addition to the ID and the source port.
+type cookieJar struct {
+	mu      sync.Mutex
+	cookies map[string]*upstreamCookie // by upstream
+}
+
+type upstreamCookie struct {
+	client string // hex
+	server string // hex, empty until the upstream answers with one
+}
+
+func newCookieJar() *cookieJar {
+	return &cookieJar{cookies: map[string]*upstreamCookie{}}
+}
+
+// get returns the cookie of the upstream, creating the client cookie on the
+// first query.
+func (j *cookieJar) get(upstream string) upstreamCookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	c := j.cookies[upstream]
+	if c == nil {
+		var b [clientCookieLen / 2]byte
+		if _, err := io.ReadFull(randomSource, b[:]); err != nil {
+			panic("freedns: reading the random source: " + err.Error())
+		}
+		c = &upstreamCookie{client: hex.EncodeToString(b[:])}
+		j.cookies[upstream] = c
+	}
+	return *c
+}
+
+// attach adds the OPT record with the cookie of the upstream to `req`.
+func (j *cookieJar) attach(req *dns.Msg, upstream string) {
+	c := j.get(upstream)
+	req.Extra = withoutOPT(req.Extra)
+	req.SetEdns0(cookieUDPSize, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: c.client + c.server})
+}
+
+// update keeps the server cookie of the response of the upstream. The
+// client cookie is already checked by isResponseTo.
+func (j *cookieJar) update(upstream string, res *dns.Msg) {
+	cookie := cookieOf(res)
+	if len(cookie) <= clientCookieLen {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if c := j.cookies[upstream]; c != nil && strings.EqualFold(cookie[:clientCookieLen], c.client) {
+		c.server = cookie[clientCookieLen:]
+	}
+}
+
+// cookieOf returns the cookie of the message in hex, or "" if it has none.
+func cookieOf(m *dns.Msg) string {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			return c.Cookie
+		}
+	}
+	return ""
+}
+
+// cookieMatches checks the cookie of the response to `req`. The response
+// must echo the client cookie if it has a cookie, and must have one if the
+// upstream is known to support cookies, i.e. `req` has a server cookie.
+func cookieMatches(res *dns.Msg, req *dns.Msg) bool {
+	sent := cookieOf(req)
+	if sent == "" {
+		return true
+	}
+	got := cookieOf(res)
+	if got == "" {
+		return len(sent) == clientCookieLen
+	}
+	return len(got) > clientCookieLen && strings.EqualFold(got[:clientCookieLen], sent[:clientCookieLen])
+}
+
+// withoutOPT returns `extra` without the OPT record.
+func withoutOPT(extra []dns.RR) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
@@ -0,0 +1,100 @@
+package freedns
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testServerCookie = "0102030405060708"
+
+// cookieUpstream answers BADCOOKIE to the queries without its server cookie,
+// and spoofs a response with a wrong client cookie before each real one.
+func cookieUpstream(t *testing.T, queries *int32) (string, func()) {
+	return fakeUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		cookie := cookieOf(req)
+		reply := func(cookie string, ip string) {
+			res := &dns.Msg{}
+			res.SetReply(req)
+			res.SetEdns0(cookieUDPSize, false)
+			res.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie}}
+			if ip == "" {
+				res.Rcode = dns.RcodeBadCookie
+			} else {
+				rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + ip)
+				res.Answer = []dns.RR{rr}
+			}
+			w.WriteMsg(res)
+		}
+		if len(cookie) < clientCookieLen {
+			t.Errorf("expect the client cookie, got %v", req)
+			return
+		}
+		client := cookie[:clientCookieLen]
+		if cookie[clientCookieLen:] != testServerCookie {
+			reply(client+testServerCookie, "")
+			return
+		}
+		reply("ffffffffffffffff"+testServerCookie, "6.6.6.6")
+		reply(client+testServerCookie, "10.0.0.1")
+	})
+}
+
+func TestUpstreamCookies(t *testing.T) {
+	var queries int32
+	upstream, stop := cookieUpstream(t, &queries)
+	defer stop()
+
+	jar := newCookieJar()
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	for i := 0; i < 2; i++ {
+		res, err := naiveResolve(context.Background(), q, true, "udp", upstream, &upstreamClient{cookies: jar})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+			t.Errorf("expect the real answer, got %v", res)
+		}
+		if res.IsEdns0() != nil {
+			t.Errorf("expect the OPT record removed, got %v", res)
+		}
+	}
+	// BADCOOKIE and the retry, and then the server cookie is known
+	if n := atomic.LoadInt32(&queries); n != 3 {
+		t.Errorf("expect 3 queries, got %d", n)
+	}
+	if c := jar.get(upstream); c.server != testServerCookie {
+		t.Errorf("expect the server cookie kept, got %+v", c)
+	}
+}
+
+func TestCookieMatches(t *testing.T) {
+	msg := func(cookie string) *dns.Msg {
+		m := &dns.Msg{}
+		m.SetQuestion("example.com.", dns.TypeA)
+		if cookie != "" {
+			m.SetEdns0(cookieUDPSize, false)
+			m.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie}}
+		}
+		return m
+	}
+	client := "1111111111111111"
+	cases := []struct {
+		req, res string
+		ok       bool
+	}{
+		{"", "", true},
+		{client, "", true}, // not known to support cookies
+		{client + testServerCookie, "", false},
+		{client, client + testServerCookie, true},
+		{client, "2222222222222222" + testServerCookie, false},
+	}
+	for _, c := range cases {
+		if got := cookieMatches(msg(c.res), msg(c.req)); got != c.ok {
+			t.Errorf("%q to %q: expect %v, got %v", c.res, c.req, c.ok, got)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package freedns
+
+import "net/http"
+
+// dashboardHTML is the single-page dashboard on the admin listener. It polls
+// the stats API, so it needs the stats enabled (Config.StatsWindow).
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>freedns-go</title>
+<style>
+body { font: 14px sans-serif; margin: 0 auto; max-width: 1100px; padding: 16px; color: #222; }
+h1 { font-size: 20px; }
+h2 { font-size: 16px; margin: 24px 0 8px; }
+.cards { display: flex; flex-wrap: wrap; gap: 12px; }
+.card { border: 1px solid #ddd; border-radius: 6px; padding: 12px 16px; min-width: 140px; }
+.card .value { font-size: 24px; font-weight: bold; }
+.card .label { color: #666; }
+.grid { display: grid; grid-template-columns: repeat(auto-fit, minmax(320px, 1fr)); gap: 16px; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #eee; white-space: nowrap; }
+td.name { overflow: hidden; text-overflow: ellipsis; max-width: 320px; }
+#error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>freedns-go</h1>
+<div id="error"></div>
+<div class="cards">
+  <div class="card"><div class="value" id="qps">-</div><div class="label">QPS (last minute)</div></div>
+  <div class="card"><div class="value" id="total">-</div><div class="label">queries (last hour)</div></div>
+  <div class="card"><div class="value" id="hit">-</div><div class="label">cache hit ratio</div></div>
+  <div class="card"><div class="value" id="blocked">-</div><div class="label">blocked (last hour)</div></div>
+</div>
+<h2>Upstreams (last hour)</h2>
+<table id="upstreams"><thead><tr><th>upstream</th><th>queries</th><th>SERVFAIL</th></tr></thead><tbody></tbody></table>
+<div class="grid">
+  <div><h2>Top domains</h2><table id="domains"><tbody></tbody></table></div>
+  <div><h2>Top blocked</h2><table id="blocks"><tbody></tbody></table></div>
+  <div><h2>Top clients</h2><table id="clients"><tbody></tbody></table></div>
+  <div><h2>Query types</h2><table id="qtypes"><tbody></tbody></table></div>
+</div>
+<h2>Recent queries</h2>
+<table id="queries"><thead><tr><th>time</th><th>client</th><th>name</th><th>type</th><th>rcode</th><th>upstream</th><th>ms</th></tr></thead><tbody></tbody></table>
+<script>
+function fill(id, rows) {
+  var body = document.querySelector("#" + id + " tbody");
+  body.innerHTML = "";
+  rows.forEach(function (row) {
+    var tr = document.createElement("tr");
+    row.forEach(function (cell, i) {
+      var td = document.createElement("td");
+      td.textContent = cell;
+      if (i === 0) td.className = "name";
+      tr.appendChild(td);
+    });
+    body.appendChild(tr);
+  });
+}
+function counts(list) {
+  return (list || []).map(function (c) { return [c.name, c.count]; });
+}
+function get(path) {
+  return fetch(path, {credentials: "same-origin"}).then(function (r) {
+    if (!r.ok) throw new Error(path + ": " + r.status);
+    return r.json();
+  });
+}
+function refresh() {
+  Promise.all([get("api/stats?window=1m&top=1"), get("api/stats?window=1h&top=10"), get("api/queries")]).then(function (r) {
+    var minute = r[0], hour = r[1], queries = r[2];
+    document.getElementById("error").textContent = "";
+    document.getElementById("qps").textContent = (minute.total / 60).toFixed(2);
+    document.getElementById("total").textContent = hour.total;
+    var answered = hour.total - hour.blocked;
+    document.getElementById("hit").textContent = answered > 0 ? (100 * hour.cached / answered).toFixed(1) + "%" : "-";
+    document.getElementById("blocked").textContent = hour.blocked;
+    fill("upstreams", (hour.upstreams || []).map(function (u) { return [u.name, u.queries, u.failures]; }));
+    fill("domains", counts(hour.top_domains));
+    fill("blocks", counts(hour.top_blocked));
+    fill("clients", counts(hour.top_clients));
+    fill("qtypes", Object.keys(hour.qtypes).sort().map(function (k) { return [k, hour.qtypes[k]]; }));
+    fill("queries", queries.map(function (q) {
+      return [new Date(q.time).toLocaleTimeString(), q.client, q.name, q.type, q.rcode, q.upstream, q.latency_ms.toFixed(1)];
+    }));
+  }).catch(function (e) {
+    document.getElementById("error").textContent = e.message;
+  });
+}
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
+
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
@@ -0,0 +1,109 @@
+package freedns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// debugDefaultDuration is how long the debug log lasts by default.
+const debugDefaultDuration = 10 * time.Minute
+
+// debugLog turns on the debug log for a while, and then reverts to the
+// configured level, so a transient problem can be debugged without
+// restarting and losing the cache.
+type debugLog struct {
+	duration time.Duration // the default
+
+	mu    sync.Mutex
+	base  logrus.Level
+	timer *time.Timer // while on
+	until time.Time
+}
+
+func newDebugLog(duration time.Duration) *debugLog {
+	if duration <= 0 {
+		duration = debugDefaultDuration
+	}
+	return &debugLog{duration: duration, base: log.GetLevel()}
+}
+
+// enable turns on the debug log for `d`, or the default duration if it's 0,
+// restarting the countdown if it's on already.
+func (l *debugLog) enable(d time.Duration) {
+	if d <= 0 {
+		d = l.duration
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	log.SetLevel(logrus.DebugLevel)
+	l.until = time.Now().Add(d)
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.timer == timer {
+			l.revert()
+		}
+	})
+	l.timer = timer
+	log.WithFields(logrus.Fields{
+		"op":    "debug_log",
+		"until": l.until.Format(time.RFC3339),
+	}).Info("debug log on")
+}
+
+// disable reverts to the configured level at once.
+func (l *debugLog) disable() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.timer != nil {
+		l.timer.Stop()
+		l.revert()
+	}
+}
+
+// revert restores the configured level. l.mu must be held.
+func (l *debugLog) revert() {
+	l.timer = nil
+	l.until = time.Time{}
+	log.WithFields(logrus.Fields{
+		"op":    "debug_log",
+		"level": l.base.String(),
+	}).Info("debug log off")
+	log.SetLevel(l.base)
+}
+
+// toggle turns the debug log on for the default duration if it's off, or
+// off otherwise, and returns if it's on.
+func (l *debugLog) toggle() bool {
+	l.mu.Lock()
+	on := l.timer != nil
+	l.mu.Unlock()
+	if on {
+		l.disable()
+	} else {
+		l.enable(0)
+	}
+	return !on
+}
+
+type debugLogStatus struct {
+	Level string     `json:"level"`
+	Until *time.Time `json:"until,omitempty"` // when the debug log reverts
+}
+
+func (l *debugLog) status() debugLogStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := debugLogStatus{Level: log.GetLevel().String()}
+	if l.timer != nil {
+		until := l.until
+		s.Until = &until
+	}
+	return s
+}
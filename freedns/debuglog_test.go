@@ -0,0 +1,30 @@
+package freedns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestDebugLog(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(logrus.WarnLevel)
+	l := newDebugLog(time.Hour)
+
+	l.enable(50 * time.Millisecond)
+	if log.GetLevel() != logrus.DebugLevel || l.status().Until == nil {
+		t.Fatalf("expect the debug log on, got %v", l.status())
+	}
+	time.Sleep(200 * time.Millisecond)
+	if log.GetLevel() != logrus.WarnLevel || l.status().Until != nil {
+		t.Errorf("expect the debug log reverted, got %v", l.status())
+	}
+
+	if !l.toggle() || log.GetLevel() != logrus.DebugLevel {
+		t.Error("expect the toggle to turn the debug log on")
+	}
+	if l.toggle() || log.GetLevel() != logrus.WarnLevel {
+		t.Error("expect the toggle to turn the debug log off")
+	}
+}
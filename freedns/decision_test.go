@@ -0,0 +1,52 @@
+package freedns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/tuna/freedns-go/decisiontest"
+)
+
+// replyingUpstream starts a fake upstream replying with `r`.
+func replyingUpstream(t *testing.T, r decisiontest.Reply) (string, func()) {
+	return fakeUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		if res := r.Msg(req); res != nil {
+			w.WriteMsg(res)
+		}
+	})
+}
+
+func TestDecisionVectors(t *testing.T) {
+	for _, v := range decisiontest.Vectors {
+		v := v
+		t.Run(v.Name, func(t *testing.T) {
+			t.Parallel()
+			fast, stopFast := replyingUpstream(t, v.Fast)
+			defer stopFast()
+			clean, stopClean := replyingUpstream(t, v.Clean)
+			defer stopClean()
+
+			resolver := newSpoofingProofResolver(fast, clean, 16, builtinClassifier{})
+			q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+			if v.Known != decisiontest.Unknown {
+				resolver.setLocation(q.Name, v.Known == decisiontest.China)
+			}
+
+			res, upstream := resolver.resolve(q, true, "udp")
+			want := map[string]string{decisiontest.Fast: fast, decisiontest.Clean: clean}[v.Want]
+			if upstream != want || res.Rcode != v.WantRcode {
+				t.Errorf("expect %s from %s, got %s from %s", dns.RcodeToString[v.WantRcode], want, dns.RcodeToString[res.Rcode], upstream)
+			}
+
+			known := decisiontest.Unknown
+			if isCN, ok := resolver.location(q.Name); ok && isCN {
+				known = decisiontest.China
+			} else if ok {
+				known = decisiontest.Foreign
+			}
+			if known != v.WantKnown {
+				t.Errorf("expect the location %d after the query, got %d", v.WantKnown, known)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package freedns
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// decisionSaveInterval is how often the changed decisions are saved.
+const decisionSaveInterval = 5 * time.Minute
+
+// decision is whether a domain was found in China, and when it was last.
+type decision struct {
+	CN   bool      `json:"cn"`
+	Time time.Time `json:"time"`
+}
+
+// decisionStore keeps the locations of the domains learned by the resolver in
+// a file, so they survive the restarts. The decisions older than `ttl` are
+// dropped, as the domains may have moved, and so are the oldest ones beyond
+// `max`.
+type decisionStore struct {
+	path string
+	ttl  time.Duration // 0 keeps them forever
+	max  int           // 0 means no limit
+
+	mu        sync.Mutex
+	decisions map[string]decision
+	dirty     bool
+}
+
+// newDecisionStore loads the decisions saved in the file, if it exists.
+func newDecisionStore(path string, ttl time.Duration, max int) (*decisionStore, error) {
+	d := &decisionStore{path: path, ttl: ttl, max: max, decisions: map[string]decision{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &d.decisions); err != nil {
+		return nil, Error("invalid " + path + ": " + err.Error())
+	}
+	d.prune(time.Now())
+	return d, nil
+}
+
+// record keeps the decision of the domain.
+func (d *decisionStore) record(name string, isCN bool) {
+	d.mu.Lock()
+	d.decisions[name] = decision{CN: isCN, Time: time.Now()}
+	d.dirty = true
+	d.mu.Unlock()
+}
+
+// each calls `f` with every decision, the oldest first, so the newest are
+// the last evicted when loaded into an LRU cache.
+func (d *decisionStore) each(f func(name string, isCN bool)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, name := range d.sorted() {
+		f(name, d.decisions[name].CN)
+	}
+}
+
+// sorted returns the domains by the time of their decisions, the oldest first.
+func (d *decisionStore) sorted() []string {
+	names := make([]string, 0, len(d.decisions))
+	for name := range d.decisions {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return d.decisions[names[i]].Time.Before(d.decisions[names[j]].Time)
+	})
+	return names
+}
+
+// prune drops the expired decisions and the oldest ones beyond d.max.
+func (d *decisionStore) prune(now time.Time) {
+	if d.ttl > 0 {
+		for name, v := range d.decisions {
+			if now.Sub(v.Time) >= d.ttl {
+				delete(d.decisions, name)
+			}
+		}
+	}
+	if d.max > 0 && len(d.decisions) > d.max {
+		for _, name := range d.sorted()[:len(d.decisions)-d.max] {
+			delete(d.decisions, name)
+		}
+	}
+}
+
+// save writes the decisions to the file if they have changed.
+func (d *decisionStore) save() error {
+	d.mu.Lock()
+	if !d.dirty {
+		d.mu.Unlock()
+		return nil
+	}
+	d.prune(time.Now())
+	b, err := json.Marshal(d.decisions)
+	d.dirty = false
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.path, b, 0644)
+}
+
+// run saves the decisions periodically until `done` is closed.
+func (d *decisionStore) run(done <-chan struct{}) {
+	ticker := time.NewTicker(decisionSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := d.save(); err != nil {
+				log.WithFields(logrus.Fields{
+					"op":   "save_decisions",
+					"file": d.path,
+				}).Error(err)
+			}
+		}
+	}
+}
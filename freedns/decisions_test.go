@@ -0,0 +1,59 @@
+package freedns
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDecisionStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "decisions.json")
+
+	d, err := newDecisionStore(path, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.record("a.example.", true)
+	d.record("b.example.", false)
+	d.record("c.example.", true)
+	if err := d.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = newDecisionStore(path, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	d.each(func(name string, isCN bool) { got[name] = isCN })
+	if len(got) != 2 || got["b.example."] || !got["c.example."] {
+		t.Errorf("expect the 2 newest decisions, got %v", got)
+	}
+
+	// the expired ones are dropped when loaded
+	b, _ := json.Marshal(map[string]decision{
+		"old.example.": {CN: true, Time: time.Now().Add(-2 * time.Hour)},
+		"new.example.": {CN: true, Time: time.Now()},
+	})
+	ioutil.WriteFile(path, b, 0644)
+	d, err = newDecisionStore(path, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.decisions["old.example."]; ok || len(d.decisions) != 1 {
+		t.Errorf("expect the expired decision dropped, got %v", d.decisions)
+	}
+
+	s := newTestServer(t, Config{DecisionCacheFile: path})
+	if isCN, ok := s.resolver.location("new.example."); !ok || !isCN {
+		t.Errorf("expect the saved location loaded, got %v, %v", isCN, ok)
+	}
+}
@@ -0,0 +1,337 @@
+package freedns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// diskCacheCap is the default maximum entries of the disk tier.
+const diskCacheCap = 100000
+
+// diskDemoteQueue caps the evicted entries waiting to be written to the disk
+// tier. The ones over it are dropped rather than blocking the lookups.
+const diskDemoteQueue = 1024
+
+// diskCompactMin is the dead bytes the disk tier keeps at least before it's
+// compacted, so a small file isn't rewritten on every overwrite.
+const diskCompactMin = 1 << 20
+
+// diskRecordHeader is the key and value lengths before each record.
+const diskRecordHeader = 6
+
+// diskSlot locates a record in the file of the disk tier.
+type diskSlot struct {
+	off  int64
+	size int64
+}
+
+// diskCache is the second tier of the response cache, an append-only file of
+// the encoded entries and an LRU index of them in the memory, so only the
+// keys and the offsets take the memory. The overwritten and evicted records
+// are left in the file, which is compacted once they're over half of it.
+type diskCache struct {
+	path string
+
+	mu    sync.Mutex
+	file  *os.File
+	end   int64
+	index *memoryCache // key -> diskSlot
+	live  int64
+	dead  int64
+}
+
+// openDiskCache opens the disk tier at `path` keeping up to `capacity`
+// entries, loading the entries of the previous runs. A corrupt tail, e.g.
+// from a power loss, is truncated.
+func openDiskCache(path string, capacity int) (*diskCache, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d := &diskCache{path: path, file: file}
+	d.index = newSizedMemoryCache(capacity, 0, nil)
+	d.index.onEvict = d.evicted
+
+	r := bufio.NewReader(file)
+	header := make([]byte, diskRecordHeader)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		klen := int64(binary.BigEndian.Uint16(header))
+		vlen := int64(binary.BigEndian.Uint32(header[2:]))
+		key := make([]byte, klen)
+		if _, err := io.ReadFull(r, key); err != nil {
+			break
+		}
+		if _, err := r.Discard(int(vlen)); err != nil {
+			break
+		}
+		size := diskRecordHeader + klen + vlen
+		d.put(string(key), diskSlot{d.end, size})
+		d.end += size
+	}
+	if err := file.Truncate(d.end); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// evicted counts the record of an entry evicted from the index as dead.
+// d.mu must be held, as the index is only used with it.
+func (d *diskCache) evicted(key string, value interface{}) {
+	slot := value.(diskSlot)
+	d.live -= slot.size
+	d.dead += slot.size
+}
+
+// put indexes the record. d.mu must be held.
+func (d *diskCache) put(key string, slot diskSlot) {
+	if old, ok := d.index.Get(key); ok {
+		d.evicted(key, old)
+	}
+	d.index.Set(key, slot)
+	d.live += slot.size
+}
+
+func (d *diskCache) get(key string) (cacheEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.index.Get(key)
+	if !ok {
+		return cacheEntry{}, false
+	}
+	slot := v.(diskSlot)
+	b := make([]byte, slot.size)
+	if _, err := d.file.ReadAt(b, slot.off); err != nil {
+		return cacheEntry{}, false
+	}
+	klen := int(binary.BigEndian.Uint16(b))
+	if diskRecordHeader+klen > len(b) || string(b[diskRecordHeader:diskRecordHeader+klen]) != key {
+		return cacheEntry{}, false
+	}
+	entry, err := decodeCacheEntry(b[diskRecordHeader+klen:])
+	if err != nil {
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (d *diskCache) set(key string, entry cacheEntry) error {
+	value, err := entry.encode()
+	if err != nil {
+		return err
+	}
+	if len(key) > 0xffff {
+		return Error("disk cache: key too long")
+	}
+	b := make([]byte, diskRecordHeader, diskRecordHeader+len(key)+len(value))
+	binary.BigEndian.PutUint16(b, uint16(len(key)))
+	binary.BigEndian.PutUint32(b[2:], uint32(len(value)))
+	b = append(append(b, key...), value...)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.file.WriteAt(b, d.end); err != nil {
+		return err
+	}
+	d.put(key, diskSlot{d.end, int64(len(b))})
+	d.end += int64(len(b))
+	if d.dead > diskCompactMin && d.dead > d.live {
+		return d.compact()
+	}
+	return nil
+}
+
+// compact rewrites the file with the live records only, in their LRU order.
+// d.mu must be held.
+func (d *diskCache) compact() error {
+	type record struct {
+		key  string
+		slot diskSlot
+	}
+	var records []record
+	d.index.each(func(key string, value interface{}) {
+		records = append(records, record{key, value.(diskSlot)})
+	})
+
+	tmp := d.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	offset := int64(0)
+	for i, r := range records {
+		b := make([]byte, r.slot.size)
+		if _, err := d.file.ReadAt(b, r.slot.off); err != nil {
+			file.Close()
+			os.Remove(tmp)
+			return err
+		}
+		w.Write(b)
+		records[i].slot.off = offset
+		offset += r.slot.size
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, d.path); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	d.file.Close()
+	d.file, d.end = file, offset
+	d.index.Purge()
+	d.live, d.dead = 0, 0
+	for _, r := range records {
+		d.put(r.key, r.slot)
+	}
+	return nil
+}
+
+func (d *diskCache) purge() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.index.Purge()
+	d.end, d.live, d.dead = 0, 0, 0
+	return d.file.Truncate(0)
+}
+
+func (d *diskCache) len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.index.Len()
+}
+
+func (d *diskCache) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
+
+type demotion struct {
+	key   string
+	entry cacheEntry
+	gen   int64 // of the purges, so the evictions before one are dropped
+}
+
+// tieredCache is the Cache of the responses in two tiers, for the routers
+// with little memory but some disk or flash. The hottest entries are kept in
+// the memory, and the ones evicted from it are written to the larger disk
+// tier in the background. A miss of the memory tier is looked up on the disk,
+// and a hit there is promoted back to the memory.
+type tieredCache struct {
+	hot  *memoryCache
+	disk *diskCache
+
+	demote  chan demotion
+	gen     int64 // atomic
+	closed  bool  // guarded by hot.mu, as the evictions are sent with it held
+	written sync.WaitGroup
+}
+
+// newTieredCache creates the cache of the memory tier `hot` over the disk
+// tier, and starts writing the evictions to the disk.
+func newTieredCache(hot *memoryCache, disk *diskCache) *tieredCache {
+	c := &tieredCache{
+		hot:    hot,
+		disk:   disk,
+		demote: make(chan demotion, diskDemoteQueue),
+	}
+	hot.onEvict = func(key string, value interface{}) {
+		entry, ok := value.(cacheEntry)
+		if !ok || c.closed {
+			return
+		}
+		select {
+		case c.demote <- demotion{key, entry, atomic.LoadInt64(&c.gen)}:
+		default:
+		}
+	}
+	c.written.Add(1)
+	go c.writeLoop()
+	return c
+}
+
+func (c *tieredCache) writeLoop() {
+	defer c.written.Done()
+	for d := range c.demote {
+		if d.gen != atomic.LoadInt64(&c.gen) {
+			continue
+		}
+		if err := c.disk.set(d.key, d.entry); err != nil {
+			log.WithFields(logrus.Fields{
+				"op":   "disk_cache",
+				"file": c.disk.path,
+			}).Error(err)
+		}
+	}
+}
+
+func (c *tieredCache) Get(key string) (interface{}, bool) {
+	if v, ok := c.hot.Get(key); ok {
+		return v, true
+	}
+	entry, ok := c.disk.get(key)
+	if !ok {
+		return nil, false
+	}
+	c.hot.Set(key, entry)
+	return entry, true
+}
+
+func (c *tieredCache) Set(key string, value interface{}) {
+	c.hot.Set(key, value)
+}
+
+func (c *tieredCache) Purge() {
+	atomic.AddInt64(&c.gen, 1)
+	c.hot.Purge()
+	if err := c.disk.purge(); err != nil {
+		log.WithFields(logrus.Fields{
+			"op":   "disk_cache",
+			"file": c.disk.path,
+		}).Error(err)
+	}
+}
+
+// Len counts the entries of both tiers, so the promoted entries still on the
+// disk are counted twice.
+func (c *tieredCache) Len() int {
+	return c.hot.Len() + c.disk.len()
+}
+
+// close writes the pending evictions and the memory tier to the disk, so
+// the next run starts with the whole cache, and closes the file.
+func (c *tieredCache) close() error {
+	c.hot.mu.Lock()
+	c.closed = true
+	c.hot.mu.Unlock()
+	close(c.demote)
+	c.written.Wait()
+
+	var hot []demotion
+	c.hot.each(func(key string, value interface{}) {
+		if entry, ok := value.(cacheEntry); ok {
+			hot = append(hot, demotion{key: key, entry: entry})
+		}
+	})
+	for _, d := range hot {
+		if err := c.disk.set(d.key, d.entry); err != nil {
+			return err
+		}
+	}
+	return c.disk.close()
+}
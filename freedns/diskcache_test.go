@@ -0,0 +1,86 @@
+package freedns
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTieredCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache")
+
+	entry := func(i int) cacheEntry {
+		res := &dns.Msg{}
+		res.SetQuestion("host"+strconv.Itoa(i)+".example.com.", dns.TypeA)
+		rr, _ := dns.NewRR(res.Question[0].Name + " 300 IN A 192.0.2.1")
+		res.Answer = []dns.RR{rr}
+		return cacheEntry{putin: time.Now(), reply: res}
+	}
+	name := func(v interface{}) string {
+		return v.(cacheEntry).reply.Question[0].Name
+	}
+
+	disk, err := openDiskCache(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTieredCache(newSizedMemoryCache(2, 0, nil), disk)
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), entry(i))
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for disk.len() < 8 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.hot.Len() != 2 || disk.len() != 8 {
+		t.Fatalf("expect 2 entries in the memory and 8 on the disk, got %d and %d", c.hot.Len(), disk.len())
+	}
+	v, ok := c.Get("0")
+	if !ok || name(v) != "host0.example.com." {
+		t.Fatalf("expect the demoted entry, got %v", v)
+	}
+	if _, ok := c.hot.Get("0"); !ok {
+		t.Error("expect the entry promoted to the memory")
+	}
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a partial record, as if the power was lost while writing it
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 1, 0, 0})
+	f.Close()
+
+	disk, err = openDiskCache(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = newTieredCache(newSizedMemoryCache(2, 0, nil), disk)
+	defer c.close()
+	if disk.len() != 10 {
+		t.Errorf("expect the 10 entries reloaded, got %d", disk.len())
+	}
+	for i := 0; i < 10; i++ {
+		v, ok := c.Get(strconv.Itoa(i))
+		if !ok || name(v) != entry(i).reply.Question[0].Name {
+			t.Errorf("expect the entry %d reloaded, got %v", i, v)
+		}
+	}
+	c.Purge()
+	if _, ok := c.Get("5"); ok || disk.len() != 0 {
+		t.Error("expect the both tiers purged")
+	}
+}
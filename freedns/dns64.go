@@ -0,0 +1,116 @@
+package freedns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// defaultDNS64Prefix is the well-known prefix of NAT64 (RFC 6052).
+const defaultDNS64Prefix = "64:ff9b::/96"
+
+// dns64 synthesizes the AAAA records of the names with only A records in the
+// NAT64 prefix (RFC 6147), for the IPv6-only clients behind a NAT64 gateway.
+// The clients of the networks behind other gateways get their prefixes.
+type dns64 struct {
+	prefix  *net.IPNet
+	clients []dns64Clients
+}
+
+// dns64Clients are the clients of a network and the prefix of its gateway.
+type dns64Clients struct {
+	clients *net.IPNet
+	prefix  *net.IPNet
+}
+
+// newDNS64 creates the DNS64 of the prefix, defaultDNS64Prefix if empty, and
+// of the prefixes of the clients in the form of `clients=prefix`, the clients
+// an IP or a CIDR, e.g. `2001:db8:20::/48=64:ff9b:20::/96`.
+func newDNS64(prefix string, clientPrefixes []string) (*dns64, error) {
+	if prefix == "" {
+		prefix = defaultDNS64Prefix
+	}
+	prefixes, err := parseNAT64Prefixes([]string{prefix})
+	if err != nil {
+		return nil, err
+	}
+	d := &dns64{prefix: prefixes[0]}
+	for _, rule := range clientPrefixes {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return nil, Error("invalid DNS64 client prefix, expect clients=prefix: " + rule)
+		}
+		clients, err := parseClientPrefixes(parts[:1])
+		if err != nil {
+			return nil, Error("invalid clients of DNS64 client prefix: " + rule)
+		}
+		prefixes, err := parseNAT64Prefixes(parts[1:])
+		if err != nil {
+			return nil, err
+		}
+		d.clients = append(d.clients, dns64Clients{clients: clients[0], prefix: prefixes[0]})
+	}
+	return d, nil
+}
+
+// prefixOf returns the prefix of the client, the first matching one of the
+// client prefixes or the default.
+func (d *dns64) prefixOf(client net.Addr) *net.IPNet {
+	for _, c := range d.clients {
+		if containsClient([]*net.IPNet{c.clients}, client) {
+			return c.prefix
+		}
+	}
+	return d.prefix
+}
+
+// needed returns if the AAAA response has no AAAA records to answer with,
+// so they're synthesized. NXDOMAIN and the failures are answered as is.
+func (d *dns64) needed(res *dns.Msg) bool {
+	if res.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	for _, rr := range res.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok && !excludedFromDNS64(aaaa.AAAA) {
+			return false
+		}
+	}
+	return true
+}
+
+// excludedFromDNS64 returns if the AAAA record is ignored as if the name had
+// none, i.e. the IPv4-mapped addresses (RFC 6147 section 5.1.4).
+func excludedFromDNS64(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// synthesize answers the AAAA query of the client with the A response,
+// replacing the A records with the AAAA records of the IPv4 addresses in the
+// prefix of the client. The CNAMEs are kept. It returns nil if there's no A
+// record to synthesize from.
+func (d *dns64) synthesize(req *dns.Msg, a *dns.Msg, client net.Addr) *dns.Msg {
+	prefix := d.prefixOf(client)
+	res := &dns.Msg{}
+	res.SetRcode(req, a.Rcode)
+	res.RecursionAvailable = a.RecursionAvailable
+	synthesized := 0
+	for _, rr := range a.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if rr.A.IsLoopback() || rr.A.IsUnspecified() {
+				continue // RFC 6147 section 5.1.4
+			}
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			res.Answer = append(res.Answer, &dns.AAAA{Hdr: hdr, AAAA: synthesizeIPv6(rr.A, prefix)})
+			synthesized++
+		case *dns.CNAME:
+			res.Answer = append(res.Answer, rr)
+		}
+	}
+	if synthesized == 0 {
+		return nil
+	}
+	return res
+}
@@ -0,0 +1,80 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNS64(t *testing.T) {
+	records := map[string]string{
+		"v4only.example.com. A":    "v4only.example.com. 60 IN A 192.0.2.33",
+		"www.example.com. A":       "www.example.com. 60 IN CNAME v4only.example.com.",
+		"dual.example.com. A":      "dual.example.com. 60 IN A 192.0.2.34",
+		"dual.example.com. AAAA":   "dual.example.com. 60 IN AAAA 2001:db8::1",
+		"mapped.example.com. A":    "mapped.example.com. 60 IN A 192.0.2.35",
+		"mapped.example.com. AAAA": "mapped.example.com. 60 IN AAAA ::ffff:192.0.2.35",
+	}
+	upstream, stop := fakeUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		res := &dns.Msg{}
+		res.SetReply(req)
+		if r, ok := records[q.Name+" "+dns.TypeToString[q.Qtype]]; ok {
+			rr, _ := dns.NewRR(r)
+			res.Answer = append(res.Answer, rr)
+			if c, ok := rr.(*dns.CNAME); ok {
+				rr, _ = dns.NewRR(records[c.Target+" A"])
+				res.Answer = append(res.Answer, rr)
+			}
+		}
+		w.WriteMsg(res)
+	})
+	defer stop()
+
+	s := newTestServer(t, Config{FastDNS: upstream, CleanDNS: upstream, DNS64: true})
+	cases := []struct {
+		name string
+		want []string
+	}{
+		{"v4only.example.com.", []string{"64:ff9b::c000:221"}},
+		{"www.example.com.", []string{"", "64:ff9b::c000:221"}}, // the CNAME kept
+		{"dual.example.com.", []string{"2001:db8::1"}},
+		{"mapped.example.com.", []string{"64:ff9b::c000:223"}},
+		{"missing.example.com.", nil},
+	}
+	for _, c := range cases {
+		req := &dns.Msg{}
+		req.SetQuestion(c.name, dns.TypeAAAA)
+		w := newRecorder()
+		s.handle(w, req, "udp")
+		if len(w.msg.Answer) != len(c.want) {
+			t.Errorf("%s: expect %v, got %v", c.name, c.want, w.msg)
+			continue
+		}
+		for i, ip := range c.want {
+			if aaaa, ok := w.msg.Answer[i].(*dns.AAAA); ip != "" && (!ok || !aaaa.AAAA.Equal(net.ParseIP(ip))) {
+				t.Errorf("%s: expect %v, got %v", c.name, c.want, w.msg)
+			}
+		}
+	}
+
+	s = newTestServer(t, Config{FastDNS: upstream, CleanDNS: upstream, DNS64: true, DNS64ClientPrefixes: []string{"2001:db8:20::/48=64:ff9b:20::/96"}})
+	for client, want := range map[string]string{"2001:db8:20::5": "64:ff9b:20::c000:221", "2001:db8:30::5": "64:ff9b::c000:221"} {
+		req := &dns.Msg{}
+		req.SetQuestion("v4only.example.com.", dns.TypeAAAA)
+		w := newRecorder()
+		w.remote = &net.UDPAddr{IP: net.ParseIP(client), Port: 12345}
+		s.handle(w, req, "udp")
+		if len(w.msg.Answer) != 1 || !w.msg.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP(want)) {
+			t.Errorf("%s: expect %s, got %v", client, want, w.msg)
+		}
+	}
+
+	if _, err := newDNS64("64:ff9b::/95", nil); err == nil {
+		t.Error("expect an error of the invalid prefix")
+	}
+	if _, err := newDNS64("", []string{"2001:db8:20::/48"}); err == nil {
+		t.Error("expect an error of the client prefix without a prefix")
+	}
+}
@@ -1,42 +1,181 @@
 package freedns
 
 import (
+	"strings"
+	"sync"
 	"time"
 
-	goc "github.com/louchenyao/golang-cache"
 	"github.com/miekg/dns"
 )
 
 type cacheEntry struct {
-	putin time.Time
-	reply *dns.Msg
+	putin      time.Time
+	reply      *dns.Msg
+	provenance provenance
 }
 
+// dnsCache caches the upstream responses. Blocked queries are answered before
+// the cache is consulted, so the entries never depend on the blocking rules.
+// The upstream policies cache in views of the server's dnsCache, sharing its
+// backend and limits, with the keys of each view prefixed by its policy, so
+// the answers of a policy's upstreams are never served to the other clients.
 type dnsCache struct {
-	backend *goc.Cache
+	backend Cache
+	prefix  string // of the keys of the view, empty for the server's
+
+	subMu       sync.Mutex
+	subscribers map[chan cacheUpdate]struct{} // the replicas
 }
 
 func newDNSCache(maxCap int) *dnsCache {
-	c, _ := goc.NewCache("lru", maxCap)
-	return &dnsCache{
-		backend: c,
+	return newDNSCacheWithBackend(NewMemoryCache(maxCap))
+}
+
+// newSizedDNSCache creates the in-memory cache bounded by the estimated bytes
+// of the entries as well.
+func newSizedDNSCache(maxCap int, maxBytes int) *dnsCache {
+	return newDNSCacheWithBackend(newSizedMemoryCache(maxCap, maxBytes, cacheEntrySize))
+}
+
+// newShardedDNSCache creates the in-memory cache split into `shards`, each
+// with its own lock.
+func newShardedDNSCache(maxCap int, maxBytes int, shards int) *dnsCache {
+	return newDNSCacheWithBackend(newShardedMemoryCache(shards, maxCap, maxBytes, cacheEntrySize))
+}
+
+// The estimated memory overheads of a cache entry, besides the records: the
+// list element, the map entry, the key string, the cacheEntry and the dns.Msg
+// with its slices; and of each record: the interface value, the RR_Header and
+// the header of the rdata slices.
+const (
+	cacheEntryOverhead  = 320
+	cacheRecordOverhead = 96
+)
+
+// cacheEntrySize estimates the bytes of a cacheEntry in the memory. The
+// records are counted by their uncompressed wire sizes, which are about the
+// sizes of their names and rdata.
+func cacheEntrySize(key string, value interface{}) int {
+	size := cacheEntryOverhead + len(key)
+	entry, ok := value.(cacheEntry)
+	if !ok {
+		return size
+	}
+	for _, q := range entry.reply.Question {
+		size += len(q.Name) + 8
+	}
+	for _, rrs := range [][]dns.RR{entry.reply.Answer, entry.reply.Ns, entry.reply.Extra} {
+		for _, rr := range rrs {
+			size += cacheRecordOverhead + dns.Len(rr)
+		}
 	}
+	return size
+}
+
+func newDNSCacheWithBackend(backend Cache) *dnsCache {
+	return &dnsCache{backend: backend}
+}
+
+// policyKeyPrefix starts the keys of the views, and never a domain name, whose
+// special characters are escaped.
+const policyKeyPrefix = "@"
+
+// view returns the cache sharing the backend of `c`, with the keys prefixed by
+// `name`. The updates of the view aren't published to the replicas.
+func (c *dnsCache) view(name string) *dnsCache {
+	return &dnsCache{backend: c.backend, prefix: policyKeyPrefix + name + "_"}
+}
+
+// key returns the key of the request in the cache.
+func (c *dnsCache) key(q dns.Question, recursion bool, net string) string {
+	return c.prefix + requestToString(q, recursion, net)
+}
+
+// owns returns if the key of the backend belongs to the cache, rather than to
+// another view of it.
+func (c *dnsCache) owns(key string) bool {
+	if c.prefix == "" {
+		return !strings.HasPrefix(key, policyKeyPrefix)
+	}
+	return strings.HasPrefix(key, c.prefix)
+}
+
+// purge drops all the entries, of the views as well.
+func (c *dnsCache) purge() {
+	c.backend.Purge()
 }
 
 func (c *dnsCache) set(res *dns.Msg, net string) {
-	key := requestToString(res.Question[0], res.RecursionDesired, net)
+	c.setFrom(res, net, provenance{})
+}
+
+// setFrom caches the response tagged with its provenance.
+func (c *dnsCache) setFrom(res *dns.Msg, net string, p provenance) {
+	key := c.key(res.Question[0], res.RecursionDesired, net)
 
 	c.backend.Set(key, cacheEntry{
-		putin: time.Now(),
-		reply: res.Copy(), // .Copy() is mandatory
+		putin:      time.Now(),
+		reply:      res.Copy(), // .Copy() is mandatory
+		provenance: p,
 	})
+	c.publish(res, net)
+}
+
+// entry returns the cached entry of the request as it is, without the TTLs
+// reduced. It must not be changed.
+func (c *dnsCache) entry(q dns.Question, recursion bool, net string) (cacheEntry, bool) {
+	v, ok := c.backend.Get(c.key(q, recursion, net))
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry, ok := v.(cacheEntry)
+	return entry, ok
+}
+
+// subscribe returns the channel of the cache updates from now on, and the
+// function to unsubscribe.
+func (c *dnsCache) subscribe() (<-chan cacheUpdate, func()) {
+	ch := make(chan cacheUpdate, cacheUpdateQueueSize)
+	c.subMu.Lock()
+	if c.subscribers == nil {
+		c.subscribers = map[chan cacheUpdate]struct{}{}
+	}
+	c.subscribers[ch] = struct{}{}
+	c.subMu.Unlock()
+	return ch, func() {
+		c.subMu.Lock()
+		delete(c.subscribers, ch)
+		c.subMu.Unlock()
+	}
+}
+
+func (c *dnsCache) publish(res *dns.Msg, net string) {
+	if c.prefix != "" {
+		return
+	}
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	if len(c.subscribers) == 0 {
+		return
+	}
+	b, err := res.Pack()
+	if err != nil {
+		return
+	}
+	u := cacheUpdate{Net: net, Msg: b}
+	for ch := range c.subscribers {
+		select {
+		case ch <- u:
+		default:
+		}
+	}
 }
 
 func (c *dnsCache) lookup(q dns.Question, recursion bool, net string) (*dns.Msg, bool) {
-	key := requestToString(q, recursion, net)
-	ci, ok := c.backend.Get(key)
+	key := c.key(q, recursion, net)
+	v, ok := c.backend.Get(key)
 	if ok {
-		entry := ci.(cacheEntry)
+		entry := v.(cacheEntry)
 		res := entry.reply.Copy() // .Copy() is mandatory
 		delta := time.Now().Sub(entry.putin).Seconds()
 		needUpdate := subTTL(res, int(delta))
@@ -46,6 +185,31 @@ func (c *dnsCache) lookup(q dns.Question, recursion bool, net string) (*dns.Msg,
 	return nil, true
 }
 
+// expiredFor returns how long the cached entry of the request has been
+// expired, i.e. since the shortest TTL of its records ran out, or 0 if it's
+// fresh or not cached.
+func (c *dnsCache) expiredFor(q dns.Question, recursion bool, net string) time.Duration {
+	entry, ok := c.entry(q, recursion, net)
+	if !ok {
+		return 0
+	}
+	ttl := -1
+	for _, rrs := range [][]dns.RR{entry.reply.Answer, entry.reply.Ns, entry.reply.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT && (ttl < 0 || int(hdr.Ttl) < ttl) {
+				ttl = int(hdr.Ttl)
+			}
+		}
+	}
+	if ttl < 0 {
+		return 0
+	}
+	if d := time.Since(entry.putin) - time.Duration(ttl)*time.Second; d > 0 {
+		return d
+	}
+	return 0
+}
+
 // requestToString generates a string that uniquely identifies the request.
 func requestToString(q dns.Question, recursion bool, net string) string {
 	s := q.Name + "_" + dns.TypeToString[q.Qtype] + "_" + dns.ClassToString[q.Qclass]
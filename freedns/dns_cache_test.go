@@ -56,3 +56,21 @@ func TestAll(t *testing.T) {
 		t.Errorf("res should be nil")
 	}
 }
+
+func TestExpiredFor(t *testing.T) {
+	c := newDNSCache(10)
+	res := answerOf("example.com.", "8.8.8.8")
+	q := res.Question[0]
+	if d := c.expiredFor(q, res.RecursionDesired, "udp"); d != 0 {
+		t.Errorf("expect 0 of the missing entry, got %v", d)
+	}
+	c.set(res, "udp")
+	if d := c.expiredFor(q, res.RecursionDesired, "udp"); d != 0 {
+		t.Errorf("expect 0 of the fresh entry, got %v", d)
+	}
+	ttl := time.Duration(res.Answer[0].Header().Ttl) * time.Second
+	c.backend.Set(requestToString(q, res.RecursionDesired, "udp"), cacheEntry{putin: time.Now().Add(-ttl - time.Minute), reply: res})
+	if d := c.expiredFor(q, res.RecursionDesired, "udp"); d < time.Minute || d > time.Minute+time.Second {
+		t.Errorf("expect the entry expired for a minute, got %v", d)
+	}
+}
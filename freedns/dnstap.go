@@ -0,0 +1,330 @@
+package freedns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// The dnstap message types (dnstap.proto), of which the client and the
+// forwarder ones are used.
+const (
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+)
+
+// The Frame Streams control frames (https://farsightsec.github.io/fstrm/).
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+
+	fstrmFieldContentType = 0x01
+)
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// dnstapQueueSize is how many frames are buffered for the collector. The
+// frames are dropped when it's full, e.g. the collector is down, so that the
+// queries are never blocked by dnstap.
+const dnstapQueueSize = 4096
+
+// dnstapRetryInterval is how long to wait before reconnecting to the
+// collector.
+const dnstapRetryInterval = 5 * time.Second
+
+// dnstapWriter sends the dnstap frames to a collector over a unix socket or
+// TCP, with the bidirectional Frame Streams handshake. A nil dnstapWriter
+// sends nothing.
+type dnstapWriter struct {
+	network  string
+	addr     string
+	identity []byte
+
+	frames chan []byte
+}
+
+// newDnstapWriter creates the writer for `target`, which is either
+// `unix:/path/to/socket` or `tcp:host:port`.
+func newDnstapWriter(target string, identity string) (*dnstapWriter, error) {
+	parts := strings.SplitN(target, ":", 2)
+	if len(parts) != 2 || (parts[0] != "unix" && parts[0] != "tcp") || parts[1] == "" {
+		return nil, Error("invalid dnstap target, expect unix:/path or tcp:host:port: " + target)
+	}
+	return &dnstapWriter{
+		network:  parts[0],
+		addr:     parts[1],
+		identity: []byte(identity),
+		frames:   make(chan []byte, dnstapQueueSize),
+	}, nil
+}
+
+// run connects to the collector and sends the frames until `done` is closed,
+// reconnecting when the connection fails.
+func (t *dnstapWriter) run(done <-chan struct{}) {
+	l := log.WithFields(logrus.Fields{
+		"op":   "dnstap",
+		"addr": t.network + ":" + t.addr,
+	})
+	for {
+		conn, err := net.DialTimeout(t.network, t.addr, dnstapRetryInterval)
+		if err == nil {
+			err = t.serve(conn, done)
+			conn.Close()
+			if err == nil {
+				return
+			}
+		}
+		l.Error(err)
+
+		select {
+		case <-done:
+			return
+		case <-time.After(dnstapRetryInterval):
+		}
+	}
+}
+
+// serve handshakes with the collector and writes the frames to it. It returns
+// nil after stopping the stream because `done` is closed.
+func (t *dnstapWriter) serve(conn net.Conn, done <-chan struct{}) error {
+	conn.SetDeadline(time.Now().Add(dnstapRetryInterval))
+	if err := writeControlFrame(conn, fstrmControlReady); err != nil {
+		return err
+	}
+	if typ, err := readControlFrame(conn); err != nil {
+		return err
+	} else if typ != fstrmControlAccept {
+		return Error("dnstap: the collector did not accept the stream")
+	}
+	if err := writeControlFrame(conn, fstrmControlStart); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	for {
+		select {
+		case <-done:
+			conn.SetDeadline(time.Now().Add(dnstapRetryInterval))
+			if err := writeControlFrame(conn, fstrmControlStop); err != nil {
+				return nil
+			}
+			readControlFrame(conn) // FINISH
+			return nil
+		case frame := <-t.frames:
+			var n [4]byte
+			binary.BigEndian.PutUint32(n[:], uint32(len(frame)))
+			if _, err := conn.Write(append(n[:], frame...)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeControlFrame writes a control frame with our content type.
+func writeControlFrame(w io.Writer, typ uint32) error {
+	var body []byte
+	body = appendUint32(body, typ)
+	if typ != fstrmControlStop && typ != fstrmControlFinish {
+		body = appendUint32(body, fstrmFieldContentType)
+		body = appendUint32(body, uint32(len(dnstapContentType)))
+		body = append(body, dnstapContentType...)
+	}
+
+	frame := appendUint32(nil, 0) // the escape of control frames
+	frame = appendUint32(frame, uint32(len(body)))
+	_, err := w.Write(append(frame, body...))
+	return err
+}
+
+// readControlFrame reads a control frame and returns its type.
+func readControlFrame(r io.Reader) (uint32, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(hdr[:4]) != 0 {
+		return 0, Error("dnstap: expect a control frame")
+	}
+	n := binary.BigEndian.Uint32(hdr[4:])
+	if n < 4 || n > 512 {
+		return 0, Error("dnstap: invalid control frame")
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(body[:4]), nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// dnstapMessage is the Message of dnstap.proto.
+type dnstapMessage struct {
+	typ          uint64
+	protocol     string // udp or tcp
+	queryAddr    net.Addr
+	responseAddr net.Addr
+	queryTime    time.Time
+	query        *dns.Msg
+	responseTime time.Time
+	response     *dns.Msg
+}
+
+// client sends the query and the response of a client.
+func (t *dnstapWriter) client(w dns.ResponseWriter, protocol string, req *dns.Msg, res *dns.Msg, start time.Time) {
+	if t == nil {
+		return
+	}
+	m := dnstapMessage{
+		typ:          dnstapClientQuery,
+		protocol:     protocol,
+		queryAddr:    w.RemoteAddr(),
+		responseAddr: w.LocalAddr(),
+		queryTime:    start,
+		query:        req,
+	}
+	t.send(m)
+	m.typ = dnstapClientResponse
+	m.responseTime = time.Now()
+	m.response = res
+	t.send(m)
+}
+
+// forwarder sends the query to an upstream, or the response if `res` is not
+// nil.
+func (t *dnstapWriter) forwarder(conn net.Conn, protocol string, req *dns.Msg, queryTime time.Time, res *dns.Msg) {
+	if t == nil {
+		return
+	}
+	m := dnstapMessage{
+		typ:          dnstapForwarderQuery,
+		protocol:     protocol,
+		queryAddr:    conn.LocalAddr(),
+		responseAddr: conn.RemoteAddr(),
+		queryTime:    queryTime,
+		query:        req,
+	}
+	if res != nil {
+		m.typ = dnstapForwarderResponse
+		m.responseTime = time.Now()
+		m.response = res
+	}
+	t.send(m)
+}
+
+func (t *dnstapWriter) send(m dnstapMessage) {
+	select {
+	case t.frames <- t.encode(m):
+	default:
+	}
+}
+
+// encode encodes the Dnstap protobuf message.
+func (t *dnstapWriter) encode(m dnstapMessage) []byte {
+	var msg []byte
+	msg = appendProtoVarint(msg, 1, m.typ)
+
+	qip, qport := addrIPPort(m.queryAddr)
+	rip, rport := addrIPPort(m.responseAddr)
+	family := uint64(1) // INET
+	if (qip != nil && qip.To4() == nil) || (rip != nil && rip.To4() == nil) {
+		family = 2 // INET6
+	}
+	msg = appendProtoVarint(msg, 2, family)
+	protocol := uint64(1) // UDP
+	if m.protocol == "tcp" {
+		protocol = 2 // TCP
+	}
+	msg = appendProtoVarint(msg, 3, protocol)
+	if qip != nil {
+		msg = appendProtoBytes(msg, 4, ipBytes(qip, family))
+		msg = appendProtoVarint(msg, 6, uint64(qport))
+	}
+	if rip != nil {
+		msg = appendProtoBytes(msg, 5, ipBytes(rip, family))
+		msg = appendProtoVarint(msg, 7, uint64(rport))
+	}
+	if !m.queryTime.IsZero() {
+		msg = appendProtoVarint(msg, 8, uint64(m.queryTime.Unix()))
+		msg = appendProtoFixed32(msg, 9, uint32(m.queryTime.Nanosecond()))
+	}
+	if m.query != nil {
+		if b, err := m.query.Pack(); err == nil {
+			msg = appendProtoBytes(msg, 10, b)
+		}
+	}
+	if m.response != nil {
+		msg = appendProtoVarint(msg, 12, uint64(m.responseTime.Unix()))
+		msg = appendProtoFixed32(msg, 13, uint32(m.responseTime.Nanosecond()))
+		if b, err := m.response.Pack(); err == nil {
+			msg = appendProtoBytes(msg, 14, b)
+		}
+	}
+
+	var frame []byte
+	if len(t.identity) > 0 {
+		frame = appendProtoBytes(frame, 1, t.identity)
+	}
+	frame = appendProtoBytes(frame, 2, []byte("freedns-go"))
+	frame = appendProtoBytes(frame, 14, msg)
+	frame = appendProtoVarint(frame, 15, 1) // MESSAGE
+	return frame
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+func ipBytes(ip net.IP, family uint64) []byte {
+	if family == 1 {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+func appendProtoKey(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	return appendVarint(appendProtoKey(b, field, 0), v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendVarint(appendProtoKey(b, field, 2), uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoFixed32(b []byte, field int, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(appendProtoKey(b, field, 5), buf[:]...)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
@@ -0,0 +1,133 @@
+package freedns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// decodeProto decodes the fields of a protobuf message, the varint and fixed32
+// ones into `ints` and the length-delimited ones into `bytes`.
+func decodeProto(t *testing.T, b []byte) (ints map[int]uint64, bytes map[int][]byte) {
+	ints, bytes = map[int]uint64{}, map[int][]byte{}
+	varint := func() uint64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid varint in %x", b)
+		}
+		b = b[n:]
+		return v
+	}
+	for len(b) > 0 {
+		key := varint()
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			ints[field] = varint()
+		case 2:
+			n := int(varint())
+			bytes[field] = b[:n]
+			b = b[n:]
+		case 5:
+			ints[field] = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			t.Fatalf("unexpected wire type of %d", key)
+		}
+	}
+	return
+}
+
+func TestDnstap(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tap, err := newDnstapWriter("tcp:"+ln.Addr().String(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		tap.run(done)
+		close(stopped)
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the bidirectional handshake
+	if typ, err := readControlFrame(conn); err != nil || typ != fstrmControlReady {
+		t.Fatalf("expect READY, got %d, %v", typ, err)
+	}
+	if err := writeControlFrame(conn, fstrmControlAccept); err != nil {
+		t.Fatal(err)
+	}
+	if typ, err := readControlFrame(conn); err != nil || typ != fstrmControlStart {
+		t.Fatalf("expect START, got %d, %v", typ, err)
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	res := &dns.Msg{}
+	res.SetReply(req)
+	tap.client(newRecorder(), "udp", req, res, time.Now())
+
+	for _, typ := range []uint64{dnstapClientQuery, dnstapClientResponse} {
+		var n [4]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			t.Fatal(err)
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(n[:]))
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			t.Fatal(err)
+		}
+
+		ints, bytes := decodeProto(t, frame)
+		if ints[15] != 1 || string(bytes[1]) != "test" {
+			t.Errorf("unexpected Dnstap %v, %v", ints, bytes)
+		}
+		ints, bytes = decodeProto(t, bytes[14])
+		if ints[1] != typ || ints[2] != 1 || ints[3] != 1 || ints[6] != 12345 || !net.IP(bytes[4]).Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("unexpected Message %v, %v", ints, bytes)
+		}
+		q := &dns.Msg{}
+		if err := q.Unpack(bytes[10]); err != nil || q.Question[0].Name != "example.com." {
+			t.Errorf("expect the query message, got %v, %v", q, err)
+		}
+		if _, ok := bytes[14]; ok != (typ == dnstapClientResponse) {
+			t.Errorf("the response message should be only in the responses")
+		}
+	}
+
+	close(done)
+	if typ, err := readControlFrame(conn); err != nil || typ != fstrmControlStop {
+		t.Fatalf("expect STOP, got %d, %v", typ, err)
+	}
+	writeControlFrame(conn, fstrmControlFinish)
+	<-stopped
+}
+
+func TestNewDnstapWriter(t *testing.T) {
+	for _, target := range []string{"unix:/run/dnstap.sock", "tcp:127.0.0.1:6000"} {
+		if _, err := newDnstapWriter(target, ""); err != nil {
+			t.Errorf("%s should be valid: %v", target, err)
+		}
+	}
+	for _, target := range []string{"", "/run/dnstap.sock", "udp:127.0.0.1:6000", "tcp:"} {
+		if _, err := newDnstapWriter(target, ""); err == nil {
+			t.Errorf("%q should be invalid", target)
+		}
+	}
+}
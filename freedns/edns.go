@@ -0,0 +1,38 @@
+package freedns
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+)
+
+// edeOption is the option code of Extended DNS Errors (RFC 8914).
+const edeOption = 15
+
+// edeOther is the Extended DNS Error info code for errors without a more
+// specific code.
+const edeOther = 0
+
+// edeBlocked is the Extended DNS Error info code for the queries blocked by
+// the policies of the resolver.
+const edeBlocked = 15
+
+// setEDE attaches an Extended DNS Error to `res`. The error is only attached
+// if the request supports EDNS, as responses must not carry the OPT record
+// otherwise.
+func setEDE(res *dns.Msg, req *dns.Msg, code uint16, text string) {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+	opt := res.IsEdns0()
+	if opt == nil {
+		res.SetEdns0(reqOpt.UDPSize(), false)
+		opt = res.IsEdns0()
+	}
+
+	data := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	data = append(data, text...)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: edeOption, Data: data})
+}
@@ -0,0 +1,34 @@
+package freedns
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestResponseTooLarge(t *testing.T) {
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeTXT)
+
+	res := responseTooLarge(req, 70000)
+	if res.Rcode != dns.RcodeServerFailure || res.IsEdns0() != nil {
+		t.Errorf("expect SERVFAIL without OPT for requests without EDNS")
+	}
+
+	req.SetEdns0(4096, false)
+	res = responseTooLarge(req, 70000)
+	opt := res.IsEdns0()
+	if res.Rcode != dns.RcodeServerFailure || opt == nil || len(opt.Option) != 1 {
+		t.Fatalf("expect SERVFAIL with an EDE option, got %v", res)
+	}
+	ede := opt.Option[0].(*dns.EDNS0_LOCAL)
+	if ede.Code != edeOption || binary.BigEndian.Uint16(ede.Data) != edeOther {
+		t.Errorf("unexpected EDE option: %v", ede)
+	}
+
+	// the option survives packing
+	if _, err := res.Pack(); err != nil {
+		t.Error(err)
+	}
+}
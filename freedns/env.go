@@ -0,0 +1,104 @@
+package freedns
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// EnvPrefix is the prefix of the environment variables of the config.
+const EnvPrefix = "FREEDNS_"
+
+// envConfigFile is the environment variable of the path of the config file,
+// which is not a field.
+const envConfigFile = EnvPrefix + "CONFIG"
+
+// EnvName returns the environment variable of the Config field, FREEDNS_
+// followed by the name in the upper snake case, e.g. FREEDNS_FAST_DNS of
+// FastDNS and FREEDNS_GEO_IP_DATABASE of GeoIPDatabase.
+func EnvName(field string) string {
+	runes := []rune(field)
+	var b strings.Builder
+	b.WriteString(EnvPrefix)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// LoadEnv fills `cfg` with the FREEDNS_* variables of `environ`, in the form
+// of os.Environ, named by EnvName. The strings are taken as they are, the
+// durations are like 1h30m, the lists of strings are separated by commas or
+// written as JSON arrays, and the other values are written in JSON, e.g.
+// FREEDNS_CACHE_CAP=4096 or FREEDNS_ADMIN_USERS={"alice":"password"}. The
+// unknown FREEDNS_* variables are errors, except FREEDNS_CONFIG, the path of
+// the config file.
+func LoadEnv(cfg *Config, environ []string) error {
+	fields := map[string]reflect.Value{}
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("json") == "-" {
+			continue
+		}
+		fields[EnvName(t.Field(i).Name)] = v.Field(i)
+	}
+
+	for _, kv := range environ {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], EnvPrefix) || kv[:i] == envConfigFile {
+			continue
+		}
+		name, value := kv[:i], kv[i+1:]
+		field, ok := fields[name]
+		if !ok {
+			return Error("unknown environment variable: " + name)
+		}
+		if err := setEnvField(field, value); err != nil {
+			return Error(name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func setEnvField(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+		return nil
+	case Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	case []string:
+		if strings.HasPrefix(strings.TrimSpace(value), "[") {
+			break
+		}
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+		return nil
+	}
+	ptr := reflect.New(field.Type())
+	if err := json.Unmarshal([]byte(value), ptr.Interface()); err != nil {
+		return err
+	}
+	field.Set(ptr.Elem())
+	return nil
+}
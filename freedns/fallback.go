@@ -0,0 +1,174 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// protocolProbeInterval is how long a chain sticks to a lower protocol before
+// the highest one is tried again.
+const protocolProbeInterval = 5 * time.Minute
+
+// upstreamProtocol is a protocol of a fallback chain, and the port used with
+// it, 0 for the port of the upstream.
+type upstreamProtocol struct {
+	name string // udp, tcp or tls
+	net  string // the network of dns.Client
+	port int
+}
+
+// address is the address of the upstream with the port of the protocol.
+func (p upstreamProtocol) address(upstream string) string {
+	if p.port == 0 {
+		return upstream
+	}
+	host, _, err := net.SplitHostPort(upstream)
+	if err != nil {
+		host = upstream
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p.port))
+}
+
+// protocolChain is the ordered fallback protocols of an upstream, e.g. tls,
+// tcp and then udp. It sticks to the highest protocol that recently worked:
+// a failed one is skipped until protocolProbeInterval later, when the
+// highest is tried again.
+type protocolChain struct {
+	protocols []upstreamProtocol
+
+	mu      sync.Mutex
+	current int
+	since   time.Time // when the chain fell back to current
+}
+
+// newProtocolChain parses the protocols, udp, tcp or tls (DNS over TLS, port
+// 853 by default), each with an optional `:port`, e.g. `tls:8853`.
+func newProtocolChain(protocols []string) (*protocolChain, error) {
+	c := &protocolChain{}
+	for _, s := range protocols {
+		parts := strings.SplitN(strings.ToLower(s), ":", 2)
+		p := upstreamProtocol{name: parts[0]}
+		switch p.name {
+		case "udp", "tcp":
+			p.net = p.name
+		case "tls":
+			p.net, p.port = "tcp-tls", 853
+		case "quic", "doq":
+			return nil, Error("DNS over QUIC is not supported: " + s)
+		default:
+			return nil, Error("unknown upstream protocol, expect udp, tcp or tls: " + s)
+		}
+		if len(parts) == 2 {
+			port, err := strconv.Atoi(parts[1])
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, Error("invalid port of upstream protocol: " + s)
+			}
+			p.port = port
+		}
+		c.protocols = append(c.protocols, p)
+	}
+	return c, nil
+}
+
+// order returns the indexes of the protocols in the order to try: the
+// current one and the lower ones after it, or all of them from the highest
+// once it's time to probe it again.
+func (c *protocolChain) order() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current > 0 && time.Since(c.since) >= protocolProbeInterval {
+		c.current = 0
+	}
+	var order []int
+	for i := c.current; i < len(c.protocols); i++ {
+		order = append(order, i)
+	}
+	return order
+}
+
+// worked sticks the chain to the i-th protocol.
+func (c *protocolChain) worked(i int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != i {
+		c.current, c.since = i, time.Now()
+	}
+}
+
+// failed falls the chain back to the protocol after the i-th, unless it's the
+// last.
+func (c *protocolChain) failed(i int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current == i && i+1 < len(c.protocols) {
+		c.current, c.since = i+1, time.Now()
+	}
+}
+
+// query resolves `q` on the upstream, or on the members of its groups in
+// turn, spilling over to the next one on errors.
+func (resolver *spoofingProofResolver) query(ctx context.Context, q dns.Question, recursion bool, net string, upstream string) (*dns.Msg, error) {
+	groups := resolver.groups[upstream]
+	if groups == nil {
+		return resolver.queryOver(ctx, q, recursion, net, upstream, upstream)
+	}
+	var res *dns.Msg
+	var err error
+	for _, address := range groups.order() {
+		res, err = resolver.queryOver(ctx, q, recursion, net, upstream, address)
+		if err == nil {
+			groups.worked(address)
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		groups.failed(address)
+		log.WithFields(logrus.Fields{
+			"op":       "spillover",
+			"upstream": upstream,
+			"member":   address,
+		}).Warn(err)
+	}
+	return res, err
+}
+
+// queryOver resolves `q` on the address of the upstream over the protocols of
+// its chain, falling back to the next one on errors, or over `net` of the
+// client if it has none. The recursiveUpstream is resolved iteratively.
+func (resolver *spoofingProofResolver) queryOver(ctx context.Context, q dns.Question, recursion bool, net string, upstream string, address string) (*dns.Msg, error) {
+	if address == recursiveUpstream && resolver.iterative != nil {
+		return resolver.iterative.resolve(ctx, q)
+	}
+	chain := resolver.chains[upstream]
+	if chain == nil {
+		return naiveResolve(ctx, q, recursion, net, address, resolver.client)
+	}
+	var res *dns.Msg
+	var err error
+	for _, i := range chain.order() {
+		p := chain.protocols[i]
+		res, err = naiveResolve(ctx, q, recursion, p.net, p.address(address), resolver.client)
+		if err == nil {
+			chain.worked(i)
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		chain.failed(i)
+		log.WithFields(logrus.Fields{
+			"op":       "fallback",
+			"upstream": address,
+			"protocol": p.name,
+		}).Warn(err)
+	}
+	return res, err
+}
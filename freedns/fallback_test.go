@@ -0,0 +1,64 @@
+package freedns
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tuna/freedns-go/decisiontest"
+)
+
+func TestProtocolChain(t *testing.T) {
+	for _, bad := range []string{"doq", "http", "tls:0", "tcp:x"} {
+		if _, err := newProtocolChain([]string{bad}); err == nil {
+			t.Errorf("%s: expect an error", bad)
+		}
+	}
+	c, err := newProtocolChain([]string{"TLS", "tcp:5353", "udp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"1.1.1.1:853", "1.1.1.1:5353", "1.1.1.1:53"} {
+		if got := c.protocols[i].address("1.1.1.1:53"); got != want {
+			t.Errorf("%s: expect %s, got %s", c.protocols[i].name, want, got)
+		}
+	}
+
+	c.failed(0)
+	c.failed(0) // already fallen back
+	if got := c.order(); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("expect to start from tcp, got %v", got)
+	}
+	c.failed(1)
+	c.failed(2) // the last is kept
+	if got := c.order(); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("expect udp only, got %v", got)
+	}
+	c.since = time.Now().Add(-protocolProbeInterval)
+	if got := c.order(); !reflect.DeepEqual(got, []int{0, 1, 2}) {
+		t.Errorf("expect the highest probed again, got %v", got)
+	}
+}
+
+func TestFallbackChain(t *testing.T) {
+	// the upstream only answers over udp, so tcp is refused
+	upstream, stop := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.Answer, IPs: []string{"114.114.114.114"}})
+	defer stop()
+	s := newTestServer(t, Config{
+		FastDNS:           upstream,
+		CleanDNS:          upstream,
+		FastDNSProtocols:  []string{"tcp", "udp"},
+		CleanDNSProtocols: []string{"tcp", "udp"},
+	})
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := newRecorder()
+	s.handle(w, req, "tcp")
+	if w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 {
+		t.Errorf("expect the answer over udp, got %v", w.msg)
+	}
+	if got := s.resolver.chains[upstream].order(); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("expect to stick to udp, got %v", got)
+	}
+}
@@ -0,0 +1,58 @@
+package freedns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// flattenMaxDepth caps the CNAMEs followed to flatten an answer, in case of a
+// loop.
+const flattenMaxDepth = 8
+
+// flatten follows the CNAME chain of the answer from the name, and returns
+// the records of the terminal name renamed to `name`, with the lowest TTL of
+// the chain. It returns the target the chain stops at instead, if the answer
+// has no records of it, e.g. when the upstream only answers the first CNAME.
+func flatten(name string, qtype uint16, answer []dns.RR) ([]dns.RR, string) {
+	target := strings.ToLower(name)
+	ttl := ^uint32(0)
+	for i := 0; i <= flattenMaxDepth; i++ {
+		var records []dns.RR
+		next := ""
+		for _, rr := range answer {
+			hdr := rr.Header()
+			if !strings.EqualFold(hdr.Name, target) {
+				continue
+			}
+			if c, ok := rr.(*dns.CNAME); ok {
+				next = strings.ToLower(c.Target)
+				if hdr.Ttl < ttl {
+					ttl = hdr.Ttl
+				}
+			} else if hdr.Rrtype == qtype {
+				records = append(records, rr)
+			}
+		}
+		if len(records) > 0 {
+			out := make([]dns.RR, len(records))
+			for j, rr := range records {
+				rr = dns.Copy(rr)
+				rr.Header().Name = name
+				if rr.Header().Ttl > ttl {
+					rr.Header().Ttl = ttl
+				}
+				out[j] = rr
+			}
+			return out, ""
+		}
+		if next == "" {
+			if target == strings.ToLower(name) {
+				return nil, "" // no CNAME at all
+			}
+			return nil, target
+		}
+		target = next
+	}
+	return nil, ""
+}
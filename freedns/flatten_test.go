@@ -0,0 +1,65 @@
+package freedns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFlattenCNAME(t *testing.T) {
+	records := map[string][]string{
+		"www.example.com.": {
+			"www.example.com. 300 IN CNAME a.cdn.example.net.",
+			"a.cdn.example.net. 30 IN CNAME b.cdn.example.net.",
+			"b.cdn.example.net. 60 IN A 203.0.113.1",
+			"b.cdn.example.net. 60 IN A 203.0.113.2",
+		},
+		// only the first link of the chain
+		"img.example.com.":     {"img.example.com. 300 IN CNAME img.cdn.example.net."},
+		"img.cdn.example.net.": {"img.cdn.example.net. 120 IN A 203.0.113.3"},
+		"loop.example.com.":    {"loop.example.com. 300 IN CNAME loop.example.com."},
+	}
+	upstream, stop := fakeUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		for _, r := range records[req.Question[0].Name] {
+			rr, _ := dns.NewRR(r)
+			res.Answer = append(res.Answer, rr)
+		}
+		w.WriteMsg(res)
+	})
+	defer stop()
+
+	s := newTestServer(t, Config{FastDNS: upstream, CleanDNS: upstream, FlattenCNAME: true})
+	cases := []struct {
+		name string
+		want []string
+		ttl  uint32
+	}{
+		{"www.example.com.", []string{"203.0.113.1", "203.0.113.2"}, 30},
+		{"img.example.com.", []string{"203.0.113.3"}, 120},
+		{"loop.example.com.", nil, 0},
+	}
+	for _, c := range cases {
+		req := &dns.Msg{}
+		req.SetQuestion(c.name, dns.TypeA)
+		w := newRecorder()
+		s.handle(w, req, "udp")
+		if c.want == nil {
+			if w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 {
+				t.Errorf("%s: expect the answer as is, got %v", c.name, w.msg)
+			}
+			continue
+		}
+		if len(w.msg.Answer) != len(c.want) {
+			t.Errorf("%s: expect %v, got %v", c.name, c.want, w.msg)
+			continue
+		}
+		for i, rr := range w.msg.Answer {
+			a, ok := rr.(*dns.A)
+			if !ok || a.Hdr.Name != c.name || a.A.String() != c.want[i] || a.Hdr.Ttl > c.ttl {
+				t.Errorf("%s: expect %v with the TTL %d, got %v", c.name, c.want, c.ttl, w.msg)
+			}
+		}
+	}
+}
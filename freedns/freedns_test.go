@@ -1,8 +1,15 @@
 package freedns
 
 import (
-	"github.com/miekg/dns"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
 )
 
 func TestAppendDefaultPort(t *testing.T) {
@@ -67,8 +74,8 @@ func TestSmokingNewRunAndShutdown(t *testing.T) {
 			Qclass: dns.ClassINET,
 		}
 
-		want, _ := naiveResolve(q, true, tt.net, tt.expectedUpstream)
-		got, err := naiveResolve(q, true, tt.net, "127.0.0.1:52345")
+		want, _ := naiveResolve(context.Background(), q, true, tt.net, tt.expectedUpstream, nil)
+		got, err := naiveResolve(context.Background(), q, true, tt.net, "127.0.0.1:52345", nil)
 
 		if err != nil {
 			t.Error(err)
@@ -91,3 +98,187 @@ func TestSmokingNewRunAndShutdown(t *testing.T) {
 
 	shut <- true
 }
+
+func TestMultiQuestion(t *testing.T) {
+	blocklist := writeTempFile(t, "a.example.com\nb.example.com\n")
+	defer os.Remove(blocklist)
+
+	req := &dns.Msg{}
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	req.Question = append(req.Question, dns.Question{Name: "b.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+
+	for _, multi := range []bool{false, true} {
+		s := newTestServer(t, Config{
+			Blocklists:    []string{blocklist},
+			BlockResponse: BlockZeroIP,
+			MultiQuestion: multi,
+		})
+		w := newRecorder()
+		s.handle(w, req, "udp")
+		if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+			t.Fatalf("expect NOERROR, got %v", w.msg)
+		}
+
+		answers := map[string]uint16{}
+		for _, rr := range w.msg.Answer {
+			answers[rr.Header().Name] = rr.Header().Rrtype
+		}
+		if answers["a.example.com."] != dns.TypeA {
+			t.Errorf("multi %v: the first question should be answered", multi)
+		}
+		if _, ok := answers["b.example.com."]; ok != multi {
+			t.Errorf("multi %v: the second question answered: %v", multi, ok)
+		}
+		if multi && (len(w.msg.Question) != 2 || answers["b.example.com."] != dns.TypeAAAA) {
+			t.Errorf("every question should be answered and kept, got %v", w.msg)
+		}
+	}
+}
+
+func TestMultiQuestionOPT(t *testing.T) {
+	// the upstream answers with an OPT record of its own
+	upstream, stop := fakeUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 114.114.114.114")
+		res.Answer = append(res.Answer, rr)
+		res.SetEdns0(1232, false)
+		w.WriteMsg(res)
+	})
+	defer stop()
+
+	req := &dns.Msg{}
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	req.Question = append(req.Question, dns.Question{Name: "b.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	req.SetEdns0(4096, false)
+
+	s := newTestServer(t, Config{FastDNS: upstream, CleanDNS: upstream, MultiQuestion: true})
+	res, _ := s.answerAll(context.Background(), req, "udp", nil)
+	opts := 0
+	for _, rr := range res.Extra {
+		if _, ok := rr.(*dns.OPT); ok {
+			opts++
+		}
+	}
+	if opts != 1 || res.IsEdns0().UDPSize() != 4096 {
+		t.Errorf("expect a single OPT record of the request, got %v", res)
+	}
+	if len(res.Answer) != 2 {
+		t.Errorf("expect both questions answered, got %v", res)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	blocklist := writeTempFile(t, "ads.example.com\n")
+	defer os.Remove(blocklist)
+	fast, _, stopFast := countingUpstream(t, "114.114.114.114")
+	defer stopFast()
+	clean, _, stopClean := countingUpstream(t, "8.8.8.8")
+	defer stopClean()
+
+	s := newTestServer(t, Config{FastDNS: fast, CleanDNS: clean, Blocklists: []string{blocklist}})
+	if r := s.Query("ads.example.com", dns.TypeA); r.Upstream != "blocklist" || r.Msg.Rcode != dns.RcodeNameError || r.Location != "" {
+		t.Errorf("expect the blocked answer, got %+v", r)
+	}
+	if r := s.Query("www.example.com", dns.TypeA); r.Upstream != s.resolver.fastUpstream || r.Location != "china" || len(r.Msg.Answer) != 1 {
+		t.Errorf("expect the China answer of the fast upstream, got %+v", r)
+	}
+}
+
+func TestJSONLog(t *testing.T) {
+	blocklist := writeTempFile(t, "example.com\n")
+	defer os.Remove(blocklist)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFormatter(&logrus.TextFormatter{})
+	}()
+
+	s := newTestServer(t, Config{
+		Blocklists: []string{blocklist},
+		LogFormat:  "json",
+	})
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	s.handle(newRecorder(), req, "udp")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expect a JSON line, got %q: %v", buf.String(), err)
+	}
+	if line["op"] != "handle" || line["client"] != "127.0.0.1:12345" || line["id"] != float64(req.Id) || line["domain"] != "example.com." {
+		t.Errorf("unexpected fields %v", line)
+	}
+	if _, ok := line["latency_ms"].(float64); !ok {
+		t.Errorf("expect the latency in ms, got %v", line["latency_ms"])
+	}
+
+	if _, err := NewServer(Config{LogFormat: "xml"}); err == nil {
+		t.Errorf("unknown log formats should be errors")
+	}
+}
+
+func TestShutdownContext(t *testing.T) {
+	s := newTestServer(t, Config{})
+	s.refreshes.Add(1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.refreshes.Done()
+	}()
+	if err := s.ShutdownContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.done:
+	default:
+		t.Error("the background jobs should be stopped")
+	}
+
+	// the deadline is up before the refresh is done
+	s = newTestServer(t, Config{})
+	s.refreshes.Add(1)
+	defer s.refreshes.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.ShutdownContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expect the deadline exceeded, got %v", err)
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	servfail, stop := fakeUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(res)
+	})
+	defer stop()
+
+	req := &dns.Msg{}
+	req.SetQuestion("flappy.example.", dns.TypeA)
+	cached := answerOf("flappy.example.", "8.8.8.8")
+	cache := func(s *Server, age time.Duration) {
+		s.recordsCache.backend.Set(requestToString(req.Question[0], true, "udp"), cacheEntry{
+			putin: time.Now().Add(-age),
+			reply: cached.Copy(),
+		})
+	}
+
+	s := newTestServer(t, Config{FastDNS: servfail, CleanDNS: servfail, StaleIfError: Duration(time.Hour)})
+	cache(s, 10*time.Minute)
+	if res, upstream := s.lookup(req, "udp"); upstream != "stale" || res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 {
+		t.Errorf("expect the stale answer on SERVFAIL, got %s from %s", dns.RcodeToString[res.Rcode], upstream)
+	}
+	cache(s, 2*time.Hour)
+	if res, upstream := s.lookup(req, "udp"); upstream == "stale" || res.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expect SERVFAIL past the max staleness, got %s from %s", dns.RcodeToString[res.Rcode], upstream)
+	}
+
+	// the upstream which can't be reached isn't covered
+	s = newTestServer(t, Config{StaleIfError: Duration(time.Hour)})
+	cache(s, 10*time.Minute)
+	if res, upstream := s.lookup(req, "udp"); upstream == "stale" || res.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expect SERVFAIL without an upstream answer, got %s from %s", dns.RcodeToString[res.Rcode], upstream)
+	}
+}
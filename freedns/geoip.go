@@ -0,0 +1,244 @@
+package freedns
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+	"github.com/sirupsen/logrus"
+	"github.com/tuna/freedns-go/chinaip"
+)
+
+// ipClassifier decides if an IP belongs to China.
+type ipClassifier interface {
+	isChinaIP(ip net.IP) bool
+}
+
+// builtinClassifier uses the China IP list compiled into the binary.
+type builtinClassifier struct{}
+
+func (builtinClassifier) isChinaIP(ip net.IP) bool {
+	return chinaip.IsChinaIP(ip.String())
+}
+
+// listClassifier uses a China IP list downloaded from a URL, and downloads it
+// again periodically. The compiled-in list is used until the first download
+// succeeds.
+type listClassifier struct {
+	url string
+
+	mu   sync.RWMutex
+	list *chinaip.List
+}
+
+func newListClassifier(url string) *listClassifier {
+	c := &listClassifier{
+		url:  url,
+		list: chinaip.Default(),
+	}
+	if err := c.update(); err != nil {
+		log.WithFields(logrus.Fields{
+			"op":  "update_chinaip",
+			"url": url,
+		}).Error(err, ", using the compiled-in list")
+	}
+	return c
+}
+
+// update downloads the list and swaps it in.
+func (c *listClassifier) update() error {
+	data, err := download(c.url)
+	if err != nil {
+		return err
+	}
+	list, err := chinaip.ParseList(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if list.Len() == 0 {
+		return Error(c.url + ": empty China IP list")
+	}
+
+	c.mu.Lock()
+	c.list = list
+	c.mu.Unlock()
+	return nil
+}
+
+// updateLoop updates the list every `interval` until `done` is closed,
+// waiting for the maintenance windows if any.
+func (c *listClassifier) updateLoop(interval time.Duration, windows maintenanceWindows, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !windows.wait(done) {
+				return
+			}
+			// drop the tick while waiting, which would update again at once
+			select {
+			case <-ticker.C:
+			default:
+			}
+			l := log.WithFields(logrus.Fields{
+				"op":  "update_chinaip",
+				"url": c.url,
+			})
+			if err := c.update(); err != nil {
+				l.Error(err)
+			} else {
+				l.Info()
+			}
+		}
+	}
+}
+
+func (c *listClassifier) isChinaIP(ip net.IP) bool {
+	c.mu.RLock()
+	list := c.list
+	c.mu.RUnlock()
+	return list.Contains(ip.String())
+}
+
+// overrideClassifier overrides the decisions of the base classifier by the
+// user-supplied CIDR lists. The foreign list wins if an IP is in both.
+type overrideClassifier struct {
+	base     ipClassifier
+	domestic *chinaip.List
+	foreign  *chinaip.List
+}
+
+func newOverrideClassifier(base ipClassifier, domesticFiles []string, foreignFiles []string) (*overrideClassifier, error) {
+	domestic, err := loadCIDRFiles(domesticFiles)
+	if err != nil {
+		return nil, err
+	}
+	foreign, err := loadCIDRFiles(foreignFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &overrideClassifier{
+		base:     base,
+		domestic: domestic,
+		foreign:  foreign,
+	}, nil
+}
+
+// loadCIDRFiles merges the CIDR lists in the files into one list.
+func loadCIDRFiles(files []string) (*chinaip.List, error) {
+	var all []byte
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		all = append(append(all, data...), '\n')
+	}
+	list, err := chinaip.ParseList(bytes.NewReader(all))
+	if err != nil {
+		return nil, Error("CIDR list: " + err.Error())
+	}
+	return list, nil
+}
+
+func (c *overrideClassifier) isChinaIP(ip net.IP) bool {
+	s := ip.String()
+	if c.foreign.Contains(s) {
+		return false
+	}
+	if c.domestic.Contains(s) {
+		return true
+	}
+	return c.base.isChinaIP(ip)
+}
+
+// geoipReloadCheckInterval is how often the mmdb file is checked for changes.
+const geoipReloadCheckInterval = time.Minute
+
+// mmdbClassifier uses a GeoLite2 (or any mmdb) country database, and reloads
+// it when the file changes.
+type mmdbClassifier struct {
+	path string
+
+	mu      sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+}
+
+func newMMDBClassifier(path string) (*mmdbClassifier, error) {
+	c := &mmdbClassifier{path: path}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the database if the file was modified since the last load.
+func (c *mmdbClassifier) load() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	unchanged := info.ModTime().Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	// the file is read into memory rather than mmapped, since the file can
+	// be overwritten in place by the updaters.
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return Error(c.path + ": " + err.Error())
+	}
+
+	c.mu.Lock()
+	c.reader = reader
+	c.modTime = info.ModTime()
+	c.mu.Unlock()
+	return nil
+}
+
+// watch reloads the database once the file changes until `done` is closed.
+func (c *mmdbClassifier) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(geoipReloadCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := c.load(); err != nil {
+				log.WithFields(logrus.Fields{
+					"op":   "reload_geoip",
+					"path": c.path,
+				}).Error(err)
+			}
+		}
+	}
+}
+
+func (c *mmdbClassifier) isChinaIP(ip net.IP) bool {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+
+	c.mu.RLock()
+	err := c.reader.Lookup(ip, &record)
+	c.mu.RUnlock()
+	return err == nil && record.Country.ISOCode == "CN"
+}
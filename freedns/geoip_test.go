@@ -0,0 +1,206 @@
+package freedns
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// buildTestMMDB builds a minimal IPv4 MaxMind DB which maps the CIDRs to the
+// countries.
+func buildTestMMDB(t *testing.T, countries map[string]string) []byte {
+	type node [2]int // -1: empty, >= 0: the child node, < -1: -2 - data index
+	nodes := []node{{-1, -1}}
+	var data [][]byte
+
+	str := func(s string) []byte {
+		return append([]byte{byte(2<<5 | len(s))}, s...)
+	}
+	for cidr, country := range countries {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		ip := ipnet.IP.To4()
+
+		// {"country": {"iso_code": country}}
+		record := []byte{7<<5 | 1}
+		record = append(record, str("country")...)
+		record = append(record, 7<<5|1)
+		record = append(record, str("iso_code")...)
+		record = append(record, str(country)...)
+		data = append(data, record)
+
+		n := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[n][bit] = -2 - (len(data) - 1)
+				break
+			}
+			if nodes[n][bit] < 0 {
+				nodes = append(nodes, node{-1, -1})
+				nodes[n][bit] = len(nodes) - 1
+			}
+			n = nodes[n][bit]
+		}
+	}
+
+	var dataSection []byte
+	var offsets []int
+	for _, d := range data {
+		offsets = append(offsets, len(dataSection))
+		dataSection = append(dataSection, d...)
+	}
+
+	var buf []byte
+	for _, n := range nodes {
+		for _, r := range n {
+			v := len(nodes) // empty
+			if r >= 0 {
+				v = r
+			} else if r < -1 {
+				v = len(nodes) + 16 + offsets[-2-r]
+			}
+			buf = append(buf, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, dataSection...)
+	buf = append(buf, "\xAB\xCD\xEFMaxMind.com"...)
+	buf = append(buf, 7<<5|3)
+	buf = append(buf, str("node_count")...)
+	buf = append(buf, 6<<5|4, byte(len(nodes)>>24), byte(len(nodes)>>16), byte(len(nodes)>>8), byte(len(nodes)))
+	buf = append(buf, str("record_size")...)
+	buf = append(buf, 5<<5|1, 24)
+	buf = append(buf, str("ip_version")...)
+	buf = append(buf, 5<<5|1, 4)
+	return buf
+}
+
+func TestMMDBClassifier(t *testing.T) {
+	path := writeTempFile(t, string(buildTestMMDB(t, map[string]string{
+		"114.114.0.0/16": "CN",
+		"8.8.8.0/24":     "US",
+	})))
+	defer os.Remove(path)
+
+	c, err := newMMDBClassifier(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		ip string
+		cn bool
+	}{
+		{"114.114.114.114", true},
+		{"8.8.8.8", false},
+		{"1.1.1.1", false},
+	}
+	for _, tt := range cases {
+		if c.isChinaIP(net.ParseIP(tt.ip)) != tt.cn {
+			t.Errorf("isChinaIP(%s) should be %v", tt.ip, tt.cn)
+		}
+	}
+
+	// reload after the file changes
+	if err := ioutil.WriteFile(path, buildTestMMDB(t, map[string]string{"8.8.8.0/24": "CN"}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.isChinaIP(net.ParseIP("8.8.8.8")) || c.isChinaIP(net.ParseIP("114.114.114.114")) {
+		t.Errorf("the database should be reloaded")
+	}
+
+	// a broken file keeps the loaded database
+	if err := ioutil.WriteFile(path, []byte("wtf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, future.Add(time.Hour), future.Add(time.Hour))
+	if err := c.load(); err == nil {
+		t.Errorf("loading a broken database should be an error")
+	}
+	if !c.isChinaIP(net.ParseIP("8.8.8.8")) {
+		t.Errorf("the loaded database should be kept")
+	}
+}
+
+func TestListClassifier(t *testing.T) {
+	list := "114.114.0.0/16\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(list))
+	}))
+	defer srv.Close()
+
+	c := newListClassifier(srv.URL)
+	if !c.isChinaIP(net.ParseIP("114.114.114.114")) || c.isChinaIP(net.ParseIP("220.181.57.216")) {
+		t.Errorf("the downloaded list should be used")
+	}
+
+	list = "220.181.0.0/16\n"
+	if err := c.update(); err != nil {
+		t.Fatal(err)
+	}
+	if c.isChinaIP(net.ParseIP("114.114.114.114")) || !c.isChinaIP(net.ParseIP("220.181.57.216")) {
+		t.Errorf("the list should be swapped after the update")
+	}
+
+	// a broken list keeps the current one
+	list = "wtf\n"
+	if err := c.update(); err == nil {
+		t.Errorf("updating with a broken list should be an error")
+	}
+	if !c.isChinaIP(net.ParseIP("220.181.57.216")) {
+		t.Errorf("the current list should be kept")
+	}
+
+	// the compiled-in list before the first successful download
+	srv.Close()
+	c = newListClassifier(srv.URL)
+	if !c.isChinaIP(net.ParseIP("114.114.114.114")) {
+		t.Errorf("the compiled-in list should be used")
+	}
+}
+
+func TestOverrideClassifier(t *testing.T) {
+	domestic := writeTempFile(t, "# corporate ranges\n203.0.113.0/24\n8.8.8.0/24\n")
+	defer os.Remove(domestic)
+	foreign := writeTempFile(t, "8.8.8.8/32\n114.114.114.0/24\n")
+	defer os.Remove(foreign)
+
+	c, err := newOverrideClassifier(builtinClassifier{}, []string{domestic}, []string{foreign})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		ip string
+		cn bool
+	}{
+		{"203.0.113.1", true},      // domestic
+		{"8.8.4.4", false},         // base
+		{"8.8.8.1", true},          // domestic
+		{"8.8.8.8", false},         // both, foreign wins
+		{"114.114.114.114", false}, // foreign
+		{"220.181.57.216", true},   // base
+	}
+	for _, tt := range cases {
+		if c.isChinaIP(net.ParseIP(tt.ip)) != tt.cn {
+			t.Errorf("isChinaIP(%s) should be %v", tt.ip, tt.cn)
+		}
+	}
+
+	if _, err := newOverrideClassifier(builtinClassifier{}, []string{"/nonexistent"}, nil); err == nil {
+		t.Errorf("missing files should be an error")
+	}
+}
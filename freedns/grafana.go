@@ -0,0 +1,114 @@
+package freedns
+
+// grafanaColumn is a column the Infinity datasource of Grafana reads from
+// the stats snapshot, by the JSON key.
+type grafanaColumn struct {
+	Selector string `json:"selector"`
+	Text     string `json:"text"`
+	Type     string `json:"type"` // timestamp, number or string
+}
+
+// grafanaPanel is a panel of the dashboard, graphing the columns of the rows
+// under `root` of the snapshot.
+type grafanaPanel struct {
+	title   string
+	kind    string // timeseries, table or piechart
+	root    string // buckets, upstreams or qtypes
+	columns []grafanaColumn
+	x, y    int
+	w, h    int
+}
+
+// grafanaPanels are the panels of the dashboard. They only read the keys of
+// statsSnapshot, which the tests check.
+var grafanaPanels = []grafanaPanel{
+	{
+		title: "Queries per minute",
+		kind:  "timeseries",
+		root:  "buckets",
+		columns: []grafanaColumn{
+			{"time", "Time", "timestamp"},
+			{"total", "Total", "number"},
+			{"cached", "Cached", "number"},
+			{"blocked", "Blocked", "number"},
+		},
+		w: 24, h: 8,
+	},
+	{
+		title: "Upstream queries per minute",
+		kind:  "timeseries",
+		root:  "buckets",
+		columns: []grafanaColumn{
+			{"time", "Time", "timestamp"},
+			{"upstream_queries", "Queries", "number"},
+			{"upstream_failures", "SERVFAIL", "number"},
+		},
+		y: 8, w: 12, h: 8,
+	},
+	{
+		title: "Upstreams",
+		kind:  "table",
+		root:  "upstreams",
+		columns: []grafanaColumn{
+			{"name", "Upstream", "string"},
+			{"queries", "Queries", "number"},
+			{"failures", "SERVFAIL", "number"},
+		},
+		x: 12, y: 8, w: 12, h: 8,
+	},
+	{
+		title: "Query types",
+		kind:  "piechart",
+		root:  "qtypes",
+		columns: []grafanaColumn{
+			{"name", "Type", "string"},
+			{"count", "Queries", "number"},
+		},
+		y: 16, w: 12, h: 8,
+	},
+}
+
+// grafanaDashboard generates the Grafana dashboard of the stats snapshot, to
+// be imported with the Infinity datasource pointed at the admin API.
+func grafanaDashboard() map[string]interface{} {
+	datasource := map[string]string{"type": "yesoreyeram-infinity-datasource", "uid": "${DS_FREEDNS}"}
+	var panels []map[string]interface{}
+	for i, p := range grafanaPanels {
+		format := "table"
+		if p.kind == "timeseries" {
+			format = "timeseries"
+		}
+		panels = append(panels, map[string]interface{}{
+			"id":         i + 1,
+			"type":       p.kind,
+			"title":      p.title,
+			"datasource": datasource,
+			"gridPos":    map[string]int{"x": p.x, "y": p.y, "w": p.w, "h": p.h},
+			"targets": []map[string]interface{}{{
+				"refId":         "A",
+				"datasource":    datasource,
+				"type":          "json",
+				"source":        "url",
+				"format":        format,
+				"url":           "/api/stats/snapshot?window=${__range_s}s",
+				"url_options":   map[string]string{"method": "GET"},
+				"root_selector": p.root,
+				"columns":       p.columns,
+			}},
+		})
+	}
+	return map[string]interface{}{
+		"__inputs": []map[string]string{{
+			"name":     "DS_FREEDNS",
+			"label":    "freedns-go admin API",
+			"type":     "datasource",
+			"pluginId": "yesoreyeram-infinity-datasource",
+		}},
+		"title":         "freedns-go",
+		"uid":           "freedns-go",
+		"schemaVersion": 39,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"panels":        panels,
+	}
+}
@@ -0,0 +1,75 @@
+package freedns
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// groupMember is an upstream of the groups, and the site it's at, empty for
+// the default upstream.
+type groupMember struct {
+	site    string
+	address string
+}
+
+// upstreamGroups are the upstreams at the sites sharing a config, which stand
+// in for the fast or the clean upstream. The ones at the local site are
+// preferred, then the default upstream and the other sites in the order
+// given. A member failed is tried after the others until protocolProbeInterval
+// later, so the queries spill over to the next site while it's down.
+type upstreamGroups struct {
+	members []groupMember
+
+	mu   sync.Mutex
+	down map[string]time.Time // member -> when it failed
+}
+
+// newUpstreamGroups parses the members in the form of `site=host:port`, e.g.
+// `sh=10.1.0.53`, several of which may be at the same site.
+func newUpstreamGroups(upstream string, members []string, site string) (*upstreamGroups, error) {
+	var local, others []groupMember
+	for _, m := range members {
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, Error("invalid upstream group member, expect site=host:port: " + m)
+		}
+		member := groupMember{site: parts[0], address: appendDefaultPort(parts[1])}
+		if parts[0] == site {
+			local = append(local, member)
+		} else {
+			others = append(others, member)
+		}
+	}
+	g := &upstreamGroups{down: map[string]time.Time{}}
+	g.members = append(local, groupMember{address: upstream})
+	g.members = append(g.members, others...)
+	return g, nil
+}
+
+// order returns the members to try, the ones failed recently last.
+func (g *upstreamGroups) order() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var up, down []string
+	for _, m := range g.members {
+		if t, ok := g.down[m.address]; ok && time.Since(t) < protocolProbeInterval {
+			down = append(down, m.address)
+		} else {
+			up = append(up, m.address)
+		}
+	}
+	return append(up, down...)
+}
+
+func (g *upstreamGroups) worked(address string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.down, address)
+}
+
+func (g *upstreamGroups) failed(address string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.down[address] = time.Now()
+}
@@ -0,0 +1,55 @@
+package freedns
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tuna/freedns-go/decisiontest"
+)
+
+func TestUpstreamGroups(t *testing.T) {
+	if _, err := newUpstreamGroups("1.1.1.1:53", []string{"10.0.0.1"}, "sh"); err == nil {
+		t.Error("expect an error without the site")
+	}
+	g, err := newUpstreamGroups("1.1.1.1:53", []string{"bj=10.2.0.53", "sh=10.1.0.53", "sh=10.1.0.54:5353"}, "sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.1.0.53:53", "10.1.0.54:5353", "1.1.1.1:53", "10.2.0.53:53"}
+	if got := g.order(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expect the local site first, got %v", got)
+	}
+	g.failed("10.1.0.53:53")
+	want = []string{"10.1.0.54:5353", "1.1.1.1:53", "10.2.0.53:53", "10.1.0.53:53"}
+	if got := g.order(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expect the failed member last, got %v", got)
+	}
+	g.down["10.1.0.53:53"] = time.Now().Add(-protocolProbeInterval)
+	if got := g.order(); got[0] != "10.1.0.53:53" {
+		t.Errorf("expect the failed member tried again, got %v", got)
+	}
+}
+
+func TestUpstreamGroupSpillover(t *testing.T) {
+	upstream, stop := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.Answer, IPs: []string{"114.114.114.114"}})
+	defer stop()
+	s := newTestServer(t, Config{
+		FastDNS:        upstream,
+		CleanDNS:       upstream,
+		Site:           "sh",
+		FastDNSGroups:  []string{"sh=127.0.0.1:1"}, // down
+		CleanDNSGroups: []string{"sh=127.0.0.1:1"},
+	})
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := newRecorder()
+	s.handle(w, req, "udp")
+	if w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 {
+		t.Errorf("expect the answer of the default upstream, got %v", w.msg)
+	}
+	if got := s.resolver.groups[upstream].order(); got[0] != upstream {
+		t.Errorf("expect the local site skipped, got %v", got)
+	}
+}
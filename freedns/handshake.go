@@ -0,0 +1,154 @@
+package freedns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tlsSessionCacheSize is how many TLS sessions to the upstreams are kept for
+// the resumption.
+const tlsSessionCacheSize = 64
+
+// tlsSessions is shared by the connections to the DNS over TLS upstreams, so
+// a new connection resumes the session of the last one instead of a full
+// handshake.
+var tlsSessions = tls.NewLRUClientSessionCache(tlsSessionCacheSize)
+
+// tlsRootCAs verifies the certificates of the upstreams, the system roots if
+// nil.
+var tlsRootCAs *x509.CertPool
+
+// tlsHandshakes counts the handshakes with the DNS over TLS upstreams of the
+// process.
+var tlsHandshakes = &handshakeStats{upstreams: map[string]*handshakeStat{}}
+
+// handshakeStat is the TLS handshakes with an upstream. A path interfered by
+// a middlebox shows up as the failures, or as full handshakes where the
+// sessions should have been resumed.
+type handshakeStat struct {
+	Upstream        string  `json:"upstream"`
+	Full            int     `json:"full"`
+	Resumed         int     `json:"resumed"`
+	Failed          int     `json:"failed"`
+	ResumptionRatio float64 `json:"resumption_ratio"` // of the successful ones
+	Latency         float64 `json:"latency_ms"`       // the average of the successful ones
+	LastError       string  `json:"last_error,omitempty"`
+
+	total time.Duration
+}
+
+type handshakeStats struct {
+	mu        sync.Mutex
+	upstreams map[string]*handshakeStat
+}
+
+func (h *handshakeStats) record(upstream string, resumed bool, err error, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.upstreams[upstream]
+	if !ok {
+		s = &handshakeStat{Upstream: upstream}
+		h.upstreams[upstream] = s
+	}
+	switch {
+	case err != nil:
+		s.Failed++
+		s.LastError = err.Error()
+		return
+	case resumed:
+		s.Resumed++
+	default:
+		s.Full++
+	}
+	s.total += latency
+}
+
+// report returns the handshakes of the upstreams, sorted by the upstreams.
+func (h *handshakeStats) report() []handshakeStat {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := make([]handshakeStat, 0, len(h.upstreams))
+	for _, s := range h.upstreams {
+		copied := *s
+		if n := s.Full + s.Resumed; n > 0 {
+			copied.ResumptionRatio = float64(s.Resumed) / float64(n)
+			copied.Latency = milliseconds(s.total / time.Duration(n))
+		}
+		stats = append(stats, copied)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Upstream < stats[j].Upstream })
+	return stats
+}
+
+// dialTLS connects to the DNS over TLS upstream, resuming the last session
+// with it if possible, and records the handshake. The certificate is verified
+// against the host name of the upstream, while the name is resolved by the
+// dialer of `client`, or by its proxy if it's connected through one.
+func dialTLS(upstream string, timeout time.Duration, client *upstreamClient) (*dns.Conn, error) {
+	dialer := client.dialer
+	deadline := time.Now().Add(timeout)
+	var raw net.Conn
+	var err error
+	if dialer != nil && dialer.proxy != nil {
+		raw, err = dialProxy(dialer.proxy, upstream, timeout)
+	} else {
+		var address string
+		if address, err = dialer.resolve(upstream, timeout); err == nil {
+			raw, err = net.DialTimeout("tcp", address, time.Until(deadline))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(upstream)
+	conn := tls.Client(raw, &tls.Config{
+		ServerName:         host,
+		ClientSessionCache: tlsSessions,
+		RootCAs:            tlsRootCAs,
+	})
+	conn.SetDeadline(deadline)
+	start := time.Now()
+	err = conn.Handshake()
+	latency := time.Since(start)
+	resumed := err == nil && conn.ConnectionState().DidResume
+	tlsHandshakes.record(upstream, resumed, err, latency)
+	if client.metrics != nil {
+		observeHandshake(client.metrics, upstream, resumed, err, latency)
+	}
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// observeHandshake sends the metrics of a TLS handshake with the upstream.
+func observeHandshake(m MetricsSink, upstream string, resumed bool, err error, latency time.Duration) {
+	result := "full"
+	if err != nil {
+		result = "error"
+	} else if resumed {
+		result = "resumed"
+	}
+	m.AddCounter("freedns_upstream_tls_handshakes_total", map[string]string{
+		"upstream": upstream,
+		"result":   result,
+	}, 1)
+	if err == nil {
+		m.Observe("freedns_upstream_tls_handshake_duration_seconds", map[string]string{
+			"upstream": upstream,
+		}, latency.Seconds())
+	}
+}
+
+// serveHandshakes writes the TLS handshakes with the upstreams.
+func serveHandshakes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, tlsHandshakes.report())
+}
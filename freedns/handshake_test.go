@@ -0,0 +1,117 @@
+package freedns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tlsUpstream starts a DNS over TLS upstream answering 93.184.216.34, with a
+// self-signed certificate of 127.0.0.1 trusted by the pool returned.
+func tlsUpstream(t *testing.T) (string, *x509.CertPool, func()) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "freedns-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(93, 184, 216, 34),
+		})
+		w.WriteMsg(res)
+	})}
+	go server.ActivateAndServe()
+	return l.Addr().String(), pool, func() { server.Shutdown() }
+}
+
+func TestTLSHandshakes(t *testing.T) {
+	upstream, pool, stop := tlsUpstream(t)
+	defer stop()
+	orig := tlsRootCAs
+	defer func() { tlsRootCAs = orig }()
+
+	sink := newRecordingSink()
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	resolve := func() error {
+		_, err := naiveResolve(context.Background(), q, true, "tcp-tls", upstream, &upstreamClient{metrics: sink})
+		return err
+	}
+	stat := func() handshakeStat {
+		for _, s := range tlsHandshakes.report() {
+			if s.Upstream == upstream {
+				return s
+			}
+		}
+		return handshakeStat{}
+	}
+
+	// the self-signed certificate isn't trusted
+	if err := resolve(); err == nil {
+		t.Fatal("expect the handshake to fail without the test root")
+	}
+	if s := stat(); s.Failed != 1 || s.LastError == "" {
+		t.Errorf("expect a failed handshake, got %+v", s)
+	}
+
+	tlsRootCAs = pool
+	for i := 0; i < 3; i++ {
+		if err := resolve(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := stat()
+	if s.Full != 1 || s.Resumed != 2 {
+		t.Errorf("expect a full handshake and then the resumed ones, got %+v", s)
+	}
+	if s.ResumptionRatio < 0.6 || s.ResumptionRatio > 0.7 || s.Latency <= 0 {
+		t.Errorf("unexpected resumption ratio or latency, got %+v", s)
+	}
+	for result, n := range map[string]float64{"full": 1, "resumed": 2, "error": 1} {
+		if got := sink.counters["freedns_upstream_tls_handshakes_total result="+result]; got != n {
+			t.Errorf("expect %v %s handshakes in the metrics, got %v", n, result, got)
+		}
+	}
+	if got := sink.samples["freedns_upstream_tls_handshake_duration_seconds"]; got != 3 {
+		t.Errorf("expect the latencies of the successful handshakes, got %d", got)
+	}
+}
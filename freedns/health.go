@@ -0,0 +1,114 @@
+package freedns
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// readyProbeInterval is how long a probe of the upstreams for /readyz is
+// reused, so the frequent probes of an orchestrator don't flood them.
+const readyProbeInterval = 10 * time.Second
+
+// readyProbeTimeout is the timeout of a probe of an upstream.
+const readyProbeTimeout = 2 * time.Second
+
+// readiness probes the upstreams for /readyz.
+type readiness struct {
+	mu        sync.Mutex
+	checked   time.Time
+	upstreams map[string]string // ok, or the error
+}
+
+// readyStatus is the body of /readyz.
+type readyStatus struct {
+	Ready     bool              `json:"ready"`
+	Listening bool              `json:"listening"` // the DNS listeners are bound
+	Stopping  bool              `json:"stopping,omitempty"`
+	Upstreams map[string]string `json:"upstreams"` // ok, or the error of the probe
+}
+
+// probeUpstreams returns the reachability of the upstreams the queries go to,
+// probed by a query of the root NS records at most every
+// readyProbeInterval. Any response counts, even an error, as the upstream is
+// reachable.
+func (s *Server) probeUpstreams() map[string]string {
+	r := &s.readiness
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.upstreams != nil && time.Since(r.checked) < readyProbeInterval {
+		return r.upstreams
+	}
+
+	upstreams := []string{s.resolver.fastUpstream, s.resolver.cleanUpstream}
+	if s.replica != nil {
+		upstreams = nil
+		if s.config.ReplicaDNS != "" {
+			upstreams = []string{s.config.ReplicaDNS}
+		}
+	}
+	results := map[string]string{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	q := dns.Question{Name: ".", Qtype: dns.TypeNS, Qclass: dns.ClassINET}
+	for _, upstream := range upstreams {
+		wg.Add(1)
+		go func(upstream string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), readyProbeTimeout)
+			defer cancel()
+			result := "ok"
+			if _, err := s.resolver.query(ctx, q, true, "udp", upstream); err != nil {
+				result = err.Error()
+			}
+			mu.Lock()
+			results[upstream] = result
+			mu.Unlock()
+		}(upstream)
+	}
+	wg.Wait()
+	r.upstreams, r.checked = results, time.Now()
+	return results
+}
+
+// ready returns if the server is ready to answer: its DNS listeners are
+// bound, it's not shutting down, and an upstream is reachable, or it's a
+// replica without ReplicaDNS.
+func (s *Server) ready() readyStatus {
+	status := readyStatus{
+		Listening: atomic.LoadInt32(&s.listeners) > 0 && atomic.LoadInt32(&s.bound) == atomic.LoadInt32(&s.listeners),
+		Upstreams: s.probeUpstreams(),
+	}
+	select {
+	case <-s.stopping:
+		status.Stopping = true
+	default:
+	}
+	reachable := len(status.Upstreams) == 0
+	for _, result := range status.Upstreams {
+		if result == "ok" {
+			reachable = true
+		}
+	}
+	status.Ready = status.Listening && !status.Stopping && reachable
+	return status
+}
+
+// serveHealthz answers as long as the process is alive.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// serveReadyz answers 200 if the server is ready, or 503.
+func (s *Server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	status := s.ready()
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
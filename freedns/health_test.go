@@ -0,0 +1,84 @@
+package freedns
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tuna/freedns-go/decisiontest"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	upstream, stop := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.Answer, IPs: []string{"114.114.114.114"}})
+	defer stop()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{
+		FastDNS:     upstream,
+		PacketConn:  pc,
+		AdminListen: "127.0.0.1:0",
+		AdminUsers:  map[string]string{"alice": "secret"},
+	})
+	api := httptest.NewServer(s.adminServer.Handler)
+	defer api.Close()
+
+	readyz := func() (int, readyStatus) {
+		res, err := http.Get(api.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var status readyStatus
+		if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, status
+	}
+
+	res, err := http.Get(api.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expect /healthz without auth, got %s", res.Status)
+	}
+	if code, status := readyz(); code != http.StatusServiceUnavailable || status.Listening {
+		t.Errorf("expect not ready before listening, got %d %+v", code, status)
+	}
+
+	go s.Run()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, status := readyz()
+		if code == http.StatusOK {
+			if status.Upstreams[upstream] != "ok" || status.Upstreams["127.0.0.1:1"] == "ok" {
+				t.Errorf("expect the fast upstream reachable only, got %+v", status.Upstreams)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect ready after listening, got %+v", status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	s.Shutdown()
+	if code, status := readyz(); code != http.StatusServiceUnavailable || !status.Stopping {
+		t.Errorf("expect not ready on shutdown, got %d %+v", code, status)
+	}
+}
+
+func TestReadinessWithoutUpstreams(t *testing.T) {
+	s := newTestServer(t, Config{})
+	defer s.Shutdown()
+	s.listeners, s.bound = 2, 2
+	if status := s.ready(); status.Ready || len(status.Upstreams) != 1 {
+		t.Errorf("expect not ready without a reachable upstream, got %+v", status)
+	}
+}
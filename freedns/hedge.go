@@ -0,0 +1,98 @@
+package freedns
+
+import (
+	"sync"
+	"time"
+)
+
+// hedgeMaxTokens caps the tokens saved up while no hedge is needed, i.e. the
+// burst of hedges.
+const hedgeMaxTokens = 10
+
+// hedgeSlowLatency is the latency of the clean upstream beyond which it's
+// considered overloaded, and the hedges cost more the slower it gets.
+const hedgeSlowLatency = 500 * time.Millisecond
+
+// hedgeLatencyWeight is the weight of a new sample in the latency EWMA.
+const hedgeLatencyWeight = 0.1
+
+// hedgeBudget caps the hedged queries, which are the queries to the clean
+// upstream racing the fast one for the domains known to be in China, to a
+// percentage of the queries. Each query earns `ratio` tokens and each hedge
+// costs one, or more when the clean upstream is slow, so the hedges back off
+// instead of adding to the load of an overloaded upstream.
+type hedgeBudget struct {
+	ratio float64
+
+	mu      sync.Mutex
+	tokens  float64
+	latency time.Duration // the EWMA of the clean upstream
+	sent    uint64
+	skipped uint64
+}
+
+func newHedgeBudget(percent float64) *hedgeBudget {
+	return &hedgeBudget{
+		ratio:  percent / 100,
+		tokens: hedgeMaxTokens,
+	}
+}
+
+// earn is called on every query.
+func (h *hedgeBudget) earn() {
+	h.mu.Lock()
+	h.tokens += h.ratio
+	if h.tokens > hedgeMaxTokens {
+		h.tokens = hedgeMaxTokens
+	}
+	h.mu.Unlock()
+}
+
+// allow returns if a hedge can be sent, and spends its cost if so.
+func (h *hedgeBudget) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cost := 1.0
+	if h.latency > hedgeSlowLatency {
+		cost = float64(h.latency) / float64(hedgeSlowLatency)
+	}
+	if h.tokens < cost {
+		h.skipped++
+		return false
+	}
+	h.tokens -= cost
+	h.sent++
+	return true
+}
+
+// observe records a latency of the clean upstream.
+func (h *hedgeBudget) observe(d time.Duration) {
+	h.mu.Lock()
+	if h.latency == 0 {
+		h.latency = d
+	} else {
+		h.latency += time.Duration(hedgeLatencyWeight * float64(d-h.latency))
+	}
+	h.mu.Unlock()
+}
+
+// hedgeStatus is the state of the hedge budget in the admin API.
+type hedgeStatus struct {
+	BudgetPercent  float64 `json:"budget_percent"`
+	Tokens         float64 `json:"tokens"`
+	CleanLatencyMS float64 `json:"clean_latency_ms"`
+	Sent           uint64  `json:"sent"`
+	Skipped        uint64  `json:"skipped"`
+}
+
+func (h *hedgeBudget) status() hedgeStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return hedgeStatus{
+		BudgetPercent:  h.ratio * 100,
+		Tokens:         h.tokens,
+		CleanLatencyMS: milliseconds(h.latency),
+		Sent:           h.sent,
+		Skipped:        h.skipped,
+	}
+}
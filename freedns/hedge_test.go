@@ -0,0 +1,125 @@
+package freedns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHedgeBudget(t *testing.T) {
+	h := newHedgeBudget(10)
+
+	// the burst first
+	for i := 0; i < hedgeMaxTokens; i++ {
+		h.earn()
+		if !h.allow() {
+			t.Fatalf("hedge %d should be in the burst", i)
+		}
+	}
+	// then one in 10 queries
+	sent := 0
+	for i := 0; i < 100; i++ {
+		h.earn()
+		if h.allow() {
+			sent++
+		}
+	}
+	if sent < 9 || sent > 11 {
+		t.Errorf("expect about 10 hedges in 100 queries, got %d", sent)
+	}
+
+	// a slow upstream costs more
+	for i := 0; i < 50; i++ {
+		h.observe(2 * time.Second)
+	}
+	sent = 0
+	for i := 0; i < 100; i++ {
+		h.earn()
+		if h.allow() {
+			sent++
+		}
+	}
+	if sent >= 9 {
+		t.Errorf("the hedges should back off when the upstream is slow, got %d", sent)
+	}
+
+	st := h.status()
+	if st.BudgetPercent != 10 || st.Sent+st.Skipped != hedgeMaxTokens+200 {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
+
+// countingUpstream starts a fake upstream answering A queries with `ip`, and
+// returns its address and the count of the queries.
+func countingUpstream(t *testing.T, ip string) (string, *int32, func()) {
+	var queries int32
+	addr, stop := fakeUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		res := &dns.Msg{}
+		res.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + ip)
+		res.Answer = append(res.Answer, rr)
+		w.WriteMsg(res)
+	})
+	return addr, &queries, stop
+}
+
+func TestResolveHedgeBudget(t *testing.T) {
+	fast, fastQueries, stopFast := countingUpstream(t, "114.114.114.114")
+	defer stopFast()
+	clean, cleanQueries, stopClean := countingUpstream(t, "8.8.8.8")
+	defer stopClean()
+
+	resolver := newSpoofingProofResolver(fast, clean, 16, builtinClassifier{})
+	resolver.hedge = newHedgeBudget(10)
+	resolver.hedge.tokens = 0
+
+	q := dns.Question{Name: "cn.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	resolver.setLocation(q.Name, true)
+	if _, upstream := resolver.resolve(q, true, "udp"); upstream != fast {
+		t.Errorf("expect the answer of the fast upstream, got %s", upstream)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(cleanQueries); n != 0 {
+		t.Errorf("the clean upstream should not be hedged out of the budget, got %d queries", n)
+	}
+
+	q.Name = "foreign.example."
+	resolver.setLocation(q.Name, false)
+	if _, upstream := resolver.resolve(q, true, "udp"); upstream != clean {
+		t.Errorf("expect the answer of the clean upstream, got %s", upstream)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(fastQueries); n != 1 {
+		t.Errorf("the fast upstream should not be queried for the foreign domains, got %d queries", n)
+	}
+}
+
+func TestResolveHedgeLateClean(t *testing.T) {
+	// the fast upstream never answers
+	hanging, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hanging.Close()
+	clean, cleanQueries, stopClean := countingUpstream(t, "8.8.8.8")
+	defer stopClean()
+
+	resolver := newSpoofingProofResolver(hanging.LocalAddr().String(), clean, 16, builtinClassifier{})
+	resolver.timeout = 300 * time.Millisecond
+	resolver.hedge = newHedgeBudget(10)
+	resolver.hedge.tokens = 0
+
+	q := dns.Question{Name: "cn.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	resolver.setLocation(q.Name, true)
+	res, upstream := resolver.resolve(q, true, "udp")
+	if upstream != clean || res.Rcode != dns.RcodeSuccess {
+		t.Errorf("expect the answer of the clean upstream queried late, got %s from %s", dns.RcodeToString[res.Rcode], upstream)
+	}
+	if n := atomic.LoadInt32(cleanQueries); n != 1 {
+		t.Errorf("expect the clean upstream queried once, got %d queries", n)
+	}
+}
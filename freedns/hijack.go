@@ -0,0 +1,143 @@
+package freedns
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// hijackProbes is the nonexistent names each upstream is asked in a round of
+// the probes, as some upstreams rotate the IPs they forge.
+const hijackProbes = 3
+
+// hijackForgedCap caps the forged IPs remembered of an upstream.
+const hijackForgedCap = 64
+
+// hijackDetector detects the upstreams answering the nonexistent names with
+// the IPs of their ad servers instead of NXDOMAIN, as many ISP resolvers do,
+// by asking them random names periodically. The answers of such an upstream
+// pointing to the IPs it forged only are turned back into NXDOMAIN, so they
+// are neither trusted as China IPs nor cached.
+type hijackDetector struct {
+	interval time.Duration
+
+	mu     sync.RWMutex
+	forged map[string]map[string]bool // upstream -> IPs
+}
+
+func newHijackDetector(interval time.Duration) *hijackDetector {
+	return &hijackDetector{
+		interval: interval,
+		forged:   map[string]map[string]bool{},
+	}
+}
+
+// hijackProbeName returns a random name which doesn't exist.
+func hijackProbeName() string {
+	var b [8]byte
+	if _, err := io.ReadFull(randomSource, b[:]); err != nil {
+		panic("freedns: reading the random source: " + err.Error())
+	}
+	return "freedns-probe-" + hex.EncodeToString(b[:]) + ".com."
+}
+
+func (h *hijackDetector) run(resolver *spoofingProofResolver, done <-chan struct{}) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.probe(resolver, resolver.fastUpstream)
+		h.probe(resolver, resolver.cleanUpstream)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe asks the upstream the random names, and remembers the IPs of the
+// answers.
+func (h *hijackDetector) probe(resolver *spoofingProofResolver, upstream string) {
+	for i := 0; i < hijackProbes; i++ {
+		q := dns.Question{Name: hijackProbeName(), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		ctx, cancel := context.WithTimeout(context.Background(), resolver.queryTimeout())
+		res, err := resolver.query(ctx, q, true, "udp", upstream)
+		cancel()
+		if err != nil || res.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		for _, ip := range answerIPs(res) {
+			if h.remember(upstream, ip) {
+				log.WithFields(logrus.Fields{
+					"op":       "hijack",
+					"upstream": upstream,
+					"ip":       ip,
+				}).Warn("upstream answers the nonexistent names with a forged IP")
+			}
+		}
+	}
+}
+
+// remember adds the forged IP of the upstream, and returns if it's new.
+func (h *hijackDetector) remember(upstream string, ip string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ips := h.forged[upstream]
+	if ips == nil {
+		ips = map[string]bool{}
+		h.forged[upstream] = ips
+	}
+	if ips[ip] || len(ips) >= hijackForgedCap {
+		return false
+	}
+	ips[ip] = true
+	return true
+}
+
+// forges returns if all the IPs of the answer are the ones the upstream
+// forged.
+func (h *hijackDetector) forges(upstream string, res *dns.Msg) bool {
+	if res.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	ips := answerIPs(res)
+	if len(ips) == 0 {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	forged := h.forged[upstream]
+	for _, ip := range ips {
+		if !forged[ip] {
+			return false
+		}
+	}
+	return true
+}
+
+// answerIPs returns the IPs of the A and AAAA records of the answer.
+func answerIPs(res *dns.Msg) []string {
+	var ips []string
+	for _, rr := range res.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A.String())
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA.String())
+		}
+	}
+	return ips
+}
+
+// unforged returns the NXDOMAIN the forged answer replaced.
+func unforged(res *dns.Msg) *dns.Msg {
+	m := res.Copy()
+	m.Rcode = dns.RcodeNameError
+	m.Answer = nil
+	return m
+}
@@ -0,0 +1,60 @@
+package freedns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// hijackingUpstream answers www.example.com, and the other names with the
+// `forged` IP if not empty, or NXDOMAIN.
+func hijackingUpstream(t *testing.T, forged string) (string, func()) {
+	return fakeUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		name := req.Question[0].Name
+		switch {
+		case name == "www.example.com.":
+			rr, _ := dns.NewRR(name + " 60 IN A 114.114.114.114")
+			res.Answer = append(res.Answer, rr)
+		case forged != "":
+			rr, _ := dns.NewRR(name + " 60 IN A " + forged)
+			res.Answer = append(res.Answer, rr)
+		default:
+			res.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(res)
+	})
+}
+
+func TestHijackDetection(t *testing.T) {
+	// the forged IP is in China, so it would be trusted otherwise
+	fast, stopFast := hijackingUpstream(t, "114.114.115.115")
+	defer stopFast()
+	clean, stopClean := hijackingUpstream(t, "")
+	defer stopClean()
+
+	s := newTestServer(t, Config{FastDNS: fast, CleanDNS: clean, HijackProbeInterval: Duration(time.Hour)})
+	s.resolver.hijack.probe(s.resolver, s.resolver.fastUpstream)
+	s.resolver.hijack.probe(s.resolver, s.resolver.cleanUpstream)
+
+	for _, c := range []struct {
+		name  string
+		rcode int
+	}{
+		{"nonexistent.example.com.", dns.RcodeNameError},
+		{"www.example.com.", dns.RcodeSuccess},
+	} {
+		req := &dns.Msg{}
+		req.SetQuestion(c.name, dns.TypeA)
+		w := newRecorder()
+		s.handle(w, req, "udp")
+		if w.msg.Rcode != c.rcode {
+			t.Errorf("%s: expect the rcode %d, got %v", c.name, c.rcode, w.msg)
+		}
+	}
+	if len(s.resolver.hijack.forged[s.resolver.cleanUpstream]) != 0 {
+		t.Error("expect no forged IPs of the clean upstream")
+	}
+}
@@ -0,0 +1,193 @@
+package freedns
+
+import (
+	"strings"
+	"unicode"
+)
+
+// The actions on the queries of homographs of the protected domains.
+const (
+	HomographLog   = "log"   // log a warning only
+	HomographBlock = "block" // log a warning and answer NXDOMAIN
+)
+
+// confusables maps the characters commonly abused in IDN homograph attacks to
+// the ASCII letters they look like. It's a small subset of the Unicode
+// confusables (UTS #39) covering the Cyrillic, Greek and fullwidth lookalikes
+// of the Latin letters, plus the digits mistaken for letters.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'ё': 'e', 'һ': 'h',
+	'і': 'i', 'ї': 'i', 'ј': 'j', 'к': 'k', 'ӏ': 'l', 'м': 'm', 'н': 'h',
+	'о': 'o', 'р': 'p', 'ԛ': 'q', 'ѕ': 's', 'т': 't', 'ц': 'u', 'ѵ': 'v',
+	'ԝ': 'w', 'х': 'x', 'у': 'y', 'з': '3',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v',
+	'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'γ': 'y',
+	// Latin
+	'ɑ': 'a', 'ɡ': 'g', 'ı': 'i', 'ɩ': 'i', 'ł': 'l', 'ɵ': 'o', 'ø': 'o',
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a', 'ç': 'c',
+	'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e', 'ì': 'i', 'í': 'i', 'î': 'i',
+	'ï': 'i', 'ñ': 'n', 'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o',
+	'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u', 'ý': 'y', 'ÿ': 'y',
+	// digits
+	'0': 'o', '1': 'l',
+}
+
+// skeleton maps the confusable characters of the name to what they look like,
+// so that two names look alike if their skeletons are equal.
+func skeleton(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		// fullwidth forms, e.g. Ｍ
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r = unicode.ToLower(r - 0xFF01 + '!')
+		}
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// homographGuard detects the queries of the names confusable with the
+// protected domains, e.g. `xn--pple-43d.com` (аpple.com with a Cyrillic а)
+// for apple.com.
+type homographGuard struct {
+	protected map[string]string // skeleton -> protected domain
+	labels    map[int]bool      // the label counts of the protected domains
+	action    string
+}
+
+func newHomographGuard(domains []string, action string) (*homographGuard, error) {
+	if action == "" {
+		action = HomographLog
+	}
+	if action != HomographLog && action != HomographBlock {
+		return nil, Error("unknown homograph action: " + action)
+	}
+	g := &homographGuard{
+		protected: map[string]string{},
+		labels:    map[int]bool{},
+		action:    action,
+	}
+	for _, d := range domains {
+		d = normalizeDomain(d)
+		g.protected[skeleton(d)] = d
+		g.labels[strings.Count(d, ".")+1] = true
+	}
+	return g, nil
+}
+
+// check returns the protected domain the name (or one of its parent domains)
+// is a homograph of, or "" if it's not a homograph.
+func (g *homographGuard) check(name string) string {
+	labels := strings.Split(normalizeDomain(name), ".")
+	for i, l := range labels {
+		if strings.HasPrefix(l, "xn--") {
+			if u, err := decodePunycode(l[4:]); err == nil {
+				labels[i] = u
+			}
+		}
+	}
+	for n := range g.labels {
+		if n > len(labels) {
+			continue
+		}
+		d := strings.Join(labels[len(labels)-n:], ".")
+		if p, ok := g.protected[skeleton(d)]; ok && d != p {
+			return p
+		}
+	}
+	return ""
+}
+
+// The parameters of Punycode (RFC 3492).
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// decodePunycode decodes the Punycode label, without the `xn--` prefix.
+func decodePunycode(s string) (string, error) {
+	var output []rune
+	if i := strings.LastIndexByte(s, '-'); i >= 0 {
+		for _, c := range s[:i] {
+			if c >= 0x80 {
+				return "", Error("invalid punycode: " + s)
+			}
+			output = append(output, c)
+		}
+		s = s[i+1:]
+	}
+
+	n, bias, i := punyInitialN, punyInitialBias, 0
+	for pos := 0; pos < len(s); {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(s) {
+				return "", Error("invalid punycode: " + s)
+			}
+			digit := punyDigit(s[pos])
+			pos++
+			if digit < 0 || digit > (1<<30-i)/w {
+				return "", Error("invalid punycode: " + s)
+			}
+			i += digit * w
+			t := k - bias
+			if t < punyTMin {
+				t = punyTMin
+			} else if t > punyTMax {
+				t = punyTMax
+			}
+			if digit < t {
+				break
+			}
+			w *= punyBase - t
+		}
+		bias = punyAdapt(i-oldi, len(output)+1, oldi == 0)
+		n += i / (len(output) + 1)
+		i %= len(output) + 1
+		if n > unicode.MaxRune {
+			return "", Error("invalid punycode: " + s)
+		}
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+	return string(output), nil
+}
+
+func punyDigit(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a')
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A')
+	}
+	return -1
+}
+
+func punyAdapt(delta int, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > (punyBase-punyTMin)*punyTMax/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
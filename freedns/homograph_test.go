@@ -0,0 +1,72 @@
+package freedns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDecodePunycode(t *testing.T) {
+	cases := map[string]string{
+		"pple-43d":                 "аpple",
+		"bcher-kva":                "bücher",
+		"l-7sba6dbr":               "раураl",
+		"ihqwcrb4cv8a8dqg056pqjye": "他们为什么不说中文",
+	}
+	for in, out := range cases {
+		if got, err := decodePunycode(in); err != nil || got != out {
+			t.Errorf("decodePunycode(%s) should be %s, got %s, %v", in, out, got, err)
+		}
+	}
+	for _, bad := range []string{"pple-4", "abé-kva", "pple-!!"} {
+		if _, err := decodePunycode(bad); err == nil {
+			t.Errorf("%q should be invalid", bad)
+		}
+	}
+}
+
+func TestHomographGuard(t *testing.T) {
+	g, err := newHomographGuard([]string{"apple.com", "PayPal.com", "icbc.com.cn"}, HomographLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name      string
+		protected string
+	}{
+		{"xn--pple-43d.com.", "apple.com"},     // Cyrillic а
+		{"www.xn--pple-43d.com.", "apple.com"}, // subdomains
+		{"xn--l-7sbq6ba.com.", "apple.com"},    // Cyrillic а, р and е
+		{"paypa1.com.", "paypal.com"},
+		{"xn--l-7sba6dbr.com.", "paypal.com"},
+		{"xn--cbc-ihd.com.cn.", "icbc.com.cn"}, // Ukrainian і
+		{"apple.com.", ""},
+		{"www.APPLE.com.", ""},
+		{"apple.net.", ""},
+		{"banana.com.", ""},
+		{"com.", ""},
+	}
+	for _, c := range cases {
+		if got := g.check(c.name); got != c.protected {
+			t.Errorf("check(%s) should be %q, got %q", c.name, c.protected, got)
+		}
+	}
+
+	if _, err := newHomographGuard(nil, "wtf"); err == nil {
+		t.Errorf("unknown actions should be errors")
+	}
+}
+
+func TestHomographBlock(t *testing.T) {
+	s := newTestServer(t, Config{
+		ProtectedDomains: []string{"apple.com"},
+		HomographAction:  HomographBlock,
+	})
+	req := &dns.Msg{}
+	req.SetQuestion("xn--pple-43d.com.", dns.TypeA)
+	w := newRecorder()
+	s.handle(w, req, "udp")
+	if w.msg == nil || w.msg.Rcode != dns.RcodeNameError {
+		t.Errorf("the homograph should be blocked, got %v", w.msg)
+	}
+}
@@ -0,0 +1,86 @@
+package freedns
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logSampleSummaryInterval is how often the Info logs skipped are summed up.
+const logSampleSummaryInterval = 10 * time.Second
+
+// logSampler keeps 1 in `rate` of the Info logs of the queries while the
+// queries per second are over `threshold`, since at high traffic writing the
+// log becomes the bottleneck. The warnings and the errors are always logged.
+// A nil logSampler keeps every log.
+type logSampler struct {
+	threshold int64
+	rate      int64
+
+	second  int64 // atomic, the Unix second being counted
+	current int64 // atomic, the queries in `second`
+	last    int64 // atomic, the queries in the second before
+
+	seen    int64 // atomic, the Info logs while sampling
+	skipped int64 // atomic, since the last summary
+}
+
+// newLogSampler creates the sampler over `threshold` queries per second,
+// keeping 1 in `rate` logs, 100 if it's 0.
+func newLogSampler(threshold int, rate int) *logSampler {
+	if rate <= 0 {
+		rate = 100
+	}
+	return &logSampler{threshold: int64(threshold), rate: int64(rate)}
+}
+
+// count counts a query.
+func (l *logSampler) count() {
+	if l == nil {
+		return
+	}
+	now := time.Now().Unix()
+	if second := atomic.LoadInt64(&l.second); second != now && atomic.CompareAndSwapInt64(&l.second, second, now) {
+		n := atomic.SwapInt64(&l.current, 0)
+		if second != now-1 {
+			n = 0 // no queries in the second before
+		}
+		atomic.StoreInt64(&l.last, n)
+	}
+	atomic.AddInt64(&l.current, 1)
+}
+
+// keep returns if an Info log of a query is written.
+func (l *logSampler) keep() bool {
+	if l == nil || atomic.LoadInt64(&l.last) <= l.threshold {
+		return true
+	}
+	if atomic.AddInt64(&l.seen, 1)%l.rate == 0 {
+		return true
+	}
+	atomic.AddInt64(&l.skipped, 1)
+	return false
+}
+
+// run logs how many logs were skipped every logSampleSummaryInterval while
+// sampling, until `done` is closed.
+func (l *logSampler) run(done <-chan struct{}) {
+	ticker := time.NewTicker(logSampleSummaryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if skipped := atomic.SwapInt64(&l.skipped, 0); skipped > 0 {
+				log.WithFields(logrus.Fields{
+					"op":      "log_sampling",
+					"skipped": skipped,
+					"qps":     atomic.LoadInt64(&l.last),
+					"rate":    l.rate,
+				}).Info("sampled the query logs under load")
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package freedns
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLogSampler(t *testing.T) {
+	var none *logSampler
+	none.count()
+	if !none.keep() {
+		t.Error("expect every log kept without sampling")
+	}
+
+	l := newLogSampler(10, 4)
+	for i := 0; i < 20; i++ {
+		if !l.keep() {
+			t.Fatal("expect every log kept under the threshold")
+		}
+	}
+	// the queries of the second before are over the threshold
+	atomic.StoreInt64(&l.second, time.Now().Unix()-1)
+	atomic.StoreInt64(&l.current, 20)
+	l.count()
+	if n := atomic.LoadInt64(&l.last); n != 20 {
+		t.Fatalf("expect 20 queries in the last second, got %d", n)
+	}
+	kept := 0
+	for i := 0; i < 20; i++ {
+		if l.keep() {
+			kept++
+		}
+	}
+	if kept != 5 || atomic.LoadInt64(&l.skipped) != 15 {
+		t.Errorf("expect 1 in 4 logs kept, got %d kept and %d skipped", kept, l.skipped)
+	}
+
+	// a quiet second resets it
+	atomic.StoreInt64(&l.second, time.Now().Unix()-5)
+	l.count()
+	if !l.keep() || atomic.LoadInt64(&l.last) != 0 {
+		t.Error("expect every log kept after a quiet second")
+	}
+}
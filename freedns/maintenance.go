@@ -0,0 +1,97 @@
+package freedns
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockRange is a range of the time of day, which crosses midnight if start
+// is after end.
+type clockRange struct {
+	start time.Duration // since midnight
+	end   time.Duration
+}
+
+// maintenanceWindows are the daily windows of local time the heavy background
+// jobs, e.g. the blocklist updates, are run in. They are run at any time if
+// there are no windows.
+type maintenanceWindows []clockRange
+
+// parseMaintenanceWindows parses the windows like `02:00-05:00`.
+func parseMaintenanceWindows(windows []string) (maintenanceWindows, error) {
+	var ws maintenanceWindows
+	for _, w := range windows {
+		parts := strings.Split(w, "-")
+		if len(parts) != 2 {
+			return nil, Error("invalid maintenance window, expect hh:mm-hh:mm: " + w)
+		}
+		start, err := parseClock(parts[0])
+		if err != nil {
+			return nil, Error("invalid maintenance window, expect hh:mm-hh:mm: " + w)
+		}
+		end, err := parseClock(parts[1])
+		if err != nil || start == end {
+			return nil, Error("invalid maintenance window, expect hh:mm-hh:mm: " + w)
+		}
+		ws = append(ws, clockRange{start, end})
+	}
+	return ws, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 2 {
+		return 0, Error("invalid time: " + s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, Error("invalid time: " + s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, Error("invalid time: " + s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// next returns how long until the next window opens, or 0 if `now` is in a
+// window.
+func (ws maintenanceWindows) next(now time.Time) time.Duration {
+	if len(ws) == 0 {
+		return 0
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	clock := now.Sub(midnight)
+
+	wait := 24 * time.Hour
+	for _, r := range ws {
+		if (r.start < r.end && clock >= r.start && clock < r.end) ||
+			(r.start > r.end && (clock >= r.start || clock < r.end)) {
+			return 0
+		}
+		d := r.start - clock
+		if d < 0 {
+			d += 24 * time.Hour
+		}
+		if d < wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// wait blocks until a window opens. It returns false if `done` is closed
+// meanwhile.
+func (ws maintenanceWindows) wait(done <-chan struct{}) bool {
+	d := ws.next(time.Now())
+	if d == 0 {
+		return true
+	}
+	select {
+	case <-done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,42 @@
+package freedns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindows(t *testing.T) {
+	ws, err := parseMaintenanceWindows([]string{"02:00-05:00", "23:30-00:30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(h, m int) time.Time {
+		return time.Date(2020, 1, 1, h, m, 0, 0, time.Local)
+	}
+	cases := []struct {
+		now  time.Time
+		wait time.Duration
+	}{
+		{at(2, 0), 0},
+		{at(4, 59), 0},
+		{at(5, 0), 18*time.Hour + 30*time.Minute},
+		{at(23, 45), 0},
+		{at(0, 15), 0},
+		{at(0, 30), 90 * time.Minute},
+		{at(20, 0), 3*time.Hour + 30*time.Minute},
+	}
+	for _, c := range cases {
+		if got := ws.next(c.now); got != c.wait {
+			t.Errorf("next(%s) should be %v, got %v", c.now.Format("15:04"), c.wait, got)
+		}
+	}
+
+	if d := maintenanceWindows(nil).next(at(12, 0)); d != 0 {
+		t.Errorf("no windows should allow any time, got %v", d)
+	}
+	for _, bad := range []string{"02:00", "02:00-02:00", "25:00-01:00", "02:60-03:00", "a-b"} {
+		if _, err := parseMaintenanceWindows([]string{bad}); err == nil {
+			t.Errorf("%q should be invalid", bad)
+		}
+	}
+}
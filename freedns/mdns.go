@@ -0,0 +1,121 @@
+package freedns
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The modes of the .local queries, which are link-local names of multicast
+// DNS (RFC 6762). The public upstreams can't answer them, and asking them is
+// slow and leaks the names of the devices on the LAN.
+const (
+	LocalNXDomain = "nxdomain" // answer NXDOMAIN without asking anyone
+	LocalMDNS     = "mdns"     // ask the devices on the LAN over multicast DNS
+	LocalForward  = "forward"  // resolve them like other names, e.g. for an AD domain named .local
+)
+
+// mdnsGroup is the IPv4 multicast address of mDNS.
+const mdnsGroup = "224.0.0.251:5353"
+
+// mdnsTimeout is how long the responders on the LAN are waited for.
+const mdnsTimeout = time.Second
+
+// mdnsMaxTTL caps the TTLs of the mDNS answers, as RFC 6762 asks for the
+// answers of the one-shot queries.
+const mdnsMaxTTL = 10
+
+// localResolver answers the .local queries by the mode. An empty mode is
+// LocalNXDomain.
+type localResolver struct {
+	mode    string
+	group   string
+	timeout time.Duration
+}
+
+func newLocalResolver(mode string) (*localResolver, error) {
+	switch mode {
+	case "":
+		mode = LocalNXDomain
+	case LocalNXDomain, LocalMDNS, LocalForward:
+	default:
+		return nil, Error("unknown .local mode: " + mode)
+	}
+	return &localResolver{mode: mode, group: mdnsGroup, timeout: mdnsTimeout}, nil
+}
+
+// isLocalName returns if the name is under .local.
+func isLocalName(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	return name == "local." || strings.HasSuffix(name, ".local.")
+}
+
+// reply answers the .local query, with NXDOMAIN if no device on the LAN
+// answers it over mDNS.
+func (l *localResolver) reply(req *dns.Msg) *dns.Msg {
+	res := &dns.Msg{}
+	if l.mode == LocalMDNS {
+		if answers, err := l.multicast(req.Question[0]); err == nil {
+			res.SetReply(req)
+			res.Answer = answers
+			return res
+		}
+	}
+	res.SetRcode(req, dns.RcodeNameError)
+	return res
+}
+
+// multicast sends the question to the mDNS group as a one-shot query from an
+// ephemeral port, which the responders answer by unicast, and returns the
+// answers of the first response with any.
+func (l *localResolver) multicast(q dns.Question) ([]dns.RR, error) {
+	group, err := net.ResolveUDPAddr("udp4", l.group)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	m := &dns.Msg{}
+	m.Id = dns.Id()
+	m.Question = []dns.Question{q}
+	b, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(b, group); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(l.timeout))
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		res := &dns.Msg{}
+		if res.Unpack(buf[:n]) != nil || !res.Response || res.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		var answers []dns.RR
+		for _, rr := range res.Answer {
+			hdr := rr.Header()
+			if !strings.EqualFold(hdr.Name, q.Name) || (hdr.Rrtype != q.Qtype && hdr.Rrtype != dns.TypeCNAME && q.Qtype != dns.TypeANY) {
+				continue
+			}
+			hdr.Class &^= 1 << 15 // the cache-flush bit
+			if hdr.Ttl > mdnsMaxTTL {
+				hdr.Ttl = mdnsMaxTTL
+			}
+			answers = append(answers, rr)
+		}
+		if len(answers) > 0 {
+			return answers, nil
+		}
+	}
+}
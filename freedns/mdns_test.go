@@ -0,0 +1,69 @@
+package freedns
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLocalNames(t *testing.T) {
+	upstream, queries, stop := countingUpstream(t, "10.0.0.1")
+	defer stop()
+	for _, c := range []struct {
+		mode     string
+		rcode    int
+		upstream bool
+	}{
+		{"", dns.RcodeNameError, false},
+		{LocalForward, dns.RcodeSuccess, true},
+	} {
+		s := newTestServer(t, Config{FastDNS: upstream, CleanDNS: upstream, LocalMode: c.mode})
+		before := atomic.LoadInt32(queries)
+		req := &dns.Msg{}
+		req.SetQuestion("printer.LOCAL.", dns.TypeA)
+		w := newRecorder()
+		s.handle(w, req, "udp")
+		if w.msg.Rcode != c.rcode || (atomic.LoadInt32(queries) > before) != c.upstream {
+			t.Errorf("%q: unexpected response %v", c.mode, w.msg)
+		}
+	}
+	if _, err := newLocalResolver("proxy"); err == nil {
+		t.Error("expect an error of the unknown mode")
+	}
+}
+
+func TestMulticastDNS(t *testing.T) {
+	// a responder answering the one-shot queries by unicast
+	responder, stop := fakeUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Question[0].Name != "printer.local." {
+			return
+		}
+		res := &dns.Msg{}
+		res.SetReply(req)
+		rr, _ := dns.NewRR("printer.local. 120 IN A 192.168.1.20")
+		rr.Header().Class |= 1 << 15
+		other, _ := dns.NewRR("nas.local. 120 IN A 192.168.1.30")
+		res.Answer = []dns.RR{rr, other}
+		w.WriteMsg(res)
+	})
+	defer stop()
+
+	l, _ := newLocalResolver(LocalMDNS)
+	l.group, l.timeout = responder, 200*time.Millisecond
+	req := &dns.Msg{}
+	req.SetQuestion("printer.local.", dns.TypeA)
+	res := l.reply(req)
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 || res.Id != req.Id {
+		t.Fatalf("expect the answer of the responder, got %v", res)
+	}
+	if hdr := res.Answer[0].Header(); hdr.Class != dns.ClassINET || hdr.Ttl != mdnsMaxTTL {
+		t.Errorf("expect the cache-flush bit cleared and the TTL capped, got %v", res)
+	}
+
+	req.SetQuestion("missing.local.", dns.TypeA)
+	if res := l.reply(req); res.Rcode != dns.RcodeNameError {
+		t.Errorf("expect NXDOMAIN without responders, got %v", res)
+	}
+}
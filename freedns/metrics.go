@@ -0,0 +1,90 @@
+package freedns
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// MetricsSink receives the metrics of the server, so an embedder can route
+// them into its own instrumentation, e.g. expvar, StatsD or an existing
+// Prometheus registry. The methods are called concurrently from the query
+// paths, so they must be safe for concurrent use and must not block.
+//
+// The counters and histograms, with their labels:
+//
+//	freedns_queries_total                            net, qtype, rcode, upstream, cache
+//	freedns_query_duration_seconds                   net, cache
+//	freedns_upstream_queries_total                   upstream, net, rcode
+//	freedns_upstream_duration_seconds                upstream, net
+//	freedns_upstream_timeouts_total                  upstream, net
+//	freedns_upstream_dropped_total                   upstream
+//	freedns_upstream_tls_handshakes_total            upstream, result
+//	freedns_upstream_tls_handshake_duration_seconds  upstream
+//
+// upstream of the queries is the upstream or the feature answering them,
+// e.g. "cache" or "blocklist", cache is hit, miss or none, and rcode of the
+// upstream queries is "error" if they fail, e.g. time out. result of the
+// handshakes with the DNS over TLS upstreams is full, resumed or error.
+type MetricsSink interface {
+	// AddCounter adds delta to the counter of the labels.
+	AddCounter(name string, labels map[string]string, delta float64)
+	// Observe records a sample, e.g. a latency in seconds, in the histogram
+	// of the labels.
+	Observe(name string, labels map[string]string, value float64)
+}
+
+// SetMetricsSink sends the metrics of the queries and the upstream exchanges
+// to `sink`. It must be called before Run.
+func (s *Server) SetMetricsSink(sink MetricsSink) {
+	s.metrics = sink
+	s.resolver.client.metrics = sink
+}
+
+// observeQuery sends the metrics of the client query of `e`.
+func observeQuery(m MetricsSink, e queryLogEntry, net string) {
+	m.AddCounter("freedns_queries_total", map[string]string{
+		"net":      net,
+		"qtype":    e.Type,
+		"rcode":    e.Rcode,
+		"upstream": e.Upstream,
+		"cache":    e.Cache,
+	}, 1)
+	m.Observe("freedns_query_duration_seconds", map[string]string{
+		"net":   net,
+		"cache": e.Cache,
+	}, e.Latency/1000)
+}
+
+// observeExchange sends the metrics of an exchange with the upstream. The
+// exchanges cancelled as the other upstream has answered are left out.
+func observeExchange(m MetricsSink, upstream string, net string, res *dns.Msg, err error, dropped int, latency time.Duration) {
+	if err == context.Canceled {
+		return
+	}
+	rcode := "error"
+	if err == nil && res != nil {
+		rcode = dns.RcodeToString[res.Rcode]
+	}
+	m.AddCounter("freedns_upstream_queries_total", map[string]string{
+		"upstream": upstream,
+		"net":      net,
+		"rcode":    rcode,
+	}, 1)
+	m.Observe("freedns_upstream_duration_seconds", map[string]string{
+		"upstream": upstream,
+		"net":      net,
+	}, latency.Seconds())
+	if err != nil && isTimeout(err) {
+		m.AddCounter("freedns_upstream_timeouts_total", map[string]string{
+			"upstream": upstream,
+			"net":      net,
+		}, 1)
+	}
+	if dropped > 0 {
+		m.AddCounter("freedns_upstream_dropped_total", map[string]string{
+			"upstream": upstream,
+		}, float64(dropped))
+	}
+}
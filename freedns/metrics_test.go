@@ -0,0 +1,82 @@
+package freedns
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/tuna/freedns-go/decisiontest"
+)
+
+// recordingSink counts the samples of each metric and labels.
+type recordingSink struct {
+	mu       sync.Mutex
+	counters map[string]float64
+	samples  map[string]int
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{counters: map[string]float64{}, samples: map[string]int{}}
+}
+
+func metricKey(name string, labels map[string]string, keys ...string) string {
+	for _, k := range keys {
+		name += " " + k + "=" + labels[k]
+	}
+	return name
+}
+
+func (r *recordingSink) AddCounter(name string, labels map[string]string, delta float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch name {
+	case "freedns_queries_total":
+		name = metricKey(name, labels, "cache", "rcode")
+	case "freedns_upstream_queries_total":
+		name = metricKey(name, labels, "upstream", "rcode")
+	case "freedns_upstream_tls_handshakes_total":
+		name = metricKey(name, labels, "result")
+	}
+	r.counters[name] += delta
+}
+
+func (r *recordingSink) Observe(name string, labels map[string]string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if value < 0 {
+		name += " negative"
+	}
+	r.samples[name]++
+}
+
+func TestMetricsSink(t *testing.T) {
+	upstream, stop := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.Answer, IPs: []string{"114.114.114.114"}})
+	defer stop()
+	s := newTestServer(t, Config{FastDNS: upstream, CleanDNS: upstream})
+	sink := newRecordingSink()
+	s.SetMetricsSink(sink)
+
+	for i := 0; i < 2; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("example.com.", dns.TypeA)
+		s.handle(newRecorder(), req, "udp")
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	for key, want := range map[string]float64{
+		"freedns_queries_total cache=miss rcode=NOERROR": 1,
+		"freedns_queries_total cache=hit rcode=NOERROR":  1,
+	} {
+		if got := sink.counters[key]; got != want {
+			t.Errorf("%s: expect %v, got %v (%v)", key, want, got, sink.counters)
+		}
+	}
+	// the clean query may be cancelled once the fast one has answered
+	if got := sink.counters["freedns_upstream_queries_total upstream="+upstream+" rcode=NOERROR"]; got < 1 {
+		t.Errorf("expect the upstream queries, got %v", sink.counters)
+	}
+	if sink.samples["freedns_query_duration_seconds"] != 2 || sink.samples["freedns_upstream_duration_seconds"] == 0 {
+		t.Errorf("unexpected samples %v", sink.samples)
+	}
+}
@@ -0,0 +1,411 @@
+package freedns
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Request is a query passing through the pipeline. Msg has exactly one
+// question, as the requests of multiple questions are split.
+type Request struct {
+	Msg    *dns.Msg
+	Net    string   // udp or tcp
+	Client net.Addr // nil for the queries not from a client
+
+	ctx context.Context
+}
+
+// Context returns the context of the request, carrying the span of the query
+// if it's traced. It's never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// Handler answers the request, and returns the response and which upstream,
+// or which feature, e.g. "blocklist", answered it. The response is logged,
+// counted and written to the client after the pipeline.
+type Handler func(req *Request) (*dns.Msg, string)
+
+// Middleware wraps the next handler of the pipeline. It can answer the
+// request itself without calling `next`, change the request before it, or
+// change the response after it.
+type Middleware func(next Handler) Handler
+
+// Use appends the middlewares to the pipeline. They run in the order given,
+// after the ones used before and before the built-in features: the ANY
+// queries, the query storms, the connectivity checks, blocking, response
+// policy zones, homograph detection, pinning, DNSBL, the reverse lookups of
+// the LAN, the .local names, CNAME flattening, DNS64, the NAT mappings, the
+// rewrite rules, rebinding protection and the cached lookup. Use must be
+// called before Run.
+func (s *Server) Use(middlewares ...Middleware) {
+	s.middlewares = append(s.middlewares, middlewares...)
+	s.handler = s.pipeline()
+}
+
+// pipeline chains the middlewares, the first one the outermost.
+func (s *Server) pipeline() Handler {
+	chain := append([]Middleware{}, s.middlewares...)
+	chain = append(chain,
+		s.anyMiddleware,
+		s.stormMiddleware,
+		s.connectivityMiddleware,
+		s.blockMiddleware,
+		s.rpzMiddleware,
+		s.homographMiddleware,
+		s.pinMiddleware,
+		s.rblMiddleware,
+		s.reverseMiddleware,
+		s.localMiddleware,
+		s.flattenMiddleware,
+		s.dns64Middleware,
+		s.natMiddleware,
+		s.rewriteMiddleware,
+		s.rebindMiddleware,
+	)
+	h := Handler(func(req *Request) (*dns.Msg, string) {
+		if s.override != nil {
+			if res, upstream := s.overrideLookup(req); res != nil {
+				return res, upstream
+			}
+		}
+		return s.lookupContext(req.Context(), req.Msg, req.Net, req.Client)
+	})
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+	return h
+}
+
+// anyMiddleware answers the ANY queries with the minimal response, unless
+// they're forwarded.
+func (s *Server) anyMiddleware(next Handler) Handler {
+	if s.config.AnyPolicy == AnyForward {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		if req.Msg.Question[0].Qtype == dns.TypeANY {
+			return minimalAny(req.Msg), "any"
+		}
+		return next(req)
+	}
+}
+
+// stormMiddleware answers the queries in their cooldowns with SERVFAIL.
+func (s *Server) stormMiddleware(next Handler) Handler {
+	if s.storm == nil {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		q := req.Msg.Question[0]
+		key := stormKey(req.Client, q)
+		if s.storm.cooling(key) {
+			res := &dns.Msg{}
+			res.SetRcode(req.Msg, dns.RcodeServerFailure)
+			setEDE(res, req.Msg, edeOther, "query storm cooldown")
+			return res, "storm"
+		}
+		res, upstream := next(req)
+		if s.storm.observe(key, res.Rcode == dns.RcodeServerFailure) {
+			log.WithFields(logrus.Fields{
+				"op":       "storm",
+				"client":   req.Client,
+				"domain":   q.Name,
+				"type":     dns.TypeToString[q.Qtype],
+				"cooldown": s.storm.cooldown.String(),
+			}).Warn("repeated failing queries, answering SERVFAIL for the cooldown")
+		}
+		return res, upstream
+	}
+}
+
+// connectivityMiddleware resolves the connectivity-check domains without the
+// filtering features after it, and skips the cache with ConnectivityFresh. The
+// domains are resolved on the upstreams of the client's policy if any.
+func (s *Server) connectivityMiddleware(next Handler) Handler {
+	if s.connectivity == nil || s.connectivity.policy == ConnectivityIgnore {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		if !s.connectivity.match(req.Msg.Question[0].Name) {
+			return next(req)
+		}
+		if s.connectivity.policy == ConnectivityPass || s.replica != nil {
+			return s.lookupContext(req.Context(), req.Msg, req.Net, req.Client)
+		}
+		_, resolver := s.resolverOf(req.Client)
+		res, upstream := resolver.resolveTraced(req.Context(), req.Msg.Question[0], req.Msg.RecursionDesired, req.Net)
+		rcode := res.Rcode
+		res.SetReply(req.Msg)
+		res.Rcode = rcode
+		return res, upstream
+	}
+}
+
+func (s *Server) blockMiddleware(next Handler) Handler {
+	if s.blocker == nil {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		if s.blocker.blocked(req.Msg.Question[0].Name) {
+			return s.blocker.reply(req.Msg), "blocklist"
+		}
+		return next(req)
+	}
+}
+
+// rpzMiddleware applies the response policy zones. The CNAME rewrites are
+// resolved by the rest of the pipeline, so the targets are checked as well.
+func (s *Server) rpzMiddleware(next Handler) Handler {
+	if s.rpz == nil {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		q := req.Msg.Question[0]
+		z, rule := s.rpz.match(q.Name)
+		if rule == nil || rule.action == rpzPassthru {
+			return next(req)
+		}
+		if rule.action != rpzCNAME {
+			return z.reply(req.Msg, rule), "rpz"
+		}
+
+		cname := z.rewrite(q, rule)
+		res := &dns.Msg{}
+		res.SetReply(req.Msg)
+		if q.Qtype != dns.TypeCNAME {
+			sub := req.Msg.Copy()
+			sub.Question[0].Name = cname.Target
+			r, _ := next(&Request{Msg: sub, Net: req.Net, Client: req.Client, ctx: req.ctx})
+			res.SetRcode(req.Msg, r.Rcode)
+			res.Answer = r.Answer
+			res.Ns = r.Ns
+		}
+		res.Answer = append([]dns.RR{cname}, res.Answer...)
+		return res, "rpz"
+	}
+}
+
+func (s *Server) homographMiddleware(next Handler) Handler {
+	if s.homograph == nil {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		if p := s.homograph.check(req.Msg.Question[0].Name); p != "" {
+			log.WithFields(logrus.Fields{
+				"op":        "homograph",
+				"domain":    req.Msg.Question[0].Name,
+				"protected": p,
+			}).Warn("query of a homograph of a protected domain")
+			if s.homograph.action == HomographBlock {
+				res := &dns.Msg{}
+				res.SetRcode(req.Msg, dns.RcodeNameError)
+				setEDE(res, req.Msg, edeBlocked, "homograph of "+p)
+				return res, "homograph"
+			}
+		}
+		return next(req)
+	}
+}
+
+// pinMiddleware answers the pinned domains. The pinned IPs are trusted, so
+// it's before the rebind check.
+func (s *Server) pinMiddleware(next Handler) Handler {
+	if s.pinner == nil {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		if res := s.pinner.reply(req.Msg); res != nil {
+			return res, "pin"
+		}
+		return next(req)
+	}
+}
+
+// rblMiddleware answers the DNSBL queries. The DNSBLs answer 127.0.0.x by
+// design, so it's before the rebind check.
+func (s *Server) rblMiddleware(next Handler) Handler {
+	if s.rbl == nil {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		if z := s.rbl.match(req.Msg.Question[0].Name); z != nil {
+			return s.rbl.resolve(z, req.Msg, req.Net)
+		}
+		return next(req)
+	}
+}
+
+// reverseMiddleware forwards the reverse lookups of the LAN ranges.
+func (s *Server) reverseMiddleware(next Handler) Handler {
+	if s.reverse == nil {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		if z := s.reverse.match(req.Msg.Question[0].Name); z != nil {
+			return s.forwardReverse(z, req.Msg, req.Net)
+		}
+		return next(req)
+	}
+}
+
+// localMiddleware answers the .local queries, unless they're forwarded like
+// the other names.
+func (s *Server) localMiddleware(next Handler) Handler {
+	if s.local == nil || s.local.mode == LocalForward {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		if isLocalName(req.Msg.Question[0].Name) {
+			return s.local.reply(req.Msg), "local"
+		}
+		return next(req)
+	}
+}
+
+// flattenMiddleware answers the A and AAAA queries with only the records of
+// the end of the CNAME chain. The targets missing from the answer are looked
+// up by the rest of the pipeline, so each link of the chain is cached.
+func (s *Server) flattenMiddleware(next Handler) Handler {
+	if !s.config.FlattenCNAME {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		q := req.Msg.Question[0]
+		res, upstream := next(req)
+		if (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) || res.Rcode != dns.RcodeSuccess {
+			return res, upstream
+		}
+		answer := res.Answer
+		for i := 0; i < flattenMaxDepth; i++ {
+			records, target := flatten(q.Name, q.Qtype, answer)
+			if records == nil && target == "" {
+				return res, upstream
+			}
+			out := res.Copy()
+			if records != nil {
+				out.Answer = records
+				return out, upstream
+			}
+			sub := req.Msg.Copy()
+			sub.Question[0].Name = target
+			r, _ := next(&Request{Msg: sub, Net: req.Net, Client: req.Client, ctx: req.ctx})
+			if r.Rcode != dns.RcodeSuccess {
+				return res, upstream
+			}
+			if len(r.Answer) == 0 { // the end of the chain has no records
+				out.Answer, out.Ns = nil, r.Ns
+				return out, upstream
+			}
+			answer = append(answer, r.Answer...)
+		}
+		return res, upstream
+	}
+}
+
+// dns64Middleware synthesizes the AAAA records of the names with only A
+// records, in the prefix of the client. The A query goes through the rest of
+// the pipeline, so its answer is cached and checked for rebinding as usual.
+func (s *Server) dns64Middleware(next Handler) Handler {
+	if s.dns64 == nil {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		q := req.Msg.Question[0]
+		res, upstream := next(req)
+		if q.Qtype != dns.TypeAAAA || q.Qclass != dns.ClassINET || !s.dns64.needed(res) {
+			return res, upstream
+		}
+		sub := req.Msg.Copy()
+		sub.Question[0].Qtype = dns.TypeA
+		a, u := next(&Request{Msg: sub, Net: req.Net, Client: req.Client, ctx: req.ctx})
+		if synthesized := s.dns64.synthesize(req.Msg, a, req.Client); synthesized != nil {
+			return synthesized, u
+		}
+		return res, upstream
+	}
+}
+
+// natMiddleware rewrites the answer IPs to their mapped addresses. The
+// mapped ones are usually private, so it's after the rebind check.
+func (s *Server) natMiddleware(next Handler) Handler {
+	if s.natMapper == nil {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		res, upstream := next(req)
+		if s.natMapper.applies(req.Client) {
+			res = s.natMapper.rewrite(res)
+		}
+		return res, upstream
+	}
+}
+
+// rewriteMiddleware applies the rewrite rules. The forced IPs skip the
+// resolution, and the new CNAME targets are resolved by the rest of the
+// pipeline. The forced IPs are usually private, so it's after the rebind
+// check.
+func (s *Server) rewriteMiddleware(next Handler) Handler {
+	if s.rewriter == nil {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		q := req.Msg.Question[0]
+		if rule := s.rewriter.match(q.Name, rewriteIP); rule != nil {
+			return answerIP(req.Msg, rule.ip), "rewrite"
+		}
+		res, upstream := next(req)
+		if res.Rcode == dns.RcodeNameError {
+			if rule := s.rewriter.match(q.Name, rewriteNXDomain); rule != nil {
+				return answerIP(req.Msg, rule.ip), "rewrite"
+			}
+			return res, upstream
+		}
+		i, rule := s.rewriter.retarget(res)
+		if rule == nil {
+			return res, upstream
+		}
+
+		// the records after the CNAME are of the old target
+		out := res.Copy()
+		c := out.Answer[i].(*dns.CNAME)
+		c.Target = rule.target
+		out.Answer = out.Answer[:i+1]
+		out.Ns = nil
+		if q.Qtype != dns.TypeCNAME {
+			sub := req.Msg.Copy()
+			sub.Question[0].Name = rule.target
+			r, _ := next(&Request{Msg: sub, Net: req.Net, Client: req.Client, ctx: req.ctx})
+			out.Rcode = r.Rcode
+			out.Answer = append(out.Answer, r.Answer...)
+			out.Ns = r.Ns
+		}
+		return out, "rewrite"
+	}
+}
+
+func (s *Server) rebindMiddleware(next Handler) Handler {
+	if s.rebind == nil {
+		return next
+	}
+	return func(req *Request) (*dns.Msg, string) {
+		res, upstream := next(req)
+		if ip := s.rebind.violates(res); ip != nil {
+			log.WithFields(logrus.Fields{
+				"op":       "rebind",
+				"domain":   req.Msg.Question[0].Name,
+				"ip":       ip.String(),
+				"upstream": upstream,
+			}).Warn("refused the answer with a private address")
+			res = &dns.Msg{}
+			res.SetRcode(req.Msg, dns.RcodeRefused)
+		}
+		return res, upstream
+	}
+}
@@ -0,0 +1,69 @@
+package freedns
+
+import (
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMiddleware(t *testing.T) {
+	blocklist := writeTempFile(t, "||blocked.example.com^\n")
+	defer os.Remove(blocklist)
+	s := newTestServer(t, Config{
+		Blocklists: []string{blocklist},
+		Pins:       []string{"nas.example.com=192.168.1.10"},
+	})
+
+	var order []string
+	var clients []string
+	s.Use(
+		func(next Handler) Handler {
+			return func(req *Request) (*dns.Msg, string) {
+				order = append(order, "first")
+				clients = append(clients, req.Client.String())
+				return next(req)
+			}
+		},
+		func(next Handler) Handler {
+			return func(req *Request) (*dns.Msg, string) {
+				order = append(order, "second")
+				// rewrite the alias to the pinned domain
+				if req.Msg.Question[0].Name == "alias.example.com." {
+					req.Msg.Question[0].Name = "nas.example.com."
+				}
+				// answer the allowed domain before the blocklist
+				if req.Msg.Question[0].Name == "blocked.example.com." && req.Msg.Question[0].Qtype == dns.TypeTXT {
+					res := &dns.Msg{}
+					res.SetReply(req.Msg)
+					return res, "plugin"
+				}
+				return next(req)
+			}
+		},
+	)
+
+	query := func(name string, qtype uint16) *recorder {
+		req := &dns.Msg{}
+		req.SetQuestion(name, qtype)
+		w := newRecorder()
+		s.handle(w, req, "udp")
+		return w
+	}
+
+	if w := query("alias.example.com.", dns.TypeA); len(w.msg.Answer) != 1 {
+		t.Errorf("the rewritten query should get the pinned answer, got %v", w.msg)
+	}
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Errorf("the middlewares should run in order, got %v", order)
+	}
+	if clients[0] != "127.0.0.1:12345" {
+		t.Errorf("the middlewares should get the client, got %s", clients[0])
+	}
+	if w := query("blocked.example.com.", dns.TypeTXT); w.msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("the middleware should answer before the blocklist, got %v", w.msg)
+	}
+	if w := query("blocked.example.com.", dns.TypeA); w.msg.Rcode != dns.RcodeNameError {
+		t.Errorf("the built-in blocklist should still work, got %v", w.msg)
+	}
+}
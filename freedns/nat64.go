@@ -0,0 +1,69 @@
+package freedns
+
+import (
+	"net"
+	"strconv"
+)
+
+// parseNAT64Prefixes parses the NAT64 prefixes. Only the prefix lengths of
+// RFC 6052 are valid: 32, 40, 48, 56, 64 and 96.
+func parseNAT64Prefixes(prefixes []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range prefixes {
+		ip, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		if ip.To4() != nil {
+			return nil, Error("NAT64 prefix is not IPv6: " + p)
+		}
+		switch ones, _ := ipnet.Mask.Size(); ones {
+		case 32, 40, 48, 56, 64, 96:
+		default:
+			return nil, Error("invalid NAT64 prefix length " + strconv.Itoa(ones) + ": " + p)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// embeddedIPv4 extracts the IPv4 address embedded in `ip` if it's in one of
+// the NAT64 `prefixes`, or returns nil.
+func embeddedIPv4(ip net.IP, prefixes []*net.IPNet) net.IP {
+	ip = ip.To16()
+	if ip == nil || ip.To4() != nil {
+		return nil
+	}
+	for _, p := range prefixes {
+		if !p.Contains(ip) {
+			continue
+		}
+		// RFC 6052 section 2.2: the IPv4 address follows the prefix, skipping
+		// the bits 64 to 71.
+		ones, _ := p.Mask.Size()
+		v4 := make(net.IP, 0, net.IPv4len)
+		for i := ones / 8; len(v4) < net.IPv4len; i++ {
+			if i != 8 {
+				v4 = append(v4, ip[i])
+			}
+		}
+		return v4
+	}
+	return nil
+}
+
+// synthesizeIPv6 embeds the IPv4 address in the NAT64 `prefix`, the reverse
+// of embeddedIPv4.
+func synthesizeIPv6(v4 net.IP, prefix *net.IPNet) net.IP {
+	v4 = v4.To4()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	ones, _ := prefix.Mask.Size()
+	for i, j := ones/8, 0; j < net.IPv4len; i++ {
+		if i != 8 {
+			ip[i] = v4[j]
+			j++
+		}
+	}
+	return ip
+}
@@ -0,0 +1,46 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEmbeddedIPv4(t *testing.T) {
+	// the examples of RFC 6052 section 2.4 for 192.0.2.33
+	cases := []struct {
+		prefix string
+		ip     string
+		ipv4   string
+	}{
+		{"64:ff9b::/96", "64:ff9b::c000:221", "192.0.2.33"},
+		{"2001:db8::/32", "2001:db8:c000:221::", "192.0.2.33"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::", "192.0.2.33"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::", "192.0.2.33"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::", "192.0.2.33"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0", "192.0.2.33"},
+		{"64:ff9b::/96", "2001:db9::c000:221", ""},
+		{"64:ff9b::/96", "114.114.114.114", ""},
+	}
+	for _, c := range cases {
+		prefixes, err := parseNAT64Prefixes([]string{c.prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := embeddedIPv4(net.ParseIP(c.ip), prefixes)
+		if c.ipv4 == "" {
+			if got != nil {
+				t.Errorf("%s should not embed an IPv4 address, got %s", c.ip, got)
+			}
+		} else if !got.Equal(net.ParseIP(c.ipv4)) {
+			t.Errorf("%s should embed %s, got %s", c.ip, c.ipv4, got)
+		} else if ip := synthesizeIPv6(got, prefixes[0]); !ip.Equal(net.ParseIP(c.ip)) {
+			t.Errorf("%s should be synthesized in %s, got %s", c.ipv4, c.prefix, ip)
+		}
+	}
+
+	for _, p := range []string{"64:ff9b::/95", "10.0.0.0/8", "wtf"} {
+		if _, err := parseNAT64Prefixes([]string{p}); err == nil {
+			t.Errorf("%s should be an invalid NAT64 prefix", p)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package freedns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// natMapping maps the addresses of a range to the range of the same size,
+// keeping the host bits.
+type natMapping struct {
+	from *net.IPNet
+	to   *net.IPNet
+}
+
+// natMapper rewrites the IPs in the A and AAAA answers to their mapped
+// addresses, e.g. the public IP of a server to its DMZ-internal counterpart,
+// for the LAN clients which can't reach it by the public IP without hairpin
+// NAT.
+type natMapper struct {
+	mappings []natMapping
+	clients  []*net.IPNet // all the clients if empty
+}
+
+// newNATMapper parses the mappings in the form of `from=to`, each an IP or a
+// CIDR of the same prefix length, e.g. `203.0.113.10=192.168.10.10` or
+// `203.0.113.0/24=192.168.10.0/24`. The first matching mapping takes effect.
+func newNATMapper(mappings []string, clients []string) (*natMapper, error) {
+	m := &natMapper{}
+	for _, s := range mappings {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 {
+			return nil, Error("invalid NAT mapping, expect from=to: " + s)
+		}
+		prefixes, err := parseClientPrefixes(parts)
+		if err != nil {
+			return nil, Error("invalid NAT mapping: " + err.Error())
+		}
+		from, to := prefixes[0], prefixes[1]
+		if len(from.IP) != len(to.IP) || from.Mask.String() != to.Mask.String() {
+			return nil, Error("the ranges of a NAT mapping must be of the same family and size: " + s)
+		}
+		m.mappings = append(m.mappings, natMapping{from: from, to: to})
+	}
+	var err error
+	if m.clients, err = parseClientPrefixes(clients); err != nil {
+		return nil, Error("invalid NAT mapping client: " + err.Error())
+	}
+	return m, nil
+}
+
+// applies returns if the answers to the client are rewritten.
+func (m *natMapper) applies(client net.Addr) bool {
+	return len(m.clients) == 0 || containsClient(m.clients, client)
+}
+
+// rewrite returns `res` with the A and AAAA records rewritten, copied first
+// if any is, since `res` may be shared, e.g. by a cache.
+func (m *natMapper) rewrite(res *dns.Msg) *dns.Msg {
+	out := res
+	for i, rr := range res.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = m.mapIP(rr.A.To4())
+		case *dns.AAAA:
+			ip = m.mapIP(rr.AAAA.To16())
+		}
+		if ip == nil {
+			continue
+		}
+		if out == res {
+			out = res.Copy()
+		}
+		switch rr := out.Answer[i].(type) {
+		case *dns.A:
+			rr.A = ip
+		case *dns.AAAA:
+			rr.AAAA = ip
+		}
+	}
+	return out
+}
+
+// mapIP returns the mapped address of the IP, or nil if it's in no range.
+func (m *natMapper) mapIP(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	for _, nm := range m.mappings {
+		if len(nm.from.IP) != len(ip) || !nm.from.Contains(ip) {
+			continue
+		}
+		mapped := make(net.IP, len(ip))
+		for i := range ip {
+			mapped[i] = nm.to.IP[i] | ip[i]&^nm.from.Mask[i]
+		}
+		return mapped
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNATMapper(t *testing.T) {
+	for _, bad := range []string{"203.0.113.1", "203.0.113.0/24=192.168.0.0/16", "203.0.113.1=fd00::1", "x=192.168.0.1"} {
+		if _, err := newNATMapper([]string{bad}, nil); err == nil {
+			t.Errorf("%s: expect an error", bad)
+		}
+	}
+	m, err := newNATMapper([]string{"203.0.113.10=192.168.10.10", "203.0.113.0/24=192.168.20.0/24", "2001:db8:1::/48=fd00:1::/48"}, []string{"192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{
+		"203.0.113.10":    "192.168.10.10", // the first match
+		"203.0.113.77":    "192.168.20.77",
+		"2001:db8:1::5:6": "fd00:1::5:6",
+		"198.51.100.1":    "",
+	} {
+		got := m.mapIP(net.ParseIP(ip).To4())
+		if got == nil {
+			got = m.mapIP(net.ParseIP(ip).To16())
+		}
+		if (want == "" && got != nil) || (want != "" && !got.Equal(net.ParseIP(want))) {
+			t.Errorf("%s: expect %q, got %s", ip, want, got)
+		}
+	}
+
+	res := &dns.Msg{}
+	res.SetQuestion("www.example.com.", dns.TypeA)
+	a, _ := dns.NewRR("www.example.com. 60 IN A 203.0.113.77")
+	res.Answer = []dns.RR{a}
+	out := m.rewrite(res)
+	if out.Answer[0].(*dns.A).A.String() != "192.168.20.77" || res.Answer[0].(*dns.A).A.String() != "203.0.113.77" {
+		t.Errorf("expect a rewritten copy, got %v and %v", out, res)
+	}
+	if !m.applies(&net.UDPAddr{IP: net.IPv4(192, 168, 1, 2)}) || m.applies(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}) {
+		t.Error("expect the answers of the LAN clients only rewritten")
+	}
+}
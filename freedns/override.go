@@ -0,0 +1,190 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// overrideOption is the private EDNS option (RFC 6891 section 6.1.2) the
+// trusted clients override the lookup of a query with. Its data is the
+// comma-separated directives:
+//
+//	nocache             resolve the query again instead of answering from the cache
+//	upstream=fast       resolve it on the fast upstream only, likewise clean
+//	upstream=host:port  resolve it on the given DNS server only
+//
+// The answers of a given upstream bypass the cache both ways, as they skip
+// the anti-spoofing decision. The response carries the option back with
+// `upstream=` the upstream which answered.
+const overrideOption = 65301
+
+// lookupOverride is the directives of the option of a query.
+type lookupOverride struct {
+	noCache  bool
+	upstream string // empty for the usual resolution
+}
+
+// overrideGuard only accepts the option from the clients in the prefixes.
+type overrideGuard struct {
+	clients []*net.IPNet
+}
+
+// newOverrideGuard parses the CIDRs or IPs of the trusted clients.
+func newOverrideGuard(clients []string) (*overrideGuard, error) {
+	prefixes, err := parseClientPrefixes(clients)
+	if err != nil {
+		return nil, Error("invalid override client: " + err.Error())
+	}
+	return &overrideGuard{clients: prefixes}, nil
+}
+
+func (g *overrideGuard) trusted(client net.Addr) bool {
+	return containsClient(g.clients, client)
+}
+
+// parseClientPrefixes parses the CIDRs or IPs of the clients, an IP being a
+// prefix of its own.
+func parseClientPrefixes(clients []string) ([]*net.IPNet, error) {
+	var prefixes []*net.IPNet
+	for _, c := range clients {
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, prefix, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// containsClient returns if the IP of the client is in any of the prefixes.
+func containsClient(prefixes []*net.IPNet, client net.Addr) bool {
+	if client == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(client.String())
+	if err != nil {
+		host = client.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOverride returns the directives of the option of `req`, or nil if it
+// has none.
+func parseOverride(req *dns.Msg) (*lookupOverride, error) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil, nil
+	}
+	for _, o := range opt.Option {
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || local.Code != overrideOption {
+			continue
+		}
+		o := &lookupOverride{}
+		for _, d := range strings.Split(string(local.Data), ",") {
+			d = strings.TrimSpace(d)
+			switch {
+			case d == "":
+			case d == "nocache":
+				o.noCache = true
+			case strings.HasPrefix(d, "upstream=") && len(d) > len("upstream="):
+				o.upstream = strings.TrimPrefix(d, "upstream=")
+			default:
+				return nil, Error("unknown override directive: " + d)
+			}
+		}
+		return o, nil
+	}
+	return nil, nil
+}
+
+// overrideLookup resolves the query by the directives of its option, or
+// returns nil to look it up as usual. The fast and the clean upstreams, and
+// the cache, are the ones of the client's policy if any.
+func (s *Server) overrideLookup(req *Request) (*dns.Msg, string) {
+	o, err := parseOverride(req.Msg)
+	if o == nil && err == nil {
+		return nil, ""
+	}
+	if !s.override.trusted(req.Client) {
+		return nil, "" // the option is ignored like any unknown one
+	}
+	l := log.WithFields(logrus.Fields{
+		"op":     "override",
+		"client": req.Client.String(),
+		"domain": req.Msg.Question[0].Name,
+	})
+	if err != nil {
+		l.Warn(err)
+		res := &dns.Msg{}
+		res.SetRcode(req.Msg, dns.RcodeFormatError)
+		return res, "override"
+	}
+	l.WithField("upstream", o.upstream).Debug("lookup overridden")
+
+	cache, resolver := s.resolverOf(req.Client)
+	var res *dns.Msg
+	var upstream string
+	switch {
+	case o.upstream != "":
+		upstream = o.upstream
+		switch upstream {
+		case "fast":
+			upstream = resolver.fastUpstream
+		case "clean":
+			upstream = resolver.cleanUpstream
+		default:
+			upstream = appendDefaultPort(upstream)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), resolver.queryTimeout())
+		res, err = resolver.query(ctx, req.Msg.Question[0], req.Msg.RecursionDesired, req.Net, upstream)
+		cancel()
+		if err != nil || res == nil {
+			res = &dns.Msg{}
+			res.SetRcode(req.Msg, dns.RcodeServerFailure)
+		}
+	case o.noCache:
+		res, upstream = resolver.resolve(req.Msg.Question[0], req.Msg.RecursionDesired, req.Net)
+		if res.Rcode == dns.RcodeSuccess {
+			cache.set(res, req.Net)
+		}
+	default:
+		return nil, ""
+	}
+	rcode := res.Rcode
+	res.SetReply(req.Msg)
+	res.Rcode = rcode
+	setOverrideUpstream(res, req.Msg, upstream)
+	return res, upstream
+}
+
+// setOverrideUpstream attaches the option with the upstream to `res`.
+func setOverrideUpstream(res *dns.Msg, req *dns.Msg, upstream string) {
+	reqOpt := req.IsEdns0()
+	opt := res.IsEdns0()
+	if opt == nil {
+		res.SetEdns0(reqOpt.UDPSize(), false)
+		opt = res.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: overrideOption, Data: []byte("upstream=" + upstream)})
+}
@@ -0,0 +1,61 @@
+package freedns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLookupOverride(t *testing.T) {
+	fast, fastQueries, stopFast := countingUpstream(t, "114.114.114.114")
+	defer stopFast()
+	other, _, stopOther := countingUpstream(t, "1.2.3.4")
+	defer stopOther()
+	s := newTestServer(t, Config{FastDNS: fast, CleanDNS: fast, OverrideClients: []string{"127.0.0.1", "::1/128"}})
+
+	query := func(directives string, remote net.IP) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion("example.com.", dns.TypeA)
+		if directives != "" {
+			req.SetEdns0(1232, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: overrideOption, Data: []byte(directives)})
+		}
+		w := newRecorder()
+		if remote != nil {
+			w.remote = &net.UDPAddr{IP: remote, Port: 12345}
+		}
+		s.handle(w, req, "udp")
+		return w.msg
+	}
+	upstreamOf := func(res *dns.Msg) string {
+		if opt := res.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == overrideOption {
+					return string(l.Data)
+				}
+			}
+		}
+		return ""
+	}
+
+	query("", nil) // cached
+	before := atomic.LoadInt32(fastQueries)
+	if res := query("nocache", nil); atomic.LoadInt32(fastQueries) == before || upstreamOf(res) != "upstream="+fast {
+		t.Errorf("expect the cache bypassed, got %v", res)
+	}
+	res := query("nocache, upstream="+other, nil)
+	if len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "1.2.3.4" || upstreamOf(res) != "upstream="+other {
+		t.Errorf("expect the answer of the given upstream, got %v", res)
+	}
+	before = atomic.LoadInt32(fastQueries)
+	res = query("nocache", net.IPv4(10, 0, 0, 9))
+	if atomic.LoadInt32(fastQueries) != before || upstreamOf(res) != "" || res.Answer[0].(*dns.A).A.String() != "114.114.114.114" {
+		t.Errorf("expect the option of an untrusted client ignored, got %v", res)
+	}
+	if res := query("upstream", nil); res.Rcode != dns.RcodeFormatError {
+		t.Errorf("expect FORMERR of the invalid directive, got %v", res)
+	}
+}
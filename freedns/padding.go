@@ -0,0 +1,26 @@
+package freedns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// paddingBlockSize is the block size the queries are padded to, as
+// recommended for the queries by RFC 8467.
+const paddingBlockSize = 128
+
+// padQuery pads the query to a multiple of paddingBlockSize with the EDNS
+// Padding option (RFC 7830), so the length of the query over an encrypted
+// connection doesn't tell the name queried. It must be the last change to the
+// query, and is only for the encrypted transports.
+func padQuery(req *dns.Msg) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+	}
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+	if rem := req.Len() % paddingBlockSize; rem != 0 {
+		padding.Padding = make([]byte, paddingBlockSize-rem)
+	}
+}
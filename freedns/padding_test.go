@@ -0,0 +1,32 @@
+package freedns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPadQuery(t *testing.T) {
+	for _, name := range []string{"a.cn.", "a-very-long-name.of-a-subdomain.example.com."} {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeAAAA)
+		padQuery(req)
+		if req.Len()%paddingBlockSize != 0 {
+			t.Errorf("expect %s padded to a multiple of %d, got %d bytes", name, paddingBlockSize, req.Len())
+		}
+		packed, err := req.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packed) != req.Len() {
+			t.Errorf("expect %d bytes packed, got %d", req.Len(), len(packed))
+		}
+		opt := req.IsEdns0()
+		if opt == nil || len(opt.Option) != 1 {
+			t.Fatalf("expect an OPT with the padding of %s, got %v", name, req)
+		}
+		if _, ok := opt.Option[0].(*dns.EDNS0_PADDING); !ok {
+			t.Errorf("expect the padding option, got %v", opt.Option[0])
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package freedns
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// pinDefaultInterval is the default interval of the health checks.
+const pinDefaultInterval = 30 * time.Second
+
+// pinProbeTimeout is how long a health check waits for the pinned IP.
+const pinProbeTimeout = 3 * time.Second
+
+// pinProbe checks if the pinned IP of the domain is alive.
+type pinProbe struct {
+	scheme string // tcp, http or https
+	port   string
+	path   string // http(s) only
+}
+
+// pinnedIP is a pinned IP and whether it passed the last health check.
+type pinnedIP struct {
+	ip      net.IP
+	healthy bool
+}
+
+// pin is a domain pinned to its preferred IPs.
+type pin struct {
+	domain string // normalized
+	probe  *pinProbe
+	ips    []*pinnedIP
+}
+
+// pinner answers the A and AAAA queries of the pinned domains with their
+// healthy pinned IPs, e.g. a self-hosted service behind a flaky dynamic DNS.
+// The queries are resolved as usual when none of the pinned IPs is healthy.
+type pinner struct {
+	interval time.Duration
+
+	mu   sync.RWMutex // guards pinnedIP.healthy
+	pins map[string]*pin
+}
+
+// newPinner parses the pins in the form of `domain=ip|ip@probe`. The probe is
+// `tcp:port`, `http:port/path` or `https:port/path`, and the IPs are always
+// healthy without it.
+func newPinner(pins []string, interval time.Duration) (*pinner, error) {
+	if interval <= 0 {
+		interval = pinDefaultInterval
+	}
+	p := &pinner{
+		interval: interval,
+		pins:     map[string]*pin{},
+	}
+	for _, s := range pins {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || normalizeDomain(parts[0]) == "" {
+			return nil, Error("invalid pin, expect domain=ip|ip@probe: " + s)
+		}
+		d := &pin{domain: normalizeDomain(parts[0])}
+		ips := parts[1]
+		if i := strings.IndexByte(ips, '@'); i >= 0 {
+			probe, err := parsePinProbe(ips[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			d.probe = probe
+			ips = ips[:i]
+		}
+		for _, v := range strings.Split(ips, "|") {
+			ip := net.ParseIP(strings.TrimSpace(v))
+			if ip == nil {
+				return nil, Error("invalid pinned IP: " + v)
+			}
+			d.ips = append(d.ips, &pinnedIP{ip: ip, healthy: true})
+		}
+		p.pins[d.domain] = d
+	}
+	return p, nil
+}
+
+func parsePinProbe(s string) (*pinProbe, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, Error("invalid pin probe, expect tcp:port, http:port/path or https:port/path: " + s)
+	}
+	probe := &pinProbe{scheme: parts[0], port: parts[1]}
+	switch probe.scheme {
+	case "tcp":
+	case "http", "https":
+		if i := strings.IndexByte(probe.port, '/'); i >= 0 {
+			probe.port, probe.path = probe.port[:i], probe.port[i:]
+		}
+		if probe.path == "" {
+			probe.path = "/"
+		}
+	case "icmp":
+		// pinging needs raw sockets, i.e. root or CAP_NET_RAW
+		return nil, Error("icmp pin probes are not supported, use a tcp or http probe instead: " + s)
+	default:
+		return nil, Error("invalid pin probe, expect tcp:port, http:port/path or https:port/path: " + s)
+	}
+	if port, err := strconv.Atoi(probe.port); err != nil || port <= 0 || port > 65535 {
+		return nil, Error("invalid pin probe port: " + s)
+	}
+	return probe, nil
+}
+
+// reply answers the request of a pinned domain, or returns nil if the domain
+// is not pinned, the qtype is not A or AAAA, or none of the pinned IPs is
+// healthy.
+func (p *pinner) reply(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil
+	}
+	d, ok := p.pins[normalizeDomain(q.Name)]
+	if !ok {
+		return nil
+	}
+
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Authoritative = true
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(p.interval / time.Second),
+	}
+	healthy := false
+	p.mu.RLock()
+	for _, pip := range d.ips {
+		if !pip.healthy {
+			continue
+		}
+		healthy = true
+		if v4 := pip.ip.To4(); v4 != nil && q.Qtype == dns.TypeA {
+			res.Answer = append(res.Answer, &dns.A{Hdr: hdr, A: v4})
+		} else if v4 == nil && q.Qtype == dns.TypeAAAA {
+			res.Answer = append(res.Answer, &dns.AAAA{Hdr: hdr, AAAA: pip.ip})
+		}
+	}
+	p.mu.RUnlock()
+	if !healthy {
+		return nil
+	}
+	return res
+}
+
+// run checks the pinned IPs every interval until `done` is closed.
+func (p *pinner) run(done <-chan struct{}) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.checkAll()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll checks all the pinned IPs with probes in parallel.
+func (p *pinner) checkAll() {
+	var wg sync.WaitGroup
+	for _, d := range p.pins {
+		if d.probe == nil {
+			continue
+		}
+		for _, pip := range d.ips {
+			wg.Add(1)
+			go func(d *pin, pip *pinnedIP) {
+				defer wg.Done()
+				err := d.probe.check(d.domain, pip.ip)
+
+				p.mu.Lock()
+				changed := pip.healthy != (err == nil)
+				pip.healthy = err == nil
+				p.mu.Unlock()
+				if changed {
+					l := log.WithFields(logrus.Fields{
+						"op":     "pin",
+						"domain": d.domain,
+						"ip":     pip.ip.String(),
+					})
+					if err != nil {
+						l.Warn("pinned IP is unhealthy: ", err)
+					} else {
+						l.Info("pinned IP is healthy again")
+					}
+				}
+			}(d, pip)
+		}
+	}
+	wg.Wait()
+}
+
+// check probes the pinned IP of the domain. The http(s) probes send the domain
+// as the Host (and the SNI), and fail on the 5xx responses.
+func (probe *pinProbe) check(domain string, ip net.IP) error {
+	addr := net.JoinHostPort(ip.String(), probe.port)
+	if probe.scheme == "tcp" {
+		conn, err := net.DialTimeout("tcp", addr, pinProbeTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := &http.Client{
+		Timeout: pinProbeTimeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Timeout: pinProbeTimeout}).DialContext,
+			TLSClientConfig: &tls.Config{
+				ServerName: domain,
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, probe.scheme+"://"+addr+probe.path, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = domain
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return Error("pin probe: " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package freedns
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPinner(t *testing.T) {
+	healthy := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "nas.example.com" || r.URL.Path != "/health" {
+			t.Errorf("unexpected probe %s%s", r.Host, r.URL.Path)
+		}
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	p, err := newPinner([]string{
+		"nas.example.com=127.0.0.1|::1@http:" + u.Port() + "/health",
+		"static.example.com=10.0.0.1",
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, qtype)
+		return p.reply(req)
+	}
+
+	p.checkAll()
+	res := query("nas.example.com.", dns.TypeA)
+	if res == nil || len(res.Answer) != 1 || !res.Answer[0].(*dns.A).A.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expect the healthy pinned IPv4, got %v", res)
+	}
+	// ::1 is down, as the test server only listens on 127.0.0.1
+	if res := query("nas.example.com.", dns.TypeAAAA); res == nil || len(res.Answer) != 0 {
+		t.Errorf("expect no AAAA answer of the unhealthy IPv6, got %v", res)
+	}
+	if res := query("nas.example.com.", dns.TypeMX); res != nil {
+		t.Error("MX queries should be resolved as usual")
+	}
+	if res := query("static.example.com.", dns.TypeA); res == nil || len(res.Answer) != 1 {
+		t.Error("the IPs without a probe should be always used")
+	}
+	if res := query("other.example.com.", dns.TypeA); res != nil {
+		t.Error("not pinned domains should be resolved as usual")
+	}
+
+	healthy = false
+	p.checkAll()
+	if res := query("nas.example.com.", dns.TypeA); res != nil {
+		t.Error("the domain should be resolved as usual when the pinned IPs are unhealthy")
+	}
+
+	for _, bad := range []string{"nas.example.com", "a.com=1.2.3", "a.com=1.2.3.4@icmp:0", "a.com=1.2.3.4@udp:53", "a.com=1.2.3.4@tcp:99999"} {
+		if _, err := newPinner([]string{bad}, 0); err == nil {
+			t.Errorf("%q should be invalid", bad)
+		}
+	}
+}
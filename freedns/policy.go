@@ -0,0 +1,75 @@
+package freedns
+
+import (
+	"net"
+	"strings"
+)
+
+// upstreamPolicy resolves the queries of the clients in a subnet on an
+// upstream pair of its own, e.g. a filtering one for the guest VLAN, with
+// the anti-spoofing logic and the settings of the default pair. Its answers
+// are cached in a view of the server's cache, so they're never served to the
+// other clients. Its queries are logged and counted by its name, the CIDR of
+// its clients.
+type upstreamPolicy struct {
+	name     string
+	clients  *net.IPNet
+	resolver *spoofingProofResolver
+	cache    *dnsCache
+}
+
+// upstreamPolicies are the policies in the order given, the first matching
+// one taking effect.
+type upstreamPolicies []*upstreamPolicy
+
+// newUpstreamPolicies parses the policies in the form of
+// `clients=fast+clean`, the clients an IP or a CIDR, e.g.
+// `192.168.20.0/24=10.0.20.53+1.1.1.3:53`. The resolvers of the policies are
+// copies of `base` with the upstreams replaced, caching in views of `cache`.
+func newUpstreamPolicies(rules []string, base *spoofingProofResolver, cache *dnsCache) (upstreamPolicies, error) {
+	var policies upstreamPolicies
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return nil, Error("invalid upstream policy, expect clients=fast+clean: " + rule)
+		}
+		prefixes, err := parseClientPrefixes(parts[:1])
+		if err != nil {
+			return nil, Error("invalid clients of upstream policy: " + rule)
+		}
+		upstreams := strings.Split(parts[1], "+")
+		if len(upstreams) != 2 || upstreams[0] == "" || upstreams[1] == "" {
+			return nil, Error("invalid upstreams of upstream policy, expect fast+clean: " + rule)
+		}
+		r := *base
+		r.fastUpstream = appendDefaultPort(strings.TrimSpace(upstreams[0]))
+		r.cleanUpstream = appendDefaultPort(strings.TrimSpace(upstreams[1]))
+		name := prefixes[0].String()
+		policies = append(policies, &upstreamPolicy{
+			name:     name,
+			clients:  prefixes[0],
+			resolver: &r,
+			cache:    cache.view(name),
+		})
+	}
+	return policies, nil
+}
+
+// match returns the policy of the client, or nil if it has none.
+func (p upstreamPolicies) match(client net.Addr) *upstreamPolicy {
+	for _, policy := range p {
+		if containsClient([]*net.IPNet{policy.clients}, client) {
+			return policy
+		}
+	}
+	return nil
+}
+
+// resolverOf returns the cache and the resolver of the client, the ones of
+// its policy if it has one.
+func (s *Server) resolverOf(client net.Addr) (*dnsCache, *spoofingProofResolver) {
+	if p := s.policies.match(client); p != nil {
+		return p.cache, p.resolver
+	}
+	return s.recordsCache, s.resolver
+}
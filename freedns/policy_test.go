@@ -0,0 +1,82 @@
+package freedns
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamPolicies(t *testing.T) {
+	fast, _, stopFast := countingUpstream(t, "114.114.114.114")
+	defer stopFast()
+	clean, _, stopClean := countingUpstream(t, "8.8.8.8")
+	defer stopClean()
+	guestFast, _, stopGuestFast := countingUpstream(t, "223.5.5.5")
+	defer stopGuestFast()
+	guestClean, _, stopGuestClean := countingUpstream(t, "1.1.1.3")
+	defer stopGuestClean()
+	s := newTestServer(t, Config{
+		FastDNS:          fast,
+		CleanDNS:         clean,
+		UpstreamPolicies: []string{"192.168.20.0/24=" + guestFast + "+" + guestClean},
+		AdminListen:      "127.0.0.1:0",
+	})
+
+	for _, c := range []struct {
+		client string
+		name   string
+		ip     string
+	}{
+		{"192.168.20.7", "cn.example.", "223.5.5.5"},
+		{"192.168.10.7", "cn.example.", "114.114.114.114"},
+		// cached apart
+		{"192.168.20.7", "cn.example.", "223.5.5.5"},
+		// the connectivity checks bypass the cache, but not the policy
+		{"192.168.20.7", "connectivitycheck.gstatic.com.", "223.5.5.5"},
+	} {
+		req := &dns.Msg{}
+		req.SetQuestion(c.name, dns.TypeA)
+		w := newRecorder()
+		w.remote = &net.UDPAddr{IP: net.ParseIP(c.client), Port: 12345}
+		s.handle(w, req, "udp")
+		if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != c.ip {
+			t.Errorf("expect %s answered %s of %s, got %v", c.client, c.ip, c.name, w.msg)
+		}
+	}
+	if sum := s.stats.summary(0, 10); sum.Total != 4 || len(sum.Policies) != 1 || sum.Policies[0] != (statsPolicy{"192.168.20.0/24", 3, 0, 1}) {
+		t.Errorf("expect 3 queries of the policy, 1 cached, got %+v", sum)
+	}
+
+	// the policy shares the backend, but not the dumps
+	if s.policies[0].cache.backend != s.recordsCache.backend || s.recordsCache.backend.Len() != 2 {
+		t.Errorf("expect both answers in the cache of the server, got %d", s.recordsCache.backend.Len())
+	}
+	if records, err := s.recordsCache.dump(); err != nil || len(records) != 1 || !strings.HasSuffix(records[0].Answers[0], "114.114.114.114") {
+		t.Errorf("expect the dump without the answer of the policy, got %v, %v", records, err)
+	}
+	s.recordsCache.purge()
+	if _, ok := s.policies[0].cache.entry(dns.Question{Name: "cn.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, true, "udp"); ok {
+		t.Error("expect the answer of the policy purged with the cache")
+	}
+}
+
+func TestNewUpstreamPolicies(t *testing.T) {
+	base := newSpoofingProofResolver("114.114.114.114:53", "8.8.8.8:53", 16, builtinClassifier{})
+	p, err := newUpstreamPolicies([]string{"10.0.0.1=223.5.5.5+1.1.1.3"}, base, newDNSCache(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p[0].resolver.fastUpstream != "223.5.5.5:53" || p[0].resolver.cleanUpstream != "1.1.1.3:53" || base.fastUpstream != "114.114.114.114:53" {
+		t.Errorf("unexpected upstreams %s and %s", p[0].resolver.fastUpstream, p[0].resolver.cleanUpstream)
+	}
+	if p.match(&net.UDPAddr{IP: net.ParseIP("10.0.0.2")}) != nil || p.match(nil) != nil {
+		t.Error("expect no policy of the other clients")
+	}
+	for _, rule := range []string{"10.0.0.0/24", "10.0.0.0/33=223.5.5.5+1.1.1.3", "10.0.0.0/24=223.5.5.5"} {
+		if _, err := newUpstreamPolicies([]string{rule}, base, newDNSCache(16)); err == nil {
+			t.Errorf("expect an error of %s", rule)
+		}
+	}
+}
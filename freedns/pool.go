@@ -0,0 +1,113 @@
+package freedns
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// poolWarnInterval is how often the queries shed are logged at most.
+const poolWarnInterval = 10 * time.Second
+
+// workerPool resolves the queries on a fixed number of workers, with a
+// bounded queue of the queries waiting for them, so a burst can't exhaust the
+// memory of a small router by resolving every query at once. The queries
+// beyond the queue are shed.
+type workerPool struct {
+	slots chan struct{} // one per query admitted, running or queued
+	jobs  chan func()
+	done  <-chan struct{}
+
+	shed     int64 // atomic, the queries shed since the start
+	lastWarn int64 // atomic, the UnixNano of the last warning
+}
+
+// newWorkerPool starts the workers, which stop when `done` is closed. Up to
+// `queue` queries wait for a worker, none if it's 0 or negative.
+func newWorkerPool(workers int, queue int, done <-chan struct{}) *workerPool {
+	if queue < 0 {
+		queue = 0
+	}
+	p := &workerPool{
+		slots: make(chan struct{}, workers+queue),
+		jobs:  make(chan func(), workers+queue),
+		done:  done,
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case job := <-p.jobs:
+			job()
+		}
+	}
+}
+
+// run runs `job` on a worker and waits for it to finish. It returns false
+// without running it if all the workers are busy and the queue is full, or
+// the pool is stopped before a worker takes it.
+func (p *workerPool) run(job func()) bool {
+	// The admission is counted by the slots rather than by the buffer of
+	// jobs, which an idle worker may not be waiting on at the moment.
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		p.shedOne()
+		return false
+	}
+	var state int32 // 1 when a worker takes it, 2 when it's given up
+	finished := make(chan struct{})
+	// never blocks, as there are as many jobs buffered as the slots
+	p.jobs <- func() {
+		if !atomic.CompareAndSwapInt32(&state, 0, 1) {
+			<-p.slots
+			return
+		}
+		// the slot is free before run returns, for the next query
+		defer func() {
+			<-p.slots
+			close(finished)
+		}()
+		job()
+	}
+	select {
+	case <-finished:
+	case <-p.done:
+		if atomic.CompareAndSwapInt32(&state, 0, 2) {
+			return false
+		}
+		<-finished
+	}
+	return true
+}
+
+// shedOne counts a query shed, and warns of the queries shed at most every
+// poolWarnInterval.
+func (p *workerPool) shedOne() {
+	n := atomic.AddInt64(&p.shed, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&p.lastWarn)
+	if now-last >= int64(poolWarnInterval) && atomic.CompareAndSwapInt64(&p.lastWarn, last, now) {
+		log.WithFields(logrus.Fields{
+			"op":   "pool",
+			"shed": n,
+		}).Warn("all the workers are busy and the queue is full, answering REFUSED")
+	}
+}
+
+// responseBusy returns the REFUSED response for the request shed by the pool.
+func responseBusy(req *dns.Msg) *dns.Msg {
+	res := &dns.Msg{}
+	res.SetRcode(req, dns.RcodeRefused)
+	setEDE(res, req, edeOther, "server busy")
+	return res
+}
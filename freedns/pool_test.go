@@ -0,0 +1,81 @@
+package freedns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// occupy keeps a worker of the pool busy until the returned function is
+// called.
+func occupy(t *testing.T, p *workerPool) func() {
+	started, release, shed := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		if !p.run(func() {
+			close(started)
+			<-release
+		}) {
+			close(shed)
+		}
+	}()
+	select {
+	case <-started:
+	case <-shed:
+		t.Fatal("expect a worker free to occupy")
+	case <-time.After(time.Second):
+		t.Fatal("expect the worker to start in a second")
+	}
+	return func() { close(release) }
+}
+
+func TestWorkerPool(t *testing.T) {
+	done := make(chan struct{})
+	p := newWorkerPool(1, 0, done)
+	// an idle worker always takes the job, even without a queue
+	for i := 0; i < 100; i++ {
+		if !p.run(func() {}) {
+			t.Fatalf("expect the job %d run by the idle worker", i)
+		}
+	}
+	release := occupy(t, p)
+	if p.run(func() { t.Error("the job beyond the queue should not run") }) {
+		t.Error("expect the job to be shed")
+	}
+	release()
+
+	ran := false
+	for i := 0; i < 100 && !ran; i++ {
+		// the worker may not be back yet
+		if !p.run(func() { ran = true }) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if !ran {
+		t.Error("expect the job to run once the worker is free")
+	}
+
+	// the queued job is given up when the pool stops
+	p = newWorkerPool(1, 1, done)
+	release = occupy(t, p)
+	defer release()
+	close(done)
+	if p.run(func() { t.Error("the job given up should not run") }) {
+		t.Error("expect the queued job to be given up")
+	}
+}
+
+func TestHandleBusy(t *testing.T) {
+	s := newTestServer(t, Config{MaxConcurrent: 1, QueueLimit: -1})
+	defer s.Shutdown()
+	release := occupy(t, s.pool)
+	defer release()
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := newRecorder()
+	s.handle(w, req, "udp")
+	if w.msg == nil || w.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("expect REFUSED with the workers busy, got %v", w.msg)
+	}
+}
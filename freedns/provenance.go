@@ -0,0 +1,171 @@
+package freedns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// The verdicts of the cached answers. The clean answers and the fast ones
+// pointing to China are trusted alike, as the poisoned answers point out of
+// China; the unverified ones are trusted less.
+const (
+	verdictClean      = "clean"      // answered by the clean upstream
+	verdictChina      = "china"      // the fast answer points to China
+	verdictUnverified = "unverified" // the other fast answers, e.g. as the clean upstream failed
+)
+
+// conflictLogSize is how many refresh conflicts are kept for the admin API.
+const conflictLogSize = 100
+
+// provenance is which upstream produced a cached answer, and what the
+// resolver made of it. It's empty for the answers cached otherwise, e.g. by
+// the overrides or the replicas.
+type provenance struct {
+	upstream string
+	verdict  string
+}
+
+// trust ranks the verdict, -1 if it's unknown.
+func (p provenance) trust() int {
+	switch p.verdict {
+	case verdictClean, verdictChina:
+		return 1
+	case verdictUnverified:
+		return 0
+	}
+	return -1
+}
+
+// provenance tags the answer resolved by the upstream.
+func (resolver *spoofingProofResolver) provenance(res *dns.Msg, upstream string) provenance {
+	p := provenance{upstream: upstream, verdict: verdictUnverified}
+	if upstream == resolver.cleanUpstream {
+		p.verdict = verdictClean
+	} else if resolver.containsChinaIP(res) {
+		p.verdict = verdictChina
+	}
+	return p
+}
+
+// answersConflict returns if the answers share nothing: no IP if both have
+// some, or else no record of the answer sections, regardless of the TTLs.
+func answersConflict(old *dns.Msg, res *dns.Msg) bool {
+	oldIPs, ips := answerIPs(old), answerIPs(res)
+	if len(oldIPs) > 0 && len(ips) > 0 {
+		return !shareAny(oldIPs, ips)
+	}
+	return !shareAny(answerRecords(old), answerRecords(res))
+}
+
+// answerRecords returns the records of the answer section in the
+// presentation format without the TTLs.
+func answerRecords(res *dns.Msg) []string {
+	var records []string
+	for _, rr := range res.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		records = append(records, strings.ToLower(rr.String()))
+	}
+	return records
+}
+
+// shareAny returns if `a` and `b` share an item, or are both empty.
+func shareAny(a []string, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	set := map[string]bool{}
+	for _, s := range a {
+		set[s] = true
+	}
+	for _, s := range b {
+		if set[s] {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshConflict is a refresh of a cached answer refused as it came from a
+// less trusted source than the cached one, and conflicts with it.
+type refreshConflict struct {
+	Time          time.Time `json:"time"`
+	Name          string    `json:"name"`
+	Type          string    `json:"type"`
+	KeptUpstream  string    `json:"kept_upstream"`
+	KeptVerdict   string    `json:"kept_verdict"`
+	Kept          []string  `json:"kept"` // the answer records
+	FreshUpstream string    `json:"fresh_upstream"`
+	FreshVerdict  string    `json:"fresh_verdict"`
+	Fresh         []string  `json:"fresh"`
+}
+
+// conflictLog keeps the latest refresh conflicts.
+type conflictLog struct {
+	mu     sync.Mutex
+	events []refreshConflict // the oldest first
+}
+
+func (l *conflictLog) record(e refreshConflict) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+	if len(l.events) > conflictLogSize {
+		l.events = l.events[len(l.events)-conflictLogSize:]
+	}
+}
+
+// latest returns the conflicts, the latest first.
+func (l *conflictLog) latest() []refreshConflict {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := make([]refreshConflict, len(l.events))
+	for i, e := range l.events {
+		events[len(events)-1-i] = e
+	}
+	return events
+}
+
+// refresh caches the fresh answer of the upstream in place of the expiring
+// one, unless it comes from a less trusted source than the cached answer and
+// conflicts with it, e.g. a poisoned answer of the fast upstream as the clean
+// one fails. The cached answer is kept then, refreshed again on the next
+// lookup, and the conflict is logged. It returns if the answer was cached.
+func (s *Server) refresh(res *dns.Msg, net string, p provenance) bool {
+	return s.refreshCache(s.recordsCache, res, net, p)
+}
+
+// refreshCache is refresh on `cache`, e.g. of an upstream policy.
+func (s *Server) refreshCache(cache *dnsCache, res *dns.Msg, net string, p provenance) bool {
+	q := res.Question[0]
+	if old, ok := cache.entry(q, res.RecursionDesired, net); ok && p.trust() < old.provenance.trust() && answersConflict(old.reply, res) {
+		e := refreshConflict{
+			Time:          time.Now(),
+			Name:          q.Name,
+			Type:          dns.TypeToString[q.Qtype],
+			KeptUpstream:  old.provenance.upstream,
+			KeptVerdict:   old.provenance.verdict,
+			Kept:          answerRecords(old.reply),
+			FreshUpstream: p.upstream,
+			FreshVerdict:  p.verdict,
+			Fresh:         answerRecords(res),
+		}
+		s.conflicts.record(e)
+		log.WithFields(logrus.Fields{
+			"op":       "refresh_conflict",
+			"domain":   q.Name,
+			"type":     e.Type,
+			"kept":     old.provenance.verdict,
+			"upstream": p.upstream,
+			"verdict":  p.verdict,
+			"fresh":    strings.Join(answerIPs(res), ","),
+		}).Warn("kept the cached answer over a conflicting refresh from a less trusted source")
+		return false
+	}
+	cache.setFrom(res, net, p)
+	return true
+}
@@ -0,0 +1,89 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func answerOf(name string, ip string) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(name, dns.TypeA)
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Answer = append(res.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP(ip),
+	})
+	return res
+}
+
+func TestRefreshProvenance(t *testing.T) {
+	s := newTestServer(t, Config{FastDNS: "127.0.0.1:1", CleanDNS: "127.0.0.2:1"})
+	defer s.Shutdown()
+	clean := provenance{upstream: "127.0.0.2:1", verdict: verdictClean}
+	fast := provenance{upstream: "127.0.0.1:1", verdict: verdictUnverified}
+
+	if p := s.resolver.provenance(answerOf("example.com.", "8.8.8.8"), "127.0.0.2:1"); p != clean {
+		t.Errorf("expect the clean verdict, got %+v", p)
+	}
+	if p := s.resolver.provenance(answerOf("example.com.", "114.114.114.114"), "127.0.0.1:1"); p.verdict != verdictChina {
+		t.Errorf("expect the china verdict, got %+v", p)
+	}
+	if p := s.resolver.provenance(answerOf("example.com.", "8.8.8.8"), "127.0.0.1:1"); p != fast {
+		t.Errorf("expect the unverified verdict, got %+v", p)
+	}
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	s.recordsCache.setFrom(answerOf("example.com.", "93.184.216.34"), "udp", clean)
+	if s.refresh(answerOf("example.com.", "10.0.0.1"), "udp", fast) {
+		t.Error("a conflicting unverified refresh should be refused")
+	}
+	if res, _ := s.recordsCache.lookup(q, true, "udp"); res.Answer[0].(*dns.A).A.String() != "93.184.216.34" {
+		t.Errorf("the clean answer should be kept, got %v", res.Answer)
+	}
+	conflicts := s.conflicts.latest()
+	if len(conflicts) != 1 || conflicts[0].KeptVerdict != verdictClean || conflicts[0].FreshUpstream != "127.0.0.1:1" {
+		t.Errorf("the conflict should be recorded, got %+v", conflicts)
+	}
+
+	// the agreeing or more trusted answers are cached
+	if !s.refresh(answerOf("example.com.", "93.184.216.34"), "udp", fast) {
+		t.Error("an agreeing unverified refresh should be cached")
+	}
+	if !s.refresh(answerOf("example.com.", "10.0.0.2"), "udp", clean) {
+		t.Error("a clean refresh should be cached")
+	}
+	if entry, _ := s.recordsCache.entry(q, true, "udp"); entry.provenance != clean {
+		t.Errorf("expect the provenance of the refresh, got %+v", entry.provenance)
+	}
+
+	// the untagged answers are always refreshed
+	s.recordsCache.set(answerOf("example.org.", "93.184.216.34"), "udp")
+	if !s.refresh(answerOf("example.org.", "10.0.0.1"), "udp", fast) {
+		t.Error("an untagged answer should be refreshed")
+	}
+}
+
+func TestCacheEntryEncoding(t *testing.T) {
+	putin := time.Unix(1600000000, 0)
+	for _, p := range []provenance{{}, {upstream: "8.8.8.8:53", verdict: verdictClean}} {
+		entry := cacheEntry{putin: putin, reply: answerOf("example.com.", "93.184.216.34"), provenance: p}
+		b, err := entry.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeCacheEntry(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.putin.Equal(putin) || got.provenance != p || len(got.reply.Answer) != 1 {
+			t.Errorf("expect the entry back, got %+v", got)
+		}
+	}
+	if _, err := decodeCacheEntry([]byte{0x80, 0, 0, 0, 0, 0, 0, 0, 9}); err == nil {
+		t.Error("expect an error for the truncated tags")
+	}
+}
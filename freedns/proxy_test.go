@@ -0,0 +1,108 @@
+package freedns
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// connectProxy serves CONNECT for the clients with the credentials
+// user:password, and returns its address.
+func connectProxy(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNzd29yZA==" {
+					io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(upstream, c)
+				io.Copy(c, upstream)
+			}(c)
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestDialProxy(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+	proxyAddr, stop := connectProxy(t)
+	defer stop()
+
+	proxy, err := parseUpstreamProxy("http://user:password@" + proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialProxy(proxy, echo.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expect ping echoed through the proxy, got %q, %v", buf, err)
+	}
+
+	noAuth, _ := parseUpstreamProxy("http://" + proxyAddr)
+	if _, err := dialProxy(noAuth, echo.Addr().String(), time.Second); err == nil {
+		t.Error("expect an error without the credentials")
+	}
+}
+
+func TestParseUpstreamProxy(t *testing.T) {
+	if u, err := parseUpstreamProxy(""); u != nil || err != nil {
+		t.Errorf("expect no proxy, got %v, %v", u, err)
+	}
+	if u, err := parseUpstreamProxy("http://10.0.0.1"); err != nil || u.Host != "10.0.0.1:80" {
+		t.Errorf("expect the default port, got %v, %v", u, err)
+	}
+	for _, proxy := range []string{"socks5://10.0.0.1:1080", "10.0.0.1:3128"} {
+		if _, err := parseUpstreamProxy(proxy); err == nil {
+			t.Errorf("expect an error of %s", proxy)
+		}
+	}
+
+	orig := os.Getenv("HTTPS_PROXY")
+	defer os.Setenv("HTTPS_PROXY", orig)
+	os.Setenv("HTTPS_PROXY", "http://10.0.0.1:3128")
+	if u, err := parseUpstreamProxy("env"); err != nil || u.Host != "10.0.0.1:3128" {
+		t.Errorf("expect the proxy of HTTPS_PROXY, got %v, %v", u, err)
+	}
+}
@@ -0,0 +1,92 @@
+package freedns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The actions of the qtype rules.
+const (
+	qtypeRefuse = "refuse" // answer REFUSED
+	qtypeDrop   = "drop"   // answer nothing, as if the query was lost
+)
+
+// qtypeRule refuses or drops the queries of the qtype, for the names under
+// the domain and from the clients if given.
+type qtypeRule struct {
+	qtype   uint16
+	domain  string     // all the names if empty
+	clients *net.IPNet // all the clients if nil
+	action  string
+}
+
+// qtypeRules filter the queries by their qtypes before the cache and the
+// upstreams, e.g. the TXT queries of a tunneling domain, or the PTR queries
+// of the guests. The first matching rule takes effect.
+type qtypeRules []*qtypeRule
+
+// newQtypeRules parses the rules in the form of `qtype[@where...]=action`,
+// each `where` a domain or the IP or CIDR of the clients, all of which must
+// match, e.g. `ANY=refuse`, `TXT@example.com=drop` or
+// `PTR@in-addr.arpa@192.168.20.0/24=refuse`.
+func newQtypeRules(rules []string) (qtypeRules, error) {
+	var r qtypeRules
+	for _, s := range rules {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 {
+			return nil, Error("invalid qtype rule, expect qtype[@domain][@clients]=action: " + s)
+		}
+		rule := &qtypeRule{action: parts[1]}
+		if rule.action != qtypeRefuse && rule.action != qtypeDrop {
+			return nil, Error("invalid action of qtype rule, expect refuse or drop: " + s)
+		}
+		where := strings.Split(parts[0], "@")
+		qtype, ok := dns.StringToType[strings.ToUpper(where[0])]
+		if !ok {
+			return nil, Error("invalid qtype of qtype rule: " + s)
+		}
+		rule.qtype = qtype
+		for _, w := range where[1:] {
+			if strings.Contains(w, "/") || net.ParseIP(w) != nil {
+				prefixes, err := parseClientPrefixes([]string{w})
+				if err != nil || rule.clients != nil {
+					return nil, Error("invalid clients of qtype rule: " + s)
+				}
+				rule.clients = prefixes[0]
+			} else if _, ok := dns.IsDomainName(w); ok && w != "" && rule.domain == "" {
+				rule.domain = strings.ToLower(dns.Fqdn(w))
+			} else {
+				return nil, Error("invalid domain of qtype rule: " + s)
+			}
+		}
+		r = append(r, rule)
+	}
+	return r, nil
+}
+
+// match returns the first rule matching any question of the request from the
+// client, or nil if none does.
+func (r qtypeRules) match(req *dns.Msg, client net.Addr) *qtypeRule {
+	for _, rule := range r {
+		if rule.clients != nil && !containsClient([]*net.IPNet{rule.clients}, client) {
+			continue
+		}
+		for _, q := range req.Question {
+			if q.Qtype == rule.qtype && (rule.domain == "" || dns.IsSubDomain(rule.domain, strings.ToLower(q.Name))) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// responseRefused returns the REFUSED response to the request refused by the
+// rule.
+func (rule *qtypeRule) responseRefused(req *dns.Msg) *dns.Msg {
+	res := &dns.Msg{}
+	res.SetRcode(req, dns.RcodeRefused)
+	setEDE(res, req, edeBlocked, "qtype "+dns.TypeToString[rule.qtype])
+	return res
+}
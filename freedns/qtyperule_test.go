@@ -0,0 +1,45 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQtypeRules(t *testing.T) {
+	s := newTestServer(t, Config{
+		QtypeRules: []string{"ANY=refuse", "TXT@tunnel.example=drop", "PTR@192.168.20.0/24=refuse"},
+		Pins:       []string{"nas.example.com=192.168.1.10"},
+	})
+	for _, c := range []struct {
+		name   string
+		qtype  uint16
+		client string
+		rcode  int // -1 for no response
+	}{
+		{"example.com.", dns.TypeANY, "192.168.10.7", dns.RcodeRefused},
+		{"a.tunnel.example.", dns.TypeTXT, "192.168.10.7", -1},
+		{"1.1.168.192.in-addr.arpa.", dns.TypePTR, "192.168.20.7", dns.RcodeRefused},
+		{"nas.example.com.", dns.TypeA, "192.168.20.7", dns.RcodeSuccess},
+	} {
+		req := &dns.Msg{}
+		req.SetQuestion(c.name, c.qtype)
+		req.SetEdns0(1232, false)
+		w := newRecorder()
+		w.remote = &net.UDPAddr{IP: net.ParseIP(c.client), Port: 12345}
+		s.handle(w, req, "udp")
+		switch {
+		case c.rcode == -1 && w.msg != nil:
+			t.Errorf("expect %s %s dropped, got %v", c.name, dns.TypeToString[c.qtype], w.msg)
+		case c.rcode != -1 && (w.msg == nil || w.msg.Rcode != c.rcode):
+			t.Errorf("expect %s %s answered %s, got %v", c.name, dns.TypeToString[c.qtype], dns.RcodeToString[c.rcode], w.msg)
+		}
+	}
+
+	for _, rule := range []string{"TXT", "NOPE=refuse", "TXT=allow", "TXT@10.0.0.0/33=drop", "TXT@a.example@b.example=drop"} {
+		if _, err := newQtypeRules([]string{rule}); err == nil {
+			t.Errorf("expect an error of %s", rule)
+		}
+	}
+}
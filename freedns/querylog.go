@@ -0,0 +1,227 @@
+package freedns
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Cache status of the queries in the query log.
+const (
+	cacheHit  = "hit"
+	cacheMiss = "miss"
+	cacheNone = "none" // answered without the cache, e.g. blocked
+)
+
+// queryLogEntry is a line of the query log. Policy is the name of the upstream
+// policy of the client if it has one.
+type queryLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Rcode    string    `json:"rcode"`
+	Upstream string    `json:"upstream"`
+	Latency  float64   `json:"latency_ms"`
+	Cache    string    `json:"cache"`
+	Policy   string    `json:"policy,omitempty"`
+}
+
+// upstreamLogEntry is a line of the upstream log, an exchange with an
+// upstream. Retries counts the source ports tried before one could be bound,
+// and Dropped the responses not matching the query.
+type upstreamLogEntry struct {
+	Time      time.Time `json:"time"`
+	Upstream  string    `json:"upstream"`
+	Net       string    `json:"net"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Rcode     string    `json:"rcode,omitempty"`
+	Truncated bool      `json:"truncated"`
+	Retries   int       `json:"retries"`
+	Dropped   int       `json:"dropped"`
+	Latency   float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// queryLog appends the queries, or the upstream exchanges, to a file as JSON
+// lines, separately from the app log. The file is rotated when it grows over
+// maxSize or gets older than interval, and the rotated files are gzipped in
+// the background. Only the latest `backups` rotated files are kept, or all of
+// them if it's 0.
+type queryLog struct {
+	path     string
+	maxSize  int64
+	interval time.Duration
+	backups  int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	wg         sync.WaitGroup // the background compression
+	compressMu sync.Mutex     // compresses and prunes one file at a time
+}
+
+func newQueryLog(path string, maxSize int64, interval time.Duration, backups int) (*queryLog, error) {
+	q := &queryLog{
+		path:     path,
+		maxSize:  maxSize,
+		interval: interval,
+		backups:  backups,
+	}
+	if err := q.open(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *queryLog) open() error {
+	f, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	q.file = f
+	q.size = info.Size()
+	q.opened = time.Now()
+	return nil
+}
+
+func (q *queryLog) write(e interface{}) {
+	b, _ := json.Marshal(e)
+	b = append(b, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.file == nil {
+		return
+	}
+	if q.size > 0 && ((q.maxSize > 0 && q.size+int64(len(b)) > q.maxSize) ||
+		(q.interval > 0 && time.Since(q.opened) >= q.interval)) {
+		if err := q.rotate(); err != nil {
+			log.WithField("op", "query_log").Error(err)
+			if q.file == nil {
+				return
+			}
+		}
+	}
+
+	n, err := q.file.Write(b)
+	q.size += int64(n)
+	if err != nil {
+		log.WithField("op", "query_log").Error(err)
+	}
+}
+
+// rotate renames the current file and opens a new one. q.mu must be held.
+func (q *queryLog) rotate() error {
+	q.file.Close()
+	q.file = nil
+
+	base := q.path + "." + time.Now().Format("20060102-150405.000000000")
+	rotated := base
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = base + "-" + strconv.Itoa(i)
+	}
+	if err := os.Rename(q.path, rotated); err != nil {
+		// keep writing to the current file
+		if err := q.open(); err != nil {
+			return err
+		}
+		return err
+	}
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.compressMu.Lock()
+		defer q.compressMu.Unlock()
+		l := log.WithField("op", "query_log")
+		if err := gzipFile(rotated); err != nil {
+			l.Error(err)
+		}
+		if err := q.prune(); err != nil {
+			l.Error(err)
+		}
+	}()
+	return q.open()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// prune removes the oldest rotated files beyond q.backups.
+func (q *queryLog) prune() error {
+	if q.backups <= 0 {
+		return nil
+	}
+	files, err := filepath.Glob(q.path + ".*.gz")
+	if err != nil {
+		return err
+	}
+	// the timestamps in the names sort by time
+	sort.Strings(files)
+	for len(files) > q.backups {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// gzipFile compresses the file into `path.gz` and removes the original.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (q *queryLog) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.wg.Wait()
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
@@ -0,0 +1,141 @@
+package freedns
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/tuna/freedns-go/decisiontest"
+)
+
+func TestQueryLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns-querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "query.log")
+
+	// every entry is larger than 100 bytes, so each one goes to a new file
+	q, err := newQueryLog(path, 100, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		q.write(queryLogEntry{Name: "example.com.", Type: "A", Rcode: "NOERROR", Upstream: "127.0.0.1:53", Cache: cacheMiss})
+	}
+	if err := q.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("expect 2 rotated files kept, got %v", rotated)
+	}
+	for _, name := range rotated {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("%s should be gzipped: %v", name, err)
+		}
+		var e queryLogEntry
+		if err := json.NewDecoder(zr).Decode(&e); err != nil || e.Name != "example.com." {
+			t.Errorf("%s: unexpected entry %+v, %v", name, e, err)
+		}
+		f.Close()
+	}
+}
+
+func TestQueryLogHandle(t *testing.T) {
+	blocklist := writeTempFile(t, "example.com\n")
+	defer os.Remove(blocklist)
+	path := writeTempFile(t, "")
+	defer os.Remove(path)
+
+	s := newTestServer(t, Config{
+		Blocklists: []string{blocklist},
+		QueryLog:   path,
+	})
+	req := &dns.Msg{}
+	req.SetQuestion("ads.example.com.", dns.TypeAAAA)
+	s.handle(newRecorder(), req, "udp")
+	s.queryLog.close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("the query should be logged")
+	}
+	var e queryLogEntry
+	if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Client != "127.0.0.1" || e.Name != "ads.example.com." || e.Type != "AAAA" ||
+		e.Rcode != "NXDOMAIN" || e.Upstream != "blocklist" || e.Cache != cacheNone || e.Time.IsZero() {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestUpstreamLog(t *testing.T) {
+	upstream, stop := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.Answer, IPs: []string{"1.2.3.4"}})
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "freedns-upstreamlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "upstream.log")
+	ulog, err := newQueryLog(path, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if _, err := naiveResolve(context.Background(), q, true, "udp", upstream, &upstreamClient{log: ulog}); err != nil {
+		t.Fatal(err)
+	}
+	// nothing listens on the tcp port
+	naiveResolve(context.Background(), q, true, "tcp", upstream, &upstreamClient{log: ulog})
+	ulog.close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []upstreamLogEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e upstreamLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expect 2 exchanges logged, got %+v", entries)
+	}
+	if e := entries[0]; e.Upstream != upstream || e.Net != "udp" || e.Name != q.Name || e.Type != "A" || e.Rcode != "NOERROR" || e.Error != "" {
+		t.Errorf("unexpected udp exchange %+v", e)
+	}
+	if e := entries[1]; e.Net != "tcp" || e.Rcode != "" || e.Error == "" {
+		t.Errorf("the failed tcp exchange should have the error, got %+v", e)
+	}
+}
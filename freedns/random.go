@@ -0,0 +1,35 @@
+package freedns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// randomSource is where the query IDs and the source ports of the upstream
+// queries come from. It's crypto/rand, so neither can be predicted by the
+// attackers spoofing the responses. Tests may replace it.
+var randomSource io.Reader = rand.Reader
+
+func randomUint16() uint16 {
+	var b [2]byte
+	if _, err := io.ReadFull(randomSource, b[:]); err != nil {
+		panic("freedns: reading the random source: " + err.Error())
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// queryID returns a random ID for an upstream query.
+func queryID() uint16 {
+	return randomUint16()
+}
+
+// sourcePort returns a random non-privileged source port for an upstream
+// query over UDP.
+func sourcePort() int {
+	for {
+		if p := int(randomUint16()); p >= 1024 {
+			return p
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package freedns
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRandomSource(t *testing.T) {
+	orig := randomSource
+	defer func() { randomSource = orig }()
+
+	randomSource = bytes.NewReader([]byte{0x12, 0x34, 0x00, 0x01, 0x04, 0x00})
+	if id := queryID(); id != 0x1234 {
+		t.Errorf("expect the query ID from the random source, got %x", id)
+	}
+	// the privileged ports are skipped
+	if port := sourcePort(); port != 1024 {
+		t.Errorf("expect the source port 1024, got %d", port)
+	}
+
+	// the random source must not fail silently
+	defer func() {
+		if recover() == nil {
+			t.Errorf("an exhausted random source should panic")
+		}
+	}()
+	queryID()
+}
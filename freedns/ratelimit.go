@@ -0,0 +1,63 @@
+package freedns
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of the events to `rate` per second on average,
+// allowing bursts of up to `burst` events.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64 // negative when the coming tokens are reserved by waiters
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long to wait before it's available.
+// It takes nothing and returns false if the wait would exceed `timeout`.
+func (b *tokenBucket) reserve(timeout time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	if wait > timeout {
+		return 0, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// wait takes a token, waiting up to `timeout` for one to be available. It
+// returns false if there's no token within `timeout`.
+func (b *tokenBucket) wait(timeout time.Duration) bool {
+	d, ok := b.reserve(timeout)
+	if ok && d > 0 {
+		time.Sleep(d)
+	}
+	return ok
+}
@@ -0,0 +1,42 @@
+package freedns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 2)
+
+	// the burst
+	for i := 0; i < 2; i++ {
+		if d, ok := b.reserve(0); !ok || d != 0 {
+			t.Errorf("the burst should be available at once")
+		}
+	}
+
+	// no token now, and the next one comes in about 100ms
+	if _, ok := b.reserve(0); ok {
+		t.Errorf("the bucket should be empty")
+	}
+	d, ok := b.reserve(time.Second)
+	if !ok || d < 50*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("expect waiting about 100ms, got %v, %v", d, ok)
+	}
+	// the reserved token makes the next waiter wait longer
+	d, ok = b.reserve(time.Second)
+	if !ok || d < 150*time.Millisecond || d > 200*time.Millisecond {
+		t.Errorf("expect waiting about 200ms, got %v, %v", d, ok)
+	}
+	if _, ok := b.reserve(100 * time.Millisecond); ok {
+		t.Errorf("the wait exceeding the timeout should fail")
+	}
+
+	start := time.Now()
+	if !b.wait(time.Second) {
+		t.Errorf("wait should get a token")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("wait should wait for the reserved tokens, waited %v", elapsed)
+	}
+}
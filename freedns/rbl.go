@@ -0,0 +1,225 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tuna/freedns-go/chinaip"
+)
+
+// rblListed is the address a locally served DNSBL zone answers for the listed
+// IPs, the conventional 127.0.0.2.
+var rblListed = net.IPv4(127, 0, 0, 2)
+
+// The defaults of the DNSBL cache.
+const (
+	rblDefaultCacheCap = 4096
+	rblDefaultMaxTTL   = 5 * time.Minute
+)
+
+// rblZone is a DNSBL zone, which is either forwarded to the upstream or
+// served from the local list.
+type rblZone struct {
+	zone     string // normalized
+	upstream string
+	list     *chinaip.List
+}
+
+// rblEntry is a cached DNSBL response.
+type rblEntry struct {
+	reply   *dns.Msg
+	expires time.Time
+}
+
+// rbl answers the DNSBL queries, i.e. `4.3.2.1.zen.spamhaus.org` asking if
+// 1.2.3.4 is listed by zen.spamhaus.org. The lookups of mail servers are
+// mostly unique names with short TTLs, so they are cached in a cache of their
+// own which doesn't evict the main one, the negative answers are cached too,
+// and the entries are never served after they expire.
+type rbl struct {
+	zones  []*rblZone
+	maxTTL time.Duration
+	cache  Cache
+}
+
+// newRBL parses the zones in the form of `zone=host:port`, forwarding the zone
+// to the DNS server, or `zone=file:path`, serving the zone from a file of the
+// listed IPs and CIDRs.
+func newRBL(zones []string, cacheCap int, maxTTL time.Duration) (*rbl, error) {
+	if cacheCap <= 0 {
+		cacheCap = rblDefaultCacheCap
+	}
+	if maxTTL <= 0 {
+		maxTTL = rblDefaultMaxTTL
+	}
+	r := &rbl{maxTTL: maxTTL}
+	for _, z := range zones {
+		parts := strings.SplitN(z, "=", 2)
+		if len(parts) != 2 || normalizeDomain(parts[0]) == "" || parts[1] == "" {
+			return nil, Error("invalid DNSBL zone, expect zone=host:port or zone=file:path: " + z)
+		}
+		zone := &rblZone{zone: normalizeDomain(parts[0])}
+		if strings.HasPrefix(parts[1], "file:") {
+			list, err := loadCIDRFiles([]string{strings.TrimPrefix(parts[1], "file:")})
+			if err != nil {
+				return nil, err
+			}
+			zone.list = list
+		} else {
+			zone.upstream = appendDefaultPort(parts[1])
+		}
+		r.zones = append(r.zones, zone)
+	}
+	r.cache = NewMemoryCache(cacheCap)
+	return r, nil
+}
+
+// match returns the zone of the name, or nil if it's not a DNSBL query.
+func (r *rbl) match(name string) *rblZone {
+	name = normalizeDomain(name)
+	for _, z := range r.zones {
+		if name == z.zone || strings.HasSuffix(name, "."+z.zone) {
+			return z
+		}
+	}
+	return nil
+}
+
+// resolve answers the DNSBL query of the zone, and returns the response and
+// which upstream is used.
+func (r *rbl) resolve(z *rblZone, req *dns.Msg, net string) (*dns.Msg, string) {
+	q := req.Question[0]
+	if z.list != nil {
+		return r.serve(z, req), "rbl"
+	}
+
+	key := requestToString(q, req.RecursionDesired, net)
+	if v, ok := r.cache.Get(key); ok {
+		entry := v.(rblEntry)
+		if left := time.Until(entry.expires); left > 0 {
+			res := entry.reply.Copy()
+			setTTL(res, uint32(left/time.Second)+1)
+			res.SetRcode(req, res.Rcode)
+			return res, "cache"
+		}
+	}
+
+	res, err := naiveResolve(context.Background(), q, req.RecursionDesired, net, z.upstream, nil)
+	if err != nil || res == nil {
+		res = &dns.Msg{}
+		res.SetRcode(req, dns.RcodeServerFailure)
+		return res, z.upstream
+	}
+	if ttl := r.ttl(res); ttl > 0 {
+		// the clients don't keep it longer than the cache either
+		setTTL(res, uint32(ttl/time.Second))
+		r.cache.Set(key, rblEntry{
+			reply:   res.Copy(),
+			expires: time.Now().Add(ttl),
+		})
+	}
+	res.SetRcode(req, res.Rcode)
+	return res, z.upstream
+}
+
+// ttl returns how long the response can be cached for, which is 0 if it can
+// not be cached. The negative answers are cached as long as the SOA says.
+func (r *rbl) ttl(res *dns.Msg) time.Duration {
+	if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+		return 0
+	}
+	ttl := uint32(0)
+	first := true
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns} {
+		for _, rr := range rrs {
+			t := rr.Header().Ttl
+			if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < t {
+				t = soa.Minttl
+			}
+			if first || t < ttl {
+				ttl, first = t, false
+			}
+		}
+	}
+	d := time.Duration(ttl) * time.Second
+	if d > r.maxTTL {
+		d = r.maxTTL
+	}
+	return d
+}
+
+func setTTL(res *dns.Msg, ttl uint32) {
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > ttl {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+}
+
+// serve answers the query from the local list: 127.0.0.2 for A queries and
+// a TXT record for TXT queries if the IP is listed, and NXDOMAIN otherwise.
+func (r *rbl) serve(z *rblZone, req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Authoritative = true
+
+	ip := rblQueryIP(normalizeDomain(q.Name), z.zone)
+	if ip == nil || !z.list.Contains(ip.String()) {
+		res.Rcode = dns.RcodeNameError
+		return res
+	}
+
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(r.maxTTL / time.Second),
+	}
+	switch q.Qtype {
+	case dns.TypeA:
+		res.Answer = append(res.Answer, &dns.A{Hdr: hdr, A: rblListed})
+	case dns.TypeTXT:
+		res.Answer = append(res.Answer, &dns.TXT{Hdr: hdr, Txt: []string{ip.String() + " is listed by " + z.zone}})
+	}
+	return res
+}
+
+// rblQueryIP returns the IP of the DNSBL query name, i.e. the reversed IPv4
+// octets or IPv6 nibbles before the zone, or nil if it's not one.
+func rblQueryIP(name string, zone string) net.IP {
+	if !strings.HasSuffix(name, "."+zone) {
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(name, "."+zone), ".")
+	switch len(labels) {
+	case 4:
+		ip := make(net.IP, 4)
+		for i, l := range labels {
+			v, err := strconv.ParseUint(l, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[3-i] = byte(v)
+		}
+		return ip
+	case 32:
+		ip := make(net.IP, 16)
+		for i, l := range labels {
+			v, err := strconv.ParseUint(l, 16, 4)
+			if err != nil || len(l) != 1 {
+				return nil
+			}
+			n := 31 - i
+			ip[n/2] |= byte(v) << uint(4*(1-n%2))
+		}
+		return ip
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package freedns
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRBLQueryIP(t *testing.T) {
+	cases := []struct {
+		name string
+		ip   string
+	}{
+		{"2.0.0.127.zen.example", "127.0.0.2"},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example", "2001:db8::1"},
+		{"0.0.127.zen.example", ""},
+		{"256.0.0.127.zen.example", ""},
+		{"2.0.0.127.other.example", ""},
+	}
+	for _, c := range cases {
+		got := rblQueryIP(c.name, "zen.example")
+		if c.ip == "" {
+			if got != nil {
+				t.Errorf("%s should not be a DNSBL query, got %s", c.name, got)
+			}
+		} else if !got.Equal(net.ParseIP(c.ip)) {
+			t.Errorf("%s should query %s, got %s", c.name, c.ip, got)
+		}
+	}
+}
+
+func TestRBLLocalZone(t *testing.T) {
+	list := writeTempFile(t, "192.0.2.0/24\n2001:db8::/32\n")
+	defer os.Remove(list)
+
+	// the DNSBL answers are not refused by the rebind protection
+	s := newTestServer(t, Config{
+		RBLZones:         []string{"rbl.lan=file:" + list},
+		RebindProtection: true,
+	})
+	cases := []struct {
+		name  string
+		qtype uint16
+		rcode int
+	}{
+		{"1.2.0.192.rbl.lan.", dns.TypeA, dns.RcodeSuccess},
+		{"1.2.0.192.RBL.lan.", dns.TypeTXT, dns.RcodeSuccess},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.rbl.lan.", dns.TypeA, dns.RcodeSuccess},
+		{"1.1.1.1.rbl.lan.", dns.TypeA, dns.RcodeNameError},
+		{"rbl.lan.", dns.TypeA, dns.RcodeNameError},
+	}
+	for _, c := range cases {
+		req := &dns.Msg{}
+		req.SetQuestion(c.name, c.qtype)
+		w := newRecorder()
+		s.handle(w, req, "udp")
+		if w.msg.Rcode != c.rcode {
+			t.Errorf("%s: expect rcode %d, got %d", c.name, c.rcode, w.msg.Rcode)
+			continue
+		}
+		if c.rcode == dns.RcodeSuccess {
+			if len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Rrtype != c.qtype {
+				t.Errorf("%s: unexpected answers %v", c.name, w.msg.Answer)
+			} else if a, ok := w.msg.Answer[0].(*dns.A); ok && !a.A.Equal(rblListed) {
+				t.Errorf("%s: expect 127.0.0.2, got %s", c.name, a.A)
+			}
+		}
+	}
+
+	if _, err := newRBL([]string{"rbl.lan"}, 0, 0); err == nil {
+		t.Errorf("zones without the source should be errors")
+	}
+}
+
+func TestRBLForwardCache(t *testing.T) {
+	var queries int32
+	zone, stop := fakeUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		res := &dns.Msg{}
+		res.SetRcode(req, dns.RcodeNameError)
+		soa, _ := dns.NewRR("zen.example. 3600 IN SOA ns.zen.example. root.zen.example. 1 3600 600 86400 60")
+		res.Ns = append(res.Ns, soa)
+		w.WriteMsg(res)
+	})
+	defer stop()
+
+	s := newTestServer(t, Config{
+		RBLZones: []string{"zen.example=" + zone},
+	})
+	for i, upstream := range []string{zone, "cache"} {
+		req := &dns.Msg{}
+		req.SetQuestion("2.0.0.127.zen.example.", dns.TypeA)
+		res, u := s.rbl.resolve(s.rbl.match(req.Question[0].Name), req, "udp")
+		if res.Rcode != dns.RcodeNameError || u != upstream || res.Id != req.Id {
+			t.Errorf("query %d: expect NXDOMAIN from %s, got %s from %s", i, upstream, dns.RcodeToString[res.Rcode], u)
+		}
+		// the negative TTL of the SOA is used
+		if len(res.Ns) != 1 || res.Ns[0].Header().Ttl > 60 {
+			t.Errorf("query %d: expect the SOA with ttl <= 60, got %v", i, res.Ns)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("expect 1 upstream query, got %d", n)
+	}
+}
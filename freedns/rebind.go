@@ -0,0 +1,81 @@
+package freedns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// rebindAllowedDomains may always resolve to private addresses.
+var rebindAllowedDomains = []string{"localhost", "local", "lan", "home.arpa", "internal"}
+
+// privateNets are the addresses a public domain should never resolve to.
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rebindGuard protects the clients from DNS rebinding by detecting the
+// answers of public domains containing private addresses.
+type rebindGuard struct {
+	allowed domainSet
+}
+
+func newRebindGuard(allow []string) *rebindGuard {
+	g := &rebindGuard{allowed: domainSet{}}
+	for _, d := range rebindAllowedDomains {
+		g.allowed.add(d)
+	}
+	for _, d := range allow {
+		g.allowed.add(d)
+	}
+	return g
+}
+
+// violates returns the private address in the answer of `res` if the name is
+// not allowed to have one, or nil.
+func (g *rebindGuard) violates(res *dns.Msg) net.IP {
+	if len(res.Question) == 0 || g.allowed.match(res.Question[0].Name) {
+		return nil
+	}
+	for _, rr := range res.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if isPrivateIP(ip) {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRebindGuard(t *testing.T) {
+	g := newRebindGuard([]string{"corp.example.com"})
+
+	cases := []struct {
+		name    string
+		ip      string
+		violate bool
+	}{
+		{"evil.com.", "192.168.1.1", true},
+		{"evil.com.", "127.0.0.1", true},
+		{"evil.com.", "::ffff:10.0.0.1", true},
+		{"evil.com.", "fd00::1", true},
+		{"evil.com.", "fe80::1", true},
+		{"example.com.", "93.184.216.34", false},
+		{"example.com.", "2606:2800:220:1::248", false},
+		{"nas.lan.", "192.168.1.2", false},
+		{"printer.local.", "169.254.0.2", false},
+		{"git.corp.example.com.", "10.0.0.2", false},
+	}
+	for _, c := range cases {
+		res := &dns.Msg{}
+		res.SetQuestion(c.name, dns.TypeA)
+		ip := net.ParseIP(c.ip)
+		hdr := dns.RR_Header{Name: c.name, Class: dns.ClassINET, Ttl: 60}
+		if ip.To4() != nil {
+			hdr.Rrtype = dns.TypeA
+			res.Answer = append(res.Answer, &dns.A{Hdr: hdr, A: ip})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			res.Answer = append(res.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+		if got := g.violates(res) != nil; got != c.violate {
+			t.Errorf("%s -> %s: violates should be %v", c.name, c.ip, c.violate)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package freedns
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recursiveUpstream is the upstream resolved iteratively from the root
+// servers, instead of an address, e.g. `-c recursive`.
+const recursiveUpstream = "recursive"
+
+// rootHints are the IPv4 addresses of a to m.root-servers.net.
+var rootHints = []string{
+	"198.41.0.4", "199.9.14.201", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+// The limits of an iterative resolution, so a broken or malicious
+// delegation can't loop. A depth is a CNAME followed or an NS name resolved.
+const (
+	iterativeMaxReferrals    = 16
+	iterativeMaxDepth        = 8
+	iterativeServerTimeout   = 800 * time.Millisecond
+	iterativeServersPerQuery = 3
+	iterativeDelegationCap   = 4096
+)
+
+// delegation is the name servers of a zone learned from a referral.
+type delegation struct {
+	servers []string // ip:port
+	expires time.Time
+}
+
+// iterativeResolver resolves the questions itself, from the root servers
+// down the delegations, without trusting any third-party resolver. Only the
+// glue records within the zone of the referring servers are used, the other
+// NS names are resolved in turn. The queries go through naiveResolve, so they
+// get the random IDs and source ports, the TCP retry and the cookies as well.
+type iterativeResolver struct {
+	roots       []string
+	port        string
+	delegations Cache // zone -> delegation
+
+	resolver *spoofingProofResolver // for the tap, the logs and the cookies
+}
+
+func newIterativeResolver(resolver *spoofingProofResolver) *iterativeResolver {
+	return &iterativeResolver{
+		roots:       rootHints,
+		port:        "53",
+		delegations: NewMemoryCache(iterativeDelegationCap),
+		resolver:    resolver,
+	}
+}
+
+// resolve answers the question, following the CNAMEs.
+func (r *iterativeResolver) resolve(ctx context.Context, q dns.Question) (*dns.Msg, error) {
+	return r.resolveDepth(ctx, q, 0)
+}
+
+func (r *iterativeResolver) resolveDepth(ctx context.Context, q dns.Question, depth int) (*dns.Msg, error) {
+	if depth > iterativeMaxDepth {
+		return nil, Error("too deep resolving " + q.Name)
+	}
+	zone, servers := r.closest(q.Name)
+	for i := 0; i < iterativeMaxReferrals; i++ {
+		res, err := r.queryServers(ctx, q, servers)
+		if err != nil {
+			return nil, err
+		}
+		if res.Rcode != dns.RcodeSuccess || len(res.Answer) > 0 || res.Authoritative {
+			return r.answer(ctx, q, res, depth)
+		}
+		child, ns, ttl := referral(res, q.Name, zone)
+		if child == "" {
+			return r.answer(ctx, q, res, depth) // a lame or odd response
+		}
+		servers = r.nameServers(ctx, zone, ns, res.Extra, depth)
+		if len(servers) == 0 {
+			return nil, Error("no address of the name servers of " + child)
+		}
+		r.delegations.Set(child, delegation{servers: servers, expires: time.Now().Add(time.Duration(ttl) * time.Second)})
+		zone = child
+	}
+	return nil, Error("too many referrals resolving " + q.Name)
+}
+
+// closest returns the closest zone of the name with known name servers.
+func (r *iterativeResolver) closest(name string) (string, []string) {
+	name = strings.ToLower(dns.Fqdn(name))
+	for {
+		if v, ok := r.delegations.Get(name); ok {
+			if d := v.(delegation); time.Now().Before(d.expires) {
+				return name, d.servers
+			}
+		}
+		if name == "." {
+			break
+		}
+		if i := strings.IndexByte(name, '.'); i >= 0 && i+1 < len(name) {
+			name = name[i+1:]
+		} else {
+			name = "."
+		}
+	}
+	servers := make([]string, len(r.roots))
+	for i, ip := range r.roots {
+		servers[i] = net.JoinHostPort(ip, r.port)
+	}
+	return ".", servers
+}
+
+// queryServers asks a few of the servers in a random order, until one
+// answers.
+func (r *iterativeResolver) queryServers(ctx context.Context, q dns.Question, servers []string) (*dns.Msg, error) {
+	order := rand.Perm(len(servers))
+	if len(order) > iterativeServersPerQuery {
+		order = order[:iterativeServersPerQuery]
+	}
+	var err error
+	for _, i := range order {
+		sctx, cancel := context.WithTimeout(ctx, iterativeServerTimeout)
+		var res *dns.Msg
+		res, err = naiveResolve(sctx, q, false, "udp", servers[i], r.resolver.client)
+		cancel()
+		if err == nil && res.Rcode != dns.RcodeServerFailure && res.Rcode != dns.RcodeRefused {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil {
+			err = Error(servers[i] + " answered " + dns.RcodeToString[res.Rcode])
+		}
+	}
+	return nil, err
+}
+
+// referral returns the child zone, its NS names and TTL if `res` delegates
+// the name to a zone under `zone`.
+func referral(res *dns.Msg, name string, zone string) (string, []string, uint32) {
+	name = strings.ToLower(name)
+	child, ttl := "", uint32(0)
+	var ns []string
+	for _, rr := range res.Ns {
+		n, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(n.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue // not closer, or not the zone of the name
+		}
+		if child == "" {
+			child, ttl = owner, n.Hdr.Ttl
+		}
+		if owner == child {
+			ns = append(ns, strings.ToLower(n.Ns))
+		}
+	}
+	return child, ns, ttl
+}
+
+// nameServers returns the addresses of the NS names of a referral from the
+// servers of `zone`, from the glue records within the zone, which the servers
+// are authoritative for, or else by resolving the names.
+func (r *iterativeResolver) nameServers(ctx context.Context, zone string, ns []string, extra []dns.RR, depth int) []string {
+	var servers []string
+	for _, rr := range extra {
+		a, ok := rr.(*dns.A)
+		if !ok || !dns.IsSubDomain(zone, strings.ToLower(a.Hdr.Name)) {
+			continue
+		}
+		for _, n := range ns {
+			if strings.EqualFold(a.Hdr.Name, n) {
+				servers = append(servers, net.JoinHostPort(a.A.String(), r.port))
+			}
+		}
+	}
+	if len(servers) > 0 {
+		return servers
+	}
+	for _, n := range ns {
+		res, err := r.resolveDepth(ctx, dns.Question{Name: n, Qtype: dns.TypeA, Qclass: dns.ClassINET}, depth+1)
+		if err != nil {
+			continue
+		}
+		for _, rr := range res.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				servers = append(servers, net.JoinHostPort(a.A.String(), r.port))
+			}
+		}
+		if len(servers) > 0 {
+			return servers
+		}
+	}
+	return nil
+}
+
+// answer returns the response to the client, following the CNAME of the
+// name if the answer stops at it.
+func (r *iterativeResolver) answer(ctx context.Context, q dns.Question, res *dns.Msg, depth int) (*dns.Msg, error) {
+	out := &dns.Msg{}
+	out.Response = true
+	out.RecursionAvailable = true
+	out.Rcode = res.Rcode
+	out.Question = []dns.Question{q}
+	out.Answer = res.Answer
+	if len(res.Answer) == 0 {
+		for _, rr := range res.Ns {
+			if _, ok := rr.(*dns.SOA); ok {
+				out.Ns = append(out.Ns, rr) // for the negative caching
+			}
+		}
+		return out, nil
+	}
+
+	// the target of the last CNAME, unless the answer has the records of it
+	target := strings.ToLower(q.Name)
+	for range res.Answer { // at most, in case of a loop
+		next := ""
+		for _, rr := range res.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, target) {
+				next = strings.ToLower(c.Target)
+			}
+		}
+		if next == "" || next == target {
+			break
+		}
+		target = next
+	}
+	if target == strings.ToLower(q.Name) || q.Qtype == dns.TypeCNAME {
+		return out, nil
+	}
+	for _, rr := range res.Answer {
+		if strings.EqualFold(rr.Header().Name, target) && rr.Header().Rrtype == q.Qtype {
+			return out, nil
+		}
+	}
+	more, err := r.resolveDepth(ctx, dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	out.Rcode = more.Rcode
+	out.Answer = append(out.Answer, more.Answer...)
+	out.Ns = more.Ns
+	return out, nil
+}
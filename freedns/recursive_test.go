@@ -0,0 +1,120 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testNameServer serves the records of its zones, and refers the names of
+// the delegated zones to their name servers.
+type testNameServer struct {
+	records     map[string][]string // name -> records
+	delegations map[string][]string // zone -> NS and glue records
+}
+
+func (s testNameServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	res := &dns.Msg{}
+	res.SetReply(req)
+	rrs := func(records []string) []dns.RR {
+		var out []dns.RR
+		for _, r := range records {
+			rr, _ := dns.NewRR(r)
+			out = append(out, rr)
+		}
+		return out
+	}
+	if records, ok := s.records[name]; ok {
+		res.Authoritative = true
+		for _, rr := range rrs(records) {
+			if rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+				res.Answer = append(res.Answer, rr)
+			}
+		}
+		w.WriteMsg(res)
+		return
+	}
+	for zone, records := range s.delegations {
+		if dns.IsSubDomain(zone, name) {
+			for _, rr := range rrs(records) {
+				if rr.Header().Rrtype == dns.TypeNS {
+					res.Ns = append(res.Ns, rr)
+				} else {
+					res.Extra = append(res.Extra, rr)
+				}
+			}
+			w.WriteMsg(res)
+			return
+		}
+	}
+	res.Authoritative = true
+	res.Rcode = dns.RcodeNameError
+	res.Ns = rrs([]string{"example.com. 60 IN SOA ns.example.net. admin.example.com. 1 3600 600 86400 60"})
+	w.WriteMsg(res)
+}
+
+func TestIterativeResolver(t *testing.T) {
+	servers := []testNameServer{
+		{ // the root
+			delegations: map[string][]string{
+				"com.": {"com. 3600 IN NS ns.gtld.", "ns.gtld. 3600 IN A 127.0.0.2"},
+				"net.": {"net. 3600 IN NS ns.gtld.", "ns.gtld. 3600 IN A 127.0.0.2"},
+			},
+		},
+		{ // com. and net.
+			delegations: map[string][]string{
+				// the glue out of the zone is ignored
+				"example.com.": {"example.com. 3600 IN NS ns.example.net.", "ns.example.net. 3600 IN A 6.6.6.6"},
+				"example.net.": {"example.net. 3600 IN NS ns.example.net.", "ns.example.net. 3600 IN A 127.0.0.3"},
+			},
+		},
+		{ // example.com. and example.net.
+			records: map[string][]string{
+				"www.example.com.": {"www.example.com. 60 IN CNAME web.example.net."},
+				"web.example.net.": {"web.example.net. 60 IN A 10.0.0.1"},
+				"ns.example.net.":  {"ns.example.net. 60 IN A 127.0.0.3"},
+			},
+		},
+	}
+	var port string
+	for i, s := range servers {
+		addr := "127.0.0." + string(rune('1'+i)) + ":" + port
+		if port == "" {
+			addr += "0"
+		}
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Skip("listening on the loopback addresses: ", err)
+		}
+		_, port, _ = net.SplitHostPort(conn.LocalAddr().String())
+		srv := &dns.Server{PacketConn: conn, Handler: s}
+		go srv.ActivateAndServe()
+		defer srv.Shutdown()
+	}
+
+	r := newIterativeResolver(newSpoofingProofResolver("", "", 16, builtinClassifier{}))
+	r.roots, r.port = []string{"127.0.0.1"}, port
+
+	q := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	res, err := r.resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Answer) != 2 || res.Answer[1].(*dns.A).A.String() != "10.0.0.1" || !res.RecursionAvailable {
+		t.Errorf("expect the CNAME followed, got %v", res)
+	}
+	if zone, servers := r.closest("other.example.com."); zone != "example.com." || servers[0] != "127.0.0.3:"+port {
+		t.Errorf("expect the delegation cached, got %s %v", zone, servers)
+	}
+
+	q.Name = "missing.example.com."
+	res, err = r.resolve(context.Background(), q)
+	if err != nil || res.Rcode != dns.RcodeNameError || len(res.Ns) != 1 {
+		t.Errorf("expect NXDOMAIN with the SOA, got %v, %v", res, err)
+	}
+}
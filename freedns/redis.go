@@ -0,0 +1,378 @@
+package freedns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// redisKeyPrefix is the prefix of the keys of the cache in Redis, so that the
+// cache can share the database with the others.
+const redisKeyPrefix = "freedns:"
+
+// redisStaleGrace is how long an entry is kept in Redis after its records
+// expire, so the expired entries can still be served while being refreshed,
+// the same as the in-memory cache.
+const redisStaleGrace = time.Hour
+
+// redisEmptyTTL is the TTL of the responses without any records.
+const redisEmptyTTL = time.Minute
+
+const (
+	redisTimeout  = time.Second
+	redisPoolSize = 8
+	// redisLogInterval limits the error logs while Redis is down
+	redisLogInterval = 10 * time.Second
+)
+
+// redisCache is the Cache of the responses kept in Redis, shared by the
+// instances using the same Redis. The entries expire in Redis after their
+// TTLs plus redisStaleGrace. Redis being down is a cache miss.
+type redisCache struct {
+	client *redisClient
+
+	logMu   sync.Mutex
+	lastLog time.Time
+}
+
+// newRedisCache creates the cache at `rawurl`, e.g.
+// `redis://:password@127.0.0.1:6379/0`.
+func newRedisCache(rawurl string) (*redisCache, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, Error("invalid Redis URL, expect redis://[:password@]host:port[/db]: " + rawurl)
+	}
+	c := &redisClient{
+		addr: u.Host,
+		pool: make(chan *redisConn, redisPoolSize),
+	}
+	if !strings.Contains(c.addr, ":") {
+		c.addr += ":6379"
+	}
+	if u.User != nil {
+		if p, ok := u.User.Password(); ok {
+			c.password = p
+		} else {
+			c.password = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, Error("invalid Redis database: " + db)
+		}
+	}
+	return &redisCache{client: c}, nil
+}
+
+func (c *redisCache) logError(err error) {
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	if time.Since(c.lastLog) < redisLogInterval {
+		return
+	}
+	c.lastLog = time.Now()
+	log.WithFields(logrus.Fields{
+		"op":   "redis",
+		"addr": c.client.addr,
+	}).Error(err)
+}
+
+func (c *redisCache) Get(key string) (interface{}, bool) {
+	v, err := c.client.do("GET", redisKeyPrefix+key)
+	if err != nil {
+		c.logError(err)
+		return nil, false
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, false
+	}
+	entry, err := decodeCacheEntry(b)
+	if err != nil {
+		return nil, false
+	}
+	return entry, true
+}
+
+// Set stores the cacheEntry values only.
+func (c *redisCache) Set(key string, value interface{}) {
+	entry, ok := value.(cacheEntry)
+	if !ok {
+		return
+	}
+	b, err := entry.encode()
+	if err != nil {
+		return
+	}
+	expiry := entryTTL(entry.reply) + redisStaleGrace
+	ms := strconv.FormatInt(int64(expiry/time.Millisecond), 10)
+	if _, err := c.client.do("SET", redisKeyPrefix+key, string(b), "PX", ms); err != nil {
+		c.logError(err)
+	}
+}
+
+// Purge deletes the keys of the cache.
+func (c *redisCache) Purge() {
+	err := c.scan(func(keys []string) error {
+		args := append([]string{"DEL"}, keys...)
+		_, err := c.client.do(args...)
+		return err
+	})
+	if err != nil {
+		c.logError(err)
+	}
+}
+
+// Len counts the keys of the cache.
+func (c *redisCache) Len() int {
+	n := 0
+	err := c.scan(func(keys []string) error {
+		n += len(keys)
+		return nil
+	})
+	if err != nil {
+		c.logError(err)
+	}
+	return n
+}
+
+// scan calls `f` with the keys of the cache in batches.
+func (c *redisCache) scan(f func(keys []string) error) error {
+	cursor := "0"
+	for {
+		v, err := c.client.do("SCAN", cursor, "MATCH", redisKeyPrefix+"*", "COUNT", "1000")
+		if err != nil {
+			return err
+		}
+		reply, ok := v.([]interface{})
+		if !ok || len(reply) != 2 {
+			return Error("redis: unexpected SCAN reply")
+		}
+		next, _ := reply[0].([]byte)
+		items, _ := reply[1].([]interface{})
+		var keys []string
+		for _, k := range items {
+			if b, ok := k.([]byte); ok {
+				keys = append(keys, string(b))
+			}
+		}
+		if len(keys) > 0 {
+			if err := f(keys); err != nil {
+				return err
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// entryTTL returns the minimum TTL of the records of the response.
+func entryTTL(res *dns.Msg) time.Duration {
+	ttl := uint32(0)
+	first := true
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl, first = rr.Header().Ttl, false
+			}
+		}
+	}
+	if first {
+		return redisEmptyTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// encode encodes the entry for the caches out of the process: the putin time
+// in unix nanoseconds, followed by the reply in the wire format. The entries
+// with a provenance have the top bit of the time set, and the upstream and
+// the verdict, each prefixed by its length in a byte, before the reply.
+func (e cacheEntry) encode() ([]byte, error) {
+	msg, err := e.reply.Pack()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 8, 8+len(msg))
+	binary.BigEndian.PutUint64(b, uint64(e.putin.UnixNano()))
+	if e.provenance != (provenance{}) && len(e.provenance.upstream) < 256 {
+		b[0] |= 0x80
+		b = append(b, byte(len(e.provenance.upstream)))
+		b = append(b, e.provenance.upstream...)
+		b = append(b, byte(len(e.provenance.verdict)))
+		b = append(b, e.provenance.verdict...)
+	}
+	return append(b, msg...), nil
+}
+
+func decodeCacheEntry(b []byte) (cacheEntry, error) {
+	if len(b) < 8 {
+		return cacheEntry{}, Error("invalid cache entry")
+	}
+	putin := binary.BigEndian.Uint64(b) &^ (1 << 63)
+	tagged := b[0]&0x80 != 0
+	b = b[8:]
+	var p provenance
+	if tagged {
+		tags := make([]string, 2)
+		for i := range tags {
+			if len(b) < 1 || len(b) < 1+int(b[0]) {
+				return cacheEntry{}, Error("invalid cache entry")
+			}
+			tags[i], b = string(b[1:1+int(b[0])]), b[1+int(b[0]):]
+		}
+		p = provenance{upstream: tags[0], verdict: tags[1]}
+	}
+	reply := &dns.Msg{}
+	if err := reply.Unpack(b); err != nil {
+		return cacheEntry{}, err
+	}
+	return cacheEntry{
+		putin:      time.Unix(0, int64(putin)),
+		reply:      reply,
+		provenance: p,
+	}, nil
+}
+
+// redisClient is a minimal client of the Redis protocol (RESP) with a pool of
+// connections.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+
+	pool chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// do sends the command and returns the reply: a string or []byte for the
+// simple and bulk strings, an int64, nil, or []interface{} for the arrays.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	v, err := conn.do(args...)
+	if _, isRedisErr := err.(redisError); err != nil && !isRedisErr {
+		conn.conn.Close()
+		return nil, err
+	}
+	select {
+	case c.pool <- conn:
+	default:
+		conn.conn.Close()
+	}
+	return v, err
+}
+
+func (c *redisClient) get() (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+	nc, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: nc, r: bufio.NewReader(nc)}
+	if c.password != "" {
+		if _, err := conn.do("AUTH", c.password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// redisError is an error reply of Redis, after which the connection is still
+// good.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (conn *redisConn) do(args ...string) (interface{}, error) {
+	conn.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b []byte
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, '\r', '\n')
+	for _, a := range args {
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(a)), 10)
+		b = append(b, '\r', '\n')
+		b = append(b, a...)
+		b = append(b, '\r', '\n')
+	}
+	if _, err := conn.conn.Write(b); err != nil {
+		return nil, err
+	}
+	return readRESP(conn.r)
+}
+
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, Error("redis: invalid reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, Error("redis: invalid reply")
+}
@@ -0,0 +1,137 @@
+package freedns
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeRedis serves GET, SET, DEL, SCAN and AUTH on a map, ignoring the
+// expiry but recording it.
+type fakeRedis struct {
+	mu      sync.Mutex
+	data    map[string]string
+	expires map[string]string
+}
+
+func startFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{data: map[string]string{}, expires: map[string]string{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn, password)
+		}
+	}()
+	return r, l.Addr().String()
+}
+
+func (r *fakeRedis) serve(conn net.Conn, password string) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	authed := password == ""
+	for {
+		v, err := readRESP(br)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, a := range v.([]interface{}) {
+			args = append(args, string(a.([]byte)))
+		}
+		if args[0] == "AUTH" {
+			authed = args[1] == password
+		}
+		if !authed {
+			conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+			continue
+		}
+
+		r.mu.Lock()
+		switch args[0] {
+		case "AUTH":
+			conn.Write([]byte("+OK\r\n"))
+		case "GET":
+			if v, ok := r.data[args[1]]; ok {
+				conn.Write([]byte("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"))
+			} else {
+				conn.Write([]byte("$-1\r\n"))
+			}
+		case "SET":
+			r.data[args[1]] = args[2]
+			r.expires[args[1]] = args[4]
+			conn.Write([]byte("+OK\r\n"))
+		case "DEL":
+			for _, k := range args[1:] {
+				delete(r.data, k)
+			}
+			conn.Write([]byte(":" + strconv.Itoa(len(args)-1) + "\r\n"))
+		case "SCAN":
+			prefix := strings.TrimSuffix(args[3], "*")
+			var keys []string
+			for k := range r.data {
+				if strings.HasPrefix(k, prefix) {
+					keys = append(keys, "$"+strconv.Itoa(len(k))+"\r\n"+k+"\r\n")
+				}
+			}
+			conn.Write([]byte("*2\r\n$1\r\n0\r\n*" + strconv.Itoa(len(keys)) + "\r\n" + strings.Join(keys, "")))
+		}
+		r.mu.Unlock()
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	fake, addr := startFakeRedis(t, "secret")
+	// the instances share the cache
+	a := newTestServer(t, Config{RedisCache: "redis://:secret@" + addr})
+	b := newTestServer(t, Config{RedisCache: "redis://:secret@" + addr})
+
+	res := &dns.Msg{}
+	res.SetQuestion("example.com.", dns.TypeA)
+	rr, _ := dns.NewRR("example.com. 300 IN A 93.184.216.34")
+	res.Answer = append(res.Answer, rr)
+	a.recordsCache.set(res, "udp")
+
+	got, upd := b.recordsCache.lookup(res.Question[0], true, "udp")
+	if got == nil || upd || len(got.Answer) != 1 || got.Answer[0].(*dns.A).A.String() != "93.184.216.34" {
+		t.Fatalf("expect the record set by the other instance, got %v", got)
+	}
+	key := redisKeyPrefix + requestToString(res.Question[0], true, "udp")
+	fake.mu.Lock()
+	expiry := fake.expires[key]
+	fake.mu.Unlock()
+	if want := strconv.Itoa(int((300*time.Second + redisStaleGrace) / time.Millisecond)); expiry != want {
+		t.Errorf("expect the expiry %s ms, got %s", want, expiry)
+	}
+
+	if n := b.recordsCache.backend.Len(); n != 1 {
+		t.Errorf("expect 1 entry, got %d", n)
+	}
+	b.recordsCache.purge()
+	if got, _ := a.recordsCache.lookup(res.Question[0], true, "udp"); got != nil {
+		t.Error("the purged entry should be gone for all the instances")
+	}
+
+	// a wrong password is a cache miss
+	c := newTestServer(t, Config{RedisCache: "redis://:wrong@" + addr})
+	a.recordsCache.set(res, "udp")
+	if got, _ := c.recordsCache.lookup(res.Question[0], true, "udp"); got != nil {
+		t.Error("expect a miss without the access to Redis")
+	}
+
+	if _, err := newRedisCache("127.0.0.1:6379"); err == nil {
+		t.Error("expect an error of the URL without the redis scheme")
+	}
+}
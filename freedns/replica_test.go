@@ -0,0 +1,59 @@
+package freedns
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestReplica(t *testing.T) {
+	primary := newTestServer(t, Config{AdminListen: "127.0.0.1:0"})
+	api := httptest.NewServer(primary.adminServer.Handler)
+	defer api.Close()
+	defer primary.Shutdown()
+
+	s := newTestServer(t, Config{ReplicaOf: api.URL})
+	defer s.Shutdown()
+	go s.replica.run(s.recordsCache, s.done)
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Answer = append(res.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(93, 184, 216, 34),
+	})
+
+	// set the record until the replica subscribes and gets it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		primary.recordsCache.set(res, "udp")
+		if cached, _ := s.recordsCache.lookup(req.Question[0], true, "udp"); cached != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the replica should get the record from the primary")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	got, upstream := s.lookup(req, "udp")
+	if upstream != "cache" || len(got.Answer) != 1 {
+		t.Errorf("the replica should answer from the cache, got %s\n%v", upstream, got)
+	}
+
+	// the misses get SERVFAIL without ReplicaDNS
+	miss := &dns.Msg{}
+	miss.SetQuestion("example.org.", dns.TypeA)
+	if got, _ := s.lookup(miss, "udp"); got.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expect SERVFAIL for a miss, got %s", dns.RcodeToString[got.Rcode])
+	}
+
+	if _, err := newReplica("192.168.1.2:8053"); err == nil {
+		t.Error("the primary should be an http(s) URL")
+	}
+}
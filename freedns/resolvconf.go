@@ -0,0 +1,148 @@
+package freedns
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// resolvConfGuard keeps the resolv.conf pointing at the listener, rewriting
+// it whenever other software (NetworkManager, DHCP clients) overwrites it, so
+// the host itself keeps using freedns-go. What the others wrote last is put
+// back on shutdown.
+type resolvConfGuard struct {
+	path    string
+	content []byte
+	watcher *dirWatcher
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	others []byte // the last content written by the others, nil if missing
+	link   string // the target if it was a symlink, e.g. of systemd-resolved
+}
+
+func newResolvConfGuard(path string, listen string) (*resolvConfGuard, error) {
+	ip, err := localNameserver(listen)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &resolvConfGuard{
+		path:    path,
+		content: []byte("# written by freedns-go\nnameserver " + ip.String() + "\n"),
+	}
+	if link, err := os.Readlink(path); err == nil {
+		g.link = link
+	}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		g.others = data
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// the files are replaced by renaming as often as written in place, so
+	// the directory is watched instead of the file
+	w, err := newDirWatcher(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	g.watcher = w
+	return g, nil
+}
+
+// localNameserver returns the IP the host reaches the listener at, the
+// loopback for the unspecified addresses. The system resolvers can only use
+// port 53.
+func localNameserver(listen string) (net.IP, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	if port != "53" {
+		return nil, Error("the system resolver can only use port 53, not " + port)
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case host == "" || ip.Equal(net.IPv4zero):
+		ip = net.IPv4(127, 0, 0, 1)
+	case ip.Equal(net.IPv6unspecified):
+		ip = net.IPv6loopback
+	case ip == nil:
+		return nil, Error("invalid listening IP: " + host)
+	}
+	return ip, nil
+}
+
+// start rewrites the resolv.conf, and again every time it changes.
+func (g *resolvConfGuard) start() {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		for {
+			g.check()
+			if err := g.watcher.wait(); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// check rewrites the resolv.conf unless it's already ours.
+func (g *resolvConfGuard) check() {
+	l := log.WithFields(logrus.Fields{
+		"op":   "guard_resolv_conf",
+		"path": g.path,
+	})
+	data, err := ioutil.ReadFile(g.path)
+	if err == nil && bytes.Equal(data, g.content) {
+		return
+	}
+	if err != nil && !os.IsNotExist(err) {
+		l.Error(err)
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err == nil {
+		g.others = data
+	} else {
+		g.others = nil
+	}
+	if link, err := os.Readlink(g.path); err == nil {
+		g.link = link
+	} else {
+		g.link = ""
+	}
+	if err := writeFileAtomic(g.path, g.content, 0644); err != nil {
+		l.Error(err)
+		return
+	}
+	l.Info("pointed the resolv.conf at the listener")
+}
+
+// stop stops watching and puts back what the others wrote last.
+func (g *resolvConfGuard) stop() error {
+	g.watcher.close()
+	g.wg.Wait()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.link != "" {
+		tmp := g.path + ".freedns-go"
+		os.Remove(tmp)
+		if err := os.Symlink(g.link, tmp); err != nil {
+			return err
+		}
+		return os.Rename(tmp, g.path)
+	}
+	if g.others == nil {
+		return os.Remove(g.path)
+	}
+	return writeFileAtomic(g.path, g.others, 0644)
+}
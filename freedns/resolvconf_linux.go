@@ -0,0 +1,57 @@
+package freedns
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// dirWatcher waits for the changes of a file in a directory with inotify(7).
+type dirWatcher struct {
+	file *os.File
+	name string
+	buf  [4096]byte
+}
+
+func newDirWatcher(dir string, name string) (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE)
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+	// non-blocking, so closing it interrupts the reads
+	return &dirWatcher{file: os.NewFile(uintptr(fd), "inotify"), name: name}, nil
+}
+
+// wait blocks until the file changes, or returns the error after close.
+func (w *dirWatcher) wait() error {
+	for {
+		n, err := w.file.Read(w.buf[:])
+		if err != nil {
+			return err
+		}
+		for i := 0; i+syscall.SizeofInotifyEvent <= n; {
+			e := (*syscall.InotifyEvent)(unsafe.Pointer(&w.buf[i]))
+			start := i + syscall.SizeofInotifyEvent
+			i = start + int(e.Len)
+			if e.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				return nil
+			}
+			name := w.buf[start:i]
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			if string(name) == w.name {
+				return nil
+			}
+		}
+	}
+}
+
+func (w *dirWatcher) close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package freedns
+
+// dirWatcher needs inotify, only available on Linux.
+type dirWatcher struct{}
+
+func newDirWatcher(dir string, name string) (*dirWatcher, error) {
+	return nil, Error("watching the resolv.conf is only supported on Linux")
+}
+
+func (w *dirWatcher) wait() error {
+	return Error("not supported")
+}
+
+func (w *dirWatcher) close() error {
+	return nil
+}
@@ -0,0 +1,72 @@
+package freedns
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestResolvConfGuard(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify is only on Linux")
+	}
+	dir, err := ioutil.TempDir("", "freedns-resolvconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "resolv.conf")
+	if err := ioutil.WriteFile(path, []byte("nameserver 192.168.1.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newResolvConfGuard(path, "0.0.0.0:5353"); err == nil {
+		t.Error("expect an error for the port other than 53")
+	}
+	g, err := newResolvConfGuard(path, "0.0.0.0:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("# written by freedns-go\nnameserver 127.0.0.1\n")
+	guarded := func() bool {
+		for i := 0; i < 100; i++ {
+			if data, _ := ioutil.ReadFile(path); bytes.Equal(data, want) {
+				return true
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+
+	g.start()
+	if !guarded() {
+		t.Fatal("the resolv.conf should point at the listener")
+	}
+	// overwritten in place, and replaced by renaming
+	if err := ioutil.WriteFile(path, []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !guarded() {
+		t.Fatal("the resolv.conf written in place should be rewritten")
+	}
+	if err := writeFileAtomic(path, []byte("nameserver 10.0.0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !guarded() {
+		t.Fatal("the renamed resolv.conf should be rewritten")
+	}
+
+	if err := g.stop(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "nameserver 10.0.0.2\n" {
+		t.Errorf("the last resolv.conf of the others should be put back, got %q", data)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("the resolv.conf should be readable by everyone, got %v, %v", info, err)
+	}
+}
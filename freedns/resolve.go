@@ -1,41 +1,172 @@
 package freedns
 
 import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
 	"time"
 
-	goc "github.com/louchenyao/golang-cache"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
-	"github.com/tuna/freedns-go/chinaip"
 )
 
+// Resolver resolves the DNS questions. Resolve returns the response and which
+// upstream answered it, and an error if no upstream could answer it or `ctx`
+// is done first.
+type Resolver interface {
+	Resolve(ctx context.Context, q dns.Question, net string) (*dns.Msg, string, error)
+}
+
+// NewResolver creates the anti-spoofing resolver of freedns-go, which queries
+// the fast upstream and the clean upstream (host:port) and uses the fast
+// answers only if they point to China IPs, without running a server. It
+// remembers the locations of up to `cacheCap` domains, but doesn't cache the
+// answers.
+func NewResolver(fastUpstream string, cleanUpstream string, cacheCap int) Resolver {
+	return newSpoofingProofResolver(appendDefaultPort(fastUpstream), appendDefaultPort(cleanUpstream), cacheCap, builtinClassifier{})
+}
+
 // spoofingProofResolver can resolve the DNS request with 100% confidence.
 type spoofingProofResolver struct {
 	fastUpstream  string
 	cleanUpstream string
 
-	// cnDomains caches if a domain belongs to China.
-	cnDomains *goc.Cache
+	// cnDomains caches if a domain belongs to China, and decisions keeps
+	// them across the restarts if not nil.
+	cnDomains Cache
+	decisions *decisionStore
+
+	classifier ipClassifier
+
+	// the AAAA records in these prefixes are classified by their embedded IPv4
+	nat64Prefixes []*net.IPNet
+
+	// budgets limit the queries to each upstream if not nil
+	budgets    map[string]*tokenBucket
+	budgetWait time.Duration
+
+	// hedge caps the clean queries racing the fast ones if not nil
+	hedge *hedgeBudget
+
+	// stretcher stretches the TTLs of the unstable upstreams if not nil
+	stretcher *ttlStretcher
+
+	// ttlOverrides forces the TTLs of the answers of the domains if not nil,
+	// winning over the stretcher
+	ttlOverrides *ttlOverrides
+
+	// hijack turns the NXDOMAINs forged by the upstreams back if not nil
+	hijack *hijackDetector
+
+	// timeout is of each query to an upstream, exchangeTimeout if 0. The
+	// failed queries are retried `retries` times after the backoffs.
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+
+	// client sends the queries to the upstreams, shared by the resolvers of
+	// the policies
+	client *upstreamClient
+
+	// chains are the fallback protocols of the upstreams, which are queried
+	// over the network of the clients without one
+	chains map[string]*protocolChain
+
+	// groups are the upstreams at the sites standing in for the fast or the
+	// clean upstream, if any
+	groups map[string]*upstreamGroups
+
+	// iterative resolves the recursiveUpstream if not nil
+	iterative *iterativeResolver
 }
 
-func newSpoofingProofResolver(fastUpstream string, cleanUpstream string, cacheCap int) *spoofingProofResolver {
-	c, _ := goc.NewCache("lru", cacheCap)
+func newSpoofingProofResolver(fastUpstream string, cleanUpstream string, cacheCap int, classifier ipClassifier) *spoofingProofResolver {
 	return &spoofingProofResolver{
 		fastUpstream:  fastUpstream,
 		cleanUpstream: cleanUpstream,
-		cnDomains:     c,
+		cnDomains:     NewMemoryCache(cacheCap),
+		classifier:    classifier,
+		client:        &upstreamClient{},
+	}
+}
+
+// Resolve implements Resolver. The question is sent with recursion desired.
+func (resolver *spoofingProofResolver) Resolve(ctx context.Context, q dns.Question, net string) (*dns.Msg, string, error) {
+	type result struct {
+		res      *dns.Msg
+		upstream string
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	ch := make(chan result, 1)
+	go func() {
+		res, upstream := resolver.resolveContext(ctx, q, true, net)
+		ch <- result{res, upstream}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	case r := <-ch:
+		// the failures made up by resolve have no question
+		if len(r.res.Question) == 0 {
+			return nil, r.upstream, Error("no upstream answered " + q.Name)
+		}
+		return r.res, r.upstream, nil
+	}
+}
+
+// location returns if the domain is known to be in China, and if it's known.
+func (resolver *spoofingProofResolver) location(name string) (bool, bool) {
+	v, ok := resolver.cnDomains.Get(name)
+	if !ok {
+		return false, false
+	}
+	return v.(bool), true
+}
+
+func (resolver *spoofingProofResolver) setLocation(name string, isCN bool) {
+	resolver.cnDomains.Set(name, isCN)
+	if resolver.decisions != nil {
+		resolver.decisions.record(name, isCN)
 	}
 }
 
-// resovle returns the response and which upstream is used
+// resovle returns the response and which upstream is used, with the TTLs
+// stretched if the upstream is unstable, or overridden for the domain.
 func (resolver *spoofingProofResolver) resolve(q dns.Question, recursion bool, net string) (*dns.Msg, string) {
+	return resolver.resolveTraced(context.Background(), q, recursion, net)
+}
+
+// resolveTraced is resolve, tracing the resolution under the span of `ctx` if
+// any.
+func (resolver *spoofingProofResolver) resolveTraced(ctx context.Context, q dns.Question, recursion bool, net string) (*dns.Msg, string) {
+	ctx, sp := startSpan(ctx, "resolve", spanKindInternal)
+	defer sp.finish()
+	res, upstream := resolver.resolveContext(ctx, q, recursion, net)
+	if resolver.stretcher != nil {
+		resolver.stretcher.stretch(res, upstream)
+	}
+	if resolver.ttlOverrides != nil {
+		resolver.ttlOverrides.apply(q.Name, res)
+	}
+	sp.setAnswer(res, upstream)
+	return res, upstream
+}
+
+// resolveContext is resolve, giving up the queries when `ctx` is done. The
+// queries still in flight when it returns, e.g. to the clean upstream after
+// the fast one has answered a China domain, are cancelled.
+func (resolver *spoofingProofResolver) resolveContext(ctx context.Context, q dns.Question, recursion bool, net string) (*dns.Msg, string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	type result struct {
 		res *dns.Msg
 		err error
 	}
-	fastCh := make(chan result, 4)
-	cleanCh := make(chan result, 4)
-
 	fail := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
 			Rcode: dns.RcodeServerFailure,
@@ -43,71 +174,292 @@ func (resolver *spoofingProofResolver) resolve(q dns.Question, recursion bool, n
 	}
 
 	Q := func(ch chan result, upstream string) {
-		res, err := naiveResolve(q, recursion, net, upstream)
+		ctx, sp := startSpan(ctx, "upstream_query", spanKindInternal)
+		sp.set("freedns.upstream", upstream)
+		defer sp.finish()
+		if b := resolver.budgets[upstream]; b != nil && !b.wait(resolver.budgetWait) {
+			log.WithFields(logrus.Fields{
+				"op":       "budget",
+				"upstream": upstream,
+				"domain":   q.Name,
+			}).Warn("upstream query budget exceeded")
+			err := Error("upstream query budget exceeded")
+			sp.fail(err)
+			ch <- result{fail, err}
+			return
+		}
+		var res *dns.Msg
+		var err error
+		for attempt := 0; attempt <= resolver.retries; attempt++ {
+			if attempt > 0 && !sleepContext(ctx, retryBackoff(resolver.backoff, attempt)) {
+				break
+			}
+			start := time.Now()
+			actx, cancel := context.WithTimeout(ctx, resolver.queryTimeout())
+			res, err = resolver.query(actx, q, recursion, net, upstream)
+			cancel()
+			// the cancelled queries say nothing of the latency
+			if resolver.hedge != nil && upstream == resolver.cleanUpstream && err != context.Canceled {
+				resolver.hedge.observe(time.Since(start))
+			}
+			if resolver.stretcher != nil && err != context.Canceled {
+				resolver.stretcher.observe(upstream, err == nil && res.Rcode != dns.RcodeServerFailure)
+			}
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+		}
 		if res == nil {
 			res = fail
+		} else if err == nil && resolver.hijack != nil && resolver.hijack.forges(upstream, res) {
+			res = unforged(res)
+		}
+		if err != context.Canceled {
+			sp.fail(err)
 		}
+		sp.set("dns.rcode", dns.RcodeToString[res.Rcode])
 		ch <- result{res, err}
 	}
 
-	go Q(cleanCh, resolver.cleanUpstream)
-	go Q(fastCh, resolver.fastUpstream)
+	// launch queries the upstream, and returns the channel of its result,
+	// which gets a timeout result after resolveTimeout from the launch, so an
+	// upstream queried late still gets the whole timeout.
+	launch := func(upstream string) chan result {
+		ch := make(chan result, 2)
+		go Q(ch, upstream)
+		go func() {
+			t := time.NewTimer(resolver.resolveTimeout())
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+			}
+			ch <- result{fail, Error("timeout")}
+		}()
+		return ch
+	}
 
-	// send timeout results
-	go func() {
-		time.Sleep(1900 * time.Millisecond)
-		fastCh <- result{fail, Error("timeout")}
-		cleanCh <- result{fail, Error("timeout")}
-	}()
+	// Both upstreams are raced unless the hedge budget is set: the clean
+	// upstream is then only raced within the budget for the domains known to
+	// be in China, and the fast one is not queried for the domains known to
+	// be not. The upstreams not raced are nil until they're queried late.
+	isCN, ok := resolver.location(q.Name)
+	raceClean, raceFast := true, true
+	if resolver.hedge != nil {
+		resolver.hedge.earn()
+		if ok && isCN {
+			raceClean = resolver.hedge.allow()
+		} else if ok {
+			raceFast = false
+		}
+	}
+	var fastCh, cleanCh chan result
+	if raceClean {
+		cleanCh = launch(resolver.cleanUpstream)
+	}
+	if raceFast {
+		fastCh = launch(resolver.fastUpstream)
+	}
+
+	// cleanOrFast returns the clean answer, or the fast answer `fast` instead
+	// if the clean upstream fails and the fast answer doesn't look spoofed,
+	// i.e. has no IPs out of China. `fast` is waited for if nil.
+	cleanOrFast := func(fast *dns.Msg) (*dns.Msg, string) {
+		_, sp := startSpan(ctx, "clean_answer", spanKindInternal)
+		defer sp.finish()
+		if cleanCh == nil {
+			cleanCh = launch(resolver.cleanUpstream)
+		}
+		r := <-cleanCh
+		if !upstreamFailed(r.res) {
+			return r.res, resolver.cleanUpstream
+		}
+		sp.fail(r.err)
+		if fast == nil {
+			if fastCh == nil {
+				fastCh = launch(resolver.fastUpstream)
+			}
+			fast = (<-fastCh).res
+		}
+		if upstreamFailed(fast) || (resolver.containsIP(fast) && !resolver.containsChinaIP(fast)) {
+			return r.res, resolver.cleanUpstream
+		}
+		log.WithFields(logrus.Fields{
+			"op":       "fallback",
+			"domain":   q.Name,
+			"upstream": resolver.fastUpstream,
+			"rcode":    dns.RcodeToString[r.res.Rcode],
+		}).Debug("clean upstream failed, answered by the fast upstream")
+		sp.set("freedns.fallback", true)
+		return fast, resolver.fastUpstream
+	}
 
 	// 1. if we can distinguish if it is a china domain, we directly uses the right upstream
-	isCN, ok := resolver.cnDomains.Get(q.Name)
 	if ok {
-		if isCN.(bool) {
-			r := <-fastCh
-			// The fast upstream returns the success result
-			if r.res != nil && r.res.Rcode == dns.RcodeSuccess {
-				// recheck if it is a china domain, and update the cache
-				// we do this recheck in case that the clean DNS spoofs the domain and returns an IP in China
-				if containsA(r.res) && !containsChinaip(r.res) {
-					resolver.cnDomains.Set(q.Name, false)
-				} else {
-					return r.res, resolver.fastUpstream
-				}
+		if !isCN {
+			return cleanOrFast(nil)
+		}
+		r := <-fastCh
+		// The fast upstream returns the success result
+		if r.res != nil && r.res.Rcode == dns.RcodeSuccess {
+			// recheck if it is a china domain, and update the cache
+			// we do this recheck in case that the clean DNS spoofs the domain and returns an IP in China
+			// The IPv6 China list is far from complete, so the AAAA records
+			// alone never overturn the location.
+			if hasIP, china := resolver.classify(ctx, r.res); hasIP && !china && resolver.containsIPv4(r.res) {
+				resolver.setLocation(q.Name, false)
+			} else {
+				return r.res, resolver.fastUpstream
 			}
 		}
-		r := <-cleanCh
-		return r.res, resolver.cleanUpstream
+		return cleanOrFast(r.res)
 	}
 
-	// 2. try to resolve by fast dns. if it contains A record which means we can decide if this is a china domain
+	// 2. try to resolve by fast dns. if it contains A or AAAA records which means we can decide if this is a china domain
 	r := <-fastCh
-	if r.res != nil && r.res.Rcode == dns.RcodeSuccess && containsA(r.res) {
-		if containsChinaip(r.res) {
-			resolver.cnDomains.Set(q.Name, true)
+	if r.res != nil && r.res.Rcode == dns.RcodeSuccess {
+		if hasIP, china := resolver.classify(ctx, r.res); china {
+			resolver.setLocation(q.Name, true)
 			return r.res, resolver.fastUpstream
+		} else if hasIP && resolver.containsIPv4(r.res) {
+			// not from the AAAA records alone, see case 1
+			resolver.setLocation(q.Name, false)
 		}
-		resolver.cnDomains.Set(q.Name, false)
 	}
 
-	// 3. the domain may not belong to China, use the clean upstream
-	r = <-cleanCh
-	return r.res, resolver.cleanUpstream
+	// 3. the domain may not belong to China, use the clean upstream, or the
+	// fast one if it fails
+	return cleanOrFast(r.res)
+}
+
+// upstreamFailed returns if the upstream failed to answer, rather than
+// answered that the name or the records don't exist.
+func upstreamFailed(res *dns.Msg) bool {
+	return res == nil || res.Rcode == dns.RcodeServerFailure || res.Rcode == dns.RcodeRefused
+}
+
+func (resolver *spoofingProofResolver) queryTimeout() time.Duration {
+	if resolver.timeout > 0 {
+		return resolver.timeout
+	}
+	return exchangeTimeout
+}
+
+// resolveTimeout is how long resolve waits for an upstream, shortly before
+// its last attempt would time out after the longest backoffs.
+func (resolver *spoofingProofResolver) resolveTimeout() time.Duration {
+	total := resolver.queryTimeout() * time.Duration(resolver.retries+1)
+	for attempt := 1; attempt <= resolver.retries; attempt++ {
+		total += maxRetryBackoff(resolver.backoff, attempt)
+	}
+	return total - 100*time.Millisecond
+}
+
+// retryBackoff returns the wait before the attempt, doubling `base` for each
+// retry with a jitter of ±50%, so the retries of many queries spread out.
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt-1)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+func maxRetryBackoff(base time.Duration, attempt int) time.Duration {
+	return (base << uint(attempt-1)) * 3 / 2
+}
+
+// sleepContext sleeps for `d`, and returns false if `ctx` is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// upstreamClient is what the queries are sent to the upstreams with. The nil
+// fields, or a nil client, leave the queries plain.
+type upstreamClient struct {
+	// tap gets the queries and the responses
+	tap *dnstapWriter
+
+	// log logs the exchanges with the upstreams, and metrics gets their
+	// metrics
+	log     *queryLog
+	metrics MetricsSink
+
+	// cookies are sent in the UDP queries
+	cookies *cookieJar
+
+	// dialer resolves the host names of the upstreams by the bootstrap DNS
+	// server, and connects them through the proxy
+	dialer *upstreamDialer
 }
 
-func naiveResolve(q dns.Question, recursion bool, net string, upstream string) (*dns.Msg, error) {
+// naiveResolve queries the upstream with `client`, which may be nil. The UDP
+// queries carry the cookies of the client, and a BADCOOKIE response is
+// queried again with the fresh server cookie. The DNS over TLS queries are
+// padded. A truncated UDP response is queried again over TCP, so the clients
+// behind the stub resolvers not retrying over TCP get the full answer, and so
+// does the cache.
+func naiveResolve(ctx context.Context, q dns.Question, recursion bool, net string, upstream string, client *upstreamClient) (*dns.Msg, error) {
+	if client == nil {
+		client = &upstreamClient{}
+	}
+	cookies := client.cookies
 	r := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
-			Id:               dns.Id(),
+			Id:               queryID(),
 			RecursionDesired: recursion,
 		},
 		Question: []dns.Question{q},
 	}
-	c := &dns.Client{Net: net}
 
-	res, _, err := c.Exchange(r, upstream)
+	if cookies != nil && net == "udp" {
+		cookies.attach(r, upstream)
+	}
+	if net == "tcp-tls" {
+		padQuery(r)
+	}
+	res, err := exchange(ctx, r, net, upstream, client)
+	if err == nil && net == "tcp-tls" {
+		// the responses are cached and answered without the OPT of the padding
+		res.Extra = withoutOPT(res.Extra)
+	}
+	if err == nil && cookies != nil && net == "udp" {
+		cookies.update(upstream, res)
+		if res.Rcode == dns.RcodeBadCookie {
+			r.Id = queryID()
+			cookies.attach(r, upstream)
+			if res, err = exchange(ctx, r, net, upstream, client); err == nil {
+				cookies.update(upstream, res)
+			}
+		}
+		if err == nil {
+			// the responses are cached and answered without the OPT, as before
+			res.Extra = withoutOPT(res.Extra)
+		}
+	}
+	if err == nil && res.Truncated && net == "udp" {
+		r.Id = queryID()
+		r.Extra = withoutOPT(r.Extra)
+		if full, err := exchange(ctx, r, "tcp", upstream, client); err == nil {
+			res = full
+		} else {
+			// the truncated response is still better than none
+			log.WithFields(logrus.Fields{
+				"op":       "naive_resolve",
+				"upstream": upstream,
+				"domain":   q.Name,
+			}).Warn("retry of the truncated response over tcp: ", err)
+		}
+	}
 
-	if err != nil {
+	if err != nil && err != context.Canceled {
 		log.WithFields(logrus.Fields{
 			"op":       "naive_resolve",
 			"upstream": upstream,
@@ -123,38 +475,231 @@ func naiveResolve(q dns.Question, recursion bool, net string, upstream string) (
 	return res, err
 }
 
-func containsA(res *dns.Msg) bool {
-	var rrs []dns.RR
+// exchangeTimeout is the timeout of an upstream query, the same as the
+// default of dns.Client, unless `ctx` of exchange has a deadline.
+const exchangeTimeout = 2 * time.Second
 
-	rrs = append(rrs, res.Answer...)
-	rrs = append(rrs, res.Ns...)
-	rrs = append(rrs, res.Extra...)
+// exchange sends the query to the upstream over `network` and waits for the
+// response. Over UDP, the packets not matching the ID and the question of the
+// query are dropped as they are either stale or spoofed, and it keeps waiting
+// for the real response until the timeout. It returns ctx.Err() as soon as
+// `ctx` is done. The exchange is sent to the tap, the log and the metrics of
+// `client`, which may be nil.
+func exchange(ctx context.Context, req *dns.Msg, network string, upstream string, client *upstreamClient) (res *dns.Msg, err error) {
+	if client == nil {
+		client = &upstreamClient{}
+	}
+	tap, ulog, metrics := client.tap, client.log, client.metrics
+	start := time.Now()
+	retries, dropped := 0, 0
+	_, sp := startSpan(ctx, "exchange", spanKindClient)
+	defer func() {
+		sp.set("freedns.upstream", upstream)
+		sp.set("net.transport", network)
+		sp.set("freedns.dropped", dropped)
+		if res != nil {
+			sp.set("dns.rcode", dns.RcodeToString[res.Rcode])
+		}
+		if err == context.Canceled {
+			sp.set("freedns.cancelled", true)
+		} else {
+			sp.fail(err)
+		}
+		sp.finish()
+	}()
+	defer func() {
+		upstreamExchanges.record(upstream, res, err, time.Since(start))
+	}()
+	if metrics != nil {
+		defer func() {
+			observeExchange(metrics, upstream, network, res, err, dropped, time.Since(start))
+		}()
+	}
+	if ulog != nil {
+		defer func() {
+			e := upstreamLogEntry{
+				Time:     start,
+				Upstream: upstream,
+				Net:      network,
+				Name:     req.Question[0].Name,
+				Type:     dns.TypeToString[req.Question[0].Qtype],
+				Retries:  retries,
+				Dropped:  dropped,
+				Latency:  float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			if res != nil {
+				e.Rcode = dns.RcodeToString[res.Rcode]
+				e.Truncated = res.Truncated
+			}
+			if err != nil {
+				e.Error = err.Error()
+			}
+			ulog.write(e)
+		}()
+	}
 
-	for i := 0; i < len(rrs); i++ {
-		_, ok := rrs[i].(*dns.A)
-		if ok {
-			return true
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(exchangeTimeout)
+	}
+	conn, retries, err := dialUpstream(network, upstream, time.Until(deadline), client)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	}
+	conn.SetDeadline(deadline)
+	// interrupt the reads on cancel
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-finished:
 		}
+	}()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			res, err = nil, ctx.Err()
+		}
+	}()
+	queryTime := time.Now()
+	if err := conn.WriteMsg(req); err != nil {
+		return nil, err
 	}
-	return false
+	tap.forwarder(conn, network, req, queryTime, nil)
+	for {
+		res, err := conn.ReadMsg()
+		if err == nil && isResponseTo(res, req) {
+			tap.forwarder(conn, network, req, queryTime, res)
+			return res, nil
+		}
+		if network != "udp" {
+			if err == nil {
+				err = dns.ErrId
+			}
+			return nil, err
+		}
+		// malformed packets are dropped as well
+		if _, malformed := err.(*dns.Error); err != nil && !malformed {
+			return nil, err
+		}
+		dropped++
+		log.WithFields(logrus.Fields{
+			"op":       "exchange",
+			"upstream": upstream,
+			"domain":   req.Question[0].Name,
+		}).Warn("dropped a response not matching the query")
+	}
+}
+
+// dialUpstream connects to the upstream. UDP queries are sent from random
+// source ports, falling back to the one chosen by the OS if the ports are in
+// use. It returns how many ports failed before the connection. The DNS over
+// TLS connections are made by dialTLS. The host name of the upstream is
+// resolved by the dialer of `client`.
+func dialUpstream(network string, upstream string, timeout time.Duration, client *upstreamClient) (*dns.Conn, int, error) {
+	if network == "tcp-tls" {
+		conn, err := dialTLS(upstream, timeout, client)
+		return conn, 0, err
+	}
+	upstream, err := client.dialer.resolve(upstream, timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	c := &dns.Client{Net: network, Timeout: timeout}
+	retries := 0
+	if network == "udp" {
+		for i := 0; i < 3; i++ {
+			c.Dialer = &net.Dialer{
+				Timeout:   timeout,
+				LocalAddr: &net.UDPAddr{Port: sourcePort()},
+			}
+			if conn, err := c.Dial(upstream); err == nil {
+				return conn, retries, nil
+			}
+			retries++
+		}
+		c.Dialer = nil
+	}
+	conn, err := c.Dial(upstream)
+	return conn, retries, err
+}
+
+// isResponseTo checks if `res` is the response to the query `req`, i.e. it has
+// the same ID, question and client cookie.
+func isResponseTo(res *dns.Msg, req *dns.Msg) bool {
+	if !res.Response || res.Id != req.Id || len(res.Question) != 1 || !cookieMatches(res, req) {
+		return false
+	}
+	q, rq := req.Question[0], res.Question[0]
+	return strings.EqualFold(q.Name, rq.Name) && q.Qtype == rq.Qtype && q.Qclass == rq.Qclass
 }
 
-// containChinaIP check if the resoponse contains IP belonging to China.
-func containsChinaip(res *dns.Msg) bool {
+// ips returns the addresses of the A and AAAA records in the response. The
+// AAAA records of the NAT64 prefixes are replaced by their embedded IPv4.
+func (resolver *spoofingProofResolver) ips(res *dns.Msg) []net.IP {
 	var rrs []dns.RR
+	var ips []net.IP
 
 	rrs = append(rrs, res.Answer...)
 	rrs = append(rrs, res.Ns...)
 	rrs = append(rrs, res.Extra...)
 
 	for i := 0; i < len(rrs); i++ {
-		rr, ok := rrs[i].(*dns.A)
-		if ok {
-			ip := rr.A.String()
-			if chinaip.IsChinaIP(ip) {
-				return true
+		switch rr := rrs[i].(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			if ip := embeddedIPv4(rr.AAAA, resolver.nat64Prefixes); ip != nil {
+				ips = append(ips, ip)
+			} else {
+				ips = append(ips, rr.AAAA)
 			}
 		}
 	}
+	return ips
+}
+
+func (resolver *spoofingProofResolver) containsIP(res *dns.Msg) bool {
+	return len(resolver.ips(res)) > 0
+}
+
+// containsIPv4 returns if the response contains IPv4 addresses, including
+// the ones embedded in the NAT64 prefixes.
+func (resolver *spoofingProofResolver) containsIPv4(res *dns.Msg) bool {
+	for _, ip := range resolver.ips(res) {
+		if ip.To4() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// classify returns if the fast answer contains IPs, and if any of them is in
+// China, tracing it under the span of `ctx` if any.
+func (resolver *spoofingProofResolver) classify(ctx context.Context, res *dns.Msg) (hasIP bool, china bool) {
+	_, sp := startSpan(ctx, "classify", spanKindInternal)
+	defer sp.finish()
+	hasIP, china = resolver.containsIP(res), resolver.containsChinaIP(res)
+	sp.set("freedns.has_ip", hasIP)
+	sp.set("freedns.china_ip", china)
+	return hasIP, china
+}
+
+// containsChinaIP check if the resoponse contains IP belonging to China.
+func (resolver *spoofingProofResolver) containsChinaIP(res *dns.Msg) bool {
+	for _, ip := range resolver.ips(res) {
+		if resolver.classifier.isChinaIP(ip) {
+			return true
+		}
+	}
 	return false
 }
@@ -1,14 +1,22 @@
 package freedns
 
 import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/tuna/freedns-go/decisiontest"
 )
 
 func Test_spoofing_proof_resolver_resolve(t *testing.T) {
-	resolver := newSpoofingProofResolver("114.114.114.114:53", "8.8.8.8:53", 1024)
+	resolver := newSpoofingProofResolver("114.114.114.114:53", "8.8.8.8:53", 1024, builtinClassifier{})
 
 	tests := []struct {
 		domain           string
@@ -54,3 +62,298 @@ func Test_spoofing_proof_resolver_resolve(t *testing.T) {
 		})
 	}
 }
+
+func TestContainsChinaIP(t *testing.T) {
+	prefixes, err := parseNAT64Prefixes([]string{"64:ff9b::/96"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := newSpoofingProofResolver("114.114.114.114:53", "8.8.8.8:53", 16, builtinClassifier{})
+	resolver.nat64Prefixes = prefixes
+
+	cases := []struct {
+		rr string
+		ip bool
+		v4 bool
+		cn bool
+	}{
+		{"example.com. 60 IN A 114.114.114.114", true, true, true},
+		{"example.com. 60 IN A 8.8.8.8", true, true, false},
+		{"example.com. 60 IN AAAA 240e:83:205::1", true, false, true},
+		{"example.com. 60 IN AAAA 2001:4860:4860::8888", true, false, false},
+		{"example.com. 60 IN AAAA 64:ff9b::7272:7272", true, true, true}, // 114.114.114.114
+		{"example.com. 60 IN MX 10 mail.example.com.", false, false, false},
+	}
+	for _, c := range cases {
+		rr, err := dns.NewRR(c.rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := &dns.Msg{Answer: []dns.RR{rr}}
+		if resolver.containsIP(res) != c.ip || resolver.containsIPv4(res) != c.v4 || resolver.containsChinaIP(res) != c.cn {
+			t.Errorf("%s: containsIP should be %v, containsIPv4 should be %v, containsChinaIP should be %v", c.rr, c.ip, c.v4, c.cn)
+		}
+	}
+}
+
+func TestResolveAAAAKeepsLocation(t *testing.T) {
+	// both upstreams answer an IPv6 address the China list may miss
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		addr, stop := fakeUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			res := &dns.Msg{}
+			res.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN AAAA 2001:4860:4860::8888")
+			res.Answer = append(res.Answer, rr)
+			w.WriteMsg(res)
+		})
+		defer stop()
+		addrs = append(addrs, addr)
+	}
+	resolver := newSpoofingProofResolver(addrs[0], addrs[1], 16, builtinClassifier{})
+
+	unknown := dns.Question{Name: "unknown.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+	resolver.resolve(unknown, true, "udp")
+	if _, ok := resolver.location(unknown.Name); ok {
+		t.Error("expect the AAAA records alone not to decide the location")
+	}
+
+	cn := dns.Question{Name: "cn.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+	resolver.setLocation(cn.Name, true)
+	if _, upstream := resolver.resolve(cn, true, "udp"); upstream != resolver.fastUpstream {
+		t.Errorf("expect the fast answer of the China domain, got %s", upstream)
+	}
+	if isCN, ok := resolver.location(cn.Name); !ok || !isCN {
+		t.Error("expect the AAAA records alone not to overturn the location")
+	}
+}
+
+func TestExchangeDropsMismatchedResponses(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a fake upstream sending the spoofed responses before the real one
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := &dns.Msg{}
+		if err := req.Unpack(buf[:n]); err != nil {
+			return
+		}
+		send := func(m *dns.Msg) {
+			b, _ := m.Pack()
+			conn.WriteTo(b, addr)
+		}
+		reply := func(name string, ip string) *dns.Msg {
+			m := &dns.Msg{}
+			m.SetReply(req)
+			rr, _ := dns.NewRR(name + " 60 IN A " + ip)
+			m.Answer = append(m.Answer, rr)
+			return m
+		}
+
+		wrongID := reply("example.com.", "6.6.6.6")
+		wrongID.Id = req.Id + 1
+		send(wrongID)
+		wrongName := reply("example.com.", "6.6.6.6")
+		wrongName.Question[0].Name = "evil.com."
+		send(wrongName)
+		notResponse := reply("example.com.", "6.6.6.6")
+		notResponse.Response = false
+		send(notResponse)
+		conn.WriteTo([]byte{0x12}, addr) // malformed
+		// the case of the name may differ
+		real := reply("example.com.", "93.184.216.34")
+		real.Question[0].Name = "EXAMPLE.com."
+		send(real)
+	}()
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	res, err := naiveResolve(context.Background(), q, true, "udp", conn.LocalAddr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "93.184.216.34" {
+		t.Errorf("expect the real response, got %v", res)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	fast, _, stopFast := countingUpstream(t, "114.114.114.114")
+	defer stopFast()
+	clean, _, stopClean := countingUpstream(t, "8.8.8.8")
+	defer stopClean()
+
+	var r Resolver = NewResolver(fast, clean, 16)
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	res, upstream, err := r.Resolve(context.Background(), q, "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstream != fast || len(res.Answer) != 1 {
+		t.Errorf("expect the China IP from the fast upstream, got %v from %s", res, upstream)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := NewResolver("127.0.0.1:1", "127.0.0.1:1", 16).Resolve(ctx, q, "udp"); err != context.Canceled {
+		t.Errorf("expect the context error, got %v", err)
+	}
+}
+
+func TestResolveCancelsTheLoser(t *testing.T) {
+	fast, stopFast := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.Answer, IPs: []string{"114.114.114.114"}})
+	defer stopFast()
+	clean, stopClean := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.Timeout})
+	defer stopClean()
+
+	dir, err := ioutil.TempDir("", "freedns-cancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "upstream.log")
+	ulog, err := newQueryLog(path, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ulog.close()
+
+	resolver := newSpoofingProofResolver(fast, clean, 16, builtinClassifier{})
+	resolver.client.log = ulog
+	q := dns.Question{Name: "example.cn.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	resolver.setLocation(q.Name, true)
+	if _, upstream := resolver.resolve(q, true, "udp"); upstream != fast {
+		t.Fatalf("expect the fast upstream, got %s", upstream)
+	}
+
+	// the clean query ends long before its timeout
+	for i := 0; i < 50; i++ {
+		data, _ := ioutil.ReadFile(path)
+		if strings.Contains(string(data), `"error":"context canceled"`) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("the clean query should be cancelled once the fast upstream answers")
+}
+
+func TestExchangeCancel(t *testing.T) {
+	upstream, stop := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.Timeout})
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	if _, err := exchange(ctx, req, "udp", upstream, nil); err != context.Canceled {
+		t.Errorf("expect context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the exchange should stop on cancel, took %v", elapsed)
+	}
+}
+
+func TestResolveRetries(t *testing.T) {
+	// drops the first query
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for i := 0; ; i++ {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := &dns.Msg{}
+			if i == 0 || req.Unpack(buf[:n]) != nil {
+				continue
+			}
+			res := decisiontest.Reply{Kind: decisiontest.Answer, IPs: []string{"114.114.114.114"}}.Msg(req)
+			b, _ := res.Pack()
+			conn.WriteTo(b, addr)
+		}
+	}()
+	upstream := conn.LocalAddr().String()
+
+	resolver := newSpoofingProofResolver(upstream, upstream, 16, builtinClassifier{})
+	resolver.timeout = 200 * time.Millisecond
+	resolver.retries = 2
+	resolver.backoff = 10 * time.Millisecond
+	q := dns.Question{Name: "example.cn.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	resolver.setLocation(q.Name, true)
+	start := time.Now()
+	res, _ := resolver.resolve(q, true, "udp")
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 {
+		t.Fatalf("the retry should be answered, got %v", res)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the attempts should time out after 200ms, took %v", elapsed)
+	}
+	if d := resolver.resolveTimeout(); d != 3*200*time.Millisecond+15*time.Millisecond+30*time.Millisecond-100*time.Millisecond {
+		t.Errorf("unexpected resolve timeout %v", d)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 4; attempt++ {
+		base := 100 * time.Millisecond << uint(attempt-1)
+		for i := 0; i < 100; i++ {
+			if d := retryBackoff(100*time.Millisecond, attempt); d < base/2 || d >= base*3/2 {
+				t.Fatalf("attempt %d: %v is out of the jitter of %v", attempt, d, base)
+			}
+		}
+	}
+	if d := retryBackoff(0, 1); d != 0 {
+		t.Errorf("expect no backoff, got %v", d)
+	}
+}
+
+func TestTruncatedRetriedOverTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		if w.RemoteAddr().Network() == "udp" {
+			res.Truncated = true
+		} else {
+			for i := 1; i <= 30; i++ {
+				rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 10.0.0." + strconv.Itoa(i))
+				res.Answer = append(res.Answer, rr)
+			}
+		}
+		w.WriteMsg(res)
+	})
+	tcp := &dns.Server{Listener: l, Handler: handler}
+	udp := &dns.Server{PacketConn: conn, Handler: handler}
+	go tcp.ActivateAndServe()
+	go udp.ActivateAndServe()
+	defer tcp.Shutdown()
+	defer udp.Shutdown()
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	res, err := naiveResolve(context.Background(), q, true, "udp", l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Truncated || len(res.Answer) != 30 {
+		t.Errorf("expect the full answer over tcp, got %v", res)
+	}
+}
@@ -0,0 +1,27 @@
+package freedns
+
+import (
+	"context"
+	"net"
+)
+
+// listenReusePort opens `n` UDP sockets on the address with SO_REUSEPORT, so
+// the kernel spreads the packets over them and each has its own receive loop.
+// The sockets after the first one are bound to the address of the first one,
+// i.e. to the same port if the port of `addr` is 0.
+func listenReusePort(addr string, n int) ([]net.PacketConn, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	var conns []net.PacketConn
+	for i := 0; i < n; i++ {
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+		addr = conn.LocalAddr().String()
+	}
+	return conns, nil
+}
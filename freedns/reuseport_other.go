@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package freedns
+
+import "syscall"
+
+// reusePortSupported is whether the platform has SO_REUSEPORT.
+const reusePortSupported = false
+
+func reusePortControl(network string, address string, c syscall.RawConn) error {
+	return Error("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,54 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+	conns, err := listenReusePort("127.0.0.1:0", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 3 {
+		t.Fatalf("expect 3 sockets, got %d", len(conns))
+	}
+	for _, c := range conns {
+		defer c.Close()
+		if c.LocalAddr().String() != conns[0].LocalAddr().String() {
+			t.Errorf("expect the sockets on %s, got %s", conns[0].LocalAddr(), c.LocalAddr())
+		}
+	}
+
+	s := newTestServer(t, Config{UDPSockets: 4})
+	if len(s.reuseServers) != 3 {
+		t.Errorf("expect 3 servers besides the first one, got %d", len(s.reuseServers))
+	}
+	if _, err := NewServer(Config{FastDNS: "127.0.0.1:1", CleanDNS: "127.0.0.1:1", Listen: "127.0.0.1:0", UDPSockets: -1}); err == nil {
+		t.Error("negative UDP sockets should be refused")
+	}
+}
+
+func TestRunReusePortFailure(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+	// a socket without SO_REUSEPORT keeps the others off the port
+	taken, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	s := newTestServer(t, Config{Listen: taken.LocalAddr().String(), UDPSockets: 2})
+	if err := s.Run(); err == nil {
+		t.Fatal("expect the sockets failing to be bound")
+	}
+	select {
+	case <-s.done:
+	default:
+		t.Error("expect the background jobs stopped after the failure")
+	}
+}
@@ -0,0 +1,112 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// reverseZone forwards the reverse lookups of the prefix to the upstream.
+type reverseZone struct {
+	prefix   *net.IPNet
+	upstream string
+}
+
+// reverseForwarder forwards the reverse (PTR) lookups of the LAN ranges to
+// the local router or directory server, so they never leak to the public
+// upstreams, which only answer NXDOMAIN for them anyway.
+type reverseForwarder struct {
+	zones []reverseZone // the longest prefix first
+}
+
+// newReverseForwarder parses the zones in the form of `cidr=host:port`, e.g.
+// `192.168.0.0/16=192.168.1.1`.
+func newReverseForwarder(zones []string) (*reverseForwarder, error) {
+	f := &reverseForwarder{}
+	for _, z := range zones {
+		parts := strings.SplitN(z, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, Error("invalid reverse server, expect cidr=host:port: " + z)
+		}
+		_, prefix, err := net.ParseCIDR(parts[0])
+		if err != nil {
+			return nil, Error("invalid reverse server: " + err.Error())
+		}
+		f.zones = append(f.zones, reverseZone{prefix: prefix, upstream: appendDefaultPort(parts[1])})
+	}
+	sort.SliceStable(f.zones, func(i, j int) bool {
+		a, _ := f.zones[i].prefix.Mask.Size()
+		b, _ := f.zones[j].prefix.Mask.Size()
+		return a > b
+	})
+	return f, nil
+}
+
+// match returns the zone of the reverse name, or nil if it's none of them.
+// Names of whole networks, e.g. 168.192.in-addr.arpa for SOA queries, match
+// the zones they're within.
+func (f *reverseForwarder) match(name string) *reverseZone {
+	ip, bits, ok := parseReverseName(name)
+	if !ok {
+		return nil
+	}
+	for i := range f.zones {
+		z := &f.zones[i]
+		ones, size := z.prefix.Mask.Size()
+		if size == len(ip)*8 && bits >= ones && z.prefix.Contains(ip) {
+			return z
+		}
+	}
+	return nil
+}
+
+// parseReverseName returns the network of the in-addr.arpa or ip6.arpa name
+// and its prefix length, e.g. 192.168.0.0 and 16 for 168.192.in-addr.arpa.
+func parseReverseName(name string) (net.IP, int, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var labels []string
+	var ip net.IP
+	var width, base int // the bits of a label, and its base
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels = strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		ip, width, base = make(net.IP, net.IPv4len), 8, 10
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		labels = strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		ip, width, base = make(net.IP, net.IPv6len), 4, 16
+	default:
+		return nil, 0, false
+	}
+	if len(labels)*width > len(ip)*8 {
+		return nil, 0, false
+	}
+	for i := range labels {
+		v, err := strconv.ParseUint(labels[len(labels)-1-i], base, width)
+		if err != nil {
+			return nil, 0, false
+		}
+		if width == 8 {
+			ip[i] = byte(v)
+		} else {
+			ip[i/2] |= byte(v) << uint(4*(1-i%2))
+		}
+	}
+	return ip, len(labels) * width, true
+}
+
+// forwardReverse forwards the query to the upstream of the zone. The failures
+// are answered with SERVFAIL rather than asking the public upstreams.
+func (s *Server) forwardReverse(z *reverseZone, req *dns.Msg, net string) (*dns.Msg, string) {
+	res, err := naiveResolve(context.Background(), req.Question[0], req.RecursionDesired, net, z.upstream, s.resolver.client)
+	if err != nil || res == nil {
+		res = &dns.Msg{}
+		res.SetRcode(req, dns.RcodeServerFailure)
+		return res, z.upstream
+	}
+	res.SetRcode(req, res.Rcode)
+	return res, z.upstream
+}
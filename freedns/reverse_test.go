@@ -0,0 +1,73 @@
+package freedns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseReverseName(t *testing.T) {
+	cases := []struct {
+		name string
+		ip   string
+		bits int
+	}{
+		{"1.1.168.192.in-addr.arpa.", "192.168.1.1", 32},
+		{"168.192.IN-ADDR.ARPA.", "192.168.0.0", 16},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", "2001:db8::1", 128},
+		{"d.f.ip6.arpa.", "fd00::", 8},
+		{"256.168.192.in-addr.arpa.", "", 0},
+		{"1.2.3.4.5.in-addr.arpa.", "", 0},
+		{"example.com.", "", 0},
+	}
+	for _, c := range cases {
+		ip, bits, ok := parseReverseName(c.name)
+		if c.ip == "" {
+			if ok {
+				t.Errorf("%s: expect no reverse name, got %s/%d", c.name, ip, bits)
+			}
+		} else if !ok || !ip.Equal(net.ParseIP(c.ip)) || bits != c.bits {
+			t.Errorf("%s: expect %s/%d, got %s/%d", c.name, c.ip, c.bits, ip, bits)
+		}
+	}
+}
+
+func TestReverseForwarding(t *testing.T) {
+	reverse, stopReverse := fakeUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN PTR router.lan.")
+		res.Answer = []dns.RR{rr}
+		w.WriteMsg(res)
+	})
+	defer stopReverse()
+	upstream, queries, stop := countingUpstream(t, "10.0.0.1")
+	defer stop()
+
+	s := newTestServer(t, Config{
+		FastDNS:        upstream,
+		CleanDNS:       upstream,
+		ReverseServers: []string{"192.168.0.0/16=" + reverse, "192.168.2.0/24=127.0.0.1:1"},
+	})
+	cases := []struct {
+		name     string
+		rcode    int
+		upstream bool
+	}{
+		{"1.1.168.192.in-addr.arpa.", dns.RcodeSuccess, false},
+		{"1.2.168.192.in-addr.arpa.", dns.RcodeServerFailure, false}, // the longer prefix
+		{"1.1.16.172.in-addr.arpa.", dns.RcodeSuccess, true},
+	}
+	for _, c := range cases {
+		before := atomic.LoadInt32(queries)
+		req := &dns.Msg{}
+		req.SetQuestion(c.name, dns.TypePTR)
+		w := newRecorder()
+		s.handle(w, req, "udp")
+		if w.msg.Rcode != c.rcode || (atomic.LoadInt32(queries) > before) != c.upstream {
+			t.Errorf("%s: unexpected response %v", c.name, w.msg)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package freedns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The actions of the rewrite rules.
+const (
+	rewriteIP       = "ip"       // answer the A or AAAA queries with the IP
+	rewriteCNAME    = "cname"    // point the CNAMEs targeting the domain at another name
+	rewriteNXDomain = "nxdomain" // answer the IP instead of NXDOMAIN
+)
+
+// rewriteTTL is the TTL of the records the rules make up.
+const rewriteTTL = 60
+
+// rewriteRule rewrites the responses of the domain and its subdomains.
+type rewriteRule struct {
+	domain string
+	action string
+	ip     net.IP // rewriteIP and rewriteNXDomain
+	target string // rewriteCNAME
+}
+
+// rewriter is the rules rewriting the responses after the resolution, e.g.
+// for the captive portals and the lab tests. The first rule of the domain
+// with the action applying to the response takes effect.
+type rewriter struct {
+	rules []rewriteRule
+}
+
+// newRewriter parses the rules in the form of `domain=action:value`, e.g.
+// `portal.lan=ip:192.168.1.1`, `cdn.example.com=cname:cdn.example.net` or
+// `lab.example.com=nxdomain:10.0.0.9`.
+func newRewriter(rules []string) (*rewriter, error) {
+	r := &rewriter{}
+	for _, s := range rules {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, Error("invalid rewrite rule, expect domain=action:value: " + s)
+		}
+		action := strings.SplitN(parts[1], ":", 2)
+		if len(action) != 2 || action[1] == "" {
+			return nil, Error("invalid rewrite rule, expect domain=action:value: " + s)
+		}
+		rule := rewriteRule{domain: strings.ToLower(dns.Fqdn(parts[0])), action: action[0]}
+		switch rule.action {
+		case rewriteIP, rewriteNXDomain:
+			if rule.ip = net.ParseIP(action[1]); rule.ip == nil {
+				return nil, Error("invalid IP of rewrite rule: " + s)
+			}
+		case rewriteCNAME:
+			if _, ok := dns.IsDomainName(action[1]); !ok {
+				return nil, Error("invalid target of rewrite rule: " + s)
+			}
+			rule.target = strings.ToLower(dns.Fqdn(action[1]))
+		default:
+			return nil, Error("unknown rewrite action, expect ip, cname or nxdomain: " + s)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// match returns the first rule of the name with the action, or nil.
+func (r *rewriter) match(name string, action string) *rewriteRule {
+	name = strings.ToLower(name)
+	for i := range r.rules {
+		if rule := &r.rules[i]; rule.action == action && dns.IsSubDomain(rule.domain, name) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// answerIP answers the query with the IP of the rule: an A or AAAA record of
+// the family of the IP, and NOERROR without answers for the other family and
+// the other types.
+func answerIP(req *dns.Msg, ip net.IP) *dns.Msg {
+	q := req.Question[0]
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.RecursionAvailable = true
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: rewriteTTL}
+	if v4 := ip.To4(); v4 != nil && q.Qtype == dns.TypeA {
+		res.Answer = []dns.RR{&dns.A{Hdr: hdr, A: v4}}
+	} else if v4 == nil && q.Qtype == dns.TypeAAAA {
+		res.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}
+	}
+	return res
+}
+
+// retarget returns the index of the first CNAME of `res` targeting a domain
+// of a cname rule, and the rule, or -1.
+func (r *rewriter) retarget(res *dns.Msg) (int, *rewriteRule) {
+	for i, rr := range res.Answer {
+		if c, ok := rr.(*dns.CNAME); ok {
+			if rule := r.match(c.Target, rewriteCNAME); rule != nil {
+				return i, rule
+			}
+		}
+	}
+	return -1, nil
+}
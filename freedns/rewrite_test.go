@@ -0,0 +1,78 @@
+package freedns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRewriteRules(t *testing.T) {
+	for _, bad := range []string{"portal.lan", "portal.lan=ip", "portal.lan=ip:x", "a.com=cname:..", "a.com=drop:1"} {
+		if _, err := newRewriter([]string{bad}); err == nil {
+			t.Errorf("%s: expect an error", bad)
+		}
+	}
+
+	records := map[string][]string{
+		"www.example.com.":  {"www.example.com. 60 IN CNAME cdn.example.com.", "cdn.example.com. 60 IN A 203.0.113.1"},
+		"test.example.net.": {"test.example.net. 60 IN A 198.51.100.1"},
+		"forced.lan.":       {"forced.lan. 60 IN A 203.0.113.9"},
+	}
+	upstream, stop := fakeUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		rrs, ok := records[req.Question[0].Name]
+		if !ok {
+			res.Rcode = dns.RcodeNameError
+		}
+		for _, r := range rrs {
+			if rr, _ := dns.NewRR(r); rr.Header().Rrtype == req.Question[0].Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+				res.Answer = append(res.Answer, rr)
+			}
+		}
+		w.WriteMsg(res)
+	})
+	defer stop()
+
+	s := newTestServer(t, Config{FastDNS: upstream, CleanDNS: upstream, RewriteRules: []string{
+		"forced.lan=ip:192.168.1.1",
+		"cdn.example.com=cname:test.example.net",
+		"lab.example.com=nxdomain:10.0.0.9",
+	}})
+	cases := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		want  []string
+	}{
+		{"forced.lan.", dns.TypeA, dns.RcodeSuccess, []string{"192.168.1.1"}},
+		{"www.forced.lan.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"test.example.net.", "198.51.100.1"}},
+		{"a.lab.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"10.0.0.9"}},
+		{"missing.example.com.", dns.TypeA, dns.RcodeNameError, nil},
+	}
+	for _, c := range cases {
+		req := &dns.Msg{}
+		req.SetQuestion(c.name, c.qtype)
+		w := newRecorder()
+		s.handle(w, req, "udp")
+		var got []string
+		for _, rr := range w.msg.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				got = append(got, rr.A.String())
+			case *dns.CNAME:
+				got = append(got, rr.Target)
+			}
+		}
+		if w.msg.Rcode != c.rcode || len(got) != len(c.want) {
+			t.Errorf("%s: expect %v, got %v", c.name, c.want, w.msg)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: expect %v, got %v", c.name, c.want, w.msg)
+			}
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package freedns
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// The policies of the RPZ rules (draft-vixie-dnsop-dns-rpz).
+type rpzAction int
+
+const (
+	rpzNXDomain rpzAction = iota // CNAME .
+	rpzNoData                    // CNAME *.
+	rpzPassthru                  // CNAME rpz-passthru.
+	rpzCNAME                     // CNAME to any other name
+	rpzLocal                     // the local data, e.g. A 10.0.0.1
+)
+
+// rpzRule is the policy of a trigger name.
+type rpzRule struct {
+	action rpzAction
+	target string   // of rpzCNAME, `*.` prefixed to prepend the query name
+	rrs    []dns.RR // of rpzLocal
+}
+
+// The minimum and default refresh intervals of a zone if its SOA has none.
+const (
+	rpzMinRefresh     = time.Minute
+	rpzDefaultRefresh = time.Hour
+)
+
+// rpzZone is a response policy zone, loaded from a zone file or transferred
+// from the primary with AXFR.
+type rpzZone struct {
+	name    string // FQDN
+	file    string
+	primary string
+
+	mu    sync.RWMutex
+	rules map[string]*rpzRule // by the normalized triggers, e.g. *.example.com
+	soa   *dns.SOA
+}
+
+// rpz applies the response policy zones. Only the QNAME triggers are
+// supported; the IP, NSDNAME and NSIP triggers are skipped as freedns-go
+// doesn't see the name servers, and so are rpz-drop and rpz-tcp-only. The
+// first zone with a matching rule takes effect.
+type rpz struct {
+	zones    []*rpzZone
+	interval time.Duration // 0 uses the refresh of the SOAs
+}
+
+// newRPZ parses the zones in the form of `zone=file:path`, loading the zone
+// file, or `zone=host:port`, transferring the zone from the primary, and
+// loads them.
+func newRPZ(zones []string, interval time.Duration) (*rpz, error) {
+	r := &rpz{interval: interval}
+	for _, z := range zones {
+		parts := strings.SplitN(z, "=", 2)
+		if len(parts) != 2 || normalizeDomain(parts[0]) == "" || parts[1] == "" {
+			return nil, Error("invalid RPZ zone, expect zone=file:path or zone=host:port: " + z)
+		}
+		zone := &rpzZone{name: dns.Fqdn(strings.ToLower(parts[0]))}
+		if strings.HasPrefix(parts[1], "file:") {
+			zone.file = strings.TrimPrefix(parts[1], "file:")
+		} else {
+			zone.primary = appendDefaultPort(parts[1])
+		}
+		if err := zone.reload(); err != nil {
+			return nil, Error("RPZ " + zone.name + ": " + err.Error())
+		}
+		r.zones = append(r.zones, zone)
+	}
+	return r, nil
+}
+
+// match returns the rule of the name and its zone, or nil if no zone has one.
+func (r *rpz) match(name string) (*rpzZone, *rpzRule) {
+	name = normalizeDomain(name)
+	for _, z := range r.zones {
+		if rule := z.match(name); rule != nil {
+			return z, rule
+		}
+	}
+	return nil, nil
+}
+
+// match returns the rule of the normalized name. The exact rule takes
+// precedence over the wildcards, and the closer wildcards over the others.
+func (z *rpzZone) match(name string) *rpzRule {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	if rule := z.rules[name]; rule != nil {
+		return rule
+	}
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if rule := z.rules["*."+name]; rule != nil {
+			return rule
+		}
+	}
+	return z.rules["*"]
+}
+
+// reply answers the request by the rule, or returns nil for rpzPassthru and
+// rpzCNAME, which need the upstreams.
+func (z *rpzZone) reply(req *dns.Msg, rule *rpzRule) *dns.Msg {
+	q := req.Question[0]
+	res := &dns.Msg{}
+	switch rule.action {
+	case rpzNXDomain:
+		res.SetRcode(req, dns.RcodeNameError)
+	case rpzNoData:
+		res.SetReply(req)
+	case rpzLocal:
+		res.SetReply(req)
+		for _, rr := range rule.rrs {
+			if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				rr = dns.Copy(rr)
+				rr.Header().Name = q.Name
+				res.Answer = append(res.Answer, rr)
+			}
+		}
+	default:
+		return nil
+	}
+	if len(res.Answer) == 0 {
+		z.mu.RLock()
+		if z.soa != nil {
+			res.Ns = []dns.RR{dns.Copy(z.soa)}
+		}
+		z.mu.RUnlock()
+	}
+	setEDE(res, req, edeBlocked, "rpz "+z.name)
+	return res
+}
+
+// rewrite returns the CNAME of the query name to the target of the rule.
+func (z *rpzZone) rewrite(q dns.Question, rule *rpzRule) *dns.CNAME {
+	target := rule.target
+	if strings.HasPrefix(target, "*.") {
+		target = q.Name + target[2:]
+	}
+	return &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: z.ttl()},
+		Target: target,
+	}
+}
+
+// ttl is of the synthesized records, the minimum TTL of the SOA.
+func (z *rpzZone) ttl() uint32 {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	if z.soa != nil {
+		return z.soa.Minttl
+	}
+	return 60
+}
+
+// reload loads the zone file, or transfers the zone if the serial of the
+// primary differs from the loaded one.
+func (z *rpzZone) reload() error {
+	var rrs []dns.RR
+	if z.file != "" {
+		f, err := os.Open(z.file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		zp := dns.NewZoneParser(f, z.name, z.file)
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			rrs = append(rrs, rr)
+		}
+		if err := zp.Err(); err != nil {
+			return err
+		}
+	} else {
+		serial, err := z.primarySerial()
+		if err != nil {
+			return err
+		}
+		z.mu.RLock()
+		unchanged := z.soa != nil && z.soa.Serial == serial
+		z.mu.RUnlock()
+		if unchanged {
+			return nil
+		}
+		if rrs, err = z.transfer(); err != nil {
+			return err
+		}
+	}
+	return z.load(rrs)
+}
+
+func (z *rpzZone) primarySerial() (uint32, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(z.name, dns.TypeSOA)
+	c := &dns.Client{Net: "tcp", Timeout: exchangeTimeout}
+	res, _, err := c.Exchange(req, z.primary)
+	if err != nil {
+		return 0, err
+	}
+	for _, rr := range res.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, Error("no SOA from " + z.primary)
+}
+
+func (z *rpzZone) transfer() ([]dns.RR, error) {
+	req := &dns.Msg{}
+	req.SetAxfr(z.name)
+	t := &dns.Transfer{}
+	envelopes, err := t.In(req, z.primary)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for e := range envelopes {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	return rrs, nil
+}
+
+// load replaces the rules by the records of the zone.
+func (z *rpzZone) load(rrs []dns.RR) error {
+	rules := map[string]*rpzRule{}
+	var soa *dns.SOA
+	skipped := 0
+	for _, rr := range rrs {
+		h := rr.Header()
+		owner := strings.ToLower(h.Name)
+		if owner == z.name {
+			if s, ok := rr.(*dns.SOA); ok && soa == nil {
+				soa = s
+			}
+			continue // the SOA and NS of the apex
+		}
+		if !strings.HasSuffix(owner, "."+z.name) {
+			skipped++
+			continue
+		}
+		trigger := strings.TrimSuffix(owner, "."+z.name)
+		if strings.Contains(trigger, ".rpz-") || strings.HasPrefix(trigger, "rpz-") {
+			skipped++ // the IP, NSDNAME or NSIP triggers
+			continue
+		}
+
+		rule := rules[trigger]
+		if cname, ok := rr.(*dns.CNAME); ok {
+			target := strings.ToLower(cname.Target)
+			switch {
+			case target == ".":
+				rule = &rpzRule{action: rpzNXDomain}
+			case target == "*.":
+				rule = &rpzRule{action: rpzNoData}
+			case target == "rpz-passthru." || target == trigger+".":
+				rule = &rpzRule{action: rpzPassthru}
+			case strings.HasPrefix(target, "rpz-"):
+				skipped++ // rpz-drop and rpz-tcp-only
+				continue
+			default:
+				rule = &rpzRule{action: rpzCNAME, target: cname.Target}
+			}
+		} else {
+			if rule == nil || rule.action != rpzLocal {
+				rule = &rpzRule{action: rpzLocal}
+			}
+			rule.rrs = append(rule.rrs, rr)
+		}
+		rules[trigger] = rule
+	}
+	if soa == nil {
+		return Error("no SOA in the zone")
+	}
+
+	z.mu.Lock()
+	z.rules, z.soa = rules, soa
+	z.mu.Unlock()
+	log.WithFields(logrus.Fields{
+		"op":      "load_rpz",
+		"zone":    z.name,
+		"serial":  soa.Serial,
+		"rules":   len(rules),
+		"skipped": skipped,
+	}).Info()
+	return nil
+}
+
+// refreshInterval is r.interval, or the refresh of the SOA of the zone.
+func (r *rpz) refreshInterval(z *rpzZone) time.Duration {
+	if r.interval > 0 {
+		return r.interval
+	}
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	d := time.Duration(z.soa.Refresh) * time.Second
+	if d <= 0 {
+		return rpzDefaultRefresh
+	}
+	if d < rpzMinRefresh {
+		return rpzMinRefresh
+	}
+	return d
+}
+
+// run reloads the zones until `done` is closed, waiting for the maintenance
+// windows if any.
+func (r *rpz) run(windows maintenanceWindows, done <-chan struct{}) {
+	for _, z := range r.zones {
+		go func(z *rpzZone) {
+			for {
+				t := time.NewTimer(r.refreshInterval(z))
+				select {
+				case <-done:
+					t.Stop()
+					return
+				case <-t.C:
+				}
+				if !windows.wait(done) {
+					return
+				}
+				if err := z.reload(); err != nil {
+					log.WithFields(logrus.Fields{
+						"op":   "load_rpz",
+						"zone": z.name,
+					}).Error(err)
+				}
+			}
+		}(z)
+	}
+}
@@ -0,0 +1,144 @@
+package freedns
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/tuna/freedns-go/decisiontest"
+)
+
+const testRPZ = `$TTL 300
+@ SOA localhost. admin.localhost. 1 3600 600 86400 60
+@ NS localhost.
+bad.example CNAME .
+*.bad.example CNAME .
+empty.example CNAME *.
+ok.bad.example CNAME rpz-passthru.
+walled.example CNAME garden.example.
+*.prefixed.example CNAME *.garden.example.
+local.example A 10.0.0.1
+local.example TXT "local"
+32.1.2.0.192.rpz-ip CNAME .
+dropped.example CNAME rpz-drop.
+`
+
+func TestRPZ(t *testing.T) {
+	zone := writeTempFile(t, testRPZ)
+	defer os.Remove(zone)
+	upstream, stop := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.Answer, IPs: []string{"114.114.114.114"}})
+	defer stop()
+
+	s := newTestServer(t, Config{
+		FastDNS:  upstream,
+		CleanDNS: upstream,
+		RPZZones: []string{"rpz.lan=file:" + zone},
+	})
+	cases := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		soa     bool
+	}{
+		{"bad.example.", dns.TypeA, dns.RcodeNameError, 0, true},
+		{"www.BAD.example.", dns.TypeA, dns.RcodeNameError, 0, true},
+		{"empty.example.", dns.TypeA, dns.RcodeSuccess, 0, true},
+		{"ok.bad.example.", dns.TypeA, dns.RcodeSuccess, 1, false},
+		{"local.example.", dns.TypeA, dns.RcodeSuccess, 1, false},
+		{"local.example.", dns.TypeAAAA, dns.RcodeSuccess, 0, true},
+		{"walled.example.", dns.TypeA, dns.RcodeSuccess, 2, false},
+		{"walled.example.", dns.TypeCNAME, dns.RcodeSuccess, 1, false},
+		{"dropped.example.", dns.TypeA, dns.RcodeSuccess, 1, false}, // unsupported
+		{"other.example.", dns.TypeA, dns.RcodeSuccess, 1, false},
+	}
+	for _, c := range cases {
+		req := &dns.Msg{}
+		req.SetQuestion(c.name, c.qtype)
+		w := newRecorder()
+		s.handle(w, req, "udp")
+		res := w.msg
+		if res.Rcode != c.rcode || len(res.Answer) != c.answers || (len(res.Ns) > 0) != c.soa {
+			t.Errorf("%s %s: unexpected response %v", c.name, dns.TypeToString[c.qtype], res)
+		}
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("x.prefixed.example.", dns.TypeA)
+	w := newRecorder()
+	s.handle(w, req, "udp")
+	if len(w.msg.Answer) != 2 || w.msg.Answer[0].(*dns.CNAME).Target != "x.prefixed.example.garden.example." {
+		t.Errorf("the query name should be prepended to the target, got %v", w.msg)
+	}
+	if a, ok := w.msg.Answer[1].(*dns.A); !ok || a.Hdr.Name != "x.prefixed.example.garden.example." {
+		t.Errorf("the target should be resolved, got %v", w.msg)
+	}
+}
+
+func TestRPZTransfer(t *testing.T) {
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(strings.NewReader(testRPZ), "rpz.lan.", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	serial := uint32(1)
+	currentSOA := func() dns.RR {
+		soa := dns.Copy(rrs[0]).(*dns.SOA)
+		soa.Serial = atomic.LoadUint32(&serial)
+		return soa
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var transfers int32
+	srv := &dns.Server{
+		Listener: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			if req.Question[0].Qtype != dns.TypeAXFR {
+				res := &dns.Msg{}
+				res.SetReply(req)
+				res.Answer = []dns.RR{currentSOA()}
+				w.WriteMsg(res)
+				return
+			}
+			atomic.AddInt32(&transfers, 1)
+			ch := make(chan *dns.Envelope)
+			tr := &dns.Transfer{}
+			go tr.Out(w, req, ch)
+			soa := currentSOA()
+			ch <- &dns.Envelope{RR: append(append([]dns.RR{soa}, rrs[1:]...), soa)}
+			close(ch)
+			w.Hijack()
+		}),
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	r, err := newRPZ([]string{"rpz.lan=" + l.Addr().String()}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, rule := r.match("bad.example."); rule == nil || rule.action != rpzNXDomain {
+		t.Errorf("expect the NXDOMAIN rule, got %+v", rule)
+	}
+	if d := r.refreshInterval(r.zones[0]); d.Seconds() != 3600 {
+		t.Errorf("expect the refresh of the SOA, got %v", d)
+	}
+
+	// transferred again only when the serial changes
+	if err := r.zones[0].reload(); err != nil || atomic.LoadInt32(&transfers) != 1 {
+		t.Errorf("expect no transfer of the same serial, got %d, %v", transfers, err)
+	}
+	atomic.AddUint32(&serial, 1)
+	if err := r.zones[0].reload(); err != nil || atomic.LoadInt32(&transfers) != 2 {
+		t.Errorf("expect the transfer of the new serial, got %d, %v", transfers, err)
+	}
+}
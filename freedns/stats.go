@@ -0,0 +1,327 @@
+package freedns
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// statsBucketSize is the time span of a stats bucket, the granularity of the
+// stats windows.
+const statsBucketSize = time.Minute
+
+// statsMaxKeys is the maximum distinct clients or domains counted in a
+// bucket. The rest are counted as statsOther, so a flood of random names
+// can't exhaust the memory.
+const statsMaxKeys = 10000
+
+const statsOther = "(other)"
+
+// statsRecent is how many recent queries are kept.
+const statsRecent = 100
+
+// statsBucket counts the queries in a statsBucketSize.
+type statsBucket struct {
+	start     time.Time
+	total     int
+	blocked   int
+	cached    int
+	clients   map[string]int
+	domains   map[string]int
+	blocks    map[string]int // the blocked domains
+	qtypes    map[string]int
+	upstreams map[string]int // the queries resolved by the upstreams
+	failures  map[string]int // the SERVFAILs of the upstreams
+	policies  map[string]*statsPolicyCount
+}
+
+// statsPolicyCount counts the queries of the clients of an upstream policy.
+type statsPolicyCount struct {
+	total   int
+	blocked int
+	cached  int
+}
+
+func newStatsBucket(start time.Time) *statsBucket {
+	return &statsBucket{
+		start:     start,
+		clients:   map[string]int{},
+		domains:   map[string]int{},
+		blocks:    map[string]int{},
+		qtypes:    map[string]int{},
+		upstreams: map[string]int{},
+		failures:  map[string]int{},
+		policies:  map[string]*statsPolicyCount{},
+	}
+}
+
+func countKey(m map[string]int, key string) {
+	if _, ok := m[key]; !ok && len(m) >= statsMaxKeys {
+		key = statsOther
+	}
+	m[key]++
+}
+
+// stats keeps the rolling counters of the queries over the last `window`.
+type stats struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	buckets []*statsBucket  // the oldest first
+	recent  []queryLogEntry // the oldest first
+}
+
+func newStats(window time.Duration) *stats {
+	return &stats{window: window}
+}
+
+func (s *stats) record(e queryLogEntry) {
+	now := time.Now()
+	start := now.Truncate(statsBucketSize)
+	domain := normalizeDomain(e.Name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.buckets)
+	if n == 0 || s.buckets[n-1].start.Before(start) {
+		s.buckets = append(s.buckets, newStatsBucket(start))
+		s.expire(now)
+	}
+	b := s.buckets[len(s.buckets)-1]
+	b.total++
+	countKey(b.clients, e.Client)
+	countKey(b.domains, domain)
+	countKey(b.qtypes, e.Type)
+	p := &statsPolicyCount{} // counting nothing without a policy
+	if e.Policy != "" {
+		if b.policies[e.Policy] == nil {
+			b.policies[e.Policy] = &statsPolicyCount{}
+		}
+		p = b.policies[e.Policy]
+		p.total++
+	}
+	switch {
+	case e.Upstream == "blocklist" || e.Upstream == "homograph" || e.Upstream == "rpz":
+		b.blocked++
+		p.blocked++
+		countKey(b.blocks, domain)
+	case e.Cache == cacheHit:
+		b.cached++
+		p.cached++
+	case e.Cache == cacheMiss:
+		countKey(b.upstreams, e.Upstream)
+		if e.Rcode == dns.RcodeToString[dns.RcodeServerFailure] {
+			countKey(b.failures, e.Upstream)
+		}
+	}
+
+	s.recent = append(s.recent, e)
+	if len(s.recent) > statsRecent {
+		s.recent = s.recent[len(s.recent)-statsRecent:]
+	}
+}
+
+// recentQueries returns the recent queries, the latest first.
+func (s *stats) recentQueries() []queryLogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queries := make([]queryLogEntry, len(s.recent))
+	for i, e := range s.recent {
+		queries[len(s.recent)-1-i] = e
+	}
+	return queries
+}
+
+// expire drops the buckets older than the window. s.mu must be held.
+func (s *stats) expire(now time.Time) {
+	i := 0
+	for i < len(s.buckets) && now.Sub(s.buckets[i].start) > s.window+statsBucketSize {
+		i++
+	}
+	s.buckets = s.buckets[i:]
+}
+
+// statsCount is a counted name.
+type statsCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// statsUpstream is the health of an upstream.
+type statsUpstream struct {
+	Name     string `json:"name"`
+	Queries  int    `json:"queries"`
+	Failures int    `json:"failures"`
+}
+
+// statsPolicy is the queries of the clients of an upstream policy.
+type statsPolicy struct {
+	Name    string `json:"name"`
+	Total   int    `json:"total"`
+	Blocked int    `json:"blocked"`
+	Cached  int    `json:"cached"`
+}
+
+// statsSummary is the stats of a window. The queries of the clients without
+// an upstream policy are the rest of the totals beyond Policies.
+type statsSummary struct {
+	Window     string          `json:"window"`
+	Total      int             `json:"total"`
+	Blocked    int             `json:"blocked"`
+	Cached     int             `json:"cached"`
+	Upstreams  []statsUpstream `json:"upstreams"`
+	TopClients []statsCount    `json:"top_clients"`
+	TopDomains []statsCount    `json:"top_domains"`
+	TopBlocked []statsCount    `json:"top_blocked"`
+	QTypes     map[string]int  `json:"qtypes"`
+	Policies   []statsPolicy   `json:"policies,omitempty"`
+}
+
+// summary sums the buckets of the last `window` up, with the top `top`
+// clients and domains. The window is capped at s.window.
+func (s *stats) summary(window time.Duration, top int) statsSummary {
+	if window <= 0 || window > s.window {
+		window = s.window
+	}
+	clients := map[string]int{}
+	domains := map[string]int{}
+	blocks := map[string]int{}
+	upstreams := map[string]int{}
+	failures := map[string]int{}
+	policies := map[string]*statsPolicy{}
+	sum := statsSummary{
+		Window: window.String(),
+		QTypes: map[string]int{},
+	}
+
+	since := time.Now().Add(-window).Truncate(statsBucketSize)
+	s.mu.Lock()
+	for _, b := range s.buckets {
+		if b.start.Before(since) {
+			continue
+		}
+		sum.Total += b.total
+		sum.Blocked += b.blocked
+		sum.Cached += b.cached
+		for k, v := range b.upstreams {
+			upstreams[k] += v
+		}
+		for k, v := range b.failures {
+			failures[k] += v
+		}
+		for k, v := range b.clients {
+			clients[k] += v
+		}
+		for k, v := range b.domains {
+			domains[k] += v
+		}
+		for k, v := range b.blocks {
+			blocks[k] += v
+		}
+		for k, v := range b.qtypes {
+			sum.QTypes[k] += v
+		}
+		for k, v := range b.policies {
+			if policies[k] == nil {
+				policies[k] = &statsPolicy{Name: k}
+			}
+			policies[k].Total += v.total
+			policies[k].Blocked += v.blocked
+			policies[k].Cached += v.cached
+		}
+	}
+	s.mu.Unlock()
+
+	sum.TopClients = topCounts(clients, top)
+	sum.TopDomains = topCounts(domains, top)
+	sum.TopBlocked = topCounts(blocks, top)
+	for _, u := range topCounts(upstreams, len(upstreams)) {
+		sum.Upstreams = append(sum.Upstreams, statsUpstream{u.Name, u.Count, failures[u.Name]})
+	}
+	for _, p := range policies {
+		sum.Policies = append(sum.Policies, *p)
+	}
+	sort.Slice(sum.Policies, func(i, j int) bool { return sum.Policies[i].Name < sum.Policies[j].Name })
+	return sum
+}
+
+// statsPoint is the counts of a bucket of the snapshot.
+type statsPoint struct {
+	Time             time.Time `json:"time"`
+	Total            int       `json:"total"`
+	Blocked          int       `json:"blocked"`
+	Cached           int       `json:"cached"`
+	UpstreamQueries  int       `json:"upstream_queries"`
+	UpstreamFailures int       `json:"upstream_failures"`
+}
+
+// statsSnapshot is the time series of the stats of a window, flat enough to
+// be graphed by the JSON datasources of Grafana. It's the schema of the
+// dashboard of grafanaDashboard.
+type statsSnapshot struct {
+	Time          time.Time       `json:"time"`
+	Window        string          `json:"window"`
+	BucketSeconds int             `json:"bucket_seconds"`
+	Buckets       []statsPoint    `json:"buckets"` // the oldest first
+	Upstreams     []statsUpstream `json:"upstreams"`
+	QTypes        []statsCount    `json:"qtypes"`
+}
+
+// snapshot returns the buckets of the last `window`, capped at s.window, and
+// the upstreams and qtypes over it.
+func (s *stats) snapshot(window time.Duration) statsSnapshot {
+	sum := s.summary(window, 0)
+	if window <= 0 || window > s.window {
+		window = s.window
+	}
+	snap := statsSnapshot{
+		Time:          time.Now(),
+		Window:        sum.Window,
+		BucketSeconds: int(statsBucketSize / time.Second),
+		Buckets:       []statsPoint{},
+		Upstreams:     sum.Upstreams,
+		QTypes:        topCounts(sum.QTypes, len(sum.QTypes)),
+	}
+	if snap.Upstreams == nil {
+		snap.Upstreams = []statsUpstream{}
+	}
+
+	since := time.Now().Add(-window).Truncate(statsBucketSize)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.buckets {
+		if b.start.Before(since) {
+			continue
+		}
+		p := statsPoint{Time: b.start, Total: b.total, Blocked: b.blocked, Cached: b.cached}
+		for _, v := range b.upstreams {
+			p.UpstreamQueries += v
+		}
+		for _, v := range b.failures {
+			p.UpstreamFailures += v
+		}
+		snap.Buckets = append(snap.Buckets, p)
+	}
+	return snap
+}
+
+// topCounts returns the `n` names of the highest counts.
+func topCounts(m map[string]int, n int) []statsCount {
+	counts := make([]statsCount, 0, len(m))
+	for k, v := range m {
+		counts = append(counts, statsCount{k, v})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
@@ -0,0 +1,181 @@
+package freedns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestStats(t *testing.T) {
+	s := newStats(time.Hour)
+	s.record(queryLogEntry{Client: "10.0.0.1", Name: "example.com.", Type: "A", Rcode: "NOERROR", Upstream: "8.8.8.8:53", Cache: cacheMiss})
+	s.record(queryLogEntry{Client: "10.0.0.1", Name: "Example.com.", Type: "AAAA", Rcode: "SERVFAIL", Upstream: "8.8.8.8:53", Cache: cacheMiss})
+	s.record(queryLogEntry{Client: "10.0.0.1", Name: "example.com.", Type: "A", Rcode: "NOERROR", Upstream: "cache", Cache: cacheHit})
+	s.record(queryLogEntry{Client: "10.0.0.2", Name: "ads.example.com.", Type: "A", Rcode: "NXDOMAIN", Upstream: "blocklist", Cache: cacheNone})
+
+	// an old bucket out of the short window
+	s.mu.Lock()
+	old := newStatsBucket(time.Now().Add(-30 * time.Minute).Truncate(statsBucketSize))
+	old.total, old.clients["10.0.0.3"], old.domains["old.com"], old.qtypes["MX"] = 5, 5, 5, 5
+	s.buckets = append([]*statsBucket{old}, s.buckets...)
+	s.mu.Unlock()
+
+	sum := s.summary(10*time.Minute, 1)
+	if sum.Total != 4 || sum.Blocked != 1 || sum.Cached != 1 || sum.QTypes["A"] != 3 || sum.QTypes["AAAA"] != 1 {
+		t.Errorf("unexpected summary %+v", sum)
+	}
+	if len(sum.Upstreams) != 1 || sum.Upstreams[0] != (statsUpstream{"8.8.8.8:53", 2, 1}) {
+		t.Errorf("unexpected upstreams %v", sum.Upstreams)
+	}
+	if len(sum.TopClients) != 1 || sum.TopClients[0] != (statsCount{"10.0.0.1", 3}) {
+		t.Errorf("unexpected top clients %v", sum.TopClients)
+	}
+	if len(sum.TopDomains) != 1 || sum.TopDomains[0] != (statsCount{"example.com", 3}) {
+		t.Errorf("unexpected top domains %v", sum.TopDomains)
+	}
+	if len(sum.TopBlocked) != 1 || sum.TopBlocked[0] != (statsCount{"ads.example.com", 1}) {
+		t.Errorf("unexpected top blocked %v", sum.TopBlocked)
+	}
+
+	// the whole window
+	sum = s.summary(0, 10)
+	if sum.Total != 9 || sum.Window != "1h0m0s" || sum.TopClients[0] != (statsCount{"10.0.0.3", 5}) {
+		t.Errorf("unexpected summary of the whole window %+v", sum)
+	}
+
+	// the buckets out of the window are dropped
+	s.mu.Lock()
+	s.buckets[0].start = time.Now().Add(-2 * time.Hour)
+	s.expire(time.Now())
+	n := len(s.buckets)
+	s.mu.Unlock()
+	if n != 1 {
+		t.Errorf("expect 1 bucket left, got %d", n)
+	}
+
+	recent := s.recentQueries()
+	if len(recent) != 4 || recent[0].Name != "ads.example.com." {
+		t.Errorf("expect the recent queries, the latest first, got %v", recent)
+	}
+}
+
+func TestStatsMaxKeys(t *testing.T) {
+	s := newStats(time.Hour)
+	for i := 0; i < statsMaxKeys+10; i++ {
+		s.record(queryLogEntry{Client: "10.0.0.1", Name: strconv.Itoa(i) + ".example.com.", Type: "A"})
+	}
+	sum := s.summary(0, statsMaxKeys+10)
+	if len(sum.TopDomains) != statsMaxKeys+1 || sum.TopDomains[0] != (statsCount{statsOther, 10}) {
+		t.Errorf("expect the extra domains counted as %s, got %d domains, the top %v", statsOther, len(sum.TopDomains), sum.TopDomains[0])
+	}
+}
+
+func TestStatsAPI(t *testing.T) {
+	blocklist := writeTempFile(t, "ads.example.com\n")
+	defer os.Remove(blocklist)
+
+	s := newTestServer(t, Config{
+		AdminListen: "127.0.0.1:0",
+		StatsWindow: Duration(time.Hour),
+		Blocklists:  []string{blocklist},
+	})
+	defer s.Shutdown()
+	api := httptest.NewServer(s.adminServer.Handler)
+	defer api.Close()
+
+	req := &dns.Msg{}
+	req.SetQuestion("ads.example.com.", dns.TypeA)
+	s.handle(newRecorder(), req, "udp")
+
+	resp, err := http.Get(api.URL + "/api/stats?window=5m&top=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum statsSummary
+	json.NewDecoder(resp.Body).Decode(&sum)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || sum.Window != "5m0s" || sum.Total != 1 || sum.Blocked != 1 ||
+		len(sum.TopClients) != 1 || sum.TopClients[0].Name != "127.0.0.1" {
+		t.Errorf("unexpected stats %d %+v", resp.StatusCode, sum)
+	}
+
+	resp, err = http.Get(api.URL + "/api/queries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries []queryLogEntry
+	json.NewDecoder(resp.Body).Decode(&queries)
+	resp.Body.Close()
+	if len(queries) != 1 || queries[0].Name != "ads.example.com." {
+		t.Errorf("unexpected recent queries %v", queries)
+	}
+
+	// the dashboard
+	resp, err = http.Get(api.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("expect the dashboard, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	resp, err = http.Get(api.URL + "/wtf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown paths should be 404, got %d", resp.StatusCode)
+	}
+
+	for _, q := range []string{"window=wtf", "top=0"} {
+		resp, err := http.Get(api.URL + "/api/stats?" + q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s should be a bad request, got %d", q, resp.StatusCode)
+		}
+	}
+}
+
+func TestStatsSnapshot(t *testing.T) {
+	s := newStats(time.Hour)
+	s.record(queryLogEntry{Client: "10.0.0.1", Name: "example.com.", Type: "A", Rcode: "NOERROR", Upstream: "8.8.8.8:53", Cache: cacheMiss})
+	s.record(queryLogEntry{Client: "10.0.0.1", Name: "example.com.", Type: "AAAA", Rcode: "SERVFAIL", Upstream: "8.8.8.8:53", Cache: cacheMiss})
+	s.record(queryLogEntry{Client: "10.0.0.1", Name: "example.com.", Type: "A", Rcode: "NOERROR", Upstream: "cache", Cache: cacheHit})
+
+	snap := s.snapshot(0)
+	if len(snap.Buckets) != 1 || snap.Buckets[0].Total != 3 || snap.Buckets[0].Cached != 1 ||
+		snap.Buckets[0].UpstreamQueries != 2 || snap.Buckets[0].UpstreamFailures != 1 {
+		t.Errorf("unexpected snapshot %+v", snap)
+	}
+
+	// the dashboard only reads the keys of the snapshot
+	b, _ := json.Marshal(snap)
+	var rows map[string]interface{}
+	json.Unmarshal(b, &rows)
+	for _, p := range grafanaPanels {
+		list, ok := rows[p.root].([]interface{})
+		if !ok || len(list) == 0 {
+			t.Errorf("%s: no rows of %s", p.title, p.root)
+			continue
+		}
+		row := list[0].(map[string]interface{})
+		for _, c := range p.columns {
+			if _, ok := row[c.Selector]; !ok {
+				t.Errorf("%s: no %s in the rows of %s", p.title, c.Selector, p.root)
+			}
+		}
+	}
+	if d := grafanaDashboard(); len(d["panels"].([]map[string]interface{})) != len(grafanaPanels) {
+		t.Errorf("unexpected dashboard %v", d)
+	}
+}
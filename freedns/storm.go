@@ -0,0 +1,91 @@
+package freedns
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stormWindow is the window the failures of a query are counted in.
+const stormWindow = 10 * time.Second
+
+// stormCap caps the queries tracked, the least recent ones forgotten first.
+const stormCap = 4096
+
+// stormEntry is the failures of a query of a client.
+type stormEntry struct {
+	failures int
+	since    time.Time // the start of the window
+	until    time.Time // the end of the cooldown
+}
+
+// stormGuard detects the storms of the identical failing queries, e.g. of a
+// misconfigured client retrying in a loop. Once a client's query fails
+// `threshold` times within stormWindow, it's answered SERVFAIL without asking
+// the upstreams for the cooldown, which protects the upstreams and keeps the
+// logs readable.
+type stormGuard struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu      sync.Mutex
+	entries Cache // client/name/type -> *stormEntry
+}
+
+func newStormGuard(threshold int, cooldown time.Duration) *stormGuard {
+	return &stormGuard{
+		threshold: threshold,
+		cooldown:  cooldown,
+		entries:   NewMemoryCache(stormCap),
+	}
+}
+
+func stormKey(client net.Addr, q dns.Question) string {
+	ip := ""
+	if client != nil {
+		ip = client.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+	return ip + "/" + q.Name + "/" + dns.TypeToString[q.Qtype]
+}
+
+// cooling returns if the query is in its cooldown.
+func (g *stormGuard) cooling(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	v, ok := g.entries.Get(key)
+	return ok && time.Now().Before(v.(*stormEntry).until)
+}
+
+// observe counts the failure of the query, and returns true if it starts the
+// cooldown.
+func (g *stormGuard) observe(key string, failed bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	v, ok := g.entries.Get(key)
+	if !failed {
+		if ok {
+			v.(*stormEntry).failures = 0
+		}
+		return false
+	}
+	now := time.Now()
+	if !ok {
+		v = &stormEntry{since: now}
+		g.entries.Set(key, v)
+	}
+	e := v.(*stormEntry)
+	if now.Sub(e.since) > stormWindow {
+		e.failures, e.since = 0, now
+	}
+	e.failures++
+	if e.failures < g.threshold {
+		return false
+	}
+	e.failures, e.since, e.until = 0, now, now.Add(g.cooldown)
+	return true
+}
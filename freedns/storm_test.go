@@ -0,0 +1,47 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/tuna/freedns-go/decisiontest"
+)
+
+func TestQueryStorm(t *testing.T) {
+	upstream, stop := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.ServFail})
+	defer stop()
+	s := newTestServer(t, Config{FastDNS: upstream, CleanDNS: upstream, StormThreshold: 3, StormCooldown: Duration(time.Minute)})
+	query := func(name string, client net.IP) string {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		res, upstream := s.handler(&Request{Msg: req, Net: "udp", Client: &net.UDPAddr{IP: client, Port: 12345}})
+		if res.Rcode != dns.RcodeServerFailure {
+			t.Errorf("%s: expect SERVFAIL, got %v", name, res)
+		}
+		return upstream
+	}
+	looping := net.IPv4(192, 168, 1, 2)
+	for i := 0; i < 3; i++ {
+		if query("broken.example.com.", looping) == "storm" {
+			t.Fatalf("expect the failure %d resolved", i+1)
+		}
+	}
+	if got := query("broken.example.com.", looping); got != "storm" {
+		t.Errorf("expect the cooldown, got %s", got)
+	}
+	if query("broken.example.com.", net.IPv4(192, 168, 1, 3)) == "storm" {
+		t.Error("expect the other clients not cooled down")
+	}
+	if query("other.example.com.", looping) == "storm" {
+		t.Error("expect the other domains not cooled down")
+	}
+
+	g := newStormGuard(2, time.Minute)
+	g.observe("k", true)
+	g.observe("k", false) // a success resets the count
+	if g.observe("k", true) {
+		t.Error("expect the count reset by the success")
+	}
+}
@@ -0,0 +1,80 @@
+package freedns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stretchHealthWeight is the weight of a new query in the health EWMA.
+const stretchHealthWeight = 0.1
+
+// stretchHealthThreshold is the health below which an upstream is unstable,
+// and the TTLs of its answers are stretched.
+const stretchHealthThreshold = 0.9
+
+// ttlStretcher stretches the TTLs of the answers of the unstable upstreams up
+// to `max`, so the clients and the cache query them less often during partial
+// outages. The health of an upstream is the EWMA of its successful queries,
+// and the TTLs are divided by it, e.g. doubled when half the queries fail. As
+// the upstream recovers, the stretch shrinks back smoothly.
+type ttlStretcher struct {
+	max uint32 // seconds
+
+	mu     sync.Mutex
+	health map[string]float64 // upstream -> 1 for healthy
+}
+
+func newTTLStretcher(max time.Duration) *ttlStretcher {
+	return &ttlStretcher{
+		max:    uint32(max / time.Second),
+		health: map[string]float64{},
+	}
+}
+
+// observe is called on every query to the upstream.
+func (t *ttlStretcher) observe(upstream string, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, known := t.health[upstream]
+	if !known {
+		h = 1
+	}
+	v := 0.0
+	if ok {
+		v = 1
+	}
+	t.health[upstream] = h + stretchHealthWeight*(v-h)
+}
+
+func (t *ttlStretcher) healthOf(upstream string) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h, ok := t.health[upstream]; ok {
+		return h
+	}
+	return 1
+}
+
+// stretch stretches the TTLs of `res` of the upstream in place, never beyond
+// the cap nor shortening them.
+func (t *ttlStretcher) stretch(res *dns.Msg, upstream string) {
+	h := t.healthOf(upstream)
+	if h >= stretchHealthThreshold || res.Rcode != dns.RcodeSuccess {
+		return
+	}
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT || hdr.Ttl >= t.max {
+				continue
+			}
+			ttl := float64(hdr.Ttl) / h
+			if h <= 0 || ttl > float64(t.max) {
+				ttl = float64(t.max)
+			}
+			hdr.Ttl = uint32(ttl)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package freedns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTTLStretcher(t *testing.T) {
+	st := newTTLStretcher(time.Hour)
+	answer := func() *dns.Msg {
+		res := &dns.Msg{}
+		res.SetQuestion("example.com.", dns.TypeA)
+		short, _ := dns.NewRR("example.com. 60 IN A 10.0.0.1")
+		long, _ := dns.NewRR("example.com. 3000 IN A 10.0.0.2")
+		res.Answer = []dns.RR{short, long}
+		res.SetEdns0(1232, false)
+		return res
+	}
+
+	res := answer()
+	st.stretch(res, "1.1.1.1:53")
+	if res.Answer[0].Header().Ttl != 60 {
+		t.Errorf("expect a healthy upstream not stretched, got %v", res)
+	}
+
+	for i := 0; i < 7; i++ { // about half the queries failed
+		st.observe("1.1.1.1:53", false)
+	}
+	h := st.healthOf("1.1.1.1:53")
+	res = answer()
+	st.stretch(res, "1.1.1.1:53")
+	if want := uint32(60 / h); res.Answer[0].Header().Ttl != want || want < 100 {
+		t.Errorf("expect the TTL stretched to %d, got %v", want, res)
+	}
+	if res.Answer[1].Header().Ttl != 3600 {
+		t.Errorf("expect the TTL capped, got %v", res)
+	}
+	if res.IsEdns0().UDPSize() != 1232 {
+		t.Errorf("expect the OPT untouched, got %v", res)
+	}
+
+	for i := 0; i < 50; i++ {
+		st.observe("1.1.1.1:53", true)
+	}
+	res = answer()
+	st.stretch(res, "1.1.1.1:53")
+	if res.Answer[0].Header().Ttl != 60 {
+		t.Errorf("expect the stretch gone after the recovery, got %v", res)
+	}
+}
@@ -0,0 +1,159 @@
+package freedns
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// systemDNS is the DNS servers of the network services (macOS) or interfaces
+// (Windows) of the system. No servers means the automatic ones, e.g. from
+// DHCP.
+type systemDNS map[string][]string
+
+// RegisterSystemDNS points the system DNS of macOS (networksetup) or Windows
+// (netsh) at the listener, so the laptop itself uses freedns-go. The previous
+// settings are kept in a file until UnregisterSystemDNS restores them, so
+// registering twice, e.g. after a crash, doesn't lose them.
+func RegisterSystemDNS(listen string) error {
+	ip, err := localNameserver(listen)
+	if err != nil {
+		return err
+	}
+	path, err := systemDNSStatePath()
+	if err != nil {
+		return err
+	}
+	previous, err := getSystemDNS()
+	if err != nil {
+		return err
+	}
+	if !fileExists(path) {
+		b, err := json.Marshal(previous)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, b, 0600); err != nil {
+			return err
+		}
+	}
+
+	settings := systemDNS{}
+	for name := range previous {
+		settings[name] = []string{ip.String()}
+	}
+	return setSystemDNS(settings)
+}
+
+// UnregisterSystemDNS restores the system DNS settings saved by
+// RegisterSystemDNS. It's a no-op if nothing is registered.
+func UnregisterSystemDNS() error {
+	path, err := systemDNSStatePath()
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var previous systemDNS
+	if err := json.Unmarshal(b, &previous); err != nil {
+		return Error("invalid " + path + ": " + err.Error())
+	}
+	if err := setSystemDNS(previous); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func systemDNSStatePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "freedns-go", "system-dns.json"), nil
+}
+
+// runCommand runs the command, returning its output in the error if it fails.
+func runCommand(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", Error(name + " " + strings.Join(args, " ") + ": " + err.Error() + ": " + strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// parseNetworkServices parses `networksetup -listallnetworkservices`. The
+// first line is a note, and the disabled services are marked by asterisks.
+func parseNetworkServices(out string) []string {
+	var services []string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for first := true; scanner.Scan(); first = false {
+		line := strings.TrimSpace(scanner.Text())
+		if first || line == "" || strings.HasPrefix(line, "*") {
+			continue
+		}
+		services = append(services, line)
+	}
+	return services
+}
+
+// parseDNSServers parses `networksetup -getdnsservers`, which is either the
+// servers one per line or a sentence when there are none.
+func parseDNSServers(out string) []string {
+	var servers []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); net.ParseIP(line) != nil {
+			servers = append(servers, line)
+		}
+	}
+	return servers
+}
+
+// parseNetshDNS parses `netsh interface ipv4 show dnsservers`:
+//
+//	Configuration for interface "Ethernet"
+//	    DNS servers configured through DHCP:  192.168.1.1
+//	    Register with which suffix:           Primary only
+//
+//	Configuration for interface "Wi-Fi"
+//	    Statically Configured DNS Servers:    8.8.8.8
+//	                                          8.8.4.4
+//
+// The servers from DHCP are recorded as none, i.e. automatic. The loopback
+// interfaces are left out.
+func parseNetshDNS(out string) systemDNS {
+	settings := systemDNS{}
+	name, static := "", false
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, "\""); strings.HasPrefix(line, "Configuration for interface") && i >= 0 {
+			name, static = strings.Trim(line[i:], "\""), false
+			if strings.Contains(name, "Loopback") {
+				name = ""
+			} else {
+				settings[name] = nil
+			}
+			continue
+		}
+		if name == "" {
+			continue
+		}
+		if i := strings.Index(line, ":"); i >= 0 && net.ParseIP(line) == nil {
+			// a new field, the servers are only on the static ones
+			static = strings.HasPrefix(line, "Statically Configured DNS Servers")
+			line = strings.TrimSpace(line[i+1:])
+		}
+		if static && net.ParseIP(line) != nil {
+			settings[name] = append(settings[name], line)
+		}
+	}
+	return settings
+}
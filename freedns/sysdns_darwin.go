@@ -0,0 +1,32 @@
+package freedns
+
+func getSystemDNS() (systemDNS, error) {
+	out, err := runCommand("networksetup", "-listallnetworkservices")
+	if err != nil {
+		return nil, err
+	}
+	settings := systemDNS{}
+	for _, service := range parseNetworkServices(out) {
+		out, err := runCommand("networksetup", "-getdnsservers", service)
+		if err != nil {
+			return nil, err
+		}
+		settings[service] = parseDNSServers(out)
+	}
+	return settings, nil
+}
+
+func setSystemDNS(settings systemDNS) error {
+	for service, servers := range settings {
+		if len(servers) == 0 {
+			servers = []string{"Empty"} // back to the automatic ones
+		}
+		if _, err := runCommand("networksetup", append([]string{"-setdnsservers", service}, servers...)...); err != nil {
+			return err
+		}
+	}
+	// the stale answers of the previous servers
+	runCommand("dscacheutil", "-flushcache")
+	runCommand("killall", "-HUP", "mDNSResponder")
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package freedns
+
+const errSystemDNS = Error("registering the system DNS is only supported on macOS and Windows, see GuardResolvConf for Linux")
+
+func getSystemDNS() (systemDNS, error) {
+	return nil, errSystemDNS
+}
+
+func setSystemDNS(settings systemDNS) error {
+	return errSystemDNS
+}
@@ -0,0 +1,62 @@
+package freedns
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNetworksetup(t *testing.T) {
+	services := parseNetworkServices(`An asterisk (*) denotes that a network service is disabled.
+USB 10/100/1000 LAN
+Wi-Fi
+*Thunderbolt Bridge
+`)
+	if want := []string{"USB 10/100/1000 LAN", "Wi-Fi"}; !reflect.DeepEqual(services, want) {
+		t.Errorf("expect %v, got %v", want, services)
+	}
+
+	if servers := parseDNSServers("There aren't any DNS Servers set on Wi-Fi.\n"); servers != nil {
+		t.Errorf("expect no servers, got %v", servers)
+	}
+	if servers := parseDNSServers("8.8.8.8\n2001:4860:4860::8888\n"); !reflect.DeepEqual(servers, []string{"8.8.8.8", "2001:4860:4860::8888"}) {
+		t.Errorf("unexpected servers %v", servers)
+	}
+}
+
+func TestParseNetshDNS(t *testing.T) {
+	settings := parseNetshDNS("\r\n" +
+		"Configuration for interface \"Ethernet\"\r\n" +
+		"    DNS servers configured through DHCP:  192.168.1.1\r\n" +
+		"    Register with which suffix:           Primary only\r\n" +
+		"\r\n" +
+		"Configuration for interface \"Wi-Fi 2\"\r\n" +
+		"    Statically Configured DNS Servers:    8.8.8.8\r\n" +
+		"                                          8.8.4.4\r\n" +
+		"    Register with which suffix:           None\r\n" +
+		"\r\n" +
+		"Configuration for interface \"Loopback Pseudo-Interface 1\"\r\n" +
+		"    Statically Configured DNS Servers:    None\r\n")
+	want := systemDNS{
+		"Ethernet": nil,
+		"Wi-Fi 2":  {"8.8.8.8", "8.8.4.4"},
+	}
+	if !reflect.DeepEqual(settings, want) {
+		t.Errorf("expect %v, got %v", want, settings)
+	}
+}
+
+func TestLocalNameserver(t *testing.T) {
+	for listen, want := range map[string]string{
+		"0.0.0.0:53":     "127.0.0.1",
+		":53":            "127.0.0.1",
+		"[::]:53":        "::1",
+		"192.168.1.2:53": "192.168.1.2",
+	} {
+		if ip, err := localNameserver(listen); err != nil || ip.String() != want {
+			t.Errorf("%s: expect %s, got %v, %v", listen, want, ip, err)
+		}
+	}
+	if _, err := localNameserver("127.0.0.1:5353"); err == nil {
+		t.Error("expect an error for the port other than 53")
+	}
+}
@@ -0,0 +1,40 @@
+package freedns
+
+import (
+	"net"
+	"strconv"
+)
+
+func getSystemDNS() (systemDNS, error) {
+	out, err := runCommand("netsh", "interface", "ipv4", "show", "dnsservers")
+	if err != nil {
+		return nil, err
+	}
+	return parseNetshDNS(out), nil
+}
+
+func setSystemDNS(settings systemDNS) error {
+	for name, servers := range settings {
+		if len(servers) == 0 {
+			if _, err := runCommand("netsh", "interface", "ipv4", "set", "dnsservers", "name="+name, "source=dhcp"); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, s := range servers {
+			if ip := net.ParseIP(s); ip == nil || ip.To4() == nil {
+				return Error("only IPv4 DNS servers can be set with netsh, not " + s)
+			}
+		}
+		if _, err := runCommand("netsh", "interface", "ipv4", "set", "dnsservers", "name="+name, "source=static", "address="+servers[0], "register=none", "validate=no"); err != nil {
+			return err
+		}
+		for i, s := range servers[1:] {
+			if _, err := runCommand("netsh", "interface", "ipv4", "add", "dnsservers", "name="+name, "address="+s, "index="+strconv.Itoa(i+2), "validate=no"); err != nil {
+				return err
+			}
+		}
+	}
+	runCommand("ipconfig", "/flushdns")
+	return nil
+}
@@ -0,0 +1,163 @@
+package freedns
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syslogWriteTimeout is how long a message waits for the syslog server. The
+// messages failing to be sent are dropped, so the queries are never blocked
+// by the log.
+const syslogWriteTimeout = time.Second
+
+// syslogFacilities are the facilities of RFC 5424 by their names.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverities are the severities of RFC 5424 of the logrus levels.
+var syslogSeverities = map[logrus.Level]int{
+	logrus.PanicLevel: 0, // emerg
+	logrus.FatalLevel: 2, // crit
+	logrus.ErrorLevel: 3, // err
+	logrus.WarnLevel:  4, // warning
+	logrus.InfoLevel:  6, // info
+	logrus.DebugLevel: 7, // debug
+	logrus.TraceLevel: 7,
+}
+
+// syslogHook sends the log to a syslog server in the format of RFC 5424,
+// over UDP, over TCP with the octet-counting framing of RFC 6587, or to a
+// local unix datagram socket, e.g. /dev/log. The connection is dialed again
+// after a failure.
+type syslogHook struct {
+	network  string // udp, tcp or unixgram
+	address  string
+	facility int
+	hostname string
+	pid      int
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// newSyslogHook creates the hook sending to `target`, udp://host:port,
+// tcp://host:port or unix:///path, with the facility of the name, daemon if
+// it's empty.
+func newSyslogHook(target string, facility string) (*syslogHook, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, Error("invalid syslog, expect udp://host:port, tcp://host:port or unix:///path: " + target)
+	}
+	h := &syslogHook{pid: os.Getpid()}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return nil, Error("missing host of syslog: " + target)
+		}
+		h.network, h.address = u.Scheme, u.Host
+		if u.Port() == "" {
+			h.address = net.JoinHostPort(u.Hostname(), "514")
+		}
+	case "unix":
+		if u.Path == "" {
+			return nil, Error("missing path of syslog: " + target)
+		}
+		h.network, h.address = "unixgram", u.Path
+	default:
+		return nil, Error("invalid syslog, expect udp://host:port, tcp://host:port or unix:///path: " + target)
+	}
+	if facility == "" {
+		facility = "daemon"
+	}
+	f, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, Error("unknown syslog facility: " + facility)
+	}
+	h.facility = f
+	if h.hostname, err = os.Hostname(); err != nil || h.hostname == "" {
+		h.hostname = "-"
+	}
+	return h, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook, sending the entry formatted by the formatter
+// of the log as the message.
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	msg, err := entry.String()
+	if err != nil {
+		return err
+	}
+	msgID := "-"
+	if op, ok := entry.Data["op"].(string); ok && op != "" {
+		msgID = op
+	}
+	line := fmt.Sprintf("<%d>1 %s %s freedns-go %d %s - %s",
+		h.facility*8+syslogSeverities[entry.Level],
+		entry.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		h.hostname, h.pid, msgID, strings.TrimRight(msg, "\n"))
+	if h.network == "tcp" {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conn == nil {
+		if h.conn, err = net.DialTimeout(h.network, h.address, syslogWriteTimeout); err != nil {
+			h.conn = nil
+			return err
+		}
+	}
+	h.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	if _, err := h.conn.Write([]byte(line)); err != nil {
+		h.conn.Close()
+		h.conn = nil
+		return err
+	}
+	return nil
+}
+
+// close closes the connection to the syslog server.
+func (h *syslogHook) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conn != nil {
+		h.conn.Close()
+		h.conn = nil
+	}
+}
+
+// logHooksMu serializes removeLogHook, which swaps the hooks of the logger
+// out and back without the one removed.
+var logHooksMu sync.Mutex
+
+// removeLogHook removes the hook `h` from the logger `l`, leaving the hooks
+// added by the others, e.g. another Server or the program embedding it.
+func removeLogHook(l *logrus.Logger, h logrus.Hook) {
+	logHooksMu.Lock()
+	defer logHooksMu.Unlock()
+	hooks := make(logrus.LevelHooks)
+	for level, levelHooks := range l.ReplaceHooks(make(logrus.LevelHooks)) {
+		for _, hook := range levelHooks {
+			if hook != h {
+				hooks[level] = append(hooks[level], hook)
+			}
+		}
+	}
+	l.ReplaceHooks(hooks)
+}
@@ -0,0 +1,117 @@
+package freedns
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	h, err := newSyslogHook("udp://"+conn.LocalAddr().String(), "local0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	l := logrus.New()
+	l.SetOutput(ioutil.Discard)
+	l.AddHook(h)
+
+	l.WithField("op", "handle").Warn("hello")
+	buf := make([]byte, 4096)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// local0 (16) * 8 + warning (4)
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<132>1 ") || !strings.Contains(msg, " freedns-go ") || !strings.Contains(msg, " handle - ") || !strings.Contains(msg, "hello") {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	h, err := newSyslogHook("tcp://"+ln.Addr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	l := logrus.New()
+	l.SetOutput(ioutil.Discard)
+	l.AddHook(h)
+
+	l.Info("first")
+	l.Error("second")
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(c)
+	for _, want := range []string{"<30>1 ", "<27>1 "} {
+		length, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			t.Fatalf("expect an octet count, got %q", length)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(msg), want) {
+			t.Errorf("expect a message of %q, got %q", want, msg)
+		}
+	}
+}
+
+func TestNewSyslogHook(t *testing.T) {
+	h, err := newSyslogHook("udp://192.168.1.2", "")
+	if err != nil || h.address != "192.168.1.2:514" || h.facility != 3 {
+		t.Errorf("expect the default port and facility, got %+v, %v", h, err)
+	}
+	if h, err := newSyslogHook("unix:///dev/log", ""); err != nil || h.network != "unixgram" || h.address != "/dev/log" {
+		t.Errorf("expect the unix datagram socket, got %+v, %v", h, err)
+	}
+	for _, c := range []struct{ target, facility string }{
+		{"192.168.1.2:514", ""}, {"http://192.168.1.2", ""}, {"udp://", ""}, {"udp://192.168.1.2", "nope"},
+	} {
+		if _, err := newSyslogHook(c.target, c.facility); err == nil {
+			t.Errorf("expect an error of %s with %q", c.target, c.facility)
+		}
+	}
+}
+
+func TestRemoveLogHook(t *testing.T) {
+	l := logrus.New()
+	mine, _ := newSyslogHook("udp://127.0.0.1", "")
+	theirs, _ := newSyslogHook("udp://127.0.0.2", "")
+	l.AddHook(theirs)
+	l.AddHook(mine)
+	removeLogHook(l, mine)
+	for level, hooks := range l.Hooks {
+		if len(hooks) != 1 || hooks[0] != theirs {
+			t.Errorf("expect only the other hook at %s, got %v", level, hooks)
+		}
+	}
+}
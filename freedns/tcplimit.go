@@ -0,0 +1,58 @@
+package freedns
+
+import (
+	"net"
+	"sync"
+)
+
+// limitListener accepts at most `n` connections at once. Accept waits for
+// one of them to be closed beyond that, so the connections held open by the
+// slow or idle clients can't run the server out of file descriptors.
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newLimitListener(l net.Listener, n int) *limitListener {
+	return &limitListener{
+		Listener: l,
+		slots:    make(chan struct{}, n),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.closed:
+		// let the listener return its error of being closed
+		return l.Listener.Accept()
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.slots }}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// limitConn frees its slot of the limitListener when it's closed.
+type limitConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
@@ -0,0 +1,62 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimitListener(inner, 1)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("the second connection should wait for the first one")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Close()
+	first.Close() // frees the slot once only
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("the second connection should be accepted after the first one is closed")
+	}
+}
+
+func TestTCPLimits(t *testing.T) {
+	s := newTestServer(t, Config{TCPIdleTimeout: Duration(5 * time.Second), TCPMaxQueries: 10})
+	if s.tcpServer.IdleTimeout == nil || s.tcpServer.IdleTimeout() != 5*time.Second {
+		t.Error("expect the TCP idle timeout of 5s")
+	}
+	if s.tcpServer.MaxTCPQueries != 10 {
+		t.Errorf("expect 10 queries on a TCP connection, got %d", s.tcpServer.MaxTCPQueries)
+	}
+	if _, err := NewServer(Config{FastDNS: "127.0.0.1:1", CleanDNS: "127.0.0.1:1", Listen: "127.0.0.1:0", TCPMaxConns: -1}); err == nil {
+		t.Error("negative TCP connections should be refused")
+	}
+}
@@ -0,0 +1,41 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// fakeUpstream starts a fake upstream answering the UDP queries by `handler`,
+// and returns its address and the func stopping it.
+func fakeUpstream(t *testing.T, handler dns.HandlerFunc) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: conn, Handler: handler}
+	go srv.ActivateAndServe()
+	return conn.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+// recorder is a dns.ResponseWriter keeping the written response.
+type recorder struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func newRecorder() *recorder {
+	return &recorder{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}}
+}
+
+func (r *recorder) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (r *recorder) RemoteAddr() net.Addr        { return r.remote }
+func (r *recorder) WriteMsg(m *dns.Msg) error   { r.msg = m; return nil }
+func (r *recorder) Write(b []byte) (int, error) { return len(b), nil }
+func (r *recorder) Close() error                { return nil }
+func (r *recorder) TsigStatus() error           { return nil }
+func (r *recorder) TsigTimersOnly(bool)         {}
+func (r *recorder) Hijack()                     {}
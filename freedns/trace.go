@@ -0,0 +1,163 @@
+package freedns
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The locations of a domain in a Trace.
+const (
+	LocationChina   = "china"
+	LocationForeign = "foreign"
+)
+
+// TraceIP is an IP of an upstream answer, and whether it's in China.
+type TraceIP struct {
+	IP    string `json:"ip"`
+	China bool   `json:"china"`
+}
+
+// TraceAnswer is the answer of an upstream in a Trace.
+type TraceAnswer struct {
+	Upstream string        `json:"upstream"`
+	Msg      *dns.Msg      `json:"-"` // nil if the upstream failed to answer
+	Error    string        `json:"error,omitempty"`
+	Latency  time.Duration `json:"latency"`
+	IPs      []TraceIP     `json:"ips,omitempty"`
+	Forged   bool          `json:"forged,omitempty"` // a forged NXDOMAIN, see HijackProbeInterval
+}
+
+// Trace is how the resolver decides on a question: the answers of both
+// upstreams, the classification of their IPs, and which one is served.
+type Trace struct {
+	Question dns.Question `json:"question"`
+	Known    string       `json:"known"` // the location known before, empty if unknown
+	Fast     TraceAnswer  `json:"fast"`
+	Clean    TraceAnswer  `json:"clean"`
+	Verdict  string       `json:"verdict"`
+	Served   string       `json:"served"`   // fast or clean
+	Location string       `json:"location"` // the location known after it
+}
+
+// Msg returns the response served.
+func (t Trace) Msg() *dns.Msg {
+	a := t.Clean
+	if t.Served == "fast" {
+		a = t.Fast
+	}
+	if a.Msg == nil {
+		res := &dns.Msg{}
+		req := &dns.Msg{Question: []dns.Question{t.Question}}
+		return res.SetRcode(req, dns.RcodeServerFailure)
+	}
+	return a.Msg
+}
+
+// Trace resolves the question on both upstreams, bypassing the cache and
+// the features of the pipeline, and returns how the resolver decides on the
+// answers. The location of the domain isn't changed.
+func (s *Server) Trace(name string, qtype uint16) Trace {
+	resolver := s.resolver
+	q := dns.Question{Name: dns.Fqdn(name), Qtype: qtype, Qclass: dns.ClassINET}
+	t := Trace{Question: q}
+	isCN, known := resolver.location(q.Name)
+	if known {
+		t.Known = LocationForeign
+		if isCN {
+			t.Known = LocationChina
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		t.Fast = resolver.traceQuery(q, resolver.fastUpstream)
+	}()
+	go func() {
+		defer wg.Done()
+		t.Clean = resolver.traceQuery(q, resolver.cleanUpstream)
+	}()
+	wg.Wait()
+
+	t.Served, t.Verdict, t.Location = resolver.decide(t.Known, t.Fast.Msg, t.Clean.Msg)
+	return t
+}
+
+// traceQuery resolves the question on the upstream, without the cache.
+func (resolver *spoofingProofResolver) traceQuery(q dns.Question, upstream string) TraceAnswer {
+	a := TraceAnswer{Upstream: upstream}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), resolver.resolveTimeout())
+	defer cancel()
+	res, err := resolver.query(ctx, q, true, "udp", upstream)
+	a.Latency = time.Since(start)
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	if resolver.hijack != nil && resolver.hijack.forges(upstream, res) {
+		res, a.Forged = unforged(res), true
+	}
+	a.Msg = res
+	a.IPs = resolver.traceIPs(res)
+	return a
+}
+
+// traceIPs classifies the IPs of the answer.
+func (resolver *spoofingProofResolver) traceIPs(res *dns.Msg) []TraceIP {
+	var ips []TraceIP
+	for _, ip := range resolver.ips(res) {
+		ips = append(ips, TraceIP{ip.String(), resolver.classifier.isChinaIP(ip)})
+	}
+	return ips
+}
+
+// decide returns which answer is served of the fast and the clean answers,
+// nil if they failed, why, and the location known after it. It mirrors the
+// decisions of resolveContext on the answers of both upstreams, and the
+// decision vectors hold for both.
+func (resolver *spoofingProofResolver) decide(known string, fast *dns.Msg, clean *dns.Msg) (string, string, string) {
+	location := known
+	cleanOrFast := func(why string) (string, string, string) {
+		if !upstreamFailed(clean) {
+			return "clean", why, location
+		}
+		if upstreamFailed(fast) {
+			return "clean", why + "; both upstreams failed", location
+		}
+		if resolver.containsIP(fast) && !resolver.containsChinaIP(fast) {
+			return "clean", why + "; the clean upstream failed, but the fast answer points out of China", location
+		}
+		return "fast", why + "; the clean upstream failed, and the fast answer has no IPs out of China", location
+	}
+
+	switch known {
+	case LocationForeign:
+		return cleanOrFast("the domain is known to be out of China")
+	case LocationChina:
+		if fast == nil || fast.Rcode != dns.RcodeSuccess {
+			return cleanOrFast("the domain is known to be in China, but the fast upstream failed")
+		}
+		if resolver.containsIP(fast) && !resolver.containsChinaIP(fast) {
+			location = LocationForeign
+			return cleanOrFast("the domain is known to be in China, but the fast answer points out of China")
+		}
+		return "fast", "the domain is known to be in China", location
+	}
+
+	if fast == nil || fast.Rcode != dns.RcodeSuccess {
+		return cleanOrFast("the fast upstream failed")
+	}
+	if !resolver.containsIP(fast) {
+		return cleanOrFast("the fast answer has no IPs to classify")
+	}
+	if resolver.containsChinaIP(fast) {
+		return "fast", "the fast answer points to China", LocationChina
+	}
+	location = LocationForeign
+	return cleanOrFast("the fast answer points out of China, possibly spoofed")
+}
@@ -0,0 +1,49 @@
+package freedns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/tuna/freedns-go/decisiontest"
+)
+
+func TestDecideVectors(t *testing.T) {
+	resolver := newSpoofingProofResolver("", "", 16, builtinClassifier{})
+	locations := map[decisiontest.Location]string{
+		decisiontest.China:   LocationChina,
+		decisiontest.Foreign: LocationForeign,
+	}
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	for _, v := range decisiontest.Vectors {
+		fast, clean := v.Fast.Msg(req), v.Clean.Msg(req)
+		served, verdict, location := resolver.decide(locations[v.Known], fast, clean)
+		res := map[string]*dns.Msg{"fast": fast, "clean": clean}[served]
+		rcode := dns.RcodeServerFailure
+		if res != nil {
+			rcode = res.Rcode
+		}
+		if served != v.Want || rcode != v.WantRcode || location != locations[v.WantKnown] {
+			t.Errorf("%s: expect %s from %s known %q, got %s from %s known %q (%s)", v.Name, dns.RcodeToString[v.WantRcode], v.Want, locations[v.WantKnown], dns.RcodeToString[rcode], served, location, verdict)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	fast, stopFast := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.Answer, IPs: []string{"31.13.64.1"}})
+	defer stopFast()
+	clean, stopClean := replyingUpstream(t, decisiontest.Reply{Kind: decisiontest.Answer, IPs: []string{"8.8.8.8"}})
+	defer stopClean()
+	s := newTestServer(t, Config{FastDNS: fast, CleanDNS: clean})
+
+	tr := s.Trace("example.com", dns.TypeA)
+	if len(tr.Fast.IPs) != 1 || tr.Fast.IPs[0].China || tr.Clean.Upstream != s.resolver.cleanUpstream {
+		t.Errorf("expect the foreign fast IP, got %+v", tr)
+	}
+	if tr.Served != "clean" || tr.Location != LocationForeign || tr.Msg().Answer[0].(*dns.A).A.String() != "8.8.8.8" {
+		t.Errorf("expect the clean answer served, got %+v", tr)
+	}
+	if _, ok := s.resolver.location("example.com."); ok {
+		t.Error("expect the location unchanged by the trace")
+	}
+}
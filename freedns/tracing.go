@@ -0,0 +1,304 @@
+package freedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// The span kinds of OTLP (trace.proto).
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// spanStatusError is the status code of the failed spans.
+const spanStatusError = 2
+
+// tracingQueueSize is how many ended spans are buffered for the collector.
+// The spans are dropped when it's full, e.g. the collector is down, so that
+// the queries are never blocked by the tracing.
+const tracingQueueSize = 4096
+
+// tracingBatchSize is how many spans are exported at most in one request, and
+// tracingFlushInterval is how long the spans wait for a batch to fill.
+const (
+	tracingBatchSize     = 512
+	tracingFlushInterval = 5 * time.Second
+)
+
+// tracer exports the spans of the sampled queries to an OpenTelemetry
+// collector over OTLP/HTTP, encoded as JSON. A nil tracer traces nothing.
+type tracer struct {
+	endpoint string
+	percent  float64 // of the queries traced
+	client   *http.Client
+
+	spans chan *span
+}
+
+// newTracer creates the tracer exporting to the OTLP/HTTP `endpoint`, e.g.
+// http://127.0.0.1:4318/v1/traces, and tracing `percent` of the queries, all
+// of them if it's 0.
+func newTracer(endpoint string, percent float64) (*tracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, Error("invalid OTLP endpoint, expect an http(s) URL: " + endpoint)
+	}
+	if percent < 0 || percent > 100 {
+		return nil, Error("the tracing sample rate must be between 0 and 100")
+	}
+	if percent == 0 {
+		percent = 100
+	}
+	return &tracer{
+		endpoint: endpoint,
+		percent:  percent,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *span, tracingQueueSize),
+	}, nil
+}
+
+// span is an operation of a traced query. Each span is used by a single
+// goroutine, and its methods do nothing on a nil span, i.e. of the queries
+// not traced.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for the root span
+	name     string
+	kind     int
+
+	start      time.Time
+	end        time.Time
+	attributes []spanAttribute
+	err        string
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{} // string, int, bool or float64
+}
+
+type spanKey struct{}
+
+// startQuery starts the root span of a client query if it's sampled, and
+// returns the context carrying it.
+func (t *tracer) startQuery(ctx context.Context, name string) (context.Context, *span) {
+	if t == nil || rand.Float64()*100 >= t.percent {
+		return ctx, nil
+	}
+	sp := &span{tracer: t, name: name, kind: spanKindServer, start: time.Now()}
+	rand.Read(sp.traceID[:])
+	rand.Read(sp.spanID[:])
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// startSpan starts a child of the span of `ctx`, and returns the context
+// carrying it. It returns a nil span if `ctx` has none, i.e. the query isn't
+// traced.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		return ctx, nil
+	}
+	sp := &span{
+		tracer:   parent.tracer,
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+	}
+	rand.Read(sp.spanID[:])
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// set sets the attribute of the span.
+func (sp *span) set(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.attributes = append(sp.attributes, spanAttribute{key, value})
+}
+
+// fail marks the span failed by `err` if it's not nil.
+func (sp *span) fail(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.err = err.Error()
+}
+
+// finish ends the span and queues it for the collector.
+func (sp *span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.end = time.Now()
+	select {
+	case sp.tracer.spans <- sp:
+	default:
+	}
+}
+
+// setQuestion sets the attributes of the question.
+func (sp *span) setQuestion(q dns.Question) {
+	sp.set("dns.question.name", q.Name)
+	sp.set("dns.question.type", dns.TypeToString[q.Qtype])
+}
+
+// setAnswer sets the attributes of the response and which upstream answered
+// it.
+func (sp *span) setAnswer(res *dns.Msg, upstream string) {
+	if res != nil {
+		sp.set("dns.rcode", dns.RcodeToString[res.Rcode])
+	}
+	sp.set("freedns.upstream", upstream)
+}
+
+// run exports the spans in batches until `done` is closed.
+func (t *tracer) run(done <-chan struct{}) {
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case <-done:
+			t.export(batch)
+			return
+		case sp := <-t.spans:
+			if batch = append(batch, sp); len(batch) >= tracingBatchSize {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		}
+	}
+}
+
+// flush exports the spans queued, e.g. on shutdown.
+func (t *tracer) flush() {
+	var batch []*span
+drain:
+	for {
+		select {
+		case sp := <-t.spans:
+			batch = append(batch, sp)
+		default:
+			break drain
+		}
+	}
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > tracingBatchSize {
+			n = tracingBatchSize
+		}
+		t.export(batch[:n])
+		batch = batch[n:]
+	}
+}
+
+// export sends the spans to the collector. The spans failing to be sent are
+// dropped.
+func (t *tracer) export(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	l := log.WithFields(logrus.Fields{
+		"op":       "tracing",
+		"endpoint": t.endpoint,
+		"spans":    len(batch),
+	})
+	body, err := json.Marshal(otlpRequest(batch))
+	if err != nil {
+		l.Error(err)
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		l.Error(err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		l.Error("the collector refused the spans: ", resp.Status)
+	}
+}
+
+// otlpRequest returns the ExportTraceServiceRequest of the spans in the JSON
+// encoding of OTLP, in which the IDs are hex and the 64-bit integers are
+// strings.
+func otlpRequest(batch []*span) map[string]interface{} {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, sp := range batch {
+		attributes := make([]map[string]interface{}, 0, len(sp.attributes))
+		for _, a := range sp.attributes {
+			attributes = append(attributes, map[string]interface{}{
+				"key":   a.key,
+				"value": otlpValue(a.value),
+			})
+		}
+		s := map[string]interface{}{
+			"traceId":           hex.EncodeToString(sp.traceID[:]),
+			"spanId":            hex.EncodeToString(sp.spanID[:]),
+			"name":              sp.name,
+			"kind":              sp.kind,
+			"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+			"attributes":        attributes,
+		}
+		if sp.parentID != [8]byte{} {
+			s["parentSpanId"] = hex.EncodeToString(sp.parentID[:])
+		}
+		if sp.err != "" {
+			s["status"] = map[string]interface{}{"code": spanStatusError, "message": sp.err}
+		}
+		spans = append(spans, s)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{map[string]interface{}{
+					"key":   "service.name",
+					"value": otlpValue("freedns-go"),
+				}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "freedns-go"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+// otlpValue returns the AnyValue of an attribute.
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	}
+	return map[string]interface{}{"stringValue": ""}
+}
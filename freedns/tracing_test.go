@@ -0,0 +1,112 @@
+package freedns
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+}
+
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	var spans []otlpSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	fast, _, stopFast := countingUpstream(t, "114.114.114.114")
+	defer stopFast()
+	clean, _, stopClean := countingUpstream(t, "8.8.8.8")
+	defer stopClean()
+	s := newTestServer(t, Config{FastDNS: fast, CleanDNS: clean, OTLPEndpoint: collector.URL + "/v1/traces"})
+
+	req := &dns.Msg{}
+	req.SetQuestion("cn.example.", dns.TypeA)
+	w := newRecorder()
+	s.handle(w, req, "udp")
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("unexpected response %v", w.msg)
+	}
+	s.tracer.flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	var root otlpSpan
+	byID := map[string]otlpSpan{}
+	for _, sp := range spans {
+		byID[sp.SpanID] = sp
+		if sp.Name == "handle" {
+			root = sp
+		}
+	}
+	if root.SpanID == "" || root.ParentSpanID != "" {
+		t.Fatalf("expect a root handle span, got %+v", spans)
+	}
+	for name, parent := range map[string]string{
+		"cache_lookup":   "handle",
+		"resolve":        "handle",
+		"upstream_query": "resolve",
+		"exchange":       "upstream_query",
+		"classify":       "resolve",
+	} {
+		found := false
+		for _, sp := range spans {
+			if sp.Name == name && sp.TraceID == root.TraceID && byID[sp.ParentSpanID].Name == parent {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expect a %s span under %s in the trace, got %+v", name, parent, spans)
+		}
+	}
+}
+
+func TestTracingNotSampled(t *testing.T) {
+	var tr *tracer
+	_, sp := tr.startQuery(context.Background(), "handle")
+	if sp != nil {
+		t.Error("expect no span of a nil tracer")
+	}
+	sp.set("key", "value")
+	sp.finish()
+
+	for _, c := range []struct {
+		endpoint string
+		percent  float64
+	}{{"127.0.0.1:4318", 0}, {"ftp://127.0.0.1/", 0}, {"http://127.0.0.1:4318", 101}} {
+		if _, err := newTracer(c.endpoint, c.percent); err == nil {
+			t.Errorf("expect an error of %s at %v%%", c.endpoint, c.percent)
+		}
+	}
+}
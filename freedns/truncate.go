@@ -0,0 +1,118 @@
+package freedns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The policies of the UDP responses over the payload size of the client.
+// Stub resolvers cope differently: some retry over TCP on TC, some give up,
+// and some only want the first address.
+const (
+	TruncationTC      = "tc"      // clear the records and set TC, so the client retries over TCP
+	TruncationTrim    = "trim"    // drop the additional and then the authority records, TC if still over
+	TruncationMinimal = "minimal" // keep only the answers that fit, without TC
+)
+
+// truncation applies the policy, or the one of the qtype, to the UDP
+// responses over the payload size of the client. An empty policy is
+// TruncationTC, as the oversized datagrams would be dropped or cut short.
+type truncation struct {
+	policy string
+	qtypes map[uint16]string
+}
+
+// newTruncation parses the rules in the form of `qtype=policy`, e.g.
+// `AAAA=minimal`, which override the policy for the qtype.
+func newTruncation(policy string, rules []string) (*truncation, error) {
+	if !validTruncationPolicy(policy) {
+		return nil, Error("unknown truncation policy: " + policy)
+	}
+	if policy == "" {
+		policy = TruncationTC
+	}
+	t := &truncation{policy: policy, qtypes: map[uint16]string{}}
+	for _, r := range rules {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 {
+			return nil, Error("invalid truncation rule, expect qtype=policy: " + r)
+		}
+		qtype, ok := dns.StringToType[strings.ToUpper(parts[0])]
+		if !ok {
+			return nil, Error("unknown qtype of truncation rule: " + r)
+		}
+		if parts[1] == "" || !validTruncationPolicy(parts[1]) {
+			return nil, Error("unknown truncation policy: " + r)
+		}
+		t.qtypes[qtype] = parts[1]
+	}
+	return t, nil
+}
+
+func validTruncationPolicy(policy string) bool {
+	switch policy {
+	case "", TruncationTC, TruncationTrim, TruncationMinimal:
+		return true
+	}
+	return false
+}
+
+// clientUDPSize is the payload size the client accepts, the UDP size of its
+// OPT record but at least 512 (RFC 6891), or 512 without EDNS.
+func clientUDPSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// apply fits `res` in the payload size of the client of `req` by the policy.
+func (t *truncation) apply(req *dns.Msg, res *dns.Msg) {
+	policy := t.policy
+	if p, ok := t.qtypes[req.Question[0].Qtype]; ok {
+		policy = p
+	}
+	size := clientUDPSize(req)
+	if res.Len() <= size {
+		return
+	}
+	switch policy {
+	case TruncationTC:
+		setTruncated(res)
+	case TruncationTrim:
+		res.Extra = onlyOPT(res.Extra)
+		if res.Len() > size {
+			res.Ns = nil
+		}
+		if res.Len() > size {
+			setTruncated(res)
+		}
+	case TruncationMinimal:
+		res.Ns = nil
+		res.Extra = onlyOPT(res.Extra)
+		res.Truncate(size)
+		res.Truncated = false
+	}
+	res.Compress = true
+}
+
+// setTruncated clears the records of `res` but the OPT, and sets TC. A
+// partial RRset is not sent, as the clients not retrying over TCP would take
+// it as the whole (RFC 2181 section 9).
+func setTruncated(res *dns.Msg) {
+	res.Answer = nil
+	res.Ns = nil
+	res.Extra = onlyOPT(res.Extra)
+	res.Truncated = true
+}
+
+// onlyOPT returns the OPT record in `extra`, if any.
+func onlyOPT(extra []dns.RR) []dns.RR {
+	for _, rr := range extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			return []dns.RR{rr}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package freedns
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// bigResponse answers `req` with 40 A records, plus the authority and
+// additional records, about 900 bytes, and the OPT record if `req` has one.
+func bigResponse(req *dns.Msg) *dns.Msg {
+	res := &dns.Msg{}
+	res.SetReply(req)
+	name := req.Question[0].Name
+	for i := 0; i < 40; i++ {
+		rr, _ := dns.NewRR(name + " 60 IN A 10.0.0." + strconv.Itoa(i))
+		res.Answer = append(res.Answer, rr)
+	}
+	for i := 0; i < 4; i++ {
+		ns, _ := dns.NewRR("example.com. 60 IN NS ns" + strconv.Itoa(i) + ".example.net.")
+		glue := &dns.A{Hdr: dns.RR_Header{Name: "ns" + strconv.Itoa(i) + ".example.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(10, 1, 0, byte(i))}
+		res.Ns = append(res.Ns, ns)
+		res.Extra = append(res.Extra, glue)
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		res.SetEdns0(opt.UDPSize(), false)
+	}
+	res.Compress = true
+	return res
+}
+
+func TestTruncation(t *testing.T) {
+	if _, err := newTruncation("drop", nil); err == nil {
+		t.Error("expect the error of the unknown policy")
+	}
+	if _, err := newTruncation("", []string{"BOGUS=tc"}); err == nil {
+		t.Error("expect the error of the unknown qtype")
+	}
+
+	tr, err := newTruncation(TruncationTC, []string{"AAAA=minimal", "mx=trim"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		qtype     uint16
+		edns      uint16
+		truncated bool
+		ns, extra bool
+		answers   int // -1 for all, 1 for some
+	}{
+		{dns.TypeA, 0, true, false, false, 0},
+		{dns.TypeA, 4096, false, true, true, -1},
+		{dns.TypeAAAA, 0, false, false, false, 1},
+		{dns.TypeMX, 0, true, false, false, 0},
+		{dns.TypeMX, 800, false, true, false, -1},
+		{dns.TypeTXT, 600, true, false, false, 0},
+	}
+	for _, c := range cases {
+		req := &dns.Msg{}
+		req.SetQuestion("example.com.", c.qtype)
+		if c.edns > 0 {
+			req.SetEdns0(c.edns, false)
+		}
+		res := bigResponse(req)
+		tr.apply(req, res)
+		if c.edns > 0 && res.IsEdns0() == nil {
+			t.Errorf("%s/%d: the OPT record is dropped", dns.TypeToString[c.qtype], c.edns)
+		}
+		if res.Len() > clientUDPSize(req) {
+			t.Errorf("%s/%d: the response of %d bytes doesn't fit", dns.TypeToString[c.qtype], c.edns, res.Len())
+		}
+		if res.Truncated != c.truncated || (len(res.Ns) > 0) != c.ns || (len(res.Extra) > len(onlyOPT(res.Extra))) != c.extra {
+			t.Errorf("%s/%d: unexpected response %v", dns.TypeToString[c.qtype], c.edns, res)
+		}
+		if c.answers < 0 && len(res.Answer) != 40 || c.answers == 0 && len(res.Answer) != 0 ||
+			c.answers == 1 && (len(res.Answer) == 0 || len(res.Answer) == 40) {
+			t.Errorf("%s/%d: unexpected %d answers", dns.TypeToString[c.qtype], c.edns, len(res.Answer))
+		}
+	}
+
+	// TruncationTC by default
+	if d, _ := newTruncation("", nil); d.policy != TruncationTC {
+		t.Errorf("expect the default of tc, got %q", d.policy)
+	}
+}
+
+func TestTruncatedOverUDP(t *testing.T) {
+	s := newTestServer(t, Config{})
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	s.handler = func(r *Request) (*dns.Msg, string) {
+		return bigResponse(r.Msg), "test"
+	}
+	w := newRecorder()
+	s.handle(w, req, "udp")
+	if !w.msg.Truncated || len(w.msg.Answer) != 0 {
+		t.Errorf("expect the truncated response over UDP, got %v", w.msg)
+	}
+	w = newRecorder()
+	s.handle(w, req, "tcp")
+	if w.msg.Truncated || len(w.msg.Answer) != 40 {
+		t.Errorf("expect the full response over TCP, got %v", w.msg)
+	}
+}
@@ -0,0 +1,72 @@
+package freedns
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ttlOverride forces the TTL of the answers of the domain and its subdomains.
+type ttlOverride struct {
+	domain string
+	ttl    uint32
+}
+
+// ttlOverrides forces the TTLs of the upstream answers of the domains, e.g.
+// of the internal zones publishing TTLs too long to fail over, both in the
+// cache and in the responses. The longest matching domain takes effect.
+type ttlOverrides struct {
+	rules []ttlOverride // the longest domain first
+}
+
+// newTTLOverrides parses the rules in the form of `domain=seconds`, e.g.
+// `internal.corp=300`.
+func newTTLOverrides(rules []string) (*ttlOverrides, error) {
+	o := &ttlOverrides{}
+	for _, s := range rules {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, Error("invalid TTL override, expect domain=seconds: " + s)
+		}
+		if _, ok := dns.IsDomainName(parts[0]); !ok {
+			return nil, Error("invalid domain of TTL override: " + s)
+		}
+		ttl, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, Error("invalid TTL of TTL override, expect seconds: " + s)
+		}
+		o.rules = append(o.rules, ttlOverride{domain: strings.ToLower(dns.Fqdn(parts[0])), ttl: uint32(ttl)})
+	}
+	sort.SliceStable(o.rules, func(i, j int) bool {
+		return dns.CountLabel(o.rules[i].domain) > dns.CountLabel(o.rules[j].domain)
+	})
+	return o, nil
+}
+
+// match returns the TTL forced on the name, and if there's one.
+func (o *ttlOverrides) match(name string) (uint32, bool) {
+	name = strings.ToLower(name)
+	for _, rule := range o.rules {
+		if dns.IsSubDomain(rule.domain, name) {
+			return rule.ttl, true
+		}
+	}
+	return 0, false
+}
+
+// apply forces the TTL of the queried name on the records of `res` in place.
+func (o *ttlOverrides) apply(name string, res *dns.Msg) {
+	ttl, ok := o.match(name)
+	if !ok {
+		return
+	}
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl = ttl
+			}
+		}
+	}
+}
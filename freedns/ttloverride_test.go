@@ -0,0 +1,47 @@
+package freedns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTTLOverrides(t *testing.T) {
+	o, err := newTTLOverrides([]string{"corp=60", "internal.corp=300"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]uint32{
+		"internal.corp.":    300,
+		"db.Internal.corp.": 300,
+		"www.corp.":         60,
+		"notinternal.corp.": 60,
+	} {
+		if ttl, ok := o.match(name); !ok || ttl != want {
+			t.Errorf("expect the TTL %d of %s, got %d, %v", want, name, ttl, ok)
+		}
+	}
+	if _, ok := o.match("example.com."); ok {
+		t.Error("expect no override of example.com.")
+	}
+
+	for _, rule := range []string{"internal.corp", "=300", "internal.corp=5m", "internal.corp=-1"} {
+		if _, err := newTTLOverrides([]string{rule}); err == nil {
+			t.Errorf("expect an error of %q", rule)
+		}
+	}
+}
+
+func TestResolveTTLOverride(t *testing.T) {
+	upstream, _, stop := countingUpstream(t, "8.8.8.8")
+	defer stop()
+	resolver := newSpoofingProofResolver(upstream, upstream, 16, builtinClassifier{})
+	resolver.ttlOverrides, _ = newTTLOverrides([]string{"internal.corp=300"})
+
+	for name, want := range map[string]uint32{"db.internal.corp.": 300, "example.com.": 60} {
+		res, _ := resolver.resolve(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, true, "udp")
+		if len(res.Answer) != 1 || res.Answer[0].Header().Ttl != want {
+			t.Errorf("expect the TTL %d of %s, got %v", want, name, res.Answer)
+		}
+	}
+}
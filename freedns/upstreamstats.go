@@ -0,0 +1,179 @@
+package freedns
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// upstreamLatencySamples is how many of the latest exchanges with an upstream
+// the latency percentiles are of.
+const upstreamLatencySamples = 1000
+
+// upstreamStatsLogInterval is how often the stats of the upstreams queried
+// since the last time are logged.
+const upstreamStatsLogInterval = 10 * time.Minute
+
+// upstreamExchanges counts the exchanges with the upstreams of the process.
+var upstreamExchanges = &upstreamStats{upstreams: map[string]*upstreamStat{}}
+
+// upstreamStat is the exchanges with an upstream, telling which of the fast
+// and the clean upstreams is degrading. The percentiles are of the latest
+// upstreamLatencySamples successful exchanges, and the counts are since the
+// start.
+type upstreamStat struct {
+	Upstream  string         `json:"upstream"`
+	Queries   int            `json:"queries"`
+	Timeouts  int            `json:"timeouts"`
+	Errors    int            `json:"errors"` // the failures other than the timeouts
+	Rcodes    map[string]int `json:"rcodes"`
+	P50       float64        `json:"p50_ms"`
+	P90       float64        `json:"p90_ms"`
+	P99       float64        `json:"p99_ms"`
+	LastError string         `json:"last_error,omitempty"`
+
+	latencies []time.Duration // a ring of the latest ones
+	next      int
+	logged    int // the queries when it was logged last
+}
+
+type upstreamStats struct {
+	mu        sync.Mutex
+	upstreams map[string]*upstreamStat
+}
+
+// record records an exchange with the upstream. The exchanges cancelled as
+// the other upstream has answered are left out.
+func (u *upstreamStats) record(upstream string, res *dns.Msg, err error, latency time.Duration) {
+	if err == context.Canceled {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	s, ok := u.upstreams[upstream]
+	if !ok {
+		s = &upstreamStat{Upstream: upstream, Rcodes: map[string]int{}}
+		u.upstreams[upstream] = s
+	}
+	s.Queries++
+	switch {
+	case err != nil && isTimeout(err):
+		s.Timeouts++
+		s.LastError = err.Error()
+	case err != nil || res == nil:
+		s.Errors++
+		if err != nil {
+			s.LastError = err.Error()
+		}
+	default:
+		s.Rcodes[dns.RcodeToString[res.Rcode]]++
+		if len(s.latencies) < upstreamLatencySamples {
+			s.latencies = append(s.latencies, latency)
+		} else {
+			s.latencies[s.next] = latency
+			s.next = (s.next + 1) % upstreamLatencySamples
+		}
+	}
+}
+
+// isTimeout returns if the exchange failed by a timeout.
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// report returns the exchanges with the upstreams, sorted by the upstreams.
+func (u *upstreamStats) report() []upstreamStat {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	stats := make([]upstreamStat, 0, len(u.upstreams))
+	for _, s := range u.upstreams {
+		stats = append(stats, s.copy())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Upstream < stats[j].Upstream })
+	return stats
+}
+
+// copy returns the copy of the stat with the percentiles, for the report.
+func (s *upstreamStat) copy() upstreamStat {
+	copied := *s
+	copied.latencies = nil
+	copied.Rcodes = make(map[string]int, len(s.Rcodes))
+	for k, v := range s.Rcodes {
+		copied.Rcodes[k] = v
+	}
+	sorted := append([]time.Duration{}, s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	copied.P50 = percentile(sorted, 0.5)
+	copied.P90 = percentile(sorted, 0.9)
+	copied.P99 = percentile(sorted, 0.99)
+	return copied
+}
+
+// percentile returns the percentile `p` of the sorted latencies in
+// milliseconds, or 0 if there are none.
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return milliseconds(sorted[i])
+}
+
+// logLoop logs the stats of the upstreams queried since the last time every
+// upstreamStatsLogInterval, until `done` is closed.
+func (u *upstreamStats) logLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(upstreamStatsLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			u.log()
+		}
+	}
+}
+
+func (u *upstreamStats) log() {
+	u.mu.Lock()
+	var stats []upstreamStat
+	for _, s := range u.upstreams {
+		if s.Queries > s.logged {
+			s.logged = s.Queries
+			stats = append(stats, s.copy())
+		}
+	}
+	u.mu.Unlock()
+	for _, s := range stats {
+		log.WithFields(logrus.Fields{
+			"op":       "upstream_stats",
+			"upstream": s.Upstream,
+			"queries":  s.Queries,
+			"timeouts": s.Timeouts,
+			"errors":   s.Errors,
+			"rcodes":   s.Rcodes,
+			"p50_ms":   s.P50,
+			"p90_ms":   s.P90,
+			"p99_ms":   s.P99,
+		}).Info()
+	}
+}
+
+// serveUpstreams writes the exchanges with the upstreams.
+func serveUpstreams(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, upstreamExchanges.report())
+}
@@ -0,0 +1,59 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamStats(t *testing.T) {
+	upstream, _, stop := countingUpstream(t, "8.8.8.8")
+	defer stop()
+	// a socket never answering
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	for i := 0; i < 3; i++ {
+		if _, err := naiveResolve(context.Background(), q, true, "udp", upstream, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := naiveResolve(ctx, q, true, "udp", silent.LocalAddr().String(), nil); err == nil {
+		t.Fatal("expect the silent upstream to time out")
+	}
+
+	stats := map[string]upstreamStat{}
+	for _, s := range upstreamExchanges.report() {
+		stats[s.Upstream] = s
+	}
+	if s := stats[upstream]; s.Queries != 3 || s.Rcodes["NOERROR"] != 3 || s.Timeouts != 0 || s.P50 <= 0 || s.P99 < s.P50 {
+		t.Errorf("unexpected stats of the upstream %+v", s)
+	}
+	if s := stats[silent.LocalAddr().String()]; s.Queries != 1 || s.Timeouts != 1 || s.LastError == "" || s.P50 != 0 {
+		t.Errorf("expect a timeout of the silent upstream, got %+v", s)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	for p, want := range map[float64]float64{0.5: 50, 0.9: 90, 0.99: 99} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("expect the percentile %v to be %v, got %v", p, want, got)
+		}
+	}
+	if got := percentile(nil, 0.5); got != 0 {
+		t.Errorf("expect 0 without samples, got %v", got)
+	}
+}
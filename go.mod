@@ -3,7 +3,8 @@ module github.com/tuna/freedns-go
 go 1.13
 
 require (
-	github.com/louchenyao/golang-cache v0.0.0-20190309153624-1d1c4bb01145
 	github.com/miekg/dns v1.1.27
+	github.com/oschwald/maxminddb-golang v1.6.0
 	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/sys v0.0.0-20191224085550-c709ea063b76
 )
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDebugSignal relays SIGUSR1, which toggles the debug log, to `c`.
+func notifyDebugSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// notifyDebugSignal does nothing, as Windows has no SIGUSR1. The debug log
+// can be toggled through the admin API instead.
+func notifyDebugSignal(c chan<- os.Signal) {}